@@ -0,0 +1,330 @@
+package gopi
+
+import (
+	"bytes"
+	"context"
+	crand "crypto/rand"
+	"encoding/hex"
+	stdjson "encoding/json"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// RequestIDHeader is the header that identifies a request, which is taken from the request if the client (or a proxy)
+// set it, and added to the response otherwise
+const RequestIDHeader = "X-Request-ID"
+
+const (
+	// maxRequestIDLength is the length over which request IDs sent by clients are replaced
+	maxRequestIDLength = 128
+	// redactedValue replaces the values of redacted fields
+	redactedValue = "[REDACTED]"
+	// clfTimeFormat is the format of the time in the Common Log Format
+	clfTimeFormat = "02/Jan/2006:15:04:05 -0700"
+)
+
+// AccessLogFormat is the format of the access log lines
+type AccessLogFormat int
+
+const (
+	// AccessLogJSON writes each request as a JSON object with the fields of AccessLogEntry. This is the default.
+	AccessLogJSON AccessLogFormat = iota
+	// AccessLogCommon writes each request in the Common Log Format, as used by Apache and nginx
+	AccessLogCommon
+	// AccessLogCombined writes each request in the Combined Log Format, i.e. the Common Log Format with the referer
+	// and the user agent
+	AccessLogCombined
+)
+
+// AccessLogConfig configures AccessLogMiddleware
+type AccessLogConfig struct {
+	// Output is where the log lines are written. Defaults to os.Stdout.
+	Output io.Writer
+	// Format defaults to AccessLogJSON
+	Format AccessLogFormat
+	// SampleRate is the fraction of the requests that are logged. Defaults to 1; a negative value logs none. Requests
+	// that fail with a 5xx status are always logged.
+	SampleRate float64
+	// RedactFields are the (JSON) names of the fields of AccessLogEntry whose values are replaced with [REDACTED],
+	// e.g. "client_ip" or "principal"
+	RedactFields []string
+	// RedactQueryParams are the query params whose values are replaced with [REDACTED] in the logged path, e.g.
+	// "token"
+	RedactQueryParams []string
+}
+
+func (cfg AccessLogConfig) withDefaults() AccessLogConfig {
+	if cfg.Output == nil {
+		cfg.Output = os.Stdout
+	}
+	if cfg.SampleRate == 0 {
+		cfg.SampleRate = 1
+	}
+	return cfg
+}
+
+// AccessLogEntry is what is logged about each request
+type AccessLogEntry struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id"`
+	Method    string    `json:"method"`
+	// Path is the path and the query of the request
+	Path string `json:"path"`
+	// Route is the template of the route that the request matched, e.g. /api/v1/users/{id}
+	Route      string  `json:"route"`
+	Proto      string  `json:"proto"`
+	Status     int     `json:"status"`
+	DurationMS float64 `json:"duration_ms"`
+	BytesIn    int64   `json:"bytes_in"`
+	BytesOut   int64   `json:"bytes_out"`
+	ClientIP   string  `json:"client_ip"`
+	UserAgent  string  `json:"user_agent,omitempty"`
+	Referer    string  `json:"referer,omitempty"`
+	Principal  string  `json:"principal,omitempty"`
+	TraceID    string  `json:"trace_id,omitempty"`
+}
+
+// stringFields returns the fields of e that can be redacted, by their JSON name
+func (e *AccessLogEntry) stringFields() map[string]*string {
+	return map[string]*string{
+		"request_id": &e.RequestID,
+		"path":       &e.Path,
+		"route":      &e.Route,
+		"client_ip":  &e.ClientIP,
+		"user_agent": &e.UserAgent,
+		"referer":    &e.Referer,
+		"principal":  &e.Principal,
+		"trace_id":   &e.TraceID,
+	}
+}
+
+// redact replaces the values of fields that are set
+func (e *AccessLogEntry) redact(fields []string) {
+	byName := e.stringFields()
+	for _, name := range fields {
+		if f, ok := byName[name]; ok && *f != "" {
+			*f = redactedValue
+		}
+	}
+}
+
+// commonLogFormat returns e in the Common Log Format, or in the Combined Log Format if combined is true
+func (e AccessLogEntry) commonLogFormat(combined bool) string {
+	bytesOut := "-"
+	if e.BytesOut > 0 {
+		bytesOut = strconv.FormatInt(e.BytesOut, 10)
+	}
+	line := fmt.Sprintf("%s - %s [%s] %s %d %s",
+		clfField(e.ClientIP), clfField(e.Principal), e.Time.Format(clfTimeFormat),
+		strconv.Quote(e.Method+" "+e.Path+" "+e.Proto), e.Status, bytesOut)
+	if combined {
+		line += fmt.Sprintf(" %s %s", strconv.Quote(e.Referer), strconv.Quote(e.UserAgent))
+	}
+	return line
+}
+
+// clfField returns v as a field of the Common Log Format, where missing values are a dash
+func clfField(v string) string {
+	if v == "" {
+		return "-"
+	}
+	return strings.ReplaceAll(v, " ", "_")
+}
+
+// accessLogInfo is what the access log learns about a request from the handlers further down the chain, which can't
+// change the context of the access log middleware
+type accessLogInfo struct {
+	mu        sync.Mutex
+	principal string
+}
+
+type accessLogInfoContextKey struct{}
+
+// AccessLogMiddleware returns a http.Handler middleware func that logs each request once it has been handled, with its
+// status, latency, size and the client that made it, according to cfg. It also identifies each request with the
+// RequestIDHeader (see RequestID).
+func AccessLogMiddleware(cfg AccessLogConfig) mux.MiddlewareFunc {
+	cfg = cfg.withDefaults()
+	var mu sync.Mutex
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			ctx, id := withRequestID(r.Context(), r.Header.Get(RequestIDHeader))
+			w.Header().Set(RequestIDHeader, id)
+
+			info := &accessLogInfo{}
+			ctx = context.WithValue(ctx, accessLogInfoContextKey{}, info)
+			var body *countingReader
+			if r.Body != nil && r.Body != http.NoBody {
+				body = &countingReader{ReadCloser: r.Body}
+				r.Body = body
+			}
+			rw := newResponseRecorder(w)
+
+			// Requests that panic are still logged, with the status written by the recovery middleware
+			defer func() {
+				status := rw.Status()
+				if status < http.StatusInternalServerError && !sampleAccessLog(cfg.SampleRate) {
+					return
+				}
+
+				info.mu.Lock()
+				principal := info.principal
+				info.mu.Unlock()
+				entry := AccessLogEntry{
+					Time:       start,
+					RequestID:  id,
+					Method:     r.Method,
+					Path:       redactQuery(r.URL, cfg.RedactQueryParams),
+					Route:      getRouteTemplate(r),
+					Proto:      r.Proto,
+					Status:     status,
+					DurationMS: float64(time.Since(start).Microseconds()) / 1000,
+					BytesOut:   rw.bytesWritten,
+					ClientIP:   RateLimitByIP(r),
+					UserAgent:  r.UserAgent(),
+					Referer:    r.Referer(),
+					Principal:  principal,
+				}
+				if body != nil {
+					entry.BytesIn = body.n
+				}
+				if sc := trace.SpanContextFromContext(r.Context()); sc.IsValid() {
+					entry.TraceID = sc.TraceID().String()
+				}
+				entry.redact(cfg.RedactFields)
+
+				line, err := formatAccessLog(entry, cfg.Format)
+				if err != nil {
+					Logger(ctx).Error("[Gopi] Formatting access log", "error", err)
+					return
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				_, err = cfg.Output.Write(line)
+				if err != nil {
+					Logger(ctx).Error("[Gopi] Writing access log", "error", err)
+				}
+			}()
+			next.ServeHTTP(rw, r.WithContext(ctx))
+		})
+	}
+}
+
+// formatAccessLog returns the log line for entry, in format
+func formatAccessLog(entry AccessLogEntry, format AccessLogFormat) ([]byte, error) {
+	switch format {
+	case AccessLogCommon, AccessLogCombined:
+		return []byte(entry.commonLogFormat(format == AccessLogCombined) + "\n"), nil
+	default:
+		var buf bytes.Buffer
+		// Encode adds the newline
+		err := stdjson.NewEncoder(&buf).Encode(entry)
+		return buf.Bytes(), err
+	}
+}
+
+// sampleAccessLog decides whether a request is logged
+func sampleAccessLog(rate float64) bool {
+	if rate >= 1 {
+		return true
+	}
+	if rate <= 0 {
+		return false
+	}
+	return rand.Float64() < rate
+}
+
+// redactQuery returns the path and the query of u, with the values of the params redacted
+func redactQuery(u *url.URL, params []string) string {
+	if len(params) == 0 || u.RawQuery == "" {
+		return u.RequestURI()
+	}
+	q := u.Query()
+	redacted := false
+	for _, p := range params {
+		if _, ok := q[p]; ok {
+			q.Set(p, redactedValue)
+			redacted = true
+		}
+	}
+	if !redacted {
+		return u.RequestURI()
+	}
+	return u.EscapedPath() + "?" + q.Encode()
+}
+
+// setAccessLogPrincipal records the principal of the request that ctx belongs to in its access log, if any
+func setAccessLogPrincipal(ctx context.Context, principal string) {
+	info, ok := ctx.Value(accessLogInfoContextKey{}).(*accessLogInfo)
+	if !ok {
+		return
+	}
+	info.mu.Lock()
+	info.principal = principal
+	info.mu.Unlock()
+}
+
+// countingReader counts the bytes read from a request body
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.ReadCloser.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+type requestIDContextKey struct{}
+
+// withRequestID returns a copy of ctx with the ID of the request, which is id if it is a valid one sent by the client,
+// and a new one otherwise
+func withRequestID(ctx context.Context, id string) (context.Context, string) {
+	if existing := RequestID(ctx); existing != "" {
+		return ctx, existing
+	}
+	if !validRequestID(id) {
+		id = newRequestID()
+	}
+	return context.WithValue(ctx, requestIDContextKey{}, id), id
+}
+
+// RequestID returns the ID of the request that ctx belongs to, or an empty string if there is none. Requests are
+// identified when access logging is enabled (see WithAccessLog).
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContextKey{}).(string)
+	return id
+}
+
+// validRequestID returns true if id can be used as is, i.e. it is not too long and only has printable ASCII
+// characters, so it can't be used to forge log lines
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' || id[i] == '"' {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	var b [16]byte
+	_, _ = crand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
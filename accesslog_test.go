@@ -0,0 +1,113 @@
+package gopi_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/teejays/gopi"
+)
+
+func TestAccessLog(t *testing.T) {
+	routes := []gopi.Route{
+		{
+			Method:       http.MethodPost,
+			Path:         "users/{id}",
+			HandlerFunc:  gopi.HandlerWrapper(http.MethodPost, SampleEndpoint),
+			Authenticate: true,
+		},
+		{
+			Method:      http.MethodGet,
+			Path:        "ping",
+			HandlerFunc: gopi.HandlerWrapper(http.MethodGet, SampleEndpoint),
+		},
+	}
+	auth := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := gopi.ContextWithPrincipal(r.Context(), "alice")
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+	handler := func(cfg gopi.AccessLogConfig) http.Handler {
+		h, err := gopi.GetHandler(context.TODO(), routes, gopi.MiddlewareFuncs{AuthMiddleware: auth}, gopi.WithAccessLog(cfg))
+		assert.NoError(t, err)
+		return h
+	}
+	post := func(h http.Handler, requestID string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/api/v0/users/42?token=secret&page=1", strings.NewReader(`{"ping":"hello"}`))
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set("User-Agent", "test-agent")
+		r.Header.Set("Referer", "https://example.com/")
+		r.RemoteAddr = "10.0.0.1:1234"
+		if requestID != "" {
+			r.Header.Set(gopi.RequestIDHeader, requestID)
+		}
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	t.Run("JSON", func(t *testing.T) {
+		var out bytes.Buffer
+		w := post(handler(gopi.AccessLogConfig{Output: &out, RedactQueryParams: []string{"token"}}), "req-1")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "req-1", w.Header().Get(gopi.RequestIDHeader))
+
+		var entry gopi.AccessLogEntry
+		assert.NoError(t, json.Unmarshal(out.Bytes(), &entry))
+		assert.Equal(t, "req-1", entry.RequestID)
+		assert.Equal(t, http.MethodPost, entry.Method)
+		assert.Equal(t, "/api/v0/users/42?page=1&token=%5BREDACTED%5D", entry.Path)
+		assert.Equal(t, "/api/v0/users/{id}", entry.Route)
+		assert.Equal(t, http.StatusOK, entry.Status)
+		assert.EqualValues(t, len(`{"ping":"hello"}`), entry.BytesIn)
+		assert.EqualValues(t, w.Body.Len(), entry.BytesOut)
+		assert.Equal(t, "10.0.0.1", entry.ClientIP)
+		assert.Equal(t, "test-agent", entry.UserAgent)
+		assert.Equal(t, "alice", entry.Principal)
+		assert.GreaterOrEqual(t, entry.DurationMS, 0.0)
+	})
+
+	t.Run("Request ID", func(t *testing.T) {
+		var out bytes.Buffer
+		h := handler(gopi.AccessLogConfig{Output: &out})
+		// IDs that could forge log lines are replaced
+		w := post(h, "bad\nid")
+		id := w.Header().Get(gopi.RequestIDHeader)
+		assert.Regexp(t, `^[0-9a-f]{32}$`, id)
+		assert.Contains(t, out.String(), `"request_id":"`+id+`"`)
+	})
+
+	t.Run("Common Log Format", func(t *testing.T) {
+		var out bytes.Buffer
+		post(handler(gopi.AccessLogConfig{Output: &out, Format: gopi.AccessLogCommon, RedactFields: []string{"principal"}}), "")
+		assert.Regexp(t, regexp.MustCompile(`^10\.0\.0\.1 - \[REDACTED\] \[\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}\] "POST /api/v0/users/42\?token=secret&page=1 HTTP/1\.1" 200 \d+\n$`), out.String())
+	})
+
+	t.Run("Combined Log Format", func(t *testing.T) {
+		var out bytes.Buffer
+		post(handler(gopi.AccessLogConfig{Output: &out, Format: gopi.AccessLogCombined}), "")
+		assert.Regexp(t, regexp.MustCompile(`^10\.0\.0\.1 - alice \[.+\] "POST .+ HTTP/1\.1" 200 \d+ "https://example.com/" "test-agent"\n$`), out.String())
+	})
+
+	t.Run("Sampling", func(t *testing.T) {
+		var out bytes.Buffer
+		h := handler(gopi.AccessLogConfig{Output: &out, SampleRate: -1})
+		post(h, "")
+		assert.Empty(t, out.String())
+
+		// Server errors are always logged
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v0/ping?req="+url.QueryEscape(`{"requestErrorWithMsg":"oops"}`), nil))
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+		assert.Contains(t, out.String(), `"status":500`)
+	})
+}
@@ -0,0 +1,298 @@
+package gopi
+
+import (
+	"context"
+	stdjson "encoding/json"
+	"expvar"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"os"
+	"reflect"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ErrInvalidLogLevel is used when a request to the admin listener sets an unknown log level
+var ErrInvalidLogLevel = fmt.Errorf("the log level has to be one of DEBUG, INFO, WARN or ERROR")
+
+// ErrLogLevelNotEnabled is used when a request to the admin listener sets a log level that the handler of the server's
+// logger doesn't log at, so it would have no effect (see WithLogger)
+var ErrLogLevelNotEnabled = fmt.Errorf("the handler of the server's logger doesn't log at this level")
+
+// AdminConfig configures the admin listener of the Server (see WithAdmin)
+type AdminConfig struct {
+	// Addr is the address that the admin listener listens on, e.g. 127.0.0.1:9090. It should not be reachable from
+	// the public network.
+	Addr string
+	// AuthMiddleware authenticates the requests to the admin listener. It is required, and separate from the
+	// AuthMiddleware of the API since operators aren't API clients.
+	AuthMiddleware mux.MiddlewareFunc
+}
+
+// AdminRoute describes a Route registered on the server, as listed by the admin listener
+type AdminRoute struct {
+	Method string `json:"method"`
+	// Path is the template of the route, e.g. /api/v1/users/{id}
+	Path         string `json:"path"`
+	Version      int    `json:"version"`
+	Authenticate bool   `json:"authenticate"`
+	// Middlewares are the names of the route-specific middlewares, from the outermost one
+	Middlewares []string `json:"middlewares"`
+}
+
+// adminLogLevel is the body of the log level endpoint
+type adminLogLevel struct {
+	Level string `json:"level"`
+}
+
+// admin serves the admin listener. It learns about the routes and the middlewares of the server as the handler is
+// built.
+type admin struct {
+	cfg   AdminConfig
+	level *slog.LevelVar
+	// logger is the logger passed to WithLogger, if any. Its handler has its own level, which the level of the server
+	// can only be above.
+	logger *slog.Logger
+
+	mu          sync.Mutex
+	routes      []AdminRoute
+	middlewares []string
+}
+
+func newAdmin(cfg AdminConfig) *admin {
+	return &admin{cfg: cfg}
+}
+
+// validate returns an error if the admin listener can't be started safely
+func (a *admin) validate() error {
+	if a.cfg.Addr == "" {
+		return fmt.Errorf("the admin listener has no address")
+	}
+	if a.cfg.AuthMiddleware == nil {
+		return fmt.Errorf("the admin listener has no AuthMiddleware")
+	}
+	return nil
+}
+
+// setRoutes records the routes and the middlewares of the server
+func (a *admin) setRoutes(routes []AdminRoute, middlewares []string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.routes = routes
+	a.middlewares = middlewares
+}
+
+// handler returns the http.Handler of the admin listener, behind its AuthMiddleware
+func (a *admin) handler() http.Handler {
+	r := mux.NewRouter()
+	r.Use(a.cfg.AuthMiddleware)
+
+	r.HandleFunc("/routes", a.serveRoutes).Methods(http.MethodGet)
+	r.HandleFunc("/middlewares", a.serveMiddlewares).Methods(http.MethodGet)
+	r.HandleFunc("/loglevel", a.serveLogLevel).Methods(http.MethodGet, http.MethodPut)
+
+	// The debug endpoints are built on runtime/pprof rather than on net/http/pprof and expvar, which register
+	// themselves on http.DefaultServeMux as soon as they are imported
+	r.Handle("/debug/vars", expvar.Handler()).Methods(http.MethodGet)
+	r.HandleFunc("/debug/pprof/cmdline", serveDebugCmdline).Methods(http.MethodGet)
+	r.HandleFunc("/debug/pprof/profile", serveDebugCPUProfile).Methods(http.MethodGet)
+	r.HandleFunc("/debug/pprof/trace", serveDebugTrace).Methods(http.MethodGet)
+	r.HandleFunc("/debug/pprof/{profile}", serveDebugProfile).Methods(http.MethodGet)
+	r.HandleFunc("/debug/pprof/", serveDebugIndex).Methods(http.MethodGet)
+	return r
+}
+
+func (a *admin) serveRoutes(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	routes := a.routes
+	a.mu.Unlock()
+	writeAdminResponse(w, r, http.StatusOK, routes)
+}
+
+func (a *admin) serveMiddlewares(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	middlewares := a.middlewares
+	a.mu.Unlock()
+	writeAdminResponse(w, r, http.StatusOK, middlewares)
+}
+
+// serveLogLevel returns the log level of the server, and changes it on PUT requests. The level can't be set below the
+// level of the logger's handler, since the records would still be dropped by the handler.
+func (a *admin) serveLogLevel(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPut {
+		var req adminLogLevel
+		err := stdjson.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, ErrInvalidJSON)
+			return
+		}
+		var level slog.Level
+		err = level.UnmarshalText([]byte(req.Level))
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, ErrInvalidLogLevel)
+			return
+		}
+		logger := a.logger
+		if logger == nil {
+			logger = slog.Default()
+		}
+		if !logger.Handler().Enabled(r.Context(), level) {
+			writeError(w, r, http.StatusBadRequest, ErrLogLevelNotEnabled)
+			return
+		}
+		a.level.Set(level)
+		Logger(r.Context()).Info("[Gopi] Log level changed", "level", level.String())
+	}
+	writeAdminResponse(w, r, http.StatusOK, adminLogLevel{Level: a.level.Level().String()})
+}
+
+func serveDebugCmdline(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = w.Write([]byte(strings.Join(os.Args, "\x00")))
+}
+
+// debugSeconds returns the duration of a CPU profile or a trace, from the seconds query param (30 by default)
+func debugSeconds(r *http.Request) time.Duration {
+	sec, err := strconv.ParseInt(r.URL.Query().Get("seconds"), 10, 64)
+	if err != nil || sec <= 0 {
+		sec = 30
+	}
+	return time.Duration(sec) * time.Second
+}
+
+// sleepDebug waits for d, or until the client goes away
+func sleepDebug(r *http.Request, d time.Duration) {
+	select {
+	case <-time.After(d):
+	case <-r.Context().Done():
+	}
+}
+
+func serveDebugCPUProfile(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="profile"`)
+	err := pprof.StartCPUProfile(w)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	sleepDebug(r, debugSeconds(r))
+	pprof.StopCPUProfile()
+}
+
+func serveDebugTrace(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="trace"`)
+	err := trace.Start(w)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	sleepDebug(r, debugSeconds(r))
+	trace.Stop()
+}
+
+// serveDebugProfile serves a named profile, e.g. heap or goroutine, in the text format if debug is set
+func serveDebugProfile(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["profile"]
+	p := pprof.Lookup(name)
+	if p == nil {
+		writeError(w, r, http.StatusNotFound, fmt.Errorf("unknown profile %s", name))
+		return
+	}
+	debug, _ := strconv.Atoi(r.URL.Query().Get("debug"))
+	if name == "heap" && r.URL.Query().Get("gc") != "" {
+		runtime.GC()
+	}
+	if debug > 0 {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	}
+	err := p.WriteTo(w, debug)
+	if err != nil {
+		Logger(r.Context()).Error("[Gopi] Writing profile", "profile", name, "error", err)
+	}
+}
+
+var debugIndexTemplate = template.Must(template.New("pprof").Parse(`<html>
+<head><title>/debug/pprof/</title></head>
+<body>
+<p>Profiles:</p>
+<ul>
+{{range .}}<li>{{.Count}} <a href="{{.Name}}?debug=1">{{.Name}}</a></li>
+{{end}}<li><a href="profile">profile</a> (CPU, ?seconds=30)</li>
+<li><a href="trace">trace</a> (?seconds=30)</li>
+</ul>
+</body>
+</html>
+`))
+
+// serveDebugIndex lists the profiles
+func serveDebugIndex(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := debugIndexTemplate.Execute(w, pprof.Profiles())
+	if err != nil {
+		Logger(r.Context()).Error("[Gopi] Writing profile index", "error", err)
+	}
+}
+
+// writeAdminResponse writes v as JSON. The admin endpoints don't use the encoders of the API, so their responses
+// don't depend on its settings, e.g. the JSON key transform.
+func writeAdminResponse(w http.ResponseWriter, r *http.Request, code int, v interface{}) {
+	body, err := stdjson.Marshal(v)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", MediaTypeJSON)
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	_, err = w.Write(body)
+	if err != nil {
+		Logger(r.Context()).Error("[Gopi] Writing admin response", "error", err)
+	}
+}
+
+// newAdminLevel returns the level of the server's logger as a slog.LevelVar, so the admin listener can change it. If
+// no level is set, it starts at the lowest level that the logger's handler logs at.
+func newAdminLevel(l *slog.Logger, level slog.Leveler) *slog.LevelVar {
+	if lv, ok := level.(*slog.LevelVar); ok {
+		return lv
+	}
+	lv := &slog.LevelVar{}
+	if level != nil {
+		lv.Set(level.Level())
+		return lv
+	}
+	if l == nil {
+		l = slog.Default()
+	}
+	lv.Set(slog.LevelError)
+	for _, candidate := range []slog.Level{slog.LevelDebug, slog.LevelInfo, slog.LevelWarn} {
+		if l.Handler().Enabled(context.Background(), candidate) {
+			lv.Set(candidate)
+			break
+		}
+	}
+	return lv
+}
+
+// middlewareName returns the name of the function mw, for the admin listener
+func middlewareName(mw mux.MiddlewareFunc) string {
+	fn := runtime.FuncForPC(reflect.ValueOf(mw).Pointer())
+	if fn == nil {
+		return "unknown"
+	}
+	return fn.Name()
+}
@@ -0,0 +1,243 @@
+package gopi_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"expvar"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/teejays/gopi"
+)
+
+// adminAuth only lets requests with the admin token through
+func adminAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer admin" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func TestAdmin(t *testing.T) {
+	routes := []gopi.Route{
+		{
+			Method:      http.MethodGet,
+			Path:        "ping",
+			Version:     1,
+			HandlerFunc: gopi.HandlerWrapper(http.MethodGet, SampleEndpoint),
+		},
+		{
+			Method:       http.MethodPost,
+			Path:         "users/{id}",
+			Version:      2,
+			HandlerFunc:  gopi.HandlerWrapper(http.MethodPost, SampleEndpoint),
+			Authenticate: true,
+			Idempotency:  gopi.IdempotencyPolicy{TTL: time.Minute},
+			Timeout:      time.Second,
+		},
+	}
+	mws := gopi.MiddlewareFuncs{
+		AuthMiddleware: func(next http.Handler) http.Handler { return next },
+	}
+	var out bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&out, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	s, err := gopi.NewServer(context.TODO(), routes, mws,
+		gopi.WithLogger(logger),
+		gopi.WithLogLevel(slog.LevelInfo),
+		gopi.WithRateLimit(gopi.RateLimit{Limit: 100, Period: time.Second}),
+		gopi.WithAdmin(gopi.AdminConfig{Addr: "127.0.0.1:0", AuthMiddleware: adminAuth}))
+	if !assert.NoError(t, err) {
+		return
+	}
+	admin := s.AdminHandler()
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer admin")
+		admin.ServeHTTP(w, r)
+		return w
+	}
+
+	t.Run("Auth", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/routes", nil))
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	})
+
+	t.Run("Routes", func(t *testing.T) {
+		w := do(http.MethodGet, "/routes", "")
+		assert.Equal(t, http.StatusOK, w.Code)
+		var got []gopi.AdminRoute
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &got))
+		if assert.Len(t, got, 2) {
+			assert.Equal(t, gopi.AdminRoute{Method: http.MethodGet, Path: "/api/v1/ping", Version: 1}, got[0])
+			assert.Equal(t, "/api/v2/users/{id}", got[1].Path)
+			assert.True(t, got[1].Authenticate)
+			if assert.Len(t, got[1].Middlewares, 3) {
+				assert.Contains(t, got[1].Middlewares[0], "TestAdmin")
+				assert.Equal(t, []string{"timeout", "idempotency"}, got[1].Middlewares[1:])
+			}
+		}
+	})
+
+	t.Run("Middlewares", func(t *testing.T) {
+		w := do(http.MethodGet, "/middlewares", "")
+		assert.Equal(t, http.StatusOK, w.Code)
+		var got []string
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &got))
+		assert.Equal(t, []string{"cors", "recovery", "rate_limit"}, got)
+	})
+
+	t.Run("Log Level", func(t *testing.T) {
+		api := s.Handler()
+		ping := func() {
+			api.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/v1/ping?req={}", nil))
+		}
+
+		w := do(http.MethodGet, "/loglevel", "")
+		assert.JSONEq(t, `{"level":"INFO"}`, w.Body.String())
+		out.Reset()
+		ping()
+		assert.NotContains(t, out.String(), "[HTTP Handler] Starting...")
+
+		w = do(http.MethodPut, "/loglevel", `{"level":"DEBUG"}`)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.JSONEq(t, `{"level":"DEBUG"}`, w.Body.String())
+		out.Reset()
+		ping()
+		assert.Contains(t, out.String(), "[HTTP Handler] Starting...")
+
+		w = do(http.MethodPut, "/loglevel", `{"level":"LOUD"}`)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("Log Level Below The Handler's", func(t *testing.T) {
+		logger := slog.New(slog.NewJSONHandler(&bytes.Buffer{}, &slog.HandlerOptions{Level: slog.LevelInfo}))
+		s, err := gopi.NewServer(context.TODO(), routes, mws,
+			gopi.WithLogger(logger),
+			gopi.WithAdmin(gopi.AdminConfig{Addr: "127.0.0.1:0", AuthMiddleware: adminAuth}))
+		if !assert.NoError(t, err) {
+			return
+		}
+		put := func(level string) *httptest.ResponseRecorder {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPut, "/loglevel", strings.NewReader(`{"level":"`+level+`"}`))
+			r.Header.Set("Authorization", "Bearer admin")
+			s.AdminHandler().ServeHTTP(w, r)
+			return w
+		}
+
+		// The handler would drop the debug records anyway
+		w := put("DEBUG")
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Contains(t, w.Body.String(), gopi.ErrLogLevelNotEnabled.Error())
+		w = put("WARN")
+		assert.Equal(t, http.StatusOK, w.Code)
+		w = put("INFO")
+		assert.Equal(t, http.StatusOK, w.Code)
+	})
+
+	t.Run("Debug", func(t *testing.T) {
+		expvar.NewInt("admin_test_requests").Set(42)
+		w := do(http.MethodGet, "/debug/pprof/", "")
+		assert.Equal(t, http.StatusOK, w.Code)
+		w = do(http.MethodGet, "/debug/pprof/goroutine?debug=1", "")
+		assert.Equal(t, http.StatusOK, w.Code)
+		w = do(http.MethodGet, "/debug/pprof/heap", "")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "application/octet-stream", w.Header().Get("Content-Type"))
+		w = do(http.MethodGet, "/debug/pprof/nope", "")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		w = do(http.MethodGet, "/debug/vars", "")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), `"memstats"`)
+		// Including the variables published by the application
+		assert.Contains(t, w.Body.String(), `"admin_test_requests": 42`)
+	})
+
+	t.Run("Not On The Default ServeMux", func(t *testing.T) {
+		// Importing gopi must not expose the profiles on http.DefaultServeMux, as net/http/pprof does. expvar registers
+		// /debug/vars there, but the server doesn't serve it.
+		_, pattern := http.DefaultServeMux.Handler(httptest.NewRequest(http.MethodGet, "/debug/pprof/", nil))
+		assert.Empty(t, pattern)
+	})
+
+	t.Run("Not On The Public Handler", func(t *testing.T) {
+		for _, path := range []string{"/debug/pprof/", "/debug/vars", "/routes", "/api/debug/pprof/"} {
+			w := httptest.NewRecorder()
+			s.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+			assert.Equal(t, http.StatusNotFound, w.Code, path)
+		}
+	})
+
+	t.Run("Invalid Config", func(t *testing.T) {
+		_, err := gopi.NewServer(context.TODO(), routes, mws, gopi.WithAdmin(gopi.AdminConfig{Addr: "127.0.0.1:0"}))
+		assert.Error(t, err)
+		_, err = gopi.NewServer(context.TODO(), routes, mws, gopi.WithAdmin(gopi.AdminConfig{AuthMiddleware: adminAuth}))
+		assert.Error(t, err)
+	})
+}
+
+func TestAdmin_Listener(t *testing.T) {
+	routes := []gopi.Route{
+		{
+			Method:      http.MethodGet,
+			Path:        "ping",
+			HandlerFunc: gopi.HandlerWrapper(http.MethodGet, SampleEndpoint),
+		},
+	}
+	freeAddr := func() *net.TCPAddr {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		defer l.Close()
+		return l.Addr().(*net.TCPAddr)
+	}
+	publicAddr, adminAddr := freeAddr(), freeAddr()
+
+	s, err := gopi.NewServer(context.TODO(), routes, gopi.MiddlewareFuncs{},
+		gopi.WithAdmin(gopi.AdminConfig{Addr: adminAddr.String(), AuthMiddleware: adminAuth}))
+	if !assert.NoError(t, err) {
+		return
+	}
+	started := make(chan error, 1)
+	go func() {
+		started <- s.StartServer(context.TODO(), "127.0.0.1", publicAddr.Port)
+	}()
+
+	get := func(url string) int {
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		if !assert.NoError(t, err) {
+			return 0
+		}
+		req.Header.Set("Authorization", "Bearer admin")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return 0
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	assert.Eventually(t, func() bool {
+		return get("http://"+adminAddr.String()+"/routes") == http.StatusOK
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, http.StatusNotFound, get("http://"+publicAddr.String()+"/debug/pprof/"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	assert.NoError(t, s.Shutdown(ctx))
+	assert.NoError(t, <-started)
+	assert.Equal(t, 0, get("http://"+adminAddr.String()+"/routes"))
+}
@@ -0,0 +1,446 @@
+package gopi
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// defaultCacheStoreSize is the number of responses kept by the default in-memory CacheStore
+	defaultCacheStoreSize = 1000
+	// maxCachedBodySize is the size, in bytes, over which responses are not cached
+	maxCachedBodySize = 1 << 20
+)
+
+// CachedResponse is a response stored in a CacheStore
+type CachedResponse struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+	// StoredAt is when the response was stored, used to tell clients how old it is
+	StoredAt time.Time
+}
+
+// CacheStore stores the responses cached by CacheMiddleware. Implementations must be safe for concurrent use.
+type CacheStore interface {
+	// Get returns the response stored under key, or false if there is none or it has expired
+	Get(ctx context.Context, key string) (CachedResponse, bool, error)
+	// Set stores resp under key, for ttl
+	Set(ctx context.Context, key string, resp CachedResponse, ttl time.Duration) error
+	// Delete removes the response stored under key, if any
+	Delete(ctx context.Context, key string) error
+}
+
+// CachePolicy configures the server-side caching of the responses of a GET route (see CacheMiddleware)
+type CachePolicy struct {
+	// TTL is how long responses are cached for. Caching is disabled if it is not set.
+	TTL time.Duration
+	// VaryHeaders are the request headers that responses depend on, which are part of the cache key (in addition to
+	// the path, the query and the Accept header)
+	VaryHeaders []string
+	// Shared means that the responses are the same for all clients. Otherwise, responses to requests with a Principal
+	// are cached separately for each principal, and marked as private so only the client itself caches them. Responses
+	// to authenticated requests without a Principal (see ContextWithPrincipal) aren't cached.
+	Shared bool
+	// Key, if set, replaces the default cache key derivation
+	Key func(r *http.Request) string
+}
+
+// cacheKey returns the key that the response to r is cached under
+func (p CachePolicy) cacheKey(r *http.Request) string {
+	if p.Key != nil {
+		return p.Key(r)
+	}
+	var b strings.Builder
+	b.WriteString(r.URL.Path)
+	b.WriteByte('?')
+	// Encode sorts the query by key, so the order of the params doesn't matter
+	b.WriteString(r.URL.Query().Encode())
+
+	headers := append([]string{"Accept"}, p.VaryHeaders...)
+	for i := range headers {
+		headers[i] = http.CanonicalHeaderKey(headers[i])
+	}
+	sort.Strings(headers)
+	for _, name := range headers {
+		fmt.Fprintf(&b, "\n%s: %s", name, strings.Join(r.Header.Values(name), ", "))
+	}
+	if !p.Shared {
+		fmt.Fprintf(&b, "\nprincipal: %s", Principal(r.Context()))
+	}
+
+	// Hash the key so its length is bounded, whatever the store
+	sum := sha256.Sum256([]byte(b.String()))
+	return hex.EncodeToString(sum[:])
+}
+
+// cacheControl returns the Cache-Control header for a cached response to r that expires in maxAge. Responses to
+// authenticated requests are private, even if they are shared on the server, since proxies can't tell the clients
+// apart.
+func (p CachePolicy) cacheControl(r *http.Request, maxAge time.Duration) string {
+	visibility := "public"
+	if isAuthenticated(r) || (!p.Shared && Principal(r.Context()) != "") {
+		visibility = "private"
+	}
+	if maxAge < 0 {
+		maxAge = 0
+	}
+	return fmt.Sprintf("%s, max-age=%d", visibility, int(maxAge.Seconds()))
+}
+
+// CacheMiddleware returns a http.Handler middleware func that caches the successful responses of GET requests in store,
+// according to policy. It is installed automatically for Routes with a Cache policy. Cached responses get a
+// Cache-Control header so clients can cache them too, and concurrent requests for a response that isn't cached yet wait
+// for the first one to produce it, instead of all hitting the handler. Clients can bypass the cache with
+// `Cache-Control: no-cache`.
+func CacheMiddleware(policy CachePolicy, store CacheStore) mux.MiddlewareFunc {
+	flights := cacheFlights{flights: map[string]*cacheFlight{}}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if policy.TTL <= 0 || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			reqCacheControl := strings.ToLower(r.Header.Get("Cache-Control"))
+			if strings.Contains(reqCacheControl, "no-store") {
+				next.ServeHTTP(w, r)
+				return
+			}
+			// Responses to authenticated clients can only be cached per client, which needs their Principal
+			if !policy.Shared && isUnscoped(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			ctx := r.Context()
+			key := policy.cacheKey(r)
+			revalidate := strings.Contains(reqCacheControl, "no-cache")
+
+			if !revalidate {
+				resp, ok, err := store.Get(ctx, key)
+				if err != nil {
+					Logger(ctx).Error("[Gopi] Getting cached response", "error", err)
+				}
+				if ok {
+					writeCachedResponse(w, r, resp, policy)
+					return
+				}
+			}
+
+			// A HEAD response has no body, so it can't fill the cache
+			if r.Method == http.MethodHead {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			cacheControl := policy.cacheControl(r, policy.TTL)
+			rec := newStoringRecorder(w, func(code int, h http.Header) (http.Header, bool) {
+				// Responses that the handler sets its own caching rules for, or that are meant for a single client,
+				// aren't cached
+				if code != http.StatusOK || h.Get("Cache-Control") != "" || len(h.Values("Set-Cookie")) > 0 {
+					return nil, false
+				}
+				h.Set("Cache-Control", cacheControl)
+				h.Set("X-Cache", "MISS")
+				stored := h.Clone()
+				stored.Del("X-Cache")
+				return stored, true
+			})
+			var flight *cacheFlight
+
+			// Only one request per key runs the handler, the others wait for its response
+			if !revalidate {
+				f, leader := flights.join(key)
+				if !leader {
+					select {
+					case <-f.done:
+					case <-ctx.Done():
+						return
+					}
+					if f.resp != nil {
+						writeCachedResponse(w, r, *f.resp, policy)
+						return
+					}
+					// The response couldn't be cached, so get our own
+					next.ServeHTTP(w, r)
+					return
+				}
+				defer flights.leave(key, f)
+				flight = f
+			}
+
+			next.ServeHTTP(rec, r)
+
+			resp, ok := rec.response()
+			if !ok {
+				return
+			}
+			err := store.Set(ctx, key, resp, policy.TTL)
+			if err != nil {
+				Logger(ctx).Error("[Gopi] Storing cached response", "error", err)
+			}
+			if flight != nil {
+				flight.resp = &resp
+			}
+		})
+	}
+}
+
+// writeCachedResponse writes resp, which was cached according to policy, as the response to r
+func writeCachedResponse(w http.ResponseWriter, r *http.Request, resp CachedResponse, policy CachePolicy) {
+	h := w.Header()
+	replayHeader(h, resp.Header)
+	age := time.Since(resp.StoredAt)
+	h.Set("Age", strconv.Itoa(int(age.Seconds())))
+	h.Set("Cache-Control", policy.cacheControl(r, policy.TTL-age))
+	h.Set("X-Cache", "HIT")
+
+	if notModified(r, h) {
+		writeNotModified(w)
+		return
+	}
+	w.WriteHeader(resp.StatusCode)
+	if r.Method == http.MethodHead {
+		return
+	}
+	_, err := w.Write(resp.Body)
+	if err != nil {
+		Logger(r.Context()).Error("[Gopi] Writing cached response", "error", err)
+	}
+}
+
+// replayHeader adds the stored header of a response to h, the header of the response to another request. The fields
+// already in h were set for that request by the outer middlewares (e.g. X-Request-ID or the rate limits), so they are
+// kept.
+func replayHeader(h, stored http.Header) {
+	for k, v := range stored {
+		if k == "Vary" {
+			// Keep what the outer middlewares (e.g. CORS) vary on
+			for _, field := range v {
+				addVary(h, field)
+			}
+			continue
+		}
+		if _, ok := h[k]; ok {
+			continue
+		}
+		h[k] = append([]string(nil), v...)
+	}
+}
+
+// storingRecorder wraps a http.ResponseWriter and keeps a copy of the response written to it, so it can be stored
+// and replayed to other requests
+type storingRecorder struct {
+	http.ResponseWriter
+	// store is called when the header is written, and returns the header to store with the response, or false if the
+	// response shouldn't be stored. It may change h, which is the header sent to the client.
+	store func(code int, h http.Header) (http.Header, bool)
+	// before is the header as it was before the handler ran. Only the fields that the handler set are stored, the
+	// others belong to the request (e.g. X-Request-ID).
+	before http.Header
+
+	status      int
+	wroteHeader bool
+	storable    bool
+	header      http.Header
+	body        bytes.Buffer
+}
+
+func newStoringRecorder(w http.ResponseWriter, store func(code int, h http.Header) (http.Header, bool)) *storingRecorder {
+	return &storingRecorder{ResponseWriter: w, store: store, before: w.Header().Clone()}
+}
+
+func (rec *storingRecorder) WriteHeader(code int) {
+	if rec.wroteHeader {
+		return
+	}
+	// Informational responses (e.g. 103 Early Hints) are followed by the actual response
+	if code >= 200 || code == http.StatusSwitchingProtocols {
+		rec.status = code
+		rec.wroteHeader = true
+		rec.header, rec.storable = rec.store(code, rec.Header())
+		for k, v := range rec.header {
+			if slices.Equal(rec.before[k], v) {
+				delete(rec.header, k)
+			}
+		}
+	}
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *storingRecorder) Write(b []byte) (int, error) {
+	if !rec.wroteHeader {
+		rec.WriteHeader(http.StatusOK)
+	}
+	if rec.storable {
+		if rec.body.Len()+len(b) > maxCachedBodySize {
+			rec.storable = false
+			rec.body = bytes.Buffer{}
+		} else {
+			rec.body.Write(b)
+		}
+	}
+	return rec.ResponseWriter.Write(b)
+}
+
+// response returns the response to store, or false if it shouldn't be stored
+func (rec *storingRecorder) response() (CachedResponse, bool) {
+	if !rec.wroteHeader || !rec.storable {
+		return CachedResponse{}, false
+	}
+	return CachedResponse{
+		StatusCode: rec.status,
+		Header:     rec.header,
+		Body:       rec.body.Bytes(),
+		StoredAt:   time.Now(),
+	}, true
+}
+
+// Flush implements http.Flusher if the underlying http.ResponseWriter supports it
+func (rec *storingRecorder) Flush() {
+	if !rec.wroteHeader {
+		rec.WriteHeader(http.StatusOK)
+	}
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap allows http.ResponseController to reach the underlying http.ResponseWriter
+func (rec *storingRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// cacheFlight is a request that is producing a response that isn't cached yet
+type cacheFlight struct {
+	done chan struct{}
+	// resp is set before done is closed if the response could be cached
+	resp *CachedResponse
+}
+
+// cacheFlights keeps track of the requests producing responses, so concurrent requests for the same key can wait for
+// them instead of producing the same response
+type cacheFlights struct {
+	mu      sync.Mutex
+	flights map[string]*cacheFlight
+}
+
+// join returns the flight for key, and true if the caller is the first to join it and should produce the response
+func (fs *cacheFlights) join(key string) (*cacheFlight, bool) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if f, ok := fs.flights[key]; ok {
+		return f, false
+	}
+	f := &cacheFlight{done: make(chan struct{})}
+	fs.flights[key] = f
+	return f, true
+}
+
+// leave releases the requests waiting on f
+func (fs *cacheFlights) leave(key string, f *cacheFlight) {
+	fs.mu.Lock()
+	delete(fs.flights, key)
+	fs.mu.Unlock()
+	close(f.done)
+}
+
+/* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+* M E M O R Y   S T O R E
+* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
+
+// MemoryCacheStore is a CacheStore that keeps responses in memory. Once it's full, the least recently used responses
+// are evicted.
+type MemoryCacheStore struct {
+	mu         sync.Mutex
+	maxEntries int
+	entries    *list.List
+	byKey      map[string]*list.Element
+}
+
+type memoryCacheEntry struct {
+	key       string
+	resp      CachedResponse
+	expiresAt time.Time
+}
+
+// NewMemoryCacheStore returns a MemoryCacheStore that holds up to maxEntries responses
+func NewMemoryCacheStore(maxEntries int) *MemoryCacheStore {
+	if maxEntries <= 0 {
+		maxEntries = defaultCacheStoreSize
+	}
+	return &MemoryCacheStore{
+		maxEntries: maxEntries,
+		entries:    list.New(),
+		byKey:      map[string]*list.Element{},
+	}
+}
+
+// Get implements CacheStore
+func (s *MemoryCacheStore) Get(ctx context.Context, key string) (CachedResponse, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	el, ok := s.byKey[key]
+	if !ok {
+		return CachedResponse{}, false, nil
+	}
+	entry := el.Value.(*memoryCacheEntry)
+	if time.Now().After(entry.expiresAt) {
+		s.remove(el)
+		return CachedResponse{}, false, nil
+	}
+	s.entries.MoveToFront(el)
+	return entry.resp, true, nil
+}
+
+// Set implements CacheStore
+func (s *MemoryCacheStore) Set(ctx context.Context, key string, resp CachedResponse, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry := &memoryCacheEntry{key: key, resp: resp, expiresAt: time.Now().Add(ttl)}
+	if el, ok := s.byKey[key]; ok {
+		el.Value = entry
+		s.entries.MoveToFront(el)
+		return nil
+	}
+	s.byKey[key] = s.entries.PushFront(entry)
+	for s.entries.Len() > s.maxEntries {
+		s.remove(s.entries.Back())
+	}
+	return nil
+}
+
+// Delete implements CacheStore
+func (s *MemoryCacheStore) Delete(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if el, ok := s.byKey[key]; ok {
+		s.remove(el)
+	}
+	return nil
+}
+
+// Len returns the number of responses in the store, including the expired ones that haven't been evicted yet
+func (s *MemoryCacheStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.entries.Len()
+}
+
+func (s *MemoryCacheStore) remove(el *list.Element) {
+	s.entries.Remove(el)
+	delete(s.byKey, el.Value.(*memoryCacheEntry).key)
+}
@@ -0,0 +1,237 @@
+package gopi_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/teejays/gopi"
+)
+
+func TestCacheMiddleware(t *testing.T) {
+	var calls atomic.Int32
+	release := make(chan struct{})
+	close(release)
+	var releaseMu sync.Mutex
+	countingEndpoint := func(ctx context.Context, req SampleReq) (SampleResp, error) {
+		calls.Add(1)
+		releaseMu.Lock()
+		ch := release
+		releaseMu.Unlock()
+		<-ch
+		if req.RequestErrorWithMsg != "" {
+			return SampleResp{}, fmt.Errorf("%s", req.RequestErrorWithMsg)
+		}
+		return SampleResp{Pong: req.Ping + " " + gopi.Principal(ctx)}, nil
+	}
+
+	routes := []gopi.Route{
+		{
+			Method:      http.MethodGet,
+			Path:        "cached",
+			HandlerFunc: gopi.HandlerWrapper(http.MethodGet, countingEndpoint),
+			Cache:       gopi.CachePolicy{TTL: time.Minute, Shared: true},
+		},
+		{
+			Method:       http.MethodGet,
+			Path:         "cached-private",
+			HandlerFunc:  gopi.HandlerWrapper(http.MethodGet, countingEndpoint),
+			Authenticate: true,
+			Cache:        gopi.CachePolicy{TTL: time.Minute},
+		},
+	}
+	auth := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := gopi.ContextWithPrincipal(r.Context(), r.Header.Get("Authorization"))
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+	// The outer middlewares set headers that belong to each request
+	var requests atomic.Int32
+	requestID := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set(gopi.RequestIDHeader, fmt.Sprint(requests.Add(1)))
+			next.ServeHTTP(w, r)
+		})
+	}
+	h, err := gopi.GetHandler(context.TODO(), routes, gopi.MiddlewareFuncs{PreMiddlewares: []mux.MiddlewareFunc{requestID}, AuthMiddleware: auth})
+	assert.NoError(t, err)
+
+	get := func(path, ping string, headers map[string]string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, path+"?req="+url.QueryEscape(`{"ping":"`+ping+`"}`), nil)
+		for k, v := range headers {
+			r.Header.Set(k, v)
+		}
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	t.Run("Hit", func(t *testing.T) {
+		calls.Store(0)
+		w := get("/api/v0/cached", "hit", nil)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "MISS", w.Header().Get("X-Cache"))
+		assert.Equal(t, "public, max-age=60", w.Header().Get("Cache-Control"))
+		body := w.Body.String()
+
+		w = get("/api/v0/cached", "hit", nil)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "HIT", w.Header().Get("X-Cache"))
+		assert.Equal(t, "0", w.Header().Get("Age"))
+		assert.Equal(t, body, w.Body.String())
+		assert.Equal(t, gopi.MediaTypeJSON, w.Header().Get("Content-Type"))
+		assert.Equal(t, fmt.Sprint(requests.Load()), w.Header().Get(gopi.RequestIDHeader))
+		assert.Equal(t, int32(1), calls.Load())
+
+		// The cached ETag can be revalidated
+		w = get("/api/v0/cached", "hit", map[string]string{"If-None-Match": w.Header().Get("ETag")})
+		assert.Equal(t, http.StatusNotModified, w.Code)
+		assert.Equal(t, int32(1), calls.Load())
+	})
+
+	t.Run("Key", func(t *testing.T) {
+		calls.Store(0)
+		get("/api/v0/cached", "key-a", nil)
+		get("/api/v0/cached", "key-b", nil)
+		get("/api/v0/cached", "key-a", map[string]string{"Accept": "application/msgpack"})
+		assert.Equal(t, int32(3), calls.Load())
+	})
+
+	t.Run("No-cache", func(t *testing.T) {
+		calls.Store(0)
+		get("/api/v0/cached", "no-cache", nil)
+		w := get("/api/v0/cached", "no-cache", map[string]string{"Cache-Control": "no-cache"})
+		assert.Equal(t, "MISS", w.Header().Get("X-Cache"))
+		assert.Equal(t, int32(2), calls.Load())
+	})
+
+	t.Run("Errors aren't cached", func(t *testing.T) {
+		calls.Store(0)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/api/v0/cached?req="+url.QueryEscape(`{"request_error_with_msg":"oops"}`), nil)
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		assert.Equal(t, int32(2), calls.Load())
+		assert.Empty(t, w.Header().Get("Cache-Control"))
+	})
+
+	t.Run("Per principal", func(t *testing.T) {
+		calls.Store(0)
+		w := get("/api/v0/cached-private", "private", map[string]string{"Authorization": "alice"})
+		assert.Equal(t, "private, max-age=60", w.Header().Get("Cache-Control"))
+		assert.Contains(t, w.Body.String(), "private alice")
+
+		w = get("/api/v0/cached-private", "private", map[string]string{"Authorization": "bob"})
+		assert.Contains(t, w.Body.String(), "private bob")
+
+		w = get("/api/v0/cached-private", "private", map[string]string{"Authorization": "alice"})
+		assert.Equal(t, "HIT", w.Header().Get("X-Cache"))
+		assert.Contains(t, w.Body.String(), "private alice")
+		assert.Equal(t, int32(2), calls.Load())
+	})
+
+	t.Run("Authenticated Without Principal", func(t *testing.T) {
+		// The AuthMiddleware checks the token, but doesn't set a Principal, so the responses can't be cached per client
+		checkOnly := func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("Authorization") == "" {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				next.ServeHTTP(w, r)
+			})
+		}
+		h, err := gopi.GetHandler(context.TODO(), routes, gopi.MiddlewareFuncs{AuthMiddleware: checkOnly})
+		if !assert.NoError(t, err) {
+			return
+		}
+		calls.Store(0)
+		for _, token := range []string{"alice", "bob"} {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "/api/v0/cached-private?req="+url.QueryEscape(`{"ping":"`+token+`"}`), nil)
+			r.Header.Set("Authorization", token)
+			h.ServeHTTP(w, r)
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Empty(t, w.Header().Get("X-Cache"))
+			assert.NotContains(t, w.Header().Get("Cache-Control"), "public")
+			assert.Contains(t, w.Body.String(), token)
+		}
+		assert.Equal(t, int32(2), calls.Load())
+
+		// Shared responses are still cached, but only privately by the clients
+		w := get("/api/v0/cached", "shared", map[string]string{"Authorization": "alice"})
+		assert.Equal(t, "private, max-age=60", w.Header().Get("Cache-Control"))
+	})
+
+	t.Run("Single flight", func(t *testing.T) {
+		calls.Store(0)
+		releaseMu.Lock()
+		release = make(chan struct{})
+		releaseMu.Unlock()
+
+		var wg sync.WaitGroup
+		codes := make([]int, 5)
+		for i := range codes {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				codes[i] = get("/api/v0/cached", "flight", nil).Code
+			}(i)
+		}
+		// Let the concurrent requests pile up behind the first one
+		assert.Eventually(t, func() bool { return calls.Load() == 1 }, time.Second, time.Millisecond)
+		time.Sleep(20 * time.Millisecond)
+		releaseMu.Lock()
+		close(release)
+		releaseMu.Unlock()
+		wg.Wait()
+
+		assert.Equal(t, int32(1), calls.Load())
+		for _, code := range codes {
+			assert.Equal(t, http.StatusOK, code)
+		}
+	})
+}
+
+func TestMemoryCacheStore(t *testing.T) {
+	ctx := context.Background()
+	s := gopi.NewMemoryCacheStore(2)
+	resp := func(body string) gopi.CachedResponse {
+		return gopi.CachedResponse{StatusCode: http.StatusOK, Body: []byte(body)}
+	}
+
+	assert.NoError(t, s.Set(ctx, "a", resp("a"), time.Minute))
+	assert.NoError(t, s.Set(ctx, "b", resp("b"), time.Minute))
+	// Using a makes b the least recently used
+	_, ok, _ := s.Get(ctx, "a")
+	assert.True(t, ok)
+	assert.NoError(t, s.Set(ctx, "c", resp("c"), time.Minute))
+	assert.Equal(t, 2, s.Len())
+
+	_, ok, _ = s.Get(ctx, "b")
+	assert.False(t, ok)
+	got, ok, _ := s.Get(ctx, "a")
+	assert.True(t, ok)
+	assert.Equal(t, "a", string(got.Body))
+
+	assert.NoError(t, s.Delete(ctx, "a"))
+	_, ok, _ = s.Get(ctx, "a")
+	assert.False(t, ok)
+
+	assert.NoError(t, s.Set(ctx, "expiring", resp("expiring"), time.Millisecond))
+	time.Sleep(5 * time.Millisecond)
+	_, ok, _ = s.Get(ctx, "expiring")
+	assert.False(t, ok)
+}
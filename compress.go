@@ -0,0 +1,392 @@
+package gopi
+
+import (
+	"bufio"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+// Content codings that gopi registers a Compressor for by default
+const (
+	EncodingGzip    = "gzip"
+	EncodingDeflate = "deflate"
+)
+
+// defaultCompressionMinSize is the size, in bytes, under which responses are not compressed, unless configured
+// otherwise
+const defaultCompressionMinSize = 1024
+
+// defaultCompressionEncodings are the content codings that responses are compressed with, in order of preference,
+// unless configured otherwise. Brotli and zstd are only used once a Compressor has been registered for them.
+var defaultCompressionEncodings = []string{"zstd", "br", EncodingGzip, EncodingDeflate}
+
+// defaultCompressionContentTypes are the media types of the responses that are compressed, unless configured otherwise
+var defaultCompressionContentTypes = []string{
+	"text/*",
+	MediaTypeJSON,
+	MediaTypeNDJSON,
+	"application/problem+json",
+	"application/xml",
+	"application/javascript",
+	"image/svg+xml",
+}
+
+// CompressWriter compresses what is written to it into an underlying writer
+type CompressWriter interface {
+	io.WriteCloser
+	// Flush writes any pending compressed data to the underlying writer, so streamed responses reach the client
+	Flush() error
+}
+
+// Compressor returns a CompressWriter that compresses into w with a content coding (e.g. gzip)
+type Compressor func(w io.Writer) (CompressWriter, error)
+
+var compressors = struct {
+	sync.RWMutex
+	m map[string]Compressor
+}{m: map[string]Compressor{}}
+
+func init() {
+	RegisterCompressor(EncodingGzip, func(w io.Writer) (CompressWriter, error) {
+		return gzip.NewWriter(w), nil
+	})
+	// The deflate content coding is the zlib format (RFC 1950), not raw deflate
+	RegisterCompressor(EncodingDeflate, func(w io.Writer) (CompressWriter, error) {
+		return zlib.NewWriter(w), nil
+	})
+}
+
+// RegisterCompressor registers c to compress responses with the content coding encoding (as used in the
+// Accept-Encoding and Content-Encoding headers), e.g. to add brotli ("br") or zstd ("zstd"). It replaces any Compressor
+// already registered for the encoding.
+func RegisterCompressor(encoding string, c Compressor) {
+	compressors.Lock()
+	defer compressors.Unlock()
+	compressors.m[strings.ToLower(encoding)] = c
+}
+
+func getCompressor(encoding string) (Compressor, bool) {
+	compressors.RLock()
+	defer compressors.RUnlock()
+	c, ok := compressors.m[encoding]
+	return c, ok
+}
+
+// CompressionConfig configures CompressionMiddleware. The zero value uses the defaults.
+type CompressionConfig struct {
+	// Encodings are the content codings that responses may be compressed with, in order of preference when the client
+	// accepts several of them equally. Encodings without a registered Compressor are ignored. Defaults to zstd, br,
+	// gzip and deflate.
+	Encodings []string
+	// MinSize is the size, in bytes, under which responses are not compressed. Defaults to 1KB; a negative value
+	// compresses responses of any size.
+	MinSize int
+	// ContentTypes are the media types of the responses that are compressed. They can be wildcards, e.g. "text/*".
+	// Defaults to text, JSON, XML, JavaScript and SVG.
+	ContentTypes []string
+}
+
+func (cfg CompressionConfig) withDefaults() CompressionConfig {
+	if len(cfg.Encodings) == 0 {
+		cfg.Encodings = defaultCompressionEncodings
+	}
+	switch {
+	case cfg.MinSize == 0:
+		cfg.MinSize = defaultCompressionMinSize
+	case cfg.MinSize < 0:
+		cfg.MinSize = 0
+	}
+	if len(cfg.ContentTypes) == 0 {
+		cfg.ContentTypes = defaultCompressionContentTypes
+	}
+	return cfg
+}
+
+// allowsContentType returns true if responses with the Content-Type ct can be compressed
+func (cfg CompressionConfig) allowsContentType(ct string) bool {
+	mediaType, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return false
+	}
+	for _, pattern := range cfg.ContentTypes {
+		if matchMediaType(strings.ToLower(pattern), mediaType) {
+			return true
+		}
+	}
+	return false
+}
+
+// CompressionMiddleware returns a http.Handler middleware func that compresses responses with the content coding
+// preferred by the client's Accept-Encoding header. Only responses of the configured content types and sizes are
+// compressed, and streamed responses are compressed as they are flushed. Responses that could be compressed always get
+// a `Vary: Accept-Encoding` header, so caches don't serve them to clients that don't accept the same codings.
+func CompressionMiddleware(cfg CompressionConfig) mux.MiddlewareFunc {
+	cfg = cfg.withDefaults()
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			cw := &compressWriter{ResponseWriter: w, cfg: cfg, logger: Logger(r.Context())}
+			cw.encoding, cw.compressor = negotiateCompression(r, cfg.Encodings)
+
+			next.ServeHTTP(cw, r)
+
+			// If the handler panics, the response isn't finished here, so the recovery middleware can still write an
+			// error if the headers haven't been sent
+			err := cw.Close()
+			if err != nil {
+				cw.logger.Error("[Gopi] Compressing response", "error", err)
+			}
+		})
+	}
+}
+
+// negotiateCompression picks the content coding to compress the response to r with, based on r's Accept-Encoding
+// header and the order of preference of encodings. It returns an empty encoding if the response shouldn't be
+// compressed.
+func negotiateCompression(r *http.Request, encodings []string) (string, Compressor) {
+	header := r.Header.Get("Accept-Encoding")
+	if strings.TrimSpace(header) == "" {
+		return "", nil
+	}
+
+	accepted := map[string]float64{}
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		q := 1.0
+		if qStr, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			var err error
+			q, err = strconv.ParseFloat(qStr, 64)
+			if err != nil {
+				continue
+			}
+		}
+		accepted[name] = q
+	}
+
+	var best string
+	var bestQ float64
+	var bestCompressor Compressor
+	for _, encoding := range encodings {
+		encoding = strings.ToLower(encoding)
+		q, ok := accepted[encoding]
+		if !ok {
+			q = accepted["*"]
+		}
+		if q <= bestQ {
+			continue
+		}
+		c, ok := getCompressor(encoding)
+		if !ok {
+			continue
+		}
+		best, bestQ, bestCompressor = encoding, q, c
+	}
+	return best, bestCompressor
+}
+
+type compressMode int
+
+const (
+	// compressModeUndecided buffers the response until we know whether to compress it
+	compressModeUndecided compressMode = iota
+	compressModePassthrough
+	compressModeCompress
+)
+
+// compressWriter wraps a http.ResponseWriter and compresses the response written to it. The response is buffered until
+// it is large enough to be worth compressing, it is flushed, or the handler returns.
+type compressWriter struct {
+	http.ResponseWriter
+	cfg        CompressionConfig
+	encoding   string
+	compressor Compressor
+	logger     *slog.Logger
+
+	status      int
+	wroteHeader bool
+	hijacked    bool
+	mode        compressMode
+	buf         []byte
+	cw          CompressWriter
+}
+
+func (w *compressWriter) WriteHeader(code int) {
+	if w.wroteHeader || w.hijacked {
+		return
+	}
+	// Informational responses (e.g. 103 Early Hints) are followed by the actual response
+	if code >= 100 && code < 200 && code != http.StatusSwitchingProtocols {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	w.status = code
+	w.wroteHeader = true
+
+	// Decide straight away if we already know that the response won't be compressed
+	if !w.compressible() {
+		w.start(false)
+		return
+	}
+	if n, err := strconv.Atoi(w.Header().Get("Content-Length")); err == nil && n < w.cfg.MinSize {
+		w.start(false)
+	}
+}
+
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	switch w.mode {
+	case compressModePassthrough:
+		return w.ResponseWriter.Write(b)
+	case compressModeCompress:
+		return w.cw.Write(b)
+	}
+	w.buf = append(w.buf, b...)
+	if len(w.buf) >= w.cfg.MinSize {
+		err := w.start(true)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// compressible returns true if the response, as described by its status and headers so far, can be compressed
+func (w *compressWriter) compressible() bool {
+	switch {
+	case w.status == http.StatusNoContent, w.status == http.StatusNotModified, w.status == http.StatusPartialContent,
+		w.status == http.StatusSwitchingProtocols:
+		return false
+	}
+	h := w.Header()
+	if h.Get("Content-Encoding") != "" || strings.Contains(strings.ToLower(h.Get("Cache-Control")), "no-transform") {
+		return false
+	}
+	// Without a Content-Type, it will be sniffed from the body
+	ct := h.Get("Content-Type")
+	return ct == "" || w.cfg.allowsContentType(ct)
+}
+
+// start decides whether the response is compressed, writes the headers and the buffered body
+func (w *compressWriter) start(compress bool) error {
+	h := w.Header()
+	if h.Get("Content-Type") == "" && len(w.buf) > 0 {
+		h.Set("Content-Type", http.DetectContentType(w.buf))
+	}
+
+	w.mode = compressModePassthrough
+	if w.compressible() && h.Get("Content-Type") != "" {
+		addVary(h, "Accept-Encoding")
+		if compress && w.compressor != nil {
+			cw, err := w.compressor(w.ResponseWriter)
+			if err != nil {
+				w.logger.Error("[Gopi] Creating compressor, the response won't be compressed", "encoding", w.encoding, "error", err)
+			} else {
+				w.mode = compressModeCompress
+				w.cw = cw
+				h.Set("Content-Encoding", w.encoding)
+				h.Del("Content-Length")
+				// The compressed representation is no longer byte-for-byte identical
+				if etag := h.Get("ETag"); strings.HasPrefix(etag, `"`) {
+					h.Set("ETag", "W/"+etag)
+				}
+			}
+		}
+	}
+
+	w.ResponseWriter.WriteHeader(w.status)
+	buf := w.buf
+	w.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if w.mode == compressModeCompress {
+		_, err = w.cw.Write(buf)
+	} else {
+		_, err = w.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+// Close finishes the response once the handler has returned
+func (w *compressWriter) Close() error {
+	if w.hijacked || !w.wroteHeader {
+		return nil
+	}
+	switch w.mode {
+	case compressModeUndecided:
+		// The response was smaller than the minimum size
+		return w.start(false)
+	case compressModeCompress:
+		return w.cw.Close()
+	}
+	return nil
+}
+
+// Flush implements http.Flusher, so streamed responses are compressed and sent as they are written
+func (w *compressWriter) Flush() {
+	if w.hijacked {
+		return
+	}
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	var err error
+	if w.mode == compressModeUndecided {
+		// A flushed response is being streamed, so we can't wait for it to reach the minimum size
+		err = w.start(true)
+	}
+	if err == nil && w.mode == compressModeCompress {
+		err = w.cw.Flush()
+	}
+	if err != nil {
+		w.logger.Error("[Gopi] Flushing compressed response", "error", err)
+		return
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker if the underlying http.ResponseWriter supports it, e.g. for WebSocket upgrades
+func (w *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	w.hijacked = true
+	return conn, brw, nil
+}
+
+// Unwrap allows http.ResponseController to reach the underlying http.ResponseWriter
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// addVary adds field to the Vary header of h, unless it is already there
+func addVary(h http.Header, field string) {
+	for _, v := range h.Values("Vary") {
+		for _, existing := range strings.Split(v, ",") {
+			existing = strings.TrimSpace(existing)
+			if existing == "*" || strings.EqualFold(existing, field) {
+				return
+			}
+		}
+	}
+	h.Add("Vary", field)
+}
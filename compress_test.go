@@ -0,0 +1,195 @@
+package gopi_test
+
+import (
+	"bufio"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/teejays/gopi"
+)
+
+func TestCompression(t *testing.T) {
+	// A test content coding, to check that compressors can be plugged in
+	gopi.RegisterCompressor("x-test", func(w io.Writer) (gopi.CompressWriter, error) {
+		return gzip.NewWriter(w), nil
+	})
+
+	routes := []gopi.Route{
+		{
+			Method:      http.MethodPost,
+			Path:        "ping",
+			HandlerFunc: gopi.HandlerWrapper(http.MethodPost, SampleEndpoint),
+		},
+		{
+			Method: http.MethodGet,
+			Path:   "image",
+			HandlerFunc: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "image/png")
+				w.Write([]byte(strings.Repeat("x", 2048)))
+			},
+		},
+	}
+	h, err := gopi.GetHandler(context.TODO(), routes, gopi.MiddlewareFuncs{},
+		gopi.WithCompression(gopi.CompressionConfig{Encodings: []string{"x-test", gopi.EncodingGzip, gopi.EncodingDeflate}}),
+	)
+	assert.NoError(t, err)
+
+	large := strings.Repeat("pong", 512)
+
+	tests := []struct {
+		name           string
+		method         string
+		path           string
+		body           string
+		acceptEncoding string
+		wantEncoding   string
+		wantVary       bool
+		wantPong       string
+	}{
+		{
+			name:           "gzip",
+			path:           "/api/v0/ping",
+			body:           `{"ping":"` + large + `"}`,
+			acceptEncoding: "gzip, deflate",
+			wantEncoding:   "gzip",
+			wantVary:       true,
+			wantPong:       large,
+		},
+		{
+			name:           "Preferred by q-value",
+			path:           "/api/v0/ping",
+			body:           `{"ping":"` + large + `"}`,
+			acceptEncoding: "gzip;q=0.5, deflate",
+			wantEncoding:   "deflate",
+			wantVary:       true,
+			wantPong:       large,
+		},
+		{
+			name:           "Pluggable encoding",
+			path:           "/api/v0/ping",
+			body:           `{"ping":"` + large + `"}`,
+			acceptEncoding: "*",
+			wantEncoding:   "x-test",
+			wantVary:       true,
+			wantPong:       large,
+		},
+		{
+			name:           "Not accepted",
+			path:           "/api/v0/ping",
+			body:           `{"ping":"` + large + `"}`,
+			acceptEncoding: "gzip;q=0, br",
+			wantVary:       true,
+			wantPong:       large,
+		},
+		{
+			name:     "No Accept-Encoding",
+			path:     "/api/v0/ping",
+			body:     `{"ping":"` + large + `"}`,
+			wantVary: true,
+			wantPong: large,
+		},
+		{
+			name:           "Under minimum size",
+			path:           "/api/v0/ping",
+			body:           `{"ping":"hello"}`,
+			acceptEncoding: "gzip",
+			wantVary:       true,
+			wantPong:       "hello",
+		},
+		{
+			name:           "Content type not allowed",
+			method:         http.MethodGet,
+			path:           "/api/v0/image",
+			acceptEncoding: "gzip",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := tt.method
+			if method == "" {
+				method = http.MethodPost
+			}
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(method, tt.path, strings.NewReader(tt.body))
+			if tt.acceptEncoding != "" {
+				r.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+			h.ServeHTTP(w, r)
+
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, tt.wantEncoding, w.Header().Get("Content-Encoding"))
+			assert.Equal(t, tt.wantVary, strings.Contains(strings.Join(w.Header().Values("Vary"), ","), "Accept-Encoding"))
+
+			var body io.Reader = w.Body
+			switch tt.wantEncoding {
+			case "gzip", "x-test":
+				assert.Empty(t, w.Header().Get("Content-Length"))
+				body, err = gzip.NewReader(body)
+				assert.NoError(t, err)
+			case "deflate":
+				body, err = zlib.NewReader(body)
+				assert.NoError(t, err)
+			}
+			data, err := io.ReadAll(body)
+			assert.NoError(t, err)
+			if tt.wantPong != "" {
+				assert.JSONEq(t, `{"status_code":200,"data":{"pong":"`+tt.wantPong+`"},"error":null}`, string(data))
+			}
+		})
+	}
+}
+
+func TestCompression_EventStream(t *testing.T) {
+	events := make(chan gopi.Event[SampleResp])
+	routes := []gopi.Route{
+		{
+			Method: http.MethodPost,
+			Path:   "events",
+			HandlerFunc: gopi.HandlerWrapper(http.MethodPost, func(ctx context.Context, req SampleReq) (gopi.EventStream[SampleResp], error) {
+				return gopi.StreamEventChan(events), nil
+			}),
+		},
+	}
+	h, err := gopi.GetHandler(context.TODO(), routes, gopi.MiddlewareFuncs{}, gopi.WithCompression(gopi.CompressionConfig{}))
+	assert.NoError(t, err)
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	req, err := http.NewRequest(http.MethodPost, srv.URL+"/api/v0/events", strings.NewReader(`{}`))
+	assert.NoError(t, err)
+	// Setting Accept-Encoding ourselves keeps the transport from transparently decompressing the response
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer resp.Body.Close()
+	assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+
+	gz, err := gzip.NewReader(resp.Body)
+	if !assert.NoError(t, err) {
+		return
+	}
+	lines := bufio.NewReader(gz)
+
+	// Each event should reach the client as soon as it is produced, even though the stream is still open
+	for _, pong := range []string{"one", "two"} {
+		events <- gopi.Event[SampleResp]{Data: SampleResp{Pong: pong}}
+		line, err := lines.ReadString('\n')
+		assert.NoError(t, err)
+		assert.JSONEq(t, `{"pong":"`+pong+`"}`, line)
+	}
+	close(events)
+	rest, err := io.ReadAll(lines)
+	assert.NoError(t, err)
+	assert.Empty(t, rest)
+}
@@ -0,0 +1,300 @@
+package gopi
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ErrOverloaded is used when a request is shed because the server is handling as many requests as it can
+var ErrOverloaded = fmt.Errorf("the server is overloaded, please try again later")
+
+const (
+	// defaultConcurrencyQueueTimeout is how long requests wait for a slot, unless configured otherwise
+	defaultConcurrencyQueueTimeout = 100 * time.Millisecond
+	// defaultConcurrencyLatencyTarget is the latency over which ConcurrencyAIMD decreases the limit, unless configured
+	// otherwise
+	defaultConcurrencyLatencyTarget = time.Second
+	// aimdBackoff is the factor that ConcurrencyAIMD multiplies the limit by when a request is too slow or fails
+	aimdBackoff = 0.9
+	// gradientSmoothing is how much each sample moves the limit of ConcurrencyGradient
+	gradientSmoothing = 0.2
+	// gradientTolerance is how much the latency can grow over the long-term average before ConcurrencyGradient
+	// decreases the limit
+	gradientTolerance = 1.5
+	// gradientLongWindow is the number of samples over which ConcurrencyGradient averages the long-term latency
+	gradientLongWindow = 100
+)
+
+// Priority is the class of a route's requests when the server is overloaded (see WithConcurrencyLimit). Queued
+// requests are let through by priority, and lower priority requests are shed first.
+type Priority int
+
+const (
+	// PriorityLow is for requests that can be shed first, e.g. background jobs
+	PriorityLow Priority = -1
+	// PriorityNormal is the default
+	PriorityNormal Priority = 0
+	// PriorityHigh is for requests that should be served before others when the server is overloaded
+	PriorityHigh Priority = 1
+	// PriorityCritical requests are never limited, e.g. health checks
+	PriorityCritical Priority = 2
+)
+
+// ConcurrencyAlgorithm determines how the concurrency limit of the server changes with its load
+type ConcurrencyAlgorithm int
+
+const (
+	// ConcurrencyFixed keeps the limit at MaxInFlight
+	ConcurrencyFixed ConcurrencyAlgorithm = iota
+	// ConcurrencyAIMD increases the limit additively while requests are fast enough, and decreases it
+	// multiplicatively when they are slower than LatencyTarget or fail with a 503 or 504
+	ConcurrencyAIMD
+	// ConcurrencyGradient adjusts the limit by comparing the latency of requests with its long-term average, so it
+	// decreases as soon as requests start queueing up downstream
+	ConcurrencyGradient
+)
+
+// ConcurrencyLimit configures how many requests the server handles at the same time (see WithConcurrencyLimit)
+type ConcurrencyLimit struct {
+	// MaxInFlight is the maximum number of requests handled at the same time. Concurrency limiting is disabled if it
+	// is not set.
+	MaxInFlight int
+	// MinInFlight is the lowest that an adaptive Algorithm can set the limit to. Defaults to 1.
+	MinInFlight int
+	// Algorithm defaults to ConcurrencyFixed. Adaptive algorithms start at MaxInFlight.
+	Algorithm ConcurrencyAlgorithm
+	// LatencyTarget is the latency over which ConcurrencyAIMD considers the server overloaded. Defaults to a second.
+	LatencyTarget time.Duration
+	// QueueSize is the maximum number of requests that wait for a slot once the limit is reached. Defaults to
+	// MaxInFlight.
+	QueueSize int
+	// QueueTimeout is how long requests wait for a slot before being rejected. Defaults to 100ms.
+	QueueTimeout time.Duration
+}
+
+func (c ConcurrencyLimit) withDefaults() ConcurrencyLimit {
+	if c.MinInFlight <= 0 {
+		c.MinInFlight = 1
+	}
+	if c.MinInFlight > c.MaxInFlight {
+		c.MinInFlight = c.MaxInFlight
+	}
+	if c.LatencyTarget <= 0 {
+		c.LatencyTarget = defaultConcurrencyLatencyTarget
+	}
+	if c.QueueSize <= 0 {
+		c.QueueSize = c.MaxInFlight
+	}
+	if c.QueueTimeout <= 0 {
+		c.QueueTimeout = defaultConcurrencyQueueTimeout
+	}
+	return c
+}
+
+// concurrencyLimiter limits the number of requests that the server handles at the same time, queueing the excess ones
+// by priority for a short while
+type concurrencyLimiter struct {
+	cfg ConcurrencyLimit
+
+	mu       sync.Mutex
+	limit    float64
+	inFlight int
+	queue    waiterQueue
+	arrivals uint64
+
+	// longRTT is the long-term average latency, for ConcurrencyGradient
+	longRTT float64
+}
+
+func newConcurrencyLimiter(cfg ConcurrencyLimit) *concurrencyLimiter {
+	cfg = cfg.withDefaults()
+	return &concurrencyLimiter{cfg: cfg, limit: float64(cfg.MaxInFlight)}
+}
+
+// waiter is a request waiting for a slot
+type waiter struct {
+	priority Priority
+	arrival  uint64
+	index    int
+	// granted receives true when the request gets a slot, and false when it is evicted by a higher priority request
+	granted chan bool
+}
+
+// acquire waits for a slot to handle a request with priority. It returns false if the request should be shed.
+func (l *concurrencyLimiter) acquire(ctx context.Context, priority Priority) bool {
+	l.mu.Lock()
+	if priority >= PriorityCritical {
+		l.inFlight++
+		l.mu.Unlock()
+		return true
+	}
+	if l.inFlight < int(l.limit) && l.queue.Len() == 0 {
+		l.inFlight++
+		l.mu.Unlock()
+		return true
+	}
+
+	// Queue up, making room by evicting a lower priority request if the queue is full
+	if l.queue.Len() >= l.cfg.QueueSize {
+		lowest := l.queue.lowest()
+		if lowest == nil || lowest.priority >= priority {
+			l.mu.Unlock()
+			return false
+		}
+		heap.Remove(&l.queue, lowest.index)
+		lowest.granted <- false
+	}
+	l.arrivals++
+	w := &waiter{priority: priority, arrival: l.arrivals, granted: make(chan bool, 1)}
+	heap.Push(&l.queue, w)
+	l.mu.Unlock()
+
+	timer := time.NewTimer(l.cfg.QueueTimeout)
+	defer timer.Stop()
+	select {
+	case granted := <-w.granted:
+		return granted
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if w.index >= 0 {
+		heap.Remove(&l.queue, w.index)
+		return false
+	}
+	// We got a slot (or were evicted) just as we gave up waiting
+	return <-w.granted
+}
+
+// release frees the slot of a request that took rtt, and lets queued requests through if there is room. overloaded
+// is true if the request failed in a way that shows that the server is overloaded. The limit is only adjusted if
+// sampled is true, since the latency of some requests (e.g. streams) doesn't reflect the load of the server.
+func (l *concurrencyLimiter) release(rtt time.Duration, overloaded, sampled bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inFlight--
+	if sampled || overloaded {
+		l.adjust(rtt, overloaded)
+	}
+
+	for l.queue.Len() > 0 && l.inFlight < int(l.limit) {
+		w := heap.Pop(&l.queue).(*waiter)
+		l.inFlight++
+		w.granted <- true
+	}
+}
+
+// adjust updates the limit according to the algorithm, with a sample from a request that has completed
+func (l *concurrencyLimiter) adjust(rtt time.Duration, overloaded bool) {
+	switch l.cfg.Algorithm {
+	case ConcurrencyAIMD:
+		if overloaded || rtt > l.cfg.LatencyTarget {
+			l.limit *= aimdBackoff
+		} else {
+			l.limit += 1 / l.limit
+		}
+	case ConcurrencyGradient:
+		sample := float64(rtt)
+		if sample <= 0 {
+			return
+		}
+		if l.longRTT == 0 {
+			l.longRTT = sample
+		}
+		l.longRTT += (sample - l.longRTT) / gradientLongWindow
+		gradient := math.Max(0.5, math.Min(1, gradientTolerance*l.longRTT/sample))
+		if overloaded {
+			gradient = 0.5
+		}
+		// The square root lets the limit grow when the latency is stable, to find out whether there is more capacity
+		newLimit := l.limit*gradient + math.Sqrt(l.limit)
+		l.limit = l.limit*(1-gradientSmoothing) + newLimit*gradientSmoothing
+	default:
+		return
+	}
+	l.limit = math.Max(float64(l.cfg.MinInFlight), math.Min(float64(l.cfg.MaxInFlight), l.limit))
+}
+
+// middleware limits the concurrency of the requests passed to next, which have priority
+func (l *concurrencyLimiter) middleware(priority Priority) func(http.Handler) http.Handler {
+	retryAfter := strconv.Itoa(max(ceilSeconds(l.cfg.QueueTimeout), 1))
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// WebSocket connections outlive the request, so they would hold their slot for as long as they are open
+			if websocket.IsWebSocketUpgrade(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if !l.acquire(r.Context(), priority) {
+				w.Header().Set("Retry-After", retryAfter)
+				writeError(w, r, http.StatusServiceUnavailable, ErrOverloaded)
+				return
+			}
+
+			rw := newResponseRecorder(w)
+			start := time.Now()
+			// The slot must be freed even if the handler panics
+			defer func() {
+				status := rw.Status()
+				overloaded := status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout
+				// Streamed responses last for as long as the client listens, so their latency isn't a sample
+				l.release(time.Since(start), overloaded, !rw.Flushed())
+			}()
+			next.ServeHTTP(rw, r)
+		})
+	}
+}
+
+// waiterQueue is a heap of waiters, with the highest priority (and then the oldest) first
+type waiterQueue []*waiter
+
+func (q waiterQueue) Len() int { return len(q) }
+
+func (q waiterQueue) Less(i, j int) bool {
+	if q[i].priority != q[j].priority {
+		return q[i].priority > q[j].priority
+	}
+	return q[i].arrival < q[j].arrival
+}
+
+func (q waiterQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *waiterQueue) Push(x interface{}) {
+	w := x.(*waiter)
+	w.index = len(*q)
+	*q = append(*q, w)
+}
+
+func (q *waiterQueue) Pop() interface{} {
+	old := *q
+	w := old[len(old)-1]
+	old[len(old)-1] = nil
+	w.index = -1
+	*q = old[:len(old)-1]
+	return w
+}
+
+// lowest returns the waiter that would be let through last, i.e. the newest with the lowest priority
+func (q waiterQueue) lowest() *waiter {
+	var lowest *waiter
+	for _, w := range q {
+		if lowest == nil || w.priority < lowest.priority || (w.priority == lowest.priority && w.arrival > lowest.arrival) {
+			lowest = w
+		}
+	}
+	return lowest
+}
@@ -0,0 +1,210 @@
+package gopi_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/teejays/gopi"
+)
+
+// blockingRoutes returns routes of each priority whose requests block until they are released, reporting on started
+// when they start being handled
+func blockingRoutes(started chan<- string, release <-chan struct{}) []gopi.Route {
+	var routes []gopi.Route
+	for path, priority := range map[string]gopi.Priority{
+		"low":      gopi.PriorityLow,
+		"normal":   gopi.PriorityNormal,
+		"high":     gopi.PriorityHigh,
+		"critical": gopi.PriorityCritical,
+	} {
+		path := path
+		routes = append(routes, gopi.Route{
+			Method: http.MethodGet,
+			Path:   path,
+			HandlerFunc: gopi.HandlerWrapper(http.MethodGet, func(ctx context.Context, req SampleReq) (SampleResp, error) {
+				started <- path + " " + req.Ping
+				<-release
+				return SampleResp{Pong: req.Ping}, nil
+			}),
+			Priority: priority,
+		})
+	}
+	return routes
+}
+
+func TestConcurrencyLimit(t *testing.T) {
+	started := make(chan string, 10)
+	release := make(chan struct{})
+	h, err := gopi.GetHandler(context.TODO(), blockingRoutes(started, release), gopi.MiddlewareFuncs{},
+		gopi.WithConcurrencyLimit(gopi.ConcurrencyLimit{MaxInFlight: 1, QueueSize: 1, QueueTimeout: 200 * time.Millisecond}),
+	)
+	assert.NoError(t, err)
+
+	type result struct {
+		name string
+		w    *httptest.ResponseRecorder
+	}
+	results := make(chan result, 10)
+	get := func(path, name string) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/api/v0/"+path+"?req="+url.QueryEscape(`{"ping":"`+name+`"}`), nil)
+		h.ServeHTTP(w, r)
+		results <- result{name: name, w: w}
+	}
+
+	// The first request takes the only slot
+	go get("normal", "first")
+	assert.Equal(t, "normal first", <-started)
+
+	// The next one waits in the queue, until a higher priority request takes its place
+	go get("low", "queued")
+	time.Sleep(20 * time.Millisecond)
+	go get("high", "important")
+	res := <-results
+	assert.Equal(t, "queued", res.name)
+	assert.Equal(t, http.StatusServiceUnavailable, res.w.Code)
+	assert.Equal(t, "1", res.w.Header().Get("Retry-After"))
+	assert.JSONEq(t, `{"status_code":503,"data":null,"error":"`+gopi.ErrOverloaded.Error()+`"}`, res.w.Body.String())
+
+	// A request that can't even be queued is rejected straight away
+	go get("normal", "rejected")
+	res = <-results
+	assert.Equal(t, "rejected", res.name)
+	assert.Equal(t, http.StatusServiceUnavailable, res.w.Code)
+
+	// Critical requests aren't limited
+	go get("critical", "health")
+	assert.Equal(t, "critical health", <-started)
+
+	// Once the first request is done, the queued one is let through
+	release <- struct{}{}
+	release <- struct{}{}
+	assert.Equal(t, "high important", <-started)
+	release <- struct{}{}
+	for i := 0; i < 3; i++ {
+		res = <-results
+		assert.Equal(t, http.StatusOK, res.w.Code, res.name)
+	}
+
+	// Requests that wait for too long are rejected
+	go get("normal", "slow")
+	assert.Equal(t, "normal slow", <-started)
+	go get("normal", "timed-out")
+	res = <-results
+	assert.Equal(t, "timed-out", res.name)
+	assert.Equal(t, http.StatusServiceUnavailable, res.w.Code)
+	release <- struct{}{}
+	assert.Equal(t, http.StatusOK, (<-results).w.Code)
+}
+
+func TestConcurrencyLimit_AIMD(t *testing.T) {
+	started := make(chan string, 10)
+	release := make(chan struct{})
+	h, err := gopi.GetHandler(context.TODO(), blockingRoutes(started, release), gopi.MiddlewareFuncs{},
+		gopi.WithConcurrencyLimit(gopi.ConcurrencyLimit{
+			MaxInFlight:   3,
+			Algorithm:     gopi.ConcurrencyAIMD,
+			LatencyTarget: time.Nanosecond,
+			QueueSize:     1,
+			QueueTimeout:  10 * time.Millisecond,
+		}),
+	)
+	assert.NoError(t, err)
+	codes := make(chan int, 10)
+	get := func() {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/api/v0/normal?req="+url.QueryEscape(`{}`), nil)
+		h.ServeHTTP(w, r)
+		codes <- w.Code
+	}
+
+	// Every request is slower than the target, so the limit backs off to a single request
+	for i := 0; i < 20; i++ {
+		go get()
+		<-started
+		release <- struct{}{}
+		assert.Equal(t, http.StatusOK, <-codes)
+	}
+
+	go get()
+	<-started
+	go get()
+	assert.Equal(t, http.StatusServiceUnavailable, <-codes)
+	release <- struct{}{}
+	assert.Equal(t, http.StatusOK, <-codes)
+}
+
+func TestConcurrencyLimit_Exemptions(t *testing.T) {
+	started := make(chan string, 10)
+	release := make(chan struct{})
+	routes := append(blockingRoutes(started, release),
+		gopi.Route{
+			Method: http.MethodGet,
+			Path:   "stream",
+			HandlerFunc: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", gopi.MediaTypeNDJSON)
+				w.Write([]byte("{}\n"))
+				http.NewResponseController(w).Flush()
+				time.Sleep(time.Millisecond)
+			},
+		},
+		gopi.Route{
+			Method: http.MethodGet,
+			Path:   "ws",
+			HandlerFunc: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusNoContent)
+			},
+		},
+	)
+	h, err := gopi.GetHandler(context.TODO(), routes, gopi.MiddlewareFuncs{},
+		gopi.WithConcurrencyLimit(gopi.ConcurrencyLimit{
+			MaxInFlight:   2,
+			Algorithm:     gopi.ConcurrencyAIMD,
+			LatencyTarget: time.Nanosecond,
+			QueueSize:     1,
+			QueueTimeout:  10 * time.Millisecond,
+		}),
+	)
+	if !assert.NoError(t, err) {
+		return
+	}
+	codes := make(chan int, 10)
+	get := func(path string, header http.Header) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/api/v0/"+path+"?req="+url.QueryEscape(`{}`), nil)
+		for k, v := range header {
+			r.Header[k] = v
+		}
+		h.ServeHTTP(w, r)
+		codes <- w.Code
+	}
+
+	// Streams are slower than the target, but their latency doesn't count, so the limit stays at 2
+	for i := 0; i < 20; i++ {
+		get("stream", nil)
+		assert.Equal(t, http.StatusOK, <-codes)
+	}
+	for i := 0; i < 2; i++ {
+		go get("normal", nil)
+		select {
+		case <-started:
+		case code := <-codes:
+			t.Fatalf("the request wasn't let through: %d", code)
+		}
+	}
+
+	// WebSocket upgrades aren't limited, since the connections outlive the requests
+	get("ws", http.Header{"Connection": {"Upgrade"}, "Upgrade": {"websocket"}})
+	assert.Equal(t, http.StatusNoContent, <-codes)
+
+	release <- struct{}{}
+	release <- struct{}{}
+	assert.Equal(t, http.StatusOK, <-codes)
+	assert.Equal(t, http.StatusOK, <-codes)
+}
@@ -0,0 +1,224 @@
+package gopi
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/teejays/gopi/json"
+)
+
+// ErrPreconditionFailed is used when the resource targeted by a request has changed since the version the client
+// based the request on (see CheckPreconditions)
+var ErrPreconditionFailed = fmt.Errorf("the resource has been modified since it was last fetched")
+
+// ETagger can be implemented by RespT types that know their version, e.g. a revision number. The ETag header of GET
+// responses is then derived from it, instead of from a hash of the value.
+type ETagger interface {
+	// ETag returns the version of the value. Weak versions only identify semantically equivalent values, and can't be
+	// used for If-Match preconditions.
+	ETag() (version string, weak bool)
+}
+
+// LastModifier can be implemented by RespT types that know when they were last modified. The Last-Modified header of
+// GET responses is then set from it, so clients can make If-Modified-Since requests.
+type LastModifier interface {
+	LastModified() time.Time
+}
+
+// formatETag returns the entity tag for version, as used in the ETag header
+func formatETag(version string, weak bool) string {
+	tag := `"` + strings.ReplaceAll(version, `"`, "") + `"`
+	if weak {
+		return "W/" + tag
+	}
+	return tag
+}
+
+// hashETag returns a strong entity tag for an encoded response
+func hashETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return formatETag(hex.EncodeToString(sum[:16]), false)
+}
+
+// valueETag returns a strong entity tag hashed from the value of v. Unlike the hash of an encoded response, it is the
+// same whatever the media type, so CheckPreconditions can compute it too.
+func valueETag(v interface{}) (string, bool) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", false
+	}
+	return hashETag(data), true
+}
+
+// setValidators sets the ETag and Last-Modified headers of the response from v: the ETag from its version if it
+// implements ETagger, or else from a hash of its value
+func setValidators(h http.Header, v interface{}) {
+	if e, ok := v.(ETagger); ok {
+		if version, weak := e.ETag(); version != "" {
+			h.Set("ETag", formatETag(version, weak))
+		}
+	} else if etag, ok := valueETag(v); ok {
+		h.Set("ETag", etag)
+	}
+	if lm, ok := v.(LastModifier); ok {
+		if t := lm.LastModified(); !t.IsZero() {
+			h.Set("Last-Modified", t.UTC().Format(http.TimeFormat))
+		}
+	}
+}
+
+// isConditionalGet returns true if r is a request whose response can be replaced by a 304 Not Modified
+func isConditionalGet(r *http.Request) bool {
+	return r != nil && (r.Method == http.MethodGet || r.Method == http.MethodHead)
+}
+
+// notModified returns true if the client already has the current version of the response, as described by the ETag
+// and Last-Modified headers of h, based on the If-None-Match and If-Modified-Since headers of r
+func notModified(r *http.Request, h http.Header) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		etag := h.Get("ETag")
+		if etag == "" {
+			return false
+		}
+		for _, tag := range parseETags(inm) {
+			if tag == "*" || weakETagMatch(tag, etag) {
+				return true
+			}
+		}
+		return false
+	}
+	// If-Modified-Since is only used when the client doesn't have an ETag
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" {
+		since, err := http.ParseTime(ims)
+		if err != nil {
+			return false
+		}
+		modified, err := http.ParseTime(h.Get("Last-Modified"))
+		if err != nil {
+			return false
+		}
+		return !modified.After(since)
+	}
+	return false
+}
+
+// writeNotModified writes a 304 Not Modified response, keeping the headers that describe the current version
+func writeNotModified(w http.ResponseWriter) {
+	h := w.Header()
+	h.Del("Content-Type")
+	h.Del("Content-Length")
+	w.WriteHeader(http.StatusNotModified)
+}
+
+// parseETags parses a list of entity tags, as used in the If-Match and If-None-Match headers
+func parseETags(header string) []string {
+	var tags []string
+	s := strings.TrimSpace(header)
+	for s != "" {
+		if s[0] == ',' || s[0] == ' ' || s[0] == '\t' {
+			s = s[1:]
+			continue
+		}
+		if s[0] == '*' {
+			tags = append(tags, "*")
+			s = s[1:]
+			continue
+		}
+		start := 0
+		if strings.HasPrefix(s, "W/") {
+			start = 2
+		}
+		if len(s) <= start || s[start] != '"' {
+			// Malformed, skip to the next tag
+			i := strings.IndexByte(s, ',')
+			if i < 0 {
+				break
+			}
+			s = s[i+1:]
+			continue
+		}
+		end := strings.IndexByte(s[start+1:], '"')
+		if end < 0 {
+			break
+		}
+		end += start + 2
+		tags = append(tags, s[:end])
+		s = s[end:]
+	}
+	return tags
+}
+
+// weakETagMatch compares two entity tags ignoring whether they are weak (RFC 9110, section 8.8.3.2)
+func weakETagMatch(a, b string) bool {
+	return strings.TrimPrefix(a, "W/") == strings.TrimPrefix(b, "W/")
+}
+
+// strongETagMatch compares two entity tags, which only match if neither is weak
+func strongETagMatch(a, b string) bool {
+	return !strings.HasPrefix(a, "W/") && !strings.HasPrefix(b, "W/") && a == b
+}
+
+/* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+* P R E C O N D I T I O N S
+* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
+
+type preconditionsContextKey struct{}
+
+// preconditions are the headers of a request that make an update conditional on the current version of the resource
+type preconditions struct {
+	ifMatch           string
+	ifUnmodifiedSince string
+}
+
+// withPreconditions adds the preconditions of r, if any, to ctx
+func withPreconditions(ctx context.Context, r *http.Request) context.Context {
+	p := preconditions{ifMatch: r.Header.Get("If-Match"), ifUnmodifiedSince: r.Header.Get("If-Unmodified-Since")}
+	if p == (preconditions{}) {
+		return ctx
+	}
+	return context.WithValue(ctx, preconditionsContextKey{}, p)
+}
+
+// CheckPreconditions checks the If-Match and If-Unmodified-Since headers of the request against current, the current
+// version of the resource that the request updates (e.g. in a PUT or PATCH handler, before saving the update). current
+// is what the GET route of the resource responds with, so it has the same ETag: its version if it implements ETagger,
+// or else a hash of its value. nil means that the resource doesn't exist. It returns ErrPreconditionFailed, which is
+// written as a 412 Precondition Failed, if the client based its update on another version, so concurrent updates don't
+// overwrite each other. Requests without preconditions always pass.
+func CheckPreconditions(ctx context.Context, current interface{}) error {
+	p, ok := ctx.Value(preconditionsContextKey{}).(preconditions)
+	if !ok {
+		return nil
+	}
+	h := http.Header{}
+	if current != nil {
+		setValidators(h, current)
+	}
+
+	if p.ifMatch != "" {
+		etag := h.Get("ETag")
+		for _, tag := range parseETags(p.ifMatch) {
+			if (tag == "*" && current != nil) || (etag != "" && strongETagMatch(tag, etag)) {
+				return nil
+			}
+		}
+		return ErrPreconditionFailed
+	}
+	// If-Unmodified-Since is only used when the client doesn't have an ETag
+	if p.ifUnmodifiedSince != "" {
+		since, err := http.ParseTime(p.ifUnmodifiedSince)
+		if err != nil {
+			return nil
+		}
+		modified, err := http.ParseTime(h.Get("Last-Modified"))
+		if err != nil || modified.After(since) {
+			return ErrPreconditionFailed
+		}
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+package gopi_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/teejays/gopi"
+)
+
+type Document struct {
+	Title     string
+	Revision  string
+	UpdatedAt time.Time
+}
+
+func (d Document) ETag() (string, bool) {
+	return d.Revision, false
+}
+
+func (d Document) LastModified() time.Time {
+	return d.UpdatedAt
+}
+
+var currentDocument = Document{
+	Title:     "Hello",
+	Revision:  "r2",
+	UpdatedAt: time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC),
+}
+
+func GetDocumentEndpoint(ctx context.Context, req SampleReq) (Document, error) {
+	return currentDocument, nil
+}
+
+func UpdateDocumentEndpoint(ctx context.Context, req Document) (Document, error) {
+	err := gopi.CheckPreconditions(ctx, currentDocument)
+	if err != nil {
+		return Document{}, err
+	}
+	return req, nil
+}
+
+// currentPing is a resource without a version of its own
+var currentPing = SampleResp{Pong: "hello"}
+
+func UpdatePingEndpoint(ctx context.Context, req SampleResp) (SampleResp, error) {
+	err := gopi.CheckPreconditions(ctx, currentPing)
+	if err != nil {
+		return SampleResp{}, err
+	}
+	return req, nil
+}
+
+func TestConditionalRequests(t *testing.T) {
+	routes := []gopi.Route{
+		{
+			Method:      http.MethodGet,
+			Path:        "ping",
+			HandlerFunc: gopi.HandlerWrapper(http.MethodGet, SampleEndpoint),
+		},
+		{
+			Method:      http.MethodGet,
+			Path:        "document",
+			HandlerFunc: gopi.HandlerWrapper(http.MethodGet, GetDocumentEndpoint),
+		},
+		{
+			Method:      http.MethodPut,
+			Path:        "ping",
+			HandlerFunc: gopi.HandlerWrapper(http.MethodPut, UpdatePingEndpoint),
+		},
+		{
+			Method:      http.MethodPut,
+			Path:        "document",
+			HandlerFunc: gopi.HandlerWrapper(http.MethodPut, UpdateDocumentEndpoint),
+		},
+	}
+	h, err := gopi.GetHandler(context.TODO(), routes, gopi.MiddlewareFuncs{})
+	assert.NoError(t, err)
+
+	serve := func(method, path, body string, headers map[string]string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		for k, v := range headers {
+			r.Header.Set(k, v)
+		}
+		h.ServeHTTP(w, r)
+		return w
+	}
+	pingPath := "/api/v0/ping?req=" + url.QueryEscape(`{"ping":"hello"}`)
+	documentPath := "/api/v0/document?req=" + url.QueryEscape(`{}`)
+
+	t.Run("Hashed ETag", func(t *testing.T) {
+		w := serve(http.MethodGet, pingPath, "", nil)
+		assert.Equal(t, http.StatusOK, w.Code)
+		etag := w.Header().Get("ETag")
+		assert.Regexp(t, `^"[0-9a-f]{32}"$`, etag)
+
+		// The same response gets the same ETag, so the client's copy is still fresh
+		w = serve(http.MethodGet, pingPath, "", map[string]string{"If-None-Match": `"other", ` + etag})
+		assert.Equal(t, http.StatusNotModified, w.Code)
+		assert.Empty(t, w.Body.String())
+		assert.Equal(t, etag, w.Header().Get("ETag"))
+
+		// A weak version of the tag (e.g. after compression) matches too
+		w = serve(http.MethodGet, pingPath, "", map[string]string{"If-None-Match": "W/" + etag})
+		assert.Equal(t, http.StatusNotModified, w.Code)
+
+		w = serve(http.MethodGet, "/api/v0/ping?req="+url.QueryEscape(`{"ping":"bye"}`), "", map[string]string{"If-None-Match": etag})
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.NotEqual(t, etag, w.Header().Get("ETag"))
+	})
+
+	t.Run("Versioned response", func(t *testing.T) {
+		w := serve(http.MethodGet, documentPath, "", nil)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, `"r2"`, w.Header().Get("ETag"))
+		assert.Equal(t, "Fri, 01 Mar 2024 12:00:00 GMT", w.Header().Get("Last-Modified"))
+
+		w = serve(http.MethodGet, documentPath, "", map[string]string{"If-None-Match": `"r2"`})
+		assert.Equal(t, http.StatusNotModified, w.Code)
+
+		w = serve(http.MethodGet, documentPath, "", map[string]string{"If-None-Match": `"r1"`})
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		w = serve(http.MethodGet, documentPath, "", map[string]string{"If-Modified-Since": "Fri, 01 Mar 2024 12:00:00 GMT"})
+		assert.Equal(t, http.StatusNotModified, w.Code)
+
+		w = serve(http.MethodGet, documentPath, "", map[string]string{"If-Modified-Since": "Thu, 29 Feb 2024 12:00:00 GMT"})
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		// If-None-Match takes precedence over If-Modified-Since
+		w = serve(http.MethodGet, documentPath, "", map[string]string{"If-None-Match": `"r1"`, "If-Modified-Since": "Fri, 01 Mar 2024 12:00:00 GMT"})
+		assert.Equal(t, http.StatusOK, w.Code)
+	})
+
+	t.Run("Preconditions", func(t *testing.T) {
+		body := `{"title":"Updated"}`
+
+		w := serve(http.MethodPut, "/api/v0/document", body, nil)
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		w = serve(http.MethodPut, "/api/v0/document", body, map[string]string{"If-Match": `"r2"`})
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		w = serve(http.MethodPut, "/api/v0/document", body, map[string]string{"If-Match": `*`})
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		w = serve(http.MethodPut, "/api/v0/document", body, map[string]string{"If-Match": `"r1"`})
+		assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+
+		// Weak tags never match for If-Match
+		w = serve(http.MethodPut, "/api/v0/document", body, map[string]string{"If-Match": `W/"r2"`})
+		assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+
+		w = serve(http.MethodPut, "/api/v0/document", body, map[string]string{"If-Unmodified-Since": "Thu, 29 Feb 2024 12:00:00 GMT"})
+		assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+
+		w = serve(http.MethodPut, "/api/v0/document", body, map[string]string{"If-Unmodified-Since": "Fri, 01 Mar 2024 12:00:00 GMT"})
+		assert.Equal(t, http.StatusOK, w.Code)
+	})
+
+	t.Run("Preconditions With Hashed ETag", func(t *testing.T) {
+		// The ETag of the GET response matches the current value, whatever the media type it was fetched in
+		for _, accept := range []string{gopi.MediaTypeJSON, gopi.MediaTypeMsgPack} {
+			w := serve(http.MethodGet, pingPath, "", map[string]string{"Accept": accept})
+			etag := w.Header().Get("ETag")
+			w = serve(http.MethodPut, "/api/v0/ping", `{"pong":"bye"}`, map[string]string{"If-Match": etag})
+			assert.Equal(t, http.StatusOK, w.Code, accept)
+		}
+
+		w := serve(http.MethodGet, "/api/v0/ping?req="+url.QueryEscape(`{"ping":"bye"}`), "", nil)
+		w = serve(http.MethodPut, "/api/v0/ping", `{"pong":"bye"}`, map[string]string{"If-Match": w.Header().Get("ETag")})
+		assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+	})
+}
@@ -0,0 +1,182 @@
+package gopi
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/teejays/gopi/json"
+)
+
+type routeConfigContextKey struct{}
+
+// routeConfig holds the settings of the Route that is serving a request, resolved against the server defaults. It is
+// stored in the request context so generic handlers and helpers can adapt their behaviour per route.
+type routeConfig struct {
+	encoderStrategy  EncoderStrategy
+	jsonKeyTransform json.KeyTransform
+	strictJSON       bool
+	maxBodySize      int64
+	streamHeartbeat  time.Duration
+	webSockets       *webSocketConns
+	formLimits       FormLimits
+	logger           *slog.Logger
+	bodyLog          *BodyLogConfig
+	authenticated    bool
+}
+
+// newRouteConfig resolves the settings for route
+func newRouteConfig(route Route, options serverOptions) routeConfig {
+	cfg := routeConfig{
+		encoderStrategy:  route.EncoderStrategy,
+		jsonKeyTransform: options.jsonKeyTransform,
+		strictJSON:       route.StrictJSON.resolve(options.strictJSON),
+		maxBodySize:      options.maxBodySize,
+		streamHeartbeat:  options.streamHeartbeat,
+		webSockets:       options.webSockets,
+		formLimits:       route.FormLimits.withDefaults(options.formLimits).withDefaults(defaultFormLimits),
+		logger:           options.logger(),
+		bodyLog:          options.bodyLog,
+		authenticated:    route.Authenticate,
+	}
+	if !route.JSONKeyTransform.IsZero() {
+		cfg.jsonKeyTransform = route.JSONKeyTransform
+	}
+	if route.MaxBodySize != 0 {
+		// A negative size disables the limit
+		cfg.maxBodySize = max(route.MaxBodySize, 0)
+	}
+	if route.StreamHeartbeat != 0 {
+		cfg.streamHeartbeat = route.StreamHeartbeat
+	}
+	if cfg.streamHeartbeat == 0 {
+		cfg.streamHeartbeat = defaultStreamHeartbeat
+	}
+	return cfg
+}
+
+// jsonOptions returns the options to use with the json package for this route
+func (cfg routeConfig) jsonOptions() []json.Option {
+	opts := []json.Option{json.WithKeyTransform(cfg.jsonKeyTransform)}
+	if cfg.strictJSON {
+		opts = append(opts, json.WithStrictDecoding())
+	}
+	return opts
+}
+
+// GetRouteHandler returns the HandlerFunc of route, wrapped so that it behaves as it does when registered through
+// GetHandler with opts (e.g. using the route's JSONKeyTransform). It is useful for testing a route in isolation.
+func GetRouteHandler(route Route, opts ...ServerOption) http.Handler {
+	h, _ := routeHandler(route, newServerOptions(opts...))
+	return h
+}
+
+// routeHandler returns the HandlerFunc of route, wrapped with the route settings and the route-specific middlewares,
+// and the names of those middlewares, from the outermost one
+func routeHandler(route Route, options serverOptions) (http.Handler, []string) {
+	var h http.Handler = route.HandlerFunc
+	var chain []string
+	use := func(name string, mw func(http.Handler) http.Handler) {
+		h = mw(h)
+		chain = append([]string{name}, chain...)
+	}
+	// The requests are validated last, so the rejected ones still count against the limits
+	if options.spec != nil {
+		if op := options.spec.operation(route); op != nil {
+			use("openapi_validation", op.middleware)
+		}
+	}
+	if options.concurrencyLimiter != nil {
+		use("concurrency_limit", options.concurrencyLimiter.middleware(route.Priority))
+	}
+	if route.Cache.TTL > 0 {
+		use("cache", CacheMiddleware(route.Cache, options.cacheStore))
+	}
+	if route.Idempotency.TTL > 0 {
+		use("idempotency", IdempotencyMiddleware(route.Idempotency, options.idempotencyStore))
+	}
+	if route.RateLimit.Limit > 0 {
+		// Each route has its own quota, which also applies to cached and replayed responses
+		limit := route.RateLimit.withDefaults()
+		key, prefix := limit.Key, route.Method+" "+GetRoutePattern(route)+" "
+		limit.Key = func(r *http.Request) string {
+			return prefix + key(r)
+		}
+		use("rate_limit", RateLimitMiddleware(limit, options.limiterStore))
+	}
+	timeout := options.timeout
+	if route.Timeout != 0 {
+		timeout = route.Timeout
+	}
+	// A negative timeout disables it, even for clients asking for one
+	if timeout >= 0 && (timeout > 0 || options.maxTimeout > 0) {
+		use("timeout", timeoutMiddleware(timeout, options.maxTimeout, options.panicReporter))
+	}
+	return withRouteConfig(newRouteConfig(route, options), h), chain
+}
+
+// withRouteConfig returns a handler that makes cfg available in the context of every request passed to next, and
+// enforces the route settings that apply to all handlers (e.g. the max body size)
+func withRouteConfig(cfg routeConfig, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cfg.maxBodySize > 0 && r.Body != nil {
+			r.Body = http.MaxBytesReader(w, r.Body, cfg.maxBodySize)
+		}
+		ctx := context.WithValue(r.Context(), routeConfigContextKey{}, cfg)
+		// Routes served through GetHandler already have the logger, but not those served through GetRouteHandler
+		if _, ok := ctx.Value(loggerContextKey{}).(*slog.Logger); !ok {
+			ctx = contextWithLogger(ctx, cfg.logger)
+		}
+		if id := r.Header.Get("Last-Event-ID"); id != "" {
+			ctx = context.WithValue(ctx, lastEventIDContextKey{}, id)
+		}
+		ctx = withPreconditions(ctx, r)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// defaultRouteConfig holds the default settings, for the requests that are not served through GetHandler
+var defaultRouteConfig = newRouteConfig(Route{}, newServerOptions())
+
+// getRouteConfig returns the routeConfig for the request r. If r is nil or was not served through GetHandler (e.g. in
+// tests that call a HandlerFunc directly), the default settings are returned.
+func getRouteConfig(r *http.Request) routeConfig {
+	if r != nil {
+		if cfg, ok := r.Context().Value(routeConfigContextKey{}).(routeConfig); ok {
+			return cfg
+		}
+	}
+	cfg := defaultRouteConfig
+	// The default logger may have been replaced since
+	cfg.logger = slog.Default()
+	return cfg
+}
+
+type principalContextKey struct{}
+
+// ContextWithPrincipal returns a copy of ctx that identifies the authenticated client making the request (e.g. a user
+// ID). The AuthMiddleware should set it, so that per-client features like caching can tell clients apart. It is also
+// recorded in the access log of the request, if any.
+func ContextWithPrincipal(ctx context.Context, principal string) context.Context {
+	setAccessLogPrincipal(ctx, principal)
+	return context.WithValue(ctx, principalContextKey{}, principal)
+}
+
+// Principal returns the authenticated client set with ContextWithPrincipal, or an empty string if there is none
+func Principal(ctx context.Context) string {
+	p, _ := ctx.Value(principalContextKey{}).(string)
+	return p
+}
+
+// isAuthenticated returns true if r is made on behalf of a client, i.e. its route requires authentication or it carries
+// credentials, so what is stored for it must not be shared with other clients
+func isAuthenticated(r *http.Request) bool {
+	return getRouteConfig(r).authenticated || r.Header.Get("Authorization") != ""
+}
+
+// isUnscoped returns true if r is authenticated but has no Principal (the AuthMiddleware didn't set one), so what is
+// stored for it can't be scoped to its client
+func isUnscoped(r *http.Request) bool {
+	return Principal(r.Context()) == "" && isAuthenticated(r)
+}
@@ -0,0 +1,360 @@
+package gopi
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/teejays/gopi/json"
+)
+
+// Media types for which gopi registers an Encoder and a Decoder by default
+const (
+	MediaTypeJSON     = "application/json"
+	MediaTypeMsgPack  = "application/msgpack"
+	MediaTypeCBOR     = "application/cbor"
+	MediaTypeProtobuf = "application/protobuf"
+)
+
+// ErrNotAcceptable is used when none of the media types accepted by the client can be used to encode the response
+var ErrNotAcceptable = fmt.Errorf("none of the media types in the Accept header are supported for this response")
+
+// ErrUnsupportedMediaType is used when there is no Decoder registered for the Content-Type of the request
+var ErrUnsupportedMediaType = fmt.Errorf("the Content-Type of the request is not supported")
+
+// Encoder encodes Go values for the HTTP response
+type Encoder interface {
+	// Encode writes the encoding of v to w
+	Encode(w io.Writer, v interface{}) error
+}
+
+// Decoder decodes the HTTP request body into Go values
+type Decoder interface {
+	// Decode reads the encoded value from r and stores it in the value pointed to by v
+	Decode(r io.Reader, v interface{}) error
+}
+
+// TypedEncoder is an Encoder that can only encode some values (e.g. protobuf can only encode proto.Message). When
+// negotiating the response media type, an Encoder implementing TypedEncoder is only picked if it can encode the value.
+type TypedEncoder interface {
+	Encoder
+	CanEncode(v interface{}) bool
+}
+
+type codecRegistry struct {
+	sync.RWMutex
+	encoders map[string]Encoder
+	decoders map[string]Decoder
+}
+
+var registry = codecRegistry{
+	encoders: map[string]Encoder{},
+	decoders: map[string]Decoder{},
+}
+
+func init() {
+	RegisterEncoder(MediaTypeJSON, jsonCodec{})
+	RegisterDecoder(MediaTypeJSON, jsonCodec{})
+	RegisterEncoder(MediaTypeMsgPack, msgpackCodec{})
+	RegisterDecoder(MediaTypeMsgPack, msgpackCodec{})
+	RegisterEncoder(MediaTypeCBOR, cborCodec{})
+	RegisterDecoder(MediaTypeCBOR, cborCodec{})
+	RegisterEncoder(MediaTypeProtobuf, protobufCodec{})
+	RegisterDecoder(MediaTypeProtobuf, protobufCodec{})
+}
+
+// RegisterEncoder registers enc to be used for responses when the client accepts mediaType. It replaces any Encoder
+// already registered for the mediaType.
+func RegisterEncoder(mediaType string, enc Encoder) {
+	registry.Lock()
+	defer registry.Unlock()
+	registry.encoders[strings.ToLower(mediaType)] = enc
+}
+
+// RegisterDecoder registers dec to be used for request bodies with Content-Type mediaType. It replaces any Decoder
+// already registered for the mediaType.
+func RegisterDecoder(mediaType string, dec Decoder) {
+	registry.Lock()
+	defer registry.Unlock()
+	registry.decoders[strings.ToLower(mediaType)] = dec
+}
+
+func getEncoder(mediaType string) (Encoder, bool) {
+	registry.RLock()
+	defer registry.RUnlock()
+	enc, ok := registry.encoders[mediaType]
+	return enc, ok
+}
+
+func getDecoder(mediaType string) (Decoder, bool) {
+	registry.RLock()
+	defer registry.RUnlock()
+	dec, ok := registry.decoders[mediaType]
+	return dec, ok
+}
+
+// canEncode returns true if enc can encode v
+func canEncode(enc Encoder, v interface{}) bool {
+	if tEnc, ok := enc.(TypedEncoder); ok {
+		return tEnc.CanEncode(v)
+	}
+	return true
+}
+
+/* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+* N E G O T I A T I O N
+* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
+
+type acceptedMediaType struct {
+	mediaType string
+	q         float64
+}
+
+// parseAccept parses the value of an Accept header into media types ordered by preference. Media types with a q of 0
+// are left out.
+func parseAccept(header string) []acceptedMediaType {
+	var accepted []acceptedMediaType
+	for _, part := range strings.Split(header, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		mediaType, params, err := mime.ParseMediaType(part)
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if qStr, ok := params["q"]; ok {
+			q, err = strconv.ParseFloat(qStr, 64)
+			if err != nil {
+				continue
+			}
+		}
+		if q <= 0 {
+			continue
+		}
+		accepted = append(accepted, acceptedMediaType{mediaType: mediaType, q: q})
+	}
+	// More specific media types are preferred over wildcards with the same q
+	sort.SliceStable(accepted, func(i, j int) bool {
+		if accepted[i].q != accepted[j].q {
+			return accepted[i].q > accepted[j].q
+		}
+		return strings.Count(accepted[i].mediaType, "*") < strings.Count(accepted[j].mediaType, "*")
+	})
+	return accepted
+}
+
+// negotiateEncoder picks the Encoder for encoding v in the response to r, based on r's Accept header. JSON is used when
+// r is nil or does not specify an Accept header. It returns false if none of the accepted media types can be used.
+func negotiateEncoder(r *http.Request, v interface{}) (string, Encoder, bool) {
+	cfg := getRouteConfig(r)
+
+	if r == nil || strings.TrimSpace(r.Header.Get("Accept")) == "" {
+		enc, ok := getEncoder(MediaTypeJSON)
+		return MediaTypeJSON, routeEncoder(enc, cfg), ok
+	}
+
+	registry.RLock()
+	defer registry.RUnlock()
+
+	// Sort the registered media types so wildcard matches are deterministic, with JSON always preferred
+	var registered []string
+	for mediaType := range registry.encoders {
+		if mediaType != MediaTypeJSON {
+			registered = append(registered, mediaType)
+		}
+	}
+	sort.Strings(registered)
+	registered = append([]string{MediaTypeJSON}, registered...)
+
+	for _, accepted := range parseAccept(r.Header.Get("Accept")) {
+		for _, mediaType := range registered {
+			if !matchMediaType(accepted.mediaType, mediaType) {
+				continue
+			}
+			enc := registry.encoders[mediaType]
+			if canEncode(enc, v) {
+				return mediaType, routeEncoder(enc, cfg), true
+			}
+		}
+	}
+	return "", nil, false
+}
+
+// matchMediaType returns true if the (possibly wildcard) pattern from an Accept header matches mediaType
+func matchMediaType(pattern, mediaType string) bool {
+	if pattern == "*/*" || pattern == mediaType {
+		return true
+	}
+	if strings.HasSuffix(pattern, "/*") {
+		return strings.HasPrefix(mediaType, strings.TrimSuffix(pattern, "*"))
+	}
+	return false
+}
+
+// decodeRequestBody decodes the body of r into v using the Decoder registered for r's Content-Type. Requests without a
+// Content-Type are decoded as JSON.
+func decodeRequestBody(r *http.Request, v interface{}) error {
+	mediaType := MediaTypeJSON
+	if ct := r.Header.Get("Content-Type"); ct != "" {
+		var err error
+		mediaType, _, err = mime.ParseMediaType(ct)
+		if err != nil {
+			return ErrUnsupportedMediaType
+		}
+	}
+	dec, ok := getDecoder(mediaType)
+	if !ok {
+		return ErrUnsupportedMediaType
+	}
+	defer r.Body.Close()
+	cfg := getRouteConfig(r)
+	if cfg.bodyLog == nil {
+		return routeDecoder(dec, cfg).Decode(r.Body, v)
+	}
+	// Keep a copy of what the decoder reads, to log it
+	var body bytes.Buffer
+	err := routeDecoder(dec, cfg).Decode(io.TeeReader(r.Body, &body), v)
+	logBody(r, "api: request body", r.Header.Get("Content-Type"), body.Bytes())
+	return err
+}
+
+// routeEncoder applies the route settings to the built-in encoders
+func routeEncoder(enc Encoder, cfg routeConfig) Encoder {
+	if _, ok := enc.(jsonCodec); ok {
+		return jsonCodec{opts: cfg.jsonOptions()}
+	}
+	return enc
+}
+
+// routeDecoder applies the route settings to the built-in decoders
+func routeDecoder(dec Decoder, cfg routeConfig) Decoder {
+	if _, ok := dec.(jsonCodec); ok {
+		return jsonCodec{opts: cfg.jsonOptions()}
+	}
+	return dec
+}
+
+/* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+* C O D E C S
+* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
+
+// jsonCodec encodes and decodes JSON using the gopi json package
+type jsonCodec struct {
+	opts []json.Option
+}
+
+func (c jsonCodec) Encode(w io.Writer, v interface{}) error {
+	data, err := json.Marshal(v, c.opts...)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func (c jsonCodec) Decode(r io.Reader, v interface{}) error {
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if len(body) < 1 {
+		return ErrEmptyBody
+	}
+	err = json.Unmarshal(body, v, c.opts...)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidJSON, err)
+	}
+	return nil
+}
+
+// msgpackCodec encodes and decodes MessagePack
+type msgpackCodec struct{}
+
+func (msgpackCodec) Encode(w io.Writer, v interface{}) error {
+	return msgpack.NewEncoder(w).Encode(v)
+}
+
+func (msgpackCodec) Decode(r io.Reader, v interface{}) error {
+	return msgpack.NewDecoder(r).Decode(v)
+}
+
+// cborCodec encodes and decodes CBOR
+type cborCodec struct{}
+
+func (cborCodec) Encode(w io.Writer, v interface{}) error {
+	return cbor.NewEncoder(w).Encode(v)
+}
+
+func (cborCodec) Decode(r io.Reader, v interface{}) error {
+	return cbor.NewDecoder(r).Decode(v)
+}
+
+// protobufCodec encodes and decodes protobuf messages. Since a StandardResponse is not a proto.Message, its Data is
+// encoded directly as the response body, which means only successful responses with a proto.Message Data can be
+// encoded as protobuf.
+type protobufCodec struct{}
+
+func (protobufCodec) CanEncode(v interface{}) bool {
+	_, ok := protobufMessage(v)
+	return ok
+}
+
+func (protobufCodec) Encode(w io.Writer, v interface{}) error {
+	msg, ok := protobufMessage(v)
+	if !ok {
+		return fmt.Errorf("cannot encode %T as protobuf: not a proto.Message", v)
+	}
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func (protobufCodec) Decode(r io.Reader, v interface{}) error {
+	msg, ok := v.(proto.Message)
+	if !ok {
+		// v may be a pointer to a (nil) message pointer, e.g. when ReqT is itself a *pb.Message
+		rv := reflect.ValueOf(v)
+		if rv.Kind() == reflect.Ptr && rv.Elem().Kind() == reflect.Ptr {
+			if rv.Elem().IsNil() {
+				rv.Elem().Set(reflect.New(rv.Elem().Type().Elem()))
+			}
+			msg, ok = rv.Elem().Interface().(proto.Message)
+		}
+	}
+	if !ok {
+		return fmt.Errorf("cannot decode protobuf into %T: not a proto.Message", v)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return proto.Unmarshal(data, msg)
+}
+
+// protobufMessage returns the proto.Message that should be encoded for v, if there is one
+func protobufMessage(v interface{}) (proto.Message, bool) {
+	if resp, ok := v.(StandardResponse); ok {
+		if resp.Error != nil {
+			return nil, false
+		}
+		v = resp.Data
+	}
+	msg, ok := v.(proto.Message)
+	return msg, ok
+}
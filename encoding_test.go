@@ -0,0 +1,160 @@
+package gopi_test
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"github.com/teejays/gopi"
+	"github.com/teejays/gopi/json"
+)
+
+func ProtoEndpoint(ctx context.Context, req *wrapperspb.StringValue) (*wrapperspb.StringValue, error) {
+	return wrapperspb.String("pong: " + req.GetValue()), nil
+}
+
+func TestContentNegotiation(t *testing.T) {
+	msgpackBody, err := msgpack.Marshal(SampleReq{Ping: "hello"})
+	assert.NoError(t, err)
+	protoBody, err := proto.Marshal(wrapperspb.String("hello"))
+	assert.NoError(t, err)
+
+	routes := []gopi.Route{
+		{
+			Method:      http.MethodPost,
+			Path:        "sample",
+			HandlerFunc: gopi.HandlerWrapper(http.MethodPost, SampleEndpoint),
+		},
+		{
+			Method:      http.MethodPost,
+			Path:        "proto",
+			HandlerFunc: gopi.HandlerWrapper(http.MethodPost, ProtoEndpoint),
+		},
+	}
+	h, err := gopi.GetHandler(context.TODO(), routes, gopi.MiddlewareFuncs{})
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name            string
+		path            string
+		contentType     string
+		accept          string
+		body            []byte
+		wantStatusCode  int
+		wantContentType string
+	}{
+		{
+			name:            "JSON by default",
+			path:            "/api/v0/sample",
+			body:            []byte(`{"ping":"hello"}`),
+			wantStatusCode:  http.StatusOK,
+			wantContentType: gopi.MediaTypeJSON,
+		},
+		{
+			name:            "MessagePack in and out",
+			path:            "/api/v0/sample",
+			contentType:     gopi.MediaTypeMsgPack,
+			accept:          gopi.MediaTypeMsgPack,
+			body:            msgpackBody,
+			wantStatusCode:  http.StatusOK,
+			wantContentType: gopi.MediaTypeMsgPack,
+		},
+		{
+			name:            "Preference by q value",
+			path:            "/api/v0/sample",
+			accept:          "application/json;q=0.5, application/cbor",
+			body:            []byte(`{"ping":"hello"}`),
+			wantStatusCode:  http.StatusOK,
+			wantContentType: gopi.MediaTypeCBOR,
+		},
+		{
+			name:            "Protobuf in and out",
+			path:            "/api/v0/proto",
+			contentType:     gopi.MediaTypeProtobuf,
+			accept:          gopi.MediaTypeProtobuf,
+			body:            protoBody,
+			wantStatusCode:  http.StatusOK,
+			wantContentType: gopi.MediaTypeProtobuf,
+		},
+		{
+			name:            "Unsupported Accept",
+			path:            "/api/v0/sample",
+			accept:          "text/csv",
+			body:            []byte(`{"ping":"hello"}`),
+			wantStatusCode:  http.StatusNotAcceptable,
+			wantContentType: gopi.MediaTypeJSON,
+		},
+		{
+			name:            "Protobuf not acceptable for non proto.Message response",
+			path:            "/api/v0/sample",
+			accept:          gopi.MediaTypeProtobuf,
+			body:            []byte(`{"ping":"hello"}`),
+			wantStatusCode:  http.StatusNotAcceptable,
+			wantContentType: gopi.MediaTypeJSON,
+		},
+		{
+			name:            "Unsupported Content-Type",
+			path:            "/api/v0/sample",
+			contentType:     "text/csv",
+			body:            []byte(`ping,hello`),
+			wantStatusCode:  http.StatusUnsupportedMediaType,
+			wantContentType: gopi.MediaTypeJSON,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, tt.path, bytes.NewReader(tt.body))
+			if tt.contentType != "" {
+				r.Header.Set("Content-Type", tt.contentType)
+			}
+			if tt.accept != "" {
+				r.Header.Set("Accept", tt.accept)
+			}
+			h.ServeHTTP(w, r)
+
+			assert.Equal(t, tt.wantStatusCode, w.Code, w.Body.String())
+			assert.Equal(t, tt.wantContentType, w.Header().Get("Content-Type"))
+		})
+	}
+}
+
+func TestContentNegotiation_KeyTransform(t *testing.T) {
+	routes := []gopi.Route{
+		{
+			Method:           http.MethodPost,
+			Path:             "sample",
+			HandlerFunc:      gopi.HandlerWrapper(http.MethodPost, SampleEndpoint),
+			JSONKeyTransform: json.CamelCaseKeys,
+		},
+	}
+	h, err := gopi.GetHandler(context.TODO(), routes, gopi.MiddlewareFuncs{})
+	assert.NoError(t, err)
+	post := func(accept string) []byte {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/api/v0/sample", strings.NewReader(`{"ping":"hello"}`))
+		r.Header.Set("Accept", accept)
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		return w.Body.Bytes()
+	}
+
+	assert.JSONEq(t, `{"statusCode":200,"data":{"pong":"hello"},"error":null}`, string(post(gopi.MediaTypeJSON)))
+
+	// The transform only applies to JSON, the other encodings keep the Go field names
+	var resp map[string]interface{}
+	assert.NoError(t, msgpack.Unmarshal(post(gopi.MediaTypeMsgPack), &resp))
+	assert.Equal(t, map[string]interface{}{"Pong": "hello"}, resp["Data"])
+	resp = nil
+	assert.NoError(t, cbor.Unmarshal(post(gopi.MediaTypeCBOR), &resp))
+	assert.Equal(t, map[interface{}]interface{}{"Pong": "hello"}, resp["Data"])
+}
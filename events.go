@@ -0,0 +1,278 @@
+package gopi
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"reflect"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/teejays/gopi/json"
+)
+
+// Media types that an EventStream can be written as
+const (
+	MediaTypeNDJSON      = "application/x-ndjson"
+	MediaTypeEventStream = "text/event-stream"
+)
+
+// defaultStreamHeartbeat is the interval between heartbeats on event streams, unless configured otherwise
+const defaultStreamHeartbeat = 15 * time.Second
+
+type lastEventIDContextKey struct{}
+
+// LastEventID returns the ID of the last event that the client received before reconnecting to an event stream (the
+// Last-Event-ID header), so the handler can resume the stream after it. It is empty for new connections.
+func LastEventID(ctx context.Context) string {
+	id, _ := ctx.Value(lastEventIDContextKey{}).(string)
+	return id
+}
+
+// Event is a single message on an EventStream
+type Event[T any] struct {
+	// ID identifies the event. Clients reconnecting to a text/event-stream send the ID of the last event they received,
+	// which is available to the handler through LastEventID. It is not written for NDJSON.
+	ID string
+	// Name is the type of the event (the `event` field of text/event-stream). It is not written for NDJSON.
+	Name string
+	// Data is written as JSON
+	Data T
+}
+
+// EventStream can be used as the RespT of the generic handlers for long-lived responses, which write each event as
+// soon as it is produced. Depending on the Accept header, the events are written as newline-delimited JSON
+// (application/x-ndjson, the default) or as Server-Sent Events (text/event-stream).
+//
+// Heartbeats are written while a text/event-stream is idle (see WithStreamHeartbeat). The stream ends when the events
+// run out, or when the client disconnects, in which case the context passed to the handler is canceled and the event
+// producer should stop. If the producer yields an error, it is written as a final StandardResponse (an `error` event
+// for text/event-stream), with a generic message unless it is an error meant for clients.
+type EventStream[T any] struct {
+	seq Seq2[Event[T], error]
+}
+
+// StreamEvents returns an EventStream with the events produced by seq
+func StreamEvents[T any](seq Seq2[Event[T], error]) EventStream[T] {
+	return EventStream[T]{seq: seq}
+}
+
+// StreamEventChan returns an EventStream with the events received from ch, until it is closed
+func StreamEventChan[T any](ch <-chan Event[T]) EventStream[T] {
+	return EventStream[T]{seq: func(yield func(Event[T], error) bool) {
+		for ev := range ch {
+			if !yield(ev, nil) {
+				return
+			}
+		}
+	}}
+}
+
+// event is an Event with its type erased, so event streams of any type can be written by writeEventStream
+type event struct {
+	id   string
+	name string
+	data interface{}
+}
+
+// eventStreamer is implemented by RespT types whose events are written to the response as they are produced
+type eventStreamer interface {
+	events() Seq2[event, error]
+}
+
+func (EventStream[T]) streamElementType() reflect.Type {
+	return typeOf[T]()
+}
+
+func (s EventStream[T]) events() Seq2[event, error] {
+	return func(yield func(event, error) bool) {
+		if s.seq == nil {
+			return
+		}
+		s.seq(func(ev Event[T], err error) bool {
+			return yield(event{id: ev.ID, name: ev.Name, data: ev.Data}, err)
+		})
+	}
+}
+
+// negotiateEventStream returns the media type to write an event stream as, based on the Accept header of r
+func negotiateEventStream(r *http.Request) (string, bool) {
+	if r == nil || strings.TrimSpace(r.Header.Get("Accept")) == "" {
+		return MediaTypeNDJSON, true
+	}
+	for _, accepted := range parseAccept(r.Header.Get("Accept")) {
+		for _, mediaType := range []string{MediaTypeNDJSON, MediaTypeEventStream} {
+			if matchMediaType(accepted.mediaType, mediaType) {
+				return mediaType, true
+			}
+		}
+	}
+	return "", false
+}
+
+// writeEventStream writes the events of s to w as they are produced, until they run out or the client disconnects
+func writeEventStream(w http.ResponseWriter, r *http.Request, s eventStreamer) {
+	mediaType, ok := negotiateEventStream(r)
+	if !ok {
+		writeError(w, r, http.StatusNotAcceptable, ErrNotAcceptable)
+		return
+	}
+
+	ctx := context.Background()
+	if r != nil {
+		ctx = r.Context()
+	}
+	cfg := getRouteConfig(r)
+
+	// Send the headers straight away, so the client knows the stream has started even if the first event takes a while
+	setContentType(w, r, mediaType)
+	w.Header().Set("Cache-Control", "no-cache")
+	// Keep reverse proxies (e.g. nginx) from buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	ew := eventWriter{w: w, rc: http.NewResponseController(w), sse: mediaType == MediaTypeEventStream}
+	err := ew.flush()
+	if err != nil {
+		Logger(ctx).Error("api: writeEventStream: flushing headers", "error", err)
+		return
+	}
+
+	// The events are produced in their own goroutine, so that heartbeats can be written while waiting for them
+	type result struct {
+		ev  event
+		err error
+	}
+	results := make(chan result)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		defer close(results)
+		// The recovery middleware can't catch panics in this goroutine, so they are reported as a stream error
+		defer func() {
+			if rec := recover(); rec != nil {
+				Logger(ctx).Error("api: writeEventStream: panic while producing events", "panic", rec, "stack", string(debug.Stack()))
+				select {
+				case results <- result{err: ErrPanic}:
+				case <-done:
+				}
+			}
+		}()
+		s.events()(func(ev event, err error) bool {
+			select {
+			case results <- result{ev: ev, err: err}:
+				return err == nil
+			case <-done:
+				return false
+			}
+		})
+	}()
+
+	var heartbeat *time.Ticker
+	var tick <-chan time.Time
+	// NDJSON has no way to write a message that clients ignore, since empty lines aren't valid
+	if cfg.streamHeartbeat > 0 && ew.sse {
+		heartbeat = time.NewTicker(cfg.streamHeartbeat)
+		defer heartbeat.Stop()
+		tick = heartbeat.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			// The client has gone away
+			return
+		case <-tick:
+			err = ew.heartbeat()
+		case res, ok := <-results:
+			if !ok {
+				return
+			}
+			var data []byte
+			err = res.err
+			if err == nil {
+				data, err = json.Marshal(res.ev.data, cfg.jsonOptions()...)
+			}
+			if err != nil {
+				// The status code has already been written, so the error is reported as the last message of the stream
+				Logger(ctx).Error("api: writeEventStream: producing events", "error", err)
+				_, resp := errorResponse(http.StatusInternalServerError, err)
+				err = ew.error(resp, cfg.jsonOptions())
+				if err != nil {
+					Logger(ctx).Error("api: writeEventStream: writing error", "error", err)
+				}
+				return
+			}
+			err = ew.event(res.ev.id, res.ev.name, data)
+			if heartbeat != nil {
+				heartbeat.Reset(cfg.streamHeartbeat)
+			}
+		}
+		if err != nil {
+			Logger(ctx).Error("api: writeEventStream: writing event stream", "error", err)
+			return
+		}
+	}
+}
+
+// eventWriter writes the messages of an event stream in either NDJSON or text/event-stream format, flushing after each
+type eventWriter struct {
+	w   http.ResponseWriter
+	rc  *http.ResponseController
+	sse bool
+}
+
+func (ew eventWriter) event(id, name string, data []byte) error {
+	var b []byte
+	if ew.sse {
+		if id != "" {
+			b = append(append(append(b, "id: "...), sseFieldValue(id)...), '\n')
+		}
+		if name != "" {
+			b = append(append(append(b, "event: "...), sseFieldValue(name)...), '\n')
+		}
+		b = append(append(append(b, "data: "...), data...), '\n', '\n')
+	} else {
+		b = append(data, '\n')
+	}
+	return ew.write(b)
+}
+
+// heartbeat writes a message that clients ignore, which is a comment in text/event-stream
+func (ew eventWriter) heartbeat() error {
+	return ew.write([]byte(": heartbeat\n\n"))
+}
+
+func (ew eventWriter) error(resp StandardResponse, opts []json.Option) error {
+	data, err := json.Marshal(resp, opts...)
+	if err != nil {
+		return err
+	}
+	if ew.sse {
+		return ew.write(append(append([]byte("event: error\ndata: "), data...), '\n', '\n'))
+	}
+	return ew.write(append(data, '\n'))
+}
+
+func (ew eventWriter) write(b []byte) error {
+	_, err := ew.w.Write(b)
+	if err != nil {
+		return err
+	}
+	return ew.flush()
+}
+
+func (ew eventWriter) flush() error {
+	err := ew.rc.Flush()
+	if errors.Is(err, http.ErrNotSupported) {
+		// The events will still be written, just not as promptly
+		return nil
+	}
+	return err
+}
+
+// sseFieldValue removes line breaks from v, since they would end the field
+func sseFieldValue(v string) string {
+	return strings.NewReplacer("\r", "", "\n", "").Replace(v)
+}
@@ -0,0 +1,398 @@
+package gopi
+
+import (
+	"bytes"
+	"context"
+	"encoding"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+
+	"github.com/teejays/gopi/json"
+)
+
+// Media types of HTML form requests, which the generic POST/PUT/PATCH handlers bind to ReqT
+const (
+	MediaTypeMultipartForm  = "multipart/form-data"
+	MediaTypeURLEncodedForm = "application/x-www-form-urlencoded"
+)
+
+// Defaults for FormLimits
+const (
+	defaultMaxFormFiles        = 10
+	defaultMaxFormFileSize     = 32 << 20 // 32 MB
+	defaultFormMemoryThreshold = 1 << 20  // 1 MB
+	// maxFormValuesSize limits the total size of the non-file values of a multipart form, which are kept in memory
+	maxFormValuesSize = 10 << 20 // 10 MB
+)
+
+// ErrTooManyFiles is used when a multipart form request has more files than allowed by the route's FormLimits
+var ErrTooManyFiles = fmt.Errorf("the request has too many files")
+
+// ErrFileTooLarge is used when a file in a multipart form request is larger than allowed by the route's FormLimits
+var ErrFileTooLarge = fmt.Errorf("a file in the request is too large")
+
+// ErrFormTooLarge is used when the values of a multipart form request are too large to be held in memory
+var ErrFormTooLarge = fmt.Errorf("the form values in the request are too large")
+
+// FormLimits limits the multipart/form-data requests that the generic handlers accept. Zero fields use the defaults.
+type FormLimits struct {
+	// MaxFiles is the maximum number of files in a request. Defaults to 10.
+	MaxFiles int
+	// MaxFileSize is the maximum size of each file, in bytes. Defaults to 32 MB.
+	MaxFileSize int64
+	// MemoryThreshold is the size, in bytes, above which a file is spooled to a temp file instead of being held in
+	// memory. Defaults to 1 MB.
+	MemoryThreshold int64
+}
+
+// withDefaults returns l with its zero fields set to the values of other
+func (l FormLimits) withDefaults(other FormLimits) FormLimits {
+	if l.MaxFiles == 0 {
+		l.MaxFiles = other.MaxFiles
+	}
+	if l.MaxFileSize == 0 {
+		l.MaxFileSize = other.MaxFileSize
+	}
+	if l.MemoryThreshold == 0 {
+		l.MemoryThreshold = other.MemoryThreshold
+	}
+	return l
+}
+
+var defaultFormLimits = FormLimits{
+	MaxFiles:        defaultMaxFormFiles,
+	MaxFileSize:     defaultMaxFormFileSize,
+	MemoryThreshold: defaultFormMemoryThreshold,
+}
+
+// FormFile is a file uploaded in a multipart/form-data request. It can be used as the type of ReqT fields (also as
+// *FormFile, []FormFile or []*FormFile). Small files are held in memory, while larger ones are spooled to a temp file
+// that is removed once the handler returns, so the file should be read before then.
+type FormFile struct {
+	// Filename is the name of the file on the client's machine
+	Filename string
+	// ContentType is the Content-Type of the file, as sent by the client
+	ContentType string
+	// Size is the size of the file in bytes
+	Size int64
+
+	content []byte
+	tmpPath string
+}
+
+// Open returns a reader over the content of the file. It has to be closed by the caller.
+func (f FormFile) Open() (io.ReadCloser, error) {
+	if f.tmpPath != "" {
+		return os.Open(f.tmpPath)
+	}
+	return io.NopCloser(bytes.NewReader(f.content)), nil
+}
+
+var (
+	formFileType        = reflect.TypeOf(FormFile{})
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+// isFormRequest returns true if the body of r is an HTML form
+func isFormRequest(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && (mediaType == MediaTypeMultipartForm || mediaType == MediaTypeURLEncodedForm)
+}
+
+// bindForm binds the form in the body of r to the struct pointed to by v. The fields of v are matched by their JSON
+// keys (with the route's key transform), or by their `form` tag. The returned func removes any temp files, and must
+// be called once the request has been handled.
+func bindForm(r *http.Request, v interface{}) (func(), error) {
+	cleanup := func() {}
+	cfg := getRouteConfig(r)
+
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Struct {
+		return cleanup, fmt.Errorf("a form can only be bound to a struct, not %T", v)
+	}
+
+	var values url.Values
+	var files map[string][]*FormFile
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == MediaTypeMultipartForm {
+		form, err := readMultipartForm(r, cfg.formLimits)
+		if form != nil {
+			ctx := r.Context()
+			cleanup = func() { form.removeAll(ctx) }
+		}
+		if err != nil {
+			return cleanup, err
+		}
+		values, files = form.values, form.files
+	} else {
+		err := r.ParseForm()
+		if err != nil {
+			return cleanup, err
+		}
+		values = r.PostForm
+	}
+
+	rv = rv.Elem()
+	for _, f := range json.StructFields(rv.Type(), cfg.jsonOptions()...) {
+		key := f.Key
+		switch tag := f.Field.Tag.Get("form"); tag {
+		case "-":
+			continue
+		case "":
+		default:
+			key = tag
+		}
+		fv := fieldByIndexAlloc(rv, f.Index)
+
+		var err error
+		if isFormFileType(f.Field.Type) {
+			err = setFormFiles(fv, files[key])
+		} else if vals, ok := values[key]; ok {
+			err = setFormValues(fv, vals)
+		}
+		if err != nil {
+			return cleanup, fmt.Errorf("invalid value for form field '%s': %w", key, err)
+		}
+	}
+	return cleanup, nil
+}
+
+// fieldByIndexAlloc is like reflect.Value.FieldByIndex, but allocates nil embedded struct pointers along the way
+func fieldByIndexAlloc(v reflect.Value, index []int) reflect.Value {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v
+}
+
+func isFormFileType(t reflect.Type) bool {
+	if t.Kind() == reflect.Slice {
+		t = t.Elem()
+	}
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t == formFileType
+}
+
+// setFormFiles sets v, whose type is one of FormFile, *FormFile, []FormFile or []*FormFile, to files
+func setFormFiles(v reflect.Value, files []*FormFile) error {
+	if len(files) == 0 {
+		return nil
+	}
+	t := v.Type()
+	if t.Kind() != reflect.Slice {
+		if len(files) > 1 {
+			return fmt.Errorf("expected a single file, got %d", len(files))
+		}
+		setFormFile(v, files[0])
+		return nil
+	}
+	s := reflect.MakeSlice(t, len(files), len(files))
+	for i, f := range files {
+		setFormFile(s.Index(i), f)
+	}
+	v.Set(s)
+	return nil
+}
+
+func setFormFile(v reflect.Value, f *FormFile) {
+	if v.Kind() == reflect.Ptr {
+		v.Set(reflect.ValueOf(f))
+		return
+	}
+	v.Set(reflect.ValueOf(*f))
+}
+
+// setFormValues sets v to the form values vals. Slices get all the values, other types only accept a single value.
+func setFormValues(v reflect.Value, vals []string) error {
+	if v.Kind() == reflect.Slice && !reflect.PointerTo(v.Type()).Implements(textUnmarshalerType) {
+		s := reflect.MakeSlice(v.Type(), len(vals), len(vals))
+		for i, val := range vals {
+			err := setFormValue(s.Index(i), val)
+			if err != nil {
+				return err
+			}
+		}
+		v.Set(s)
+		return nil
+	}
+	if len(vals) > 1 {
+		return fmt.Errorf("expected a single value, got %d", len(vals))
+	}
+	return setFormValue(v, vals[0])
+}
+
+// setFormValue parses val into v according to its type
+func setFormValue(v reflect.Value, val string) error {
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return setFormValue(v.Elem(), val)
+	}
+	if u, ok := v.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return u.UnmarshalText([]byte(val))
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(val)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(val)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(val, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(val, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(val, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(n)
+	default:
+		return fmt.Errorf("fields of type %s can't be set from a form", v.Type())
+	}
+	return nil
+}
+
+/* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+* M U L T I P A R T
+* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
+
+type multipartForm struct {
+	values url.Values
+	files  map[string][]*FormFile
+}
+
+// removeAll removes the temp files of the form
+func (f *multipartForm) removeAll(ctx context.Context) {
+	for _, files := range f.files {
+		for _, file := range files {
+			if file.tmpPath == "" {
+				continue
+			}
+			err := os.Remove(file.tmpPath)
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				Logger(ctx).Error("api: removing temp file of uploaded file", "path", file.tmpPath, "error", err)
+			}
+		}
+	}
+}
+
+// readMultipartForm reads the multipart form in the body of r, part by part, enforcing limits as it goes. The form is
+// returned even with an error, so its temp files can be removed.
+func readMultipartForm(r *http.Request, limits FormLimits) (*multipartForm, error) {
+	form := &multipartForm{values: url.Values{}, files: map[string][]*FormFile{}}
+
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return form, err
+	}
+
+	var valuesSize int64
+	var fileCount int
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return form, nil
+		}
+		if err != nil {
+			return form, err
+		}
+
+		name := part.FormName()
+		if name == "" {
+			part.Close()
+			continue
+		}
+
+		// Form values are held in memory
+		if part.FileName() == "" {
+			val, err := io.ReadAll(io.LimitReader(part, maxFormValuesSize-valuesSize+1))
+			part.Close()
+			if err != nil {
+				return form, err
+			}
+			valuesSize += int64(len(val))
+			if valuesSize > maxFormValuesSize {
+				return form, ErrFormTooLarge
+			}
+			form.values.Add(name, string(val))
+			continue
+		}
+
+		fileCount++
+		if fileCount > limits.MaxFiles {
+			part.Close()
+			return form, ErrTooManyFiles
+		}
+		file := &FormFile{Filename: part.FileName(), ContentType: part.Header.Get("Content-Type")}
+		form.files[name] = append(form.files[name], file)
+		err = spoolFormFile(file, part, limits)
+		part.Close()
+		if err != nil {
+			return form, err
+		}
+	}
+}
+
+// spoolFormFile reads the content of file from r, holding it in memory unless it is larger than the memory threshold,
+// in which case it is written to a temp file
+func spoolFormFile(file *FormFile, r io.Reader, limits FormLimits) error {
+	var buf bytes.Buffer
+	n, err := io.Copy(&buf, io.LimitReader(r, limits.MemoryThreshold+1))
+	if err != nil {
+		return err
+	}
+	if n > limits.MaxFileSize {
+		return ErrFileTooLarge
+	}
+	if n <= limits.MemoryThreshold {
+		file.content = buf.Bytes()
+		file.Size = n
+		return nil
+	}
+
+	tmp, err := os.CreateTemp("", "gopi-upload-*")
+	if err != nil {
+		return err
+	}
+	defer tmp.Close()
+	file.tmpPath = tmp.Name()
+
+	written, err := io.Copy(tmp, io.MultiReader(&buf, io.LimitReader(r, limits.MaxFileSize-n+1)))
+	if err != nil {
+		return err
+	}
+	if written > limits.MaxFileSize {
+		return ErrFileTooLarge
+	}
+	file.Size = written
+	return nil
+}
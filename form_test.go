@@ -0,0 +1,198 @@
+package gopi_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/teejays/gopi"
+)
+
+type UploadReq struct {
+	Title       string `validate:"required"`
+	Count       int
+	Tags        []string
+	Attachment  *gopi.FormFile  `validate:"required"`
+	Extras      []gopi.FormFile `form:"extra"`
+	Description string          `form:"-"`
+}
+
+type UploadResp struct {
+	Title    string
+	Count    int
+	Tags     []string
+	Files    []string
+	Contents []string
+}
+
+func UploadEndpoint(ctx context.Context, req UploadReq) (UploadResp, error) {
+	resp := UploadResp{Title: req.Title, Count: req.Count, Tags: req.Tags}
+	for _, f := range append([]gopi.FormFile{*req.Attachment}, req.Extras...) {
+		r, err := f.Open()
+		if err != nil {
+			return resp, err
+		}
+		content, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			return resp, err
+		}
+		resp.Files = append(resp.Files, f.Filename)
+		resp.Contents = append(resp.Contents, string(content))
+	}
+	return resp, nil
+}
+
+type SearchReq struct {
+	Query string `validate:"required"`
+	Page  int
+	Tags  []string
+}
+
+func SearchEndpoint(ctx context.Context, req SearchReq) (SearchReq, error) {
+	return req, nil
+}
+
+// multipartBody returns a multipart form body with the values and files (name -> filename -> content)
+func multipartBody(t *testing.T, values map[string][]string, files map[string]map[string]string) (string, *bytes.Buffer) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for name, vals := range values {
+		for _, val := range vals {
+			assert.NoError(t, mw.WriteField(name, val))
+		}
+	}
+	for name, byFilename := range files {
+		for filename, content := range byFilename {
+			fw, err := mw.CreateFormFile(name, filename)
+			assert.NoError(t, err)
+			_, err = fw.Write([]byte(content))
+			assert.NoError(t, err)
+		}
+	}
+	assert.NoError(t, mw.Close())
+	return mw.FormDataContentType(), &body
+}
+
+func TestFormBinding(t *testing.T) {
+	routes := []gopi.Route{
+		{
+			Method:      http.MethodPost,
+			Path:        "upload",
+			HandlerFunc: gopi.HandlerWrapper(http.MethodPost, UploadEndpoint),
+			// Spool anything over 8 bytes to a temp file
+			FormLimits: gopi.FormLimits{MaxFiles: 2, MaxFileSize: 32, MemoryThreshold: 8},
+		},
+		{
+			Method:      http.MethodPost,
+			Path:        "search",
+			HandlerFunc: gopi.HandlerWrapper(http.MethodPost, SearchEndpoint),
+		},
+	}
+	h, err := gopi.GetHandler(context.TODO(), routes, gopi.MiddlewareFuncs{})
+	assert.NoError(t, err)
+
+	type formTest struct {
+		name           string
+		path           string
+		contentType    string
+		body           io.Reader
+		wantStatusCode int
+		wantBody       string
+	}
+
+	tests := []formTest{
+		{
+			name:           "URL encoded",
+			path:           "/api/v0/search",
+			contentType:    gopi.MediaTypeURLEncodedForm,
+			body:           strings.NewReader(`query=shoes&page=2&tags=red&tags=blue`),
+			wantStatusCode: http.StatusOK,
+			wantBody:       `{"status_code":200,"data":{"query":"shoes","page":2,"tags":["red","blue"]},"error":null}`,
+		},
+		{
+			name:           "URL encoded, validation error",
+			path:           "/api/v0/search",
+			contentType:    gopi.MediaTypeURLEncodedForm,
+			body:           strings.NewReader(`page=2`),
+			wantStatusCode: http.StatusBadRequest,
+		},
+		{
+			name:           "URL encoded, invalid number",
+			path:           "/api/v0/search",
+			contentType:    gopi.MediaTypeURLEncodedForm,
+			body:           strings.NewReader(`query=shoes&page=two`),
+			wantStatusCode: http.StatusBadRequest,
+		},
+	}
+
+	contentType, body := multipartBody(t,
+		map[string][]string{"title": {"report"}, "count": {"3"}, "tags": {"a", "b"}, "description": {"ignored"}},
+		map[string]map[string]string{"attachment": {"small.txt": "tiny"}, "extra": {"large.txt": "spooled to a temp file"}},
+	)
+	tests = append(tests, formTest{
+		name:           "Multipart",
+		path:           "/api/v0/upload",
+		contentType:    contentType,
+		body:           body,
+		wantStatusCode: http.StatusOK,
+		wantBody:       `{"status_code":200,"data":{"title":"report","count":3,"tags":["a","b"],"files":["small.txt","large.txt"],"contents":["tiny","spooled to a temp file"]},"error":null}`,
+	})
+
+	contentType, body = multipartBody(t,
+		map[string][]string{"title": {"report"}},
+		nil,
+	)
+	tests = append(tests, formTest{
+		name:           "Multipart, missing required file",
+		path:           "/api/v0/upload",
+		contentType:    contentType,
+		body:           body,
+		wantStatusCode: http.StatusBadRequest,
+	})
+
+	contentType, body = multipartBody(t,
+		map[string][]string{"title": {"report"}},
+		map[string]map[string]string{"attachment": {"huge.txt": strings.Repeat("a", 33)}},
+	)
+	tests = append(tests, formTest{
+		name:           "Multipart, file too large",
+		path:           "/api/v0/upload",
+		contentType:    contentType,
+		body:           body,
+		wantStatusCode: http.StatusRequestEntityTooLarge,
+	})
+
+	contentType, body = multipartBody(t,
+		map[string][]string{"title": {"report"}},
+		map[string]map[string]string{"attachment": {"1.txt": "1"}, "extra": {"2.txt": "2", "3.txt": "3"}},
+	)
+	tests = append(tests, formTest{
+		name:           "Multipart, too many files",
+		path:           "/api/v0/upload",
+		contentType:    contentType,
+		body:           body,
+		wantStatusCode: http.StatusRequestEntityTooLarge,
+	})
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, tt.path, tt.body)
+			r.Header.Set("Content-Type", tt.contentType)
+			h.ServeHTTP(w, r)
+
+			assert.Equal(t, tt.wantStatusCode, w.Code, w.Body.String())
+			if tt.wantBody != "" {
+				assert.JSONEq(t, tt.wantBody, w.Body.String())
+			}
+		})
+	}
+}
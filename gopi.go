@@ -3,11 +3,16 @@ package gopi
 import (
 	"context"
 	"fmt"
+	"log/slog"
+	"net"
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
-	"github.com/teejays/goku-util/log"
+
+	"github.com/teejays/gopi/json"
 )
 
 // Route represents a standard route object
@@ -17,6 +22,62 @@ type Route struct {
 	Path         string
 	HandlerFunc  http.HandlerFunc
 	Authenticate bool
+
+	// EncoderStrategy determines how the generic handlers write responses for this route. Defaults to buffered.
+	EncoderStrategy EncoderStrategy
+	// JSONKeyTransform overrides the server's JSON key transform for this route. It only applies to JSON: MessagePack
+	// and CBOR keep the Go field names, or the names in the struct tags.
+	JSONKeyTransform json.KeyTransform
+	// StrictJSON turns strict decoding of JSON requests on or off for this route, overriding the server's setting (see
+	// WithStrictJSON)
+	StrictJSON Toggle
+	// MaxBodySize overrides the server's limit on the size of request bodies, in bytes, for this route. A negative value
+	// disables it, e.g. for uploads.
+	MaxBodySize int64
+	// StreamHeartbeat overrides the server's interval between heartbeats on Server-Sent Event streams for this route. A
+	// negative value disables heartbeats.
+	StreamHeartbeat time.Duration
+	// FormLimits overrides the server's limits on multipart form requests for this route. Zero fields use the server's
+	// limits.
+	FormLimits FormLimits
+	// Cache enables server-side caching of the responses of this GET route, if its TTL is set
+	Cache CachePolicy
+	// Idempotency makes retries of requests to this route with an idempotency key safe, if its TTL is set (see
+	// IdempotencyMiddleware)
+	Idempotency IdempotencyPolicy
+	// RateLimit limits the requests that each client can make to this route, if its Limit is set. It applies on top
+	// of the server's rate limit.
+	RateLimit RateLimit
+	// Priority is the class of this route's requests when the server is overloaded (see WithConcurrencyLimit)
+	Priority Priority
+	// Timeout overrides the server's timeout for the requests to this route (see WithTimeout). A negative value
+	// disables it, e.g. for long-lived streams.
+	Timeout time.Duration
+	// Doc describes this route in the OpenAPI document of the server (see WithOpenAPI)
+	Doc RouteDoc
+}
+
+// Toggle is a setting that a Route can turn on or off. The zero value keeps the server's setting.
+type Toggle int
+
+const (
+	// ToggleDefault keeps the server's setting
+	ToggleDefault Toggle = iota
+	// ToggleOn turns the setting on for the route
+	ToggleOn
+	// ToggleOff turns the setting off for the route
+	ToggleOff
+)
+
+// resolve returns whether the setting is on, given the server's setting
+func (t Toggle) resolve(server bool) bool {
+	switch t {
+	case ToggleOn:
+		return true
+	case ToggleOff:
+		return false
+	}
+	return server
 }
 
 type MiddlewareFuncs struct {
@@ -27,28 +88,84 @@ type MiddlewareFuncs struct {
 
 type Server struct {
 	rootHandler http.Handler
+	webSockets  *webSocketConns
+	health      *health
+	logger      *slog.Logger
+	state       *serverState
+
+	// admin and adminHandler are only set if the admin listener is enabled (see WithAdmin)
+	admin        *admin
+	adminHandler http.Handler
 }
 
-func NewServer(ctx context.Context, routes []Route, middlewares MiddlewareFuncs) (Server, error) {
-	m, err := GetHandler(ctx, routes, middlewares)
+// serverState holds the parts of a Server that are only set once it has started
+type serverState struct {
+	mu          sync.Mutex
+	httpServer  *http.Server
+	adminServer *http.Server
+}
+
+func NewServer(ctx context.Context, routes []Route, middlewares MiddlewareFuncs, opts ...ServerOption) (Server, error) {
+	options := newServerOptions(opts...)
+	if options.admin != nil {
+		err := options.admin.validate()
+		if err != nil {
+			return Server{}, fmt.Errorf("could not setup the admin listener: %w", err)
+		}
+	}
+	m, err := getHandler(ctx, routes, middlewares, options)
 	if err != nil {
 		return Server{}, fmt.Errorf("could not setup the http handler: %w", err)
 	}
 
-	return Server{rootHandler: m}, nil
+	s := Server{rootHandler: m, webSockets: options.webSockets, health: options.health, logger: options.logger(), state: &serverState{}}
+	if options.admin != nil {
+		s.admin = options.admin
+		s.adminHandler = withLogger(s.logger, options.admin.handler())
+	}
+	return s, nil
 
 }
 
-// StartServer initializes and runs the HTTP server. This is a blocking function.
+// StartServer initializes and runs the HTTP server, and the admin listener if it is enabled. This is a blocking
+// function, which returns once the server has been shut down with Shutdown.
 func (s *Server) StartServer(ctx context.Context, addr string, port int) error {
 
-	http.Handle("/", s.rootHandler)
+	// The server has its own handler rather than http.DefaultServeMux, which packages like net/http/pprof register
+	// their handlers on, so they can't end up on the public API
+	srv := &http.Server{Addr: fmt.Sprintf("%s:%d", addr, port), Handler: s.rootHandler}
+	// Hijacked connections aren't closed by http.Server.Shutdown, so close the WebSocket connections ourselves
+	srv.RegisterOnShutdown(s.webSockets.closeAll)
+
+	var adminSrv *http.Server
+	if s.admin != nil {
+		l, err := net.Listen("tcp", s.admin.cfg.Addr)
+		if err != nil {
+			return fmt.Errorf("admin listener failed to start: %w", err)
+		}
+		adminSrv = &http.Server{Handler: s.adminHandler}
+		go func() {
+			err := adminSrv.Serve(l)
+			if err != nil && err != http.ErrServerClosed {
+				s.logger.ErrorContext(ctx, "[Gopi] Admin listener failed", "error", err)
+			}
+		}()
+		s.logger.InfoContext(ctx, "[Gopi] Admin listener listening", "address", l.Addr().String())
+	}
+
+	s.state.mu.Lock()
+	s.state.httpServer = srv
+	s.state.adminServer = adminSrv
+	s.state.mu.Unlock()
 
 	// Start the server
-	log.Info(ctx, "[Gopi] HTTP Server listening", "address", addr, "port", port)
+	s.logger.InfoContext(ctx, "[Gopi] HTTP Server listening", "address", addr, "port", port)
 
-	err := http.ListenAndServe(fmt.Sprintf("%s:%d", addr, port), nil)
-	if err != nil {
+	err := srv.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		if adminSrv != nil {
+			adminSrv.Close()
+		}
 		return fmt.Errorf("HTTP Server failed to start or continue running: %w", err)
 	}
 
@@ -56,25 +173,127 @@ func (s *Server) StartServer(ctx context.Context, addr string, port int) error {
 
 }
 
+// Handler returns the root http.Handler of the server, e.g. to serve it with your own http.Server
+func (s *Server) Handler() http.Handler {
+	return s.rootHandler
+}
+
+// AdminHandler returns the http.Handler of the admin listener (see WithAdmin), e.g. to serve it with your own
+// http.Server, or nil if it is not enabled
+func (s *Server) AdminHandler() http.Handler {
+	return s.adminHandler
+}
+
+// RegisterHealthCheck adds a check to the health endpoints of the server (see WithHealthChecks), replacing any existing
+// check with the same name
+func (s *Server) RegisterHealthCheck(check HealthCheck) {
+	s.health.register(check)
+}
+
+// Shutdown gracefully shuts down the server: it fails the readiness endpoint, waits for the ShutdownDelay of the health
+// config, stops accepting new connections, closes the WebSocket connections and waits for the requests in progress to
+// finish, until ctx is done
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.state.mu.Lock()
+	srv, adminSrv := s.state.httpServer, s.state.adminServer
+	s.state.mu.Unlock()
+
+	s.health.shutdown()
+	if srv != nil {
+		// Keep serving while load balancers notice that the server isn't ready anymore
+		if delay := s.health.cfg.ShutdownDelay; delay > 0 {
+			t := time.NewTimer(delay)
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				t.Stop()
+			}
+		}
+		err := srv.Shutdown(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	// The admin listener stays up until the end, so the shutdown can be observed
+	if adminSrv != nil {
+		err := adminSrv.Shutdown(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	s.webSockets.closeAll()
+	return s.webSockets.wait(ctx)
+}
+
 // GetHandler constructs a HTTP handler with all the routes and middleware funcs configured
-func GetHandler(ctx context.Context, routes []Route, middlewares MiddlewareFuncs) (http.Handler, error) {
+func GetHandler(ctx context.Context, routes []Route, middlewares MiddlewareFuncs, opts ...ServerOption) (http.Handler, error) {
+	return getHandler(ctx, routes, middlewares, newServerOptions(opts...))
+}
+
+func getHandler(ctx context.Context, routes []Route, middlewares MiddlewareFuncs, options serverOptions) (http.Handler, error) {
+	logger := options.logger()
 
-	// Initiate a router
-	m := mux.NewRouter().PathPrefix("/api").Subrouter()
+	// Initiate a router. The API lives under /api, leaving the root for operational endpoints (e.g. metrics).
+	root := mux.NewRouter()
+	m := root.PathPrefix("/api").Subrouter()
 
 	// Enable CORS
 	// TODO: Have tighter control over CORS policy, but okay for
 	// as long as we're just developing. This shouldn't really go on prod.
 	originsOk := handlers.AllowedOrigins([]string{"*"})
 	credsOk := handlers.AllowCredentials()
-	headersOk := handlers.AllowedHeaders([]string{"Content-Type", "authorization"})
+	headersOk := handlers.AllowedHeaders([]string{
+		"Content-Type", "authorization",
+		IdempotencyKeyHeader, "If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since", TimeoutHeader,
+		"traceparent", "tracestate", RequestIDHeader, "Last-Event-ID",
+	})
+	// Browsers only let clients read the headers that are exposed
+	exposedOk := handlers.ExposedHeaders([]string{
+		"ETag", "Last-Modified", "Idempotent-Replayed", "Retry-After", "RateLimit-Limit", "RateLimit-Remaining",
+		"RateLimit-Reset", RequestIDHeader, "X-Cache", "Age",
+	})
 	methodsOk := handlers.AllowedMethods([]string{http.MethodHead, http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete, http.MethodOptions, http.MethodPatch})
-	corsEnabler := handlers.CORS(originsOk, credsOk, headersOk, methodsOk)
+	corsEnabler := handlers.CORS(originsOk, credsOk, headersOk, exposedOk, methodsOk)
+
+	// chain keeps the names of the middlewares of the API, for the admin listener
+	chain := []string{"cors"}
+	use := func(name string, mw mux.MiddlewareFunc) {
+		m.Use(mw)
+		chain = append(chain, name)
+	}
+
+	// Record metrics, traces and access logs first, so they include the requests rejected or recovered by the other
+	// middlewares
+	if options.metrics != nil {
+		use("metrics", options.metrics.Middleware)
+		root.Handle(options.metrics.cfg.Path, options.metrics).Methods(http.MethodGet, http.MethodHead)
+	}
+	if !options.disableHealth {
+		root.Handle(options.health.cfg.LivenessPath, options.health.handler(true)).Methods(http.MethodGet, http.MethodHead)
+		root.Handle(options.health.cfg.ReadinessPath, options.health.handler(false)).Methods(http.MethodGet, http.MethodHead)
+	}
+	if options.tracing != nil {
+		use("tracing", TracingMiddleware(*options.tracing))
+	}
+	// The access log goes inside the tracing middleware, so it can log the trace ID
+	if options.accessLog != nil {
+		use("access_log", AccessLogMiddleware(*options.accessLog))
+	}
+	// Recover from panics in any of the middlewares or handlers, unless explicitly disabled
+	if !options.disableRecovery {
+		use("recovery", RecoveryMiddleware(options.panicReporter))
+	}
+	if options.rateLimit != nil {
+		use("rate_limit", RateLimitMiddleware(*options.rateLimit, options.limiterStore))
+	}
+	if options.compression != nil {
+		use("compression", CompressionMiddleware(*options.compression))
+	}
 
 	// Register routes to the handler
 	// Set up pre handler middlewares
 	for _, mw := range middlewares.PreMiddlewares {
-		m.Use(mux.MiddlewareFunc(mw))
+		use(middlewareName(mw), mux.MiddlewareFunc(mw))
 	}
 
 	// Create an authenticated subrouter
@@ -96,7 +315,14 @@ func GetHandler(ctx context.Context, routes []Route, middlewares MiddlewareFuncs
 		}
 		routesLookup[key] = true
 	}
+	if options.spec != nil {
+		err := options.spec.check(routes)
+		if err != nil {
+			return nil, err
+		}
+	}
 	// Range over routes and register them
+	var adminRoutes []AdminRoute
 	for _, route := range routes {
 		// If the route is supposed to be authenticated, use auth mux
 		r := m
@@ -108,7 +334,7 @@ func GetHandler(ctx context.Context, routes []Route, middlewares MiddlewareFuncs
 			r = a
 		}
 		// Register the route
-		log.Info(ctx, "[Gopi] Registering endpoint", "path", GetRoutePattern(route), "method", route.Method)
+		logger.InfoContext(ctx, "[Gopi] Registering endpoint", "path", GetRoutePattern(route), "method", route.Method)
 
 		if route.Method == "" {
 			return nil, fmt.Errorf("route [%s] has no http method", route.Path)
@@ -120,31 +346,71 @@ func GetHandler(ctx context.Context, routes []Route, middlewares MiddlewareFuncs
 			return nil, fmt.Errorf("route [%s] has no HandlerFunc", route.Path)
 		}
 
-		mRoute := r.HandleFunc(GetRoutePattern(route), route.HandlerFunc).
+		h, routeChain := routeHandler(route, options)
+		mRoute := r.Handle(GetRoutePattern(route), h).
 			Methods(route.Method)
 
 		fullPath, err := mRoute.GetPathTemplate()
 		if err != nil {
 			return nil, err
 		}
-		log.Info(ctx, "[Gopi] Registered Endpoint", "method", route.Method, "path", fullPath)
+		if route.Authenticate {
+			routeChain = append([]string{middlewareName(middlewares.AuthMiddleware)}, routeChain...)
+		}
+		adminRoutes = append(adminRoutes, AdminRoute{
+			Method:       route.Method,
+			Path:         fullPath,
+			Version:      route.Version,
+			Authenticate: route.Authenticate,
+			Middlewares:  routeChain,
+		})
+		logger.InfoContext(ctx, "[Gopi] Registered Endpoint", "method", route.Method, "path", fullPath)
 	}
 
 	// Set up pre handler middlewares
 	for _, mw := range middlewares.PostMiddlewares {
-		m.Use(mux.MiddlewareFunc(mw))
+		use(middlewareName(mw), mux.MiddlewareFunc(mw))
+	}
+	if options.admin != nil {
+		options.admin.setRoutes(adminRoutes, chain)
+	}
+
+	// Serve the OpenAPI document of the routes, and its UI
+	if options.openAPI != nil {
+		doc, err := generateOpenAPI(routes, options, *options.openAPI)
+		if err != nil {
+			return nil, fmt.Errorf("generating the OpenAPI document: %w", err)
+		}
+		h, err := openAPIDocumentHandler(doc)
+		if err != nil {
+			return nil, err
+		}
+		root.Handle(options.openAPI.Path, h).Methods(http.MethodGet, http.MethodHead)
+		if ui, ok := openAPIUIHandler(*options.openAPI); ok {
+			root.Handle(options.openAPI.UIPath, ui).Methods(http.MethodGet)
+		}
 	}
 
-	mc := corsEnabler(m)
+	mc := corsEnabler(root)
 
-	return mc, nil
+	return withLogger(logger, mc), nil
+}
+
+// withLogger makes l available to the middlewares and handlers of next through Logger
+func withLogger(l *slog.Logger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(contextWithLogger(r.Context(), l)))
+	})
 }
 
 // LoggerMiddleware is a http.Handler middleware function that logs any request received
+//
+// Deprecated: LoggerMiddleware logs requests before they are handled, so it can't tell how they went. Use
+// WithAccessLog instead.
 func LoggerMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Log the request
-		log.DebugNoCtx("[Gopi] HTTP request received", "http_method", r.Method, "path", r.URL.Path)
+		Logger(r.Context()).Debug("[Gopi] HTTP request received", "http_method", r.Method, "path", r.URL.Path)
 		// Call the next handler
 		next.ServeHTTP(w, r)
 	})
@@ -4,10 +4,13 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/teejays/gopi"
+	"github.com/teejays/gopi/json"
 )
 
 type SampleReq struct {
@@ -141,3 +144,324 @@ func TestNewServer(t *testing.T) {
 		})
 	}
 }
+
+func TestRecoveryMiddleware(t *testing.T) {
+	var reported interface{}
+	routes := []gopi.Route{
+		{
+			Method: http.MethodGet,
+			Path:   "panic",
+			HandlerFunc: func(w http.ResponseWriter, r *http.Request) {
+				panic("something went wrong")
+			},
+		},
+	}
+	reporter := func(r *http.Request, recovered interface{}, stack []byte) {
+		reported = recovered
+	}
+
+	h, err := gopi.GetHandler(context.TODO(), routes, gopi.MiddlewareFuncs{}, gopi.WithPanicReporter(reporter))
+	assert.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/api/v0/panic", nil)
+	h.ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.JSONEq(t, fmt.Sprintf(`{"status_code":500,"data":null,"error":%q}`, gopi.ErrMessageGeneric), w.Body.String())
+	assert.Equal(t, "something went wrong", reported)
+}
+
+func TestCORS(t *testing.T) {
+	routes := []gopi.Route{
+		{
+			Method:      http.MethodPost,
+			Path:        "orders",
+			HandlerFunc: gopi.HandlerWrapper(http.MethodPost, SampleEndpoint),
+		},
+	}
+	h, err := gopi.GetHandler(context.TODO(), routes, gopi.MiddlewareFuncs{})
+	assert.NoError(t, err)
+
+	// Browsers check that the headers sent by the clients are allowed
+	for _, header := range []string{"Content-Type", gopi.IdempotencyKeyHeader, "If-Match", "If-None-Match", gopi.TimeoutHeader, "traceparent", gopi.RequestIDHeader, "Last-Event-ID"} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodOptions, "/api/v0/orders", nil)
+		r.Header.Set("Origin", "https://example.com")
+		r.Header.Set("Access-Control-Request-Method", http.MethodPost)
+		r.Header.Set("Access-Control-Request-Headers", header)
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusOK, w.Code, header)
+		assert.NotEmpty(t, w.Header().Get("Access-Control-Allow-Origin"), header)
+	}
+
+	// and only let them read the response headers that are exposed
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/api/v0/orders", strings.NewReader(`{"ping":"hello"}`))
+	r.Header.Set("Origin", "https://example.com")
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	exposed := strings.ToLower(w.Header().Get("Access-Control-Expose-Headers"))
+	for _, header := range []string{"ETag", "Idempotent-Replayed", "Retry-After", "RateLimit-Remaining", gopi.RequestIDHeader} {
+		assert.Contains(t, exposed, strings.ToLower(header))
+	}
+}
+
+func TestWriteResponseForRequest(t *testing.T) {
+	routes := []gopi.Route{
+		{
+			Method: http.MethodGet,
+			Path:   "users",
+			HandlerFunc: func(w http.ResponseWriter, r *http.Request) {
+				gopi.WriteStandardResponseForRequest(w, r, struct{ UserID int }{UserID: 1})
+			},
+			JSONKeyTransform: json.CamelCaseKeys,
+		},
+		{
+			Method: http.MethodGet,
+			Path:   "default",
+			HandlerFunc: func(w http.ResponseWriter, r *http.Request) {
+				gopi.WriteStandardResponse(w, struct{ UserID int }{UserID: 1})
+			},
+			JSONKeyTransform: json.CamelCaseKeys,
+		},
+	}
+	h, err := gopi.GetHandler(context.TODO(), routes, gopi.MiddlewareFuncs{})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v0/users", nil))
+	assert.JSONEq(t, `{"statusCode":200,"data":{"userID":1},"error":null}`, w.Body.String())
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v0/default", nil))
+	assert.JSONEq(t, `{"status_code":200,"data":{"user_id":1},"error":null}`, w.Body.String())
+
+	w = httptest.NewRecorder()
+	gopi.WriteErrorForRequest(w, httptest.NewRequest(http.MethodGet, "/", nil), http.StatusNotFound, fmt.Errorf("no such user"))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.JSONEq(t, `{"status_code":404,"data":null,"error":"no such user"}`, w.Body.String())
+}
+
+type unencodableResp struct {
+	Fn func()
+}
+
+func TestWriteResponse_MarshalFailure(t *testing.T) {
+	endpoint := func(ctx context.Context, req SampleReq) (unencodableResp, error) {
+		return unencodableResp{Fn: func() {}}, nil
+	}
+
+	tests := []struct {
+		name            string
+		encoderStrategy gopi.EncoderStrategy
+		wantStatusCode  int
+		wantBody        string
+	}{
+		{
+			name:            "Buffered, single clean error",
+			encoderStrategy: gopi.EncoderStrategyBuffered,
+			wantStatusCode:  http.StatusInternalServerError,
+			wantBody:        fmt.Sprintf(`{"status_code":500,"data":null,"error":%q}`, gopi.ErrMessageGeneric),
+		},
+		{
+			name:            "Streaming, status already sent",
+			encoderStrategy: gopi.EncoderStrategyStreaming,
+			wantStatusCode:  http.StatusOK,
+			wantBody:        "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			routes := []gopi.Route{
+				{
+					Method:          http.MethodPost,
+					Path:            "foo",
+					HandlerFunc:     gopi.HandlerWrapper(http.MethodPost, endpoint),
+					EncoderStrategy: tt.encoderStrategy,
+				},
+			}
+			h, err := gopi.GetHandler(context.TODO(), routes, gopi.MiddlewareFuncs{})
+			assert.NoError(t, err)
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/api/v0/foo", strings.NewReader(`{"ping":"hello"}`))
+			h.ServeHTTP(w, r)
+
+			assert.Equal(t, tt.wantStatusCode, w.Code)
+			if tt.wantBody == "" {
+				assert.Empty(t, w.Body.String())
+				return
+			}
+			assert.JSONEq(t, tt.wantBody, w.Body.String())
+		})
+	}
+}
+
+func TestJSONKeyTransform(t *testing.T) {
+	type Req struct {
+		PingValue string
+	}
+	type Resp struct {
+		PongValue string
+	}
+	endpoint := func(ctx context.Context, req Req) (Resp, error) {
+		return Resp{PongValue: req.PingValue}, nil
+	}
+
+	routes := []gopi.Route{
+		{
+			Method:      http.MethodPost,
+			Path:        "server-default",
+			HandlerFunc: gopi.HandlerWrapper(http.MethodPost, endpoint),
+		},
+		{
+			Method:           http.MethodPost,
+			Path:             "route-override",
+			HandlerFunc:      gopi.HandlerWrapper(http.MethodPost, endpoint),
+			JSONKeyTransform: json.SnakeCaseKeys,
+		},
+	}
+	h, err := gopi.GetHandler(context.TODO(), routes, gopi.MiddlewareFuncs{}, gopi.WithJSONKeyTransform(json.CamelCaseKeys))
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		path     string
+		body     string
+		wantBody string
+	}{
+		{
+			name:     "Server default",
+			path:     "/api/v0/server-default",
+			body:     `{"pingValue":"hello"}`,
+			wantBody: `{"statusCode":200,"data":{"pongValue":"hello"},"error":null}`,
+		},
+		{
+			name:     "Route override",
+			path:     "/api/v0/route-override",
+			body:     `{"ping_value":"hello"}`,
+			wantBody: `{"status_code":200,"data":{"pong_value":"hello"},"error":null}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader(tt.body))
+			h.ServeHTTP(w, r)
+
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.JSONEq(t, tt.wantBody, w.Body.String())
+		})
+	}
+}
+
+func TestStrictJSONAndMaxBodySize(t *testing.T) {
+	routes := []gopi.Route{
+		{
+			Method:      http.MethodPost,
+			Path:        "lenient",
+			HandlerFunc: gopi.HandlerWrapper(http.MethodPost, SampleEndpoint),
+		},
+		{
+			Method:      http.MethodPost,
+			Path:        "strict",
+			HandlerFunc: gopi.HandlerWrapper(http.MethodPost, SampleEndpoint),
+			StrictJSON:  gopi.ToggleOn,
+		},
+		{
+			Method:      http.MethodPost,
+			Path:        "small",
+			HandlerFunc: gopi.HandlerWrapper(http.MethodPost, SampleEndpoint),
+			MaxBodySize: 8,
+		},
+		{
+			Method:      http.MethodPost,
+			Path:        "unlimited",
+			HandlerFunc: gopi.HandlerWrapper(http.MethodPost, SampleEndpoint),
+			MaxBodySize: -1,
+			StrictJSON:  gopi.ToggleOff,
+		},
+	}
+	h, err := gopi.GetHandler(context.TODO(), routes, gopi.MiddlewareFuncs{}, gopi.WithMaxBodySize(1024))
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name           string
+		path           string
+		body           string
+		wantStatusCode int
+	}{
+		{
+			name:           "Lenient, unknown field",
+			path:           "/api/v0/lenient",
+			body:           `{"ping":"hello","foo":"bar"}`,
+			wantStatusCode: http.StatusOK,
+		},
+		{
+			name:           "Strict, good",
+			path:           "/api/v0/strict",
+			body:           `{"ping":"hello"}`,
+			wantStatusCode: http.StatusOK,
+		},
+		{
+			name:           "Strict, unknown field",
+			path:           "/api/v0/strict",
+			body:           `{"ping":"hello","foo":"bar"}`,
+			wantStatusCode: http.StatusBadRequest,
+		},
+		{
+			name:           "Strict, duplicate key",
+			path:           "/api/v0/strict",
+			body:           `{"ping":"hello","ping":"bye"}`,
+			wantStatusCode: http.StatusBadRequest,
+		},
+		{
+			name:           "Strict, trailing data",
+			path:           "/api/v0/strict",
+			body:           `{"ping":"hello"} {}`,
+			wantStatusCode: http.StatusBadRequest,
+		},
+		{
+			name:           "Body too large for route",
+			path:           "/api/v0/small",
+			body:           `{"ping":"hello"}`,
+			wantStatusCode: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:           "Body too large for server",
+			path:           "/api/v0/lenient",
+			body:           fmt.Sprintf(`{"ping":"%s"}`, strings.Repeat("a", 2048)),
+			wantStatusCode: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:           "No limit for route",
+			path:           "/api/v0/unlimited",
+			body:           fmt.Sprintf(`{"ping":"%s"}`, strings.Repeat("a", 2048)),
+			wantStatusCode: http.StatusOK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader(tt.body))
+			h.ServeHTTP(w, r)
+
+			assert.Equal(t, tt.wantStatusCode, w.Code, w.Body.String())
+		})
+	}
+
+	t.Run("Strict server, lenient route", func(t *testing.T) {
+		h, err := gopi.GetHandler(context.TODO(), routes, gopi.MiddlewareFuncs{}, gopi.WithStrictJSON())
+		if !assert.NoError(t, err) {
+			return
+		}
+		for path, want := range map[string]int{"/api/v0/lenient": http.StatusBadRequest, "/api/v0/unlimited": http.StatusOK} {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, path, strings.NewReader(`{"ping":"hello","foo":"bar"}`)))
+			assert.Equal(t, want, w.Code, path)
+		}
+	})
+}
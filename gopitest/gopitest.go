@@ -22,6 +22,7 @@ import (
 // TestSuite defines a configuration that wraps a bunch of individual tests for a single HandlerFunc
 type TestSuite struct {
 	Route                 gopi.Route
+	ServerOptions         []gopi.ServerOption // e.g. the JSON key transform configured on the server
 	AuthBearerTokenFunc   func(*testing.T) string
 	AuthMiddlewareHandler mux.MiddlewareFunc
 	AfterTestFunc         func(*testing.T)
@@ -77,7 +78,7 @@ func (ts TestSuite) RunHandlerTest(t *testing.T, tt HandlerTest) {
 	// Figure out what handler are we using
 	var handler http.Handler = ts.Route.HandlerFunc
 	if handler == nil {
-		t.Errorf("HandlerFunc provided in TestSuite are nil for %s", ts.Route)
+		t.Errorf("HandlerFunc provided in TestSuite are nil for %s %s", ts.Route.Method, ts.Route.Path)
 	}
 
 	// Authorization?
@@ -97,6 +98,7 @@ func (ts TestSuite) RunHandlerTest(t *testing.T, tt HandlerTest) {
 	// Create the HTTP request and response
 	hreq := HandlerReqParams{
 		Route:           ts.Route,
+		ServerOptions:   ts.ServerOptions,
 		AuthBearerToken: authBearerToken,
 	}
 	resp, body, err := hreq.MakeHandlerRequest(tt.Content, nil)
@@ -195,14 +197,16 @@ type HandlerReqParams struct {
 	HandlerFunc     http.HandlerFunc
 	AuthBearerToken string
 	Middlewares     gopi.MiddlewareFuncs
+	ServerOptions   []gopi.ServerOption
 }
 
 // MakeHandlerRequest makes an request to the handler specified in p, using the content. It errors if there is an
 // error making the request, or if the received status code is not among the accepted status codes
 func (p HandlerReqParams) MakeHandlerRequest(content string, acceptedStatusCodes []int) (*http.Response, []byte, error) {
 
-	// Figure out what handler are we using
-	var handler http.Handler = p.Route.HandlerFunc
+	// Figure out what handler are we using. Wrap it the same way the server does, so route and server settings
+	// (e.g. the JSON key transform) are honored.
+	var handler http.Handler = gopi.GetRouteHandler(p.Route, p.ServerOptions...)
 
 	// Create the HTTP request and response
 	var buff = bytes.NewBufferString(content)
@@ -241,7 +245,7 @@ func (p HandlerReqParams) MakeHandlerRequest(content string, acceptedStatusCodes
 			statusMap[status] = true
 		}
 		if v, hasKey := statusMap[w.Code]; !hasKey || !v {
-			return resp, body, fmt.Errorf("apitest: handler request to %s resulted in a unaccepteable %d status:\n%s", p.Route, w.Code, string(body))
+			return resp, body, fmt.Errorf("apitest: handler request to %s %s resulted in a unaccepteable %d status:\n%s", p.Route.Method, p.Route.Path, w.Code, string(body))
 		}
 	}
 
@@ -0,0 +1,262 @@
+package gopi
+
+import (
+	"context"
+	stdjson "encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultHealthCheckTimeout is how long a health check can take, unless configured otherwise
+	defaultHealthCheckTimeout = 5 * time.Second
+	defaultLivenessPath       = "/healthz"
+	defaultReadinessPath      = "/readyz"
+)
+
+// ErrHealthCheckTimeout is reported for the health checks that don't finish within their Timeout
+var ErrHealthCheckTimeout = fmt.Errorf("the health check timed out")
+
+// HealthStatus is the outcome of a health check, or of all of them
+type HealthStatus string
+
+const (
+	// HealthPass means that all the checks passed
+	HealthPass HealthStatus = "pass"
+	// HealthWarn means that only checks that aren't critical failed, so the server can still serve requests
+	HealthWarn HealthStatus = "warn"
+	// HealthFail means that a critical check failed, or that the server is shutting down
+	HealthFail HealthStatus = "fail"
+)
+
+// HealthCheck checks a dependency of the server, e.g. that its database is reachable
+type HealthCheck struct {
+	// Name identifies the check in the reports. It has to be unique.
+	Name string
+	// Check returns an error if the dependency is unhealthy. ctx is done once the Timeout has passed.
+	Check func(ctx context.Context) error
+	// Timeout is how long Check can take before the check fails. Defaults to 5 seconds.
+	Timeout time.Duration
+	// Critical checks make the server unready when they fail. The failures of the other checks are reported, but the
+	// server is still ready.
+	Critical bool
+	// Liveness checks also run on the liveness endpoint, so a critical one that fails makes the orchestrator restart
+	// the server. Only use them for failures that a restart fixes, e.g. a deadlock.
+	Liveness bool
+}
+
+// HealthConfig configures the liveness and readiness endpoints of the server (see WithHealth)
+type HealthConfig struct {
+	// LivenessPath defaults to /healthz
+	LivenessPath string
+	// ReadinessPath defaults to /readyz
+	ReadinessPath string
+	// ShutdownDelay is how long Shutdown waits after the server becomes unready before it stops accepting connections,
+	// so that load balancers have time to stop sending it requests
+	ShutdownDelay time.Duration
+	// ExposeErrors includes the errors of the failed checks in the reports. The endpoints are usually public and the
+	// errors can reveal the internals of the server, so by default they are only logged.
+	ExposeErrors bool
+}
+
+func (cfg HealthConfig) withDefaults() HealthConfig {
+	if cfg.LivenessPath == "" {
+		cfg.LivenessPath = defaultLivenessPath
+	}
+	if cfg.ReadinessPath == "" {
+		cfg.ReadinessPath = defaultReadinessPath
+	}
+	return cfg
+}
+
+// HealthReport is the body of the responses of the health endpoints
+type HealthReport struct {
+	Status HealthStatus `json:"status"`
+	// Error explains why the server isn't ready when it's not because of a check, e.g. because it is shutting down
+	Error  string                       `json:"error,omitempty"`
+	Checks map[string]HealthCheckResult `json:"checks,omitempty"`
+}
+
+// HealthCheckResult is the outcome of one health check
+type HealthCheckResult struct {
+	Status     HealthStatus `json:"status"`
+	Critical   bool         `json:"critical"`
+	DurationMS float64      `json:"duration_ms"`
+	// Error is only reported if HealthConfig.ExposeErrors is set
+	Error string `json:"error,omitempty"`
+}
+
+// health keeps the health checks of a server, which can be registered until it shuts down
+type health struct {
+	cfg HealthConfig
+
+	mu           sync.Mutex
+	checks       []HealthCheck
+	shuttingDown bool
+}
+
+func newHealth(cfg HealthConfig) *health {
+	return &health{cfg: cfg.withDefaults()}
+}
+
+// register adds checks, replacing the existing checks with the same names
+func (h *health) register(checks ...HealthCheck) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, c := range checks {
+		if c.Timeout <= 0 {
+			c.Timeout = defaultHealthCheckTimeout
+		}
+		replaced := false
+		for i := range h.checks {
+			if h.checks[i].Name == c.Name {
+				h.checks[i] = c
+				replaced = true
+			}
+		}
+		if !replaced {
+			h.checks = append(h.checks, c)
+		}
+	}
+}
+
+// shutdown makes the server unready
+func (h *health) shutdown() {
+	h.mu.Lock()
+	h.shuttingDown = true
+	h.mu.Unlock()
+}
+
+// report runs the checks, or only the liveness ones, concurrently and aggregates their results
+func (h *health) report(ctx context.Context, liveness bool) HealthReport {
+	h.mu.Lock()
+	shuttingDown := h.shuttingDown
+	var checks []HealthCheck
+	for _, c := range h.checks {
+		if c.Liveness || !liveness {
+			checks = append(checks, c)
+		}
+	}
+	h.mu.Unlock()
+
+	report := HealthReport{Status: HealthPass}
+	if len(checks) > 0 {
+		report.Checks = make(map[string]HealthCheckResult, len(checks))
+	}
+	results := make([]HealthCheckResult, len(checks))
+	var wg sync.WaitGroup
+	for i, c := range checks {
+		wg.Add(1)
+		go func(i int, c HealthCheck) {
+			defer wg.Done()
+			results[i] = runHealthCheck(ctx, c)
+		}(i, c)
+	}
+	wg.Wait()
+
+	for i, c := range checks {
+		res := results[i]
+		report.Checks[c.Name] = res
+		if res.Status != HealthFail {
+			continue
+		}
+		if c.Critical {
+			report.Status = HealthFail
+		} else if report.Status == HealthPass {
+			report.Status = HealthWarn
+		}
+	}
+	// The server is still alive while it shuts down, so only readiness fails
+	if shuttingDown && !liveness {
+		report.Status = HealthFail
+		report.Error = ErrServerShuttingDown.Error()
+	}
+	return report
+}
+
+// runHealthCheck runs c, giving up on it once its timeout has passed
+func runHealthCheck(ctx context.Context, c HealthCheck) HealthCheckResult {
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(ctx, c.Timeout)
+	defer cancel()
+
+	// Buffered, so the check can finish after we have given up on it
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if rec := recover(); rec != nil {
+				done <- fmt.Errorf("the health check panicked: %v", rec)
+			}
+		}()
+		done <- c.Check(ctx)
+	}()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ErrHealthCheckTimeout
+	}
+
+	res := HealthCheckResult{
+		Status:     HealthPass,
+		Critical:   c.Critical,
+		DurationMS: float64(time.Since(start).Microseconds()) / 1000,
+	}
+	if err != nil {
+		res.Status = HealthFail
+		res.Error = err.Error()
+	}
+	return res
+}
+
+// handler returns the http.Handler of the liveness or the readiness endpoint
+func (h *health) handler(liveness bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := h.report(r.Context(), liveness)
+
+		names := make([]string, 0, len(report.Checks))
+		for name := range report.Checks {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			res := report.Checks[name]
+			if res.Status != HealthFail {
+				continue
+			}
+			Logger(r.Context()).Warn("[Gopi] Health check failed", "path", r.URL.Path, "check", name, "critical", res.Critical, "error", res.Error)
+			if !h.cfg.ExposeErrors {
+				res.Error = ""
+				report.Checks[name] = res
+			}
+		}
+
+		code := http.StatusOK
+		if report.Status == HealthFail {
+			code = http.StatusServiceUnavailable
+			if report.Error != "" {
+				Logger(r.Context()).Warn("[Gopi] Server is not ready", "path", r.URL.Path, "error", report.Error)
+			}
+		}
+
+		body, err := stdjson.Marshal(report)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		w.Header().Set("Content-Type", MediaTypeJSON)
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(code)
+		if r.Method == http.MethodHead {
+			return
+		}
+		_, err = w.Write(body)
+		if err != nil {
+			Logger(r.Context()).Error("[Gopi] Writing health report", "error", err)
+		}
+	})
+}
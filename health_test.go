@@ -0,0 +1,147 @@
+package gopi_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/teejays/gopi"
+)
+
+func TestHealth(t *testing.T) {
+	routes := []gopi.Route{
+		{
+			Method:      http.MethodGet,
+			Path:        "ping",
+			HandlerFunc: gopi.HandlerWrapper(http.MethodGet, SampleEndpoint),
+		},
+	}
+	pass := func(ctx context.Context) error { return nil }
+	fail := func(ctx context.Context) error { return fmt.Errorf("unreachable") }
+	get := func(t *testing.T, h http.Handler, path string) (*httptest.ResponseRecorder, gopi.HealthReport) {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		var report gopi.HealthReport
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+		return w, report
+	}
+	handler := func(t *testing.T, opts ...gopi.ServerOption) http.Handler {
+		h, err := gopi.GetHandler(context.TODO(), routes, gopi.MiddlewareFuncs{}, opts...)
+		assert.NoError(t, err)
+		return h
+	}
+
+	t.Run("No Checks", func(t *testing.T) {
+		h := handler(t)
+		for _, path := range []string{"/healthz", "/readyz"} {
+			w, report := get(t, h, path)
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, "no-store", w.Header().Get("Cache-Control"))
+			assert.Equal(t, gopi.HealthPass, report.Status)
+		}
+	})
+
+	t.Run("Critical Check Fails", func(t *testing.T) {
+		h := handler(t, gopi.WithHealthChecks(
+			gopi.HealthCheck{Name: "db", Check: fail, Critical: true},
+			gopi.HealthCheck{Name: "cache", Check: pass},
+		))
+		w, report := get(t, h, "/readyz")
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+		assert.Equal(t, gopi.HealthFail, report.Status)
+		assert.Equal(t, gopi.HealthFail, report.Checks["db"].Status)
+		// The errors are only logged, unless they are exposed
+		assert.Empty(t, report.Checks["db"].Error)
+		assert.NotContains(t, w.Body.String(), "unreachable")
+		assert.True(t, report.Checks["db"].Critical)
+		assert.Equal(t, gopi.HealthPass, report.Checks["cache"].Status)
+
+		// Only the liveness checks run on the liveness endpoint
+		w, report = get(t, h, "/healthz")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, gopi.HealthPass, report.Status)
+		assert.Empty(t, report.Checks)
+	})
+
+	t.Run("Exposed Errors", func(t *testing.T) {
+		h := handler(t, gopi.WithHealth(gopi.HealthConfig{ExposeErrors: true}), gopi.WithHealthChecks(gopi.HealthCheck{Name: "db", Check: fail, Critical: true}))
+		_, report := get(t, h, "/readyz")
+		assert.Equal(t, "unreachable", report.Checks["db"].Error)
+	})
+
+	t.Run("Non-Critical Check Fails", func(t *testing.T) {
+		h := handler(t, gopi.WithHealthChecks(gopi.HealthCheck{Name: "cache", Check: fail}))
+		w, report := get(t, h, "/readyz")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, gopi.HealthWarn, report.Status)
+	})
+
+	t.Run("Liveness Check", func(t *testing.T) {
+		h := handler(t, gopi.WithHealthChecks(gopi.HealthCheck{Name: "loop", Check: fail, Critical: true, Liveness: true}))
+		w, report := get(t, h, "/healthz")
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+		assert.Equal(t, gopi.HealthFail, report.Checks["loop"].Status)
+	})
+
+	t.Run("Timeout", func(t *testing.T) {
+		slow := func(ctx context.Context) error {
+			time.Sleep(time.Second)
+			return nil
+		}
+		h := handler(t, gopi.WithHealth(gopi.HealthConfig{ExposeErrors: true}), gopi.WithHealthChecks(gopi.HealthCheck{Name: "slow", Check: slow, Timeout: 10 * time.Millisecond, Critical: true}))
+		start := time.Now()
+		w, report := get(t, h, "/readyz")
+		assert.Less(t, time.Since(start), 500*time.Millisecond)
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+		assert.Equal(t, gopi.ErrHealthCheckTimeout.Error(), report.Checks["slow"].Error)
+	})
+
+	t.Run("Panic", func(t *testing.T) {
+		boom := func(ctx context.Context) error { panic("boom") }
+		h := handler(t, gopi.WithHealth(gopi.HealthConfig{ExposeErrors: true}), gopi.WithHealthChecks(gopi.HealthCheck{Name: "boom", Check: boom, Critical: true}))
+		w, report := get(t, h, "/readyz")
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+		assert.Contains(t, report.Checks["boom"].Error, "boom")
+	})
+
+	t.Run("Custom Paths", func(t *testing.T) {
+		h := handler(t, gopi.WithHealth(gopi.HealthConfig{LivenessPath: "/live", ReadinessPath: "/ready"}))
+		w, _ := get(t, h, "/ready")
+		assert.Equal(t, http.StatusOK, w.Code)
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		h := handler(t, gopi.WithoutHealthEndpoints())
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run("Shutdown", func(t *testing.T) {
+		s, err := gopi.NewServer(context.TODO(), routes, gopi.MiddlewareFuncs{})
+		assert.NoError(t, err)
+		s.RegisterHealthCheck(gopi.HealthCheck{Name: "db", Check: pass, Critical: true})
+
+		w, report := get(t, s.Handler(), "/readyz")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, gopi.HealthPass, report.Checks["db"].Status)
+
+		assert.NoError(t, s.Shutdown(context.Background()))
+		w, report = get(t, s.Handler(), "/readyz")
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+		assert.Equal(t, gopi.ErrServerShuttingDown.Error(), report.Error)
+
+		// The server is still alive while it shuts down
+		w, _ = get(t, s.Handler(), "/healthz")
+		assert.Equal(t, http.StatusOK, w.Code)
+	})
+}
@@ -1,9 +1,12 @@
 package gopi
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"mime"
 	"net/http"
 	"reflect"
 	"strconv"
@@ -11,9 +14,8 @@ import (
 
 	"github.com/gorilla/mux"
 	"github.com/teejays/goku-util/errutil"
-	"github.com/teejays/goku-util/httputil"
-	"github.com/teejays/goku-util/log"
 	"github.com/teejays/goku-util/panics"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/teejays/gopi/json"
 	"github.com/teejays/gopi/validator"
@@ -26,7 +28,7 @@ func GetQueryParamInt(r *http.Request, name string, defaultVal int) (int, error)
 		return defaultVal, err
 	}
 	values, exist := r.Form[name]
-	log.DebugNoCtx("URL values", "param", name, "value", values)
+	requestLogger(r).Debug("URL values", "param", name, "value", values)
 	if !exist {
 		return defaultVal, nil
 	}
@@ -46,7 +48,7 @@ func GetMuxParamInt(r *http.Request, name string) (int64, error) {
 
 	var vars = mux.Vars(r)
 
-	log.DebugNoCtx("MUX vars", "value", vars)
+	requestLogger(r).Debug("MUX vars", "value", vars)
 	valStr := vars[name]
 	if strings.TrimSpace(valStr) == "" {
 		return -1, fmt.Errorf("could not find var %s in the route", name)
@@ -64,7 +66,7 @@ func GetMuxParamInt(r *http.Request, name string) (int64, error) {
 func GetMuxParamStr(r *http.Request, name string) (string, error) {
 
 	var vars = mux.Vars(r)
-	log.DebugNoCtx("MUX vars", "value", vars)
+	requestLogger(r).Debug("MUX vars", "value", vars)
 	valStr := vars[name]
 	if strings.TrimSpace(valStr) == "" {
 		return "", fmt.Errorf("var '%s' is not in the route", name)
@@ -79,49 +81,178 @@ type StandardResponse struct {
 	Error      interface{}
 }
 
+// WriteStandardResponse writes v as the data of a StandardResponse with the default settings. Handlers should use
+// WriteStandardResponseForRequest, which follows the settings of their route.
 func WriteStandardResponse(w http.ResponseWriter, v interface{}) {
+	writeStandardResponse(w, nil, v)
+}
+
+// WriteStandardResponseForRequest writes v as the data of a StandardResponse to the request r, following the settings
+// of its route (e.g. its JSON key transform) and the media types accepted by the client
+func WriteStandardResponseForRequest(w http.ResponseWriter, r *http.Request, v interface{}) {
+	writeStandardResponse(w, r, v)
+}
+
+func writeStandardResponse(w http.ResponseWriter, r *http.Request, v interface{}) {
+	if stream, ok := v.(responseStreamer); ok {
+		writeStreamResponse(w, r, http.StatusOK, stream)
+		return
+	}
+	if stream, ok := v.(eventStreamer); ok {
+		writeEventStream(w, r, stream)
+		return
+	}
+
+	// If the response knows its version, we don't even need to encode it to tell that the client already has it
+	if isConditionalGet(r) {
+		setValidators(w.Header(), v)
+		if notModified(r, w.Header()) {
+			w.Header().Add("Vary", "Accept")
+			writeNotModified(w)
+			return
+		}
+	}
+
 	var resp = StandardResponse{
 		StatusCode: http.StatusOK,
 		Data:       v,
 		Error:      nil,
 	}
-	writeResponse(w, http.StatusOK, resp)
+	writeResponse(w, r, http.StatusOK, resp)
 }
 
-// WriteResponse is a helper function to help write HTTP response
+// WriteResponse is a helper function to help write HTTP response, with the default settings. Handlers should use
+// WriteResponseForRequest, which follows the settings of their route.
 func WriteResponse(w http.ResponseWriter, code int, v interface{}) {
-	writeResponse(w, code, v)
+	writeResponse(w, nil, code, v)
 }
 
-func writeResponse(w http.ResponseWriter, code int, v interface{}) {
-	w.WriteHeader(code)
-	log.DebugNoCtx("api: writeResponse", "kind", reflect.ValueOf(v).Kind(), "content", v)
+// WriteResponseForRequest writes v as the response to the request r, following the settings of its route (e.g. its
+// JSON key transform and EncoderStrategy) and the media types accepted by the client
+func WriteResponseForRequest(w http.ResponseWriter, r *http.Request, code int, v interface{}) {
+	writeResponse(w, r, code, v)
+}
+
+// EncoderStrategy determines how a response is encoded and written to the HTTP response
+type EncoderStrategy int
+
+const (
+	// EncoderStrategyBuffered encodes the whole response in memory before writing anything to the HTTP response, so
+	// that an encoding failure still results in a single clean error response. This is the default.
+	EncoderStrategyBuffered EncoderStrategy = iota
+	// EncoderStrategyStreaming writes the status code first and encodes the response directly into the HTTP response.
+	// Encoding failures can then only be logged, since the status code has already been sent.
+	EncoderStrategyStreaming
+)
+
+// writeResponse encodes v and writes it to w with the status code. The request r is used to negotiate the encoding and
+// look up the route settings, and can be nil in which case the defaults are used.
+func writeResponse(w http.ResponseWriter, r *http.Request, code int, v interface{}) {
+	requestLogger(r).Debug("api: writeResponse", "kind", reflect.ValueOf(v).Kind())
 
 	if v == nil {
+		w.WriteHeader(code)
+		return
+	}
+
+	mediaType, enc, ok := negotiateEncoder(r, v)
+	if !ok {
+		writeError(w, r, http.StatusNotAcceptable, ErrNotAcceptable)
+		return
+	}
+	setContentType(w, r, mediaType)
+
+	cfg := getRouteConfig(r)
+
+	if cfg.encoderStrategy == EncoderStrategyStreaming {
+		w.WriteHeader(code)
+		err := enc.Encode(w, v)
+		if err != nil {
+			requestLogger(r).Error("api: writeResponse: encoding response after the status code has been written", "error", err)
+		}
 		return
 	}
 
-	// Json marshal the resp
-	data, err := json.Marshal(v)
+	// Encode the resp before writing anything, so we can still write a clean error if it fails
+	var buff bytes.Buffer
+	err := enc.Encode(&buff, v)
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, err)
+		writeError(w, r, http.StatusInternalServerError, err)
 		return
 	}
 
+	// Successful GET responses get an ETag, so clients can revalidate their cached copy instead of fetching it again
+	if code == http.StatusOK && isConditionalGet(r) {
+		if w.Header().Get("ETag") == "" {
+			w.Header().Set("ETag", hashETag(buff.Bytes()))
+		}
+		if notModified(r, w.Header()) {
+			writeNotModified(w)
+			return
+		}
+	}
+
+	logBody(r, "api: writeResponse: response body", w.Header().Get("Content-Type"), buff.Bytes())
+
 	// Write the response
-	_, err = w.Write(data)
+	w.Header().Set("Content-Length", strconv.Itoa(buff.Len()))
+	w.WriteHeader(code)
+	_, err = w.Write(buff.Bytes())
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, err)
+		// The status code has already been written, so all we can do is log
+		requestLogger(r).Error("api: writeResponse: writing response", "error", err)
 		return
 	}
 }
 
-// WriteError is a helper function to help write HTTP response
+// WriteError is a helper function to help write HTTP response, with the default settings. Handlers should use
+// WriteErrorForRequest, which follows the settings of their route.
 func WriteError(w http.ResponseWriter, code int, err error) {
-	writeError(w, code, err)
+	writeError(w, nil, code, err)
 }
 
-func writeError(w http.ResponseWriter, code int, err error) {
+// WriteErrorForRequest writes err as the response to the request r, following the settings of its route and the media
+// types accepted by the client. The error is also logged and recorded on the span of the request.
+func WriteErrorForRequest(w http.ResponseWriter, r *http.Request, code int, err error) {
+	writeError(w, r, code, err)
+}
+
+func writeError(w http.ResponseWriter, r *http.Request, code int, err error) {
+
+	requestLogger(r).Error("Writing error to http response", "error", err)
+	if r != nil {
+		trace.SpanFromContext(r.Context()).RecordError(err)
+	}
+
+	code, resp := errorResponse(code, err)
+
+	// Errors have to be written even if the client doesn't accept any of our media types, so fall back to JSON
+	mediaType, enc, ok := negotiateEncoder(r, resp)
+	if !ok {
+		mediaType, enc, _ = negotiateEncoder(nil, resp)
+	}
+
+	var buff bytes.Buffer
+	err = enc.Encode(&buff, resp)
+	if err != nil {
+		panic(fmt.Sprintf("Failed to encode an error for http response: %v", err))
+	}
+	setContentType(w, r, mediaType)
+	w.Header().Set("Content-Length", strconv.Itoa(buff.Len()))
+	w.WriteHeader(code)
+	_, err = w.Write(buff.Bytes())
+	// The handler timed out, and the timeout response has been written in place of this one
+	if errors.Is(err, http.ErrHandlerTimeout) {
+		return
+	}
+	if err != nil {
+		panic(fmt.Sprintf("Failed to write error to the http response: %v", err))
+	}
+}
+
+// errorResponse returns the status code and StandardResponse to report err with. If code is not set, it is derived
+// from err.
+func errorResponse(code int, err error) (int, StandardResponse) {
 
 	var errMessage string
 
@@ -130,8 +261,6 @@ func writeError(w http.ResponseWriter, code int, err error) {
 		errMessage = ErrMessageGeneric
 	}
 
-	log.ErrorNoCtx("Writing error to http response", "error", err)
-
 	// If it a goku error?
 	if gErr, ok := errutil.AsGokuError(err); ok {
 		errMessage = gErr.GetExternalMsg()
@@ -145,26 +274,48 @@ func writeError(w http.ResponseWriter, code int, err error) {
 
 	}
 
+	// The request body was larger than the allowed max body size
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		code = http.StatusRequestEntityTooLarge
+	}
+
+	// The resource has changed since the client last fetched it
+	if code < 1 && errors.Is(err, ErrPreconditionFailed) {
+		code = http.StatusPreconditionFailed
+	}
+
+	// The request (or something it was waiting on) took too long
+	if code < 1 && errors.Is(err, context.DeadlineExceeded) {
+		code = http.StatusGatewayTimeout
+		// Handlers that give up on their deadline get the same response as the ones that the timeout cuts off
+		if _, ok := errutil.AsGokuError(err); !ok {
+			errMessage = ErrRequestTimeout.Error()
+		}
+	}
+
 	// Still no code? Use InternalServerError
 	if code < 1 {
 		code = http.StatusInternalServerError
 	}
 
-	resp := StandardResponse{
+	return code, StandardResponse{
 		StatusCode: code,
 		Data:       nil,
 		Error:      errMessage,
 	}
+}
 
-	w.WriteHeader(code)
-	data, err := json.Marshal(resp)
-	if err != nil {
-		panic(fmt.Sprintf("Failed to json.Unmarshal an error for http response: %v", err))
+// setContentType sets the Content-Type header of the response to mediaType, unless it has already been set to it (e.g.
+// by SetJSONHeaderMiddleware)
+func setContentType(w http.ResponseWriter, r *http.Request, mediaType string) {
+	if r != nil {
+		w.Header().Add("Vary", "Accept")
 	}
-	_, err = w.Write(data)
-	if err != nil {
-		panic(fmt.Sprintf("Failed to write error to the http response: %v", err))
+	if existing, _, err := mime.ParseMediaType(w.Header().Get("Content-Type")); err == nil && existing == mediaType {
+		return
 	}
+	w.Header().Set("Content-Type", mediaType)
 }
 
 // UnmarshalJSONFromRequest takes in a pointer to an object and populates
@@ -184,12 +335,12 @@ func UnmarshalJSONFromRequest(r *http.Request, v interface{}) error {
 		return ErrEmptyBody
 	}
 
-	log.DebugNoCtx("api: Unmarshaling to JSON", "body", string(body))
+	logBody(r, "api: Unmarshaling to JSON", r.Header.Get("Content-Type"), body)
 
 	// Unmarshal JSON into Go type
-	err = json.Unmarshal(body, &v)
+	err = json.Unmarshal(body, &v, getRouteConfig(r).jsonOptions()...)
 	if err != nil {
-		log.ErrorNoCtx("api: Unmarshaling to JSON", "error", err)
+		Logger(r.Context()).Error("api: Unmarshaling to JSON", "error", err)
 		return ErrInvalidJSON
 	}
 
@@ -201,6 +352,24 @@ func UnmarshalJSONFromRequest(r *http.Request, v interface{}) error {
 	return nil
 }
 
+// validateRequest runs the validator on req, if it is a struct (or a pointer to one)
+func validateRequest(req interface{}) error {
+	t := reflect.TypeOf(req)
+	if t == nil {
+		return nil
+	}
+	if t.Kind() == reflect.Ptr {
+		if reflect.ValueOf(req).IsNil() {
+			return nil
+		}
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+	return validator.Validate(req)
+}
+
 func HandlerWrapper[ReqT any, RespT any](httpMethod string, fn func(context.Context, ReqT) (RespT, error)) http.HandlerFunc {
 
 	switch httpMethod {
@@ -218,64 +387,104 @@ func HandlerWrapper[ReqT any, RespT any](httpMethod string, fn func(context.Cont
 
 func GetGenericGetHandler[ReqT, RespT any](fn func(context.Context, ReqT) (RespT, error)) http.HandlerFunc {
 
-	return func(w http.ResponseWriter, r *http.Request) {
+	return describeHandler[ReqT, RespT](handlerQuery, func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
 
-		log.Debug(ctx, "[HTTP Handler] Starting...")
+		Logger(ctx).Debug("[HTTP Handler] Starting...")
 
 		// Get the req data from URL
 		reqParam, ok := r.URL.Query()["req"]
 		if !ok || len(reqParam) < 1 {
-			WriteError(w, http.StatusBadRequest, fmt.Errorf("URL param 'req' is required"))
+			writeError(w, r, http.StatusBadRequest, fmt.Errorf("URL param 'req' is required"))
 			return
 		}
 		if len(reqParam) > 1 {
-			WriteError(w, http.StatusBadRequest, fmt.Errorf("multiple URL params with name 'req' found"))
+			writeError(w, r, http.StatusBadRequest, fmt.Errorf("multiple URL params with name 'req' found"))
 			return
 		}
 
 		var req ReqT
-		err := json.Unmarshal([]byte(reqParam[0]), &req)
+		err := json.Unmarshal([]byte(reqParam[0]), &req, getRouteConfig(r).jsonOptions()...)
 		if err != nil {
-			WriteError(w, http.StatusBadRequest, err)
+			writeError(w, r, http.StatusBadRequest, err)
 			return
 		}
 
 		// Call the method
 		resp, err := fn(ctx, req)
 		if err != nil {
-			WriteError(w, 0, err)
+			writeError(w, r, 0, err)
 			return
 		}
 
-		WriteStandardResponse(w, resp)
+		writeStandardResponse(w, r, resp)
 		return
-	}
+	})
 }
 
 func GetGenericPostPutPatchHandler[ReqT, RespT any](fn func(context.Context, ReqT) (RespT, error)) http.HandlerFunc {
 
-	return func(w http.ResponseWriter, r *http.Request) {
+	return describeHandler[ReqT, RespT](handlerBody, func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
 
-		log.Debug(ctx, "[HTTP Handler] Starting...")
+		Logger(ctx).Debug("[HTTP Handler] Starting...")
 
-		// Get the req from HTTP body
+		// Get the req from HTTP body, decoded according to its Content-Type. Streamed requests are instead decoded as
+		// the handler reads them, and forms are bound field by field.
 		var req ReqT
-		err := httputil.UnmarshalJSONFromRequest(r, &req)
-		if err != nil {
-			WriteError(w, http.StatusBadRequest, err)
-			return
+		stream, isStream := any(&req).(requestStreamer)
+		if isStream {
+			err := stream.bindRequest(r)
+			if err != nil {
+				writeError(w, r, http.StatusUnsupportedMediaType, err)
+				return
+			}
+		} else if isFormRequest(r) {
+			cleanup, err := bindForm(r, &req)
+			defer cleanup()
+			if err == ErrTooManyFiles || err == ErrFileTooLarge || err == ErrFormTooLarge {
+				writeError(w, r, http.StatusRequestEntityTooLarge, err)
+				return
+			}
+			if err != nil {
+				writeError(w, r, http.StatusBadRequest, err)
+				return
+			}
+			err = validateRequest(req)
+			if err != nil {
+				writeError(w, r, http.StatusBadRequest, err)
+				return
+			}
+		} else {
+			err := decodeRequestBody(r, &req)
+			if err == ErrUnsupportedMediaType {
+				writeError(w, r, http.StatusUnsupportedMediaType, err)
+				return
+			}
+			if err != nil {
+				writeError(w, r, http.StatusBadRequest, err)
+				return
+			}
+			err = validateRequest(req)
+			if err != nil {
+				writeError(w, r, http.StatusBadRequest, err)
+				return
+			}
 		}
 
 		// Call the method
 		resp, err := fn(r.Context(), req)
+		// A bad request stream takes precedence, since the handler may have failed because of it
+		if isStream && stream.streamErr() != nil {
+			writeError(w, r, http.StatusBadRequest, stream.streamErr())
+			return
+		}
 		if err != nil {
-			WriteError(w, 0, err)
+			writeError(w, r, 0, err)
 			return
 		}
 
-		WriteStandardResponse(w, resp)
+		writeStandardResponse(w, r, resp)
 
-	}
+	})
 }
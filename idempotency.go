@@ -0,0 +1,281 @@
+package gopi
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// IdempotencyKeyHeader is the request header in which clients send a unique key for a request that they may retry
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+const (
+	// maxIdempotencyKeyLength is the length over which idempotency keys are rejected
+	maxIdempotencyKeyLength = 255
+	// maxIdempotentBodySize is the size, in bytes, over which the bodies of requests with an idempotency key are
+	// rejected, since they are held in memory to fingerprint the requests
+	maxIdempotentBodySize = 10 << 20
+	// memoryIdempotencySweepInterval is the number of requests after which MemoryIdempotencyStore evicts the expired
+	// keys
+	memoryIdempotencySweepInterval = 1024
+)
+
+var (
+	// ErrIdempotencyKeyRequired is used when a route requires an idempotency key and the request has none
+	ErrIdempotencyKeyRequired = fmt.Errorf("the %s header is required", IdempotencyKeyHeader)
+	// ErrIdempotencyKeyInvalid is used when an idempotency key is too long
+	ErrIdempotencyKeyInvalid = fmt.Errorf("the %s header must be at most %d characters", IdempotencyKeyHeader, maxIdempotencyKeyLength)
+	// ErrIdempotencyInFlight is used when a request is retried while the first one with the same key is still being
+	// handled
+	ErrIdempotencyInFlight = fmt.Errorf("a request with the same %s is still being processed", IdempotencyKeyHeader)
+	// ErrIdempotentBodyTooLarge is used when the body of a request with an idempotency key is too large to be
+	// fingerprinted
+	ErrIdempotentBodyTooLarge = fmt.Errorf("the body of a request with an %s must be at most %d bytes", IdempotencyKeyHeader, maxIdempotentBodySize)
+	// ErrIdempotencyKeyReused is used when an idempotency key is reused for a different request
+	ErrIdempotencyKeyReused = fmt.Errorf("the %s has already been used for a different request", IdempotencyKeyHeader)
+)
+
+// IdempotencyRecord is what an IdempotencyStore keeps for an idempotency key
+type IdempotencyRecord struct {
+	// Fingerprint identifies the request that the key was first used for, so it can't be reused for another one
+	Fingerprint string
+	// Response is the response to that request, or nil while it is still being handled
+	Response *CachedResponse
+}
+
+// IdempotencyStore stores the responses replayed by IdempotencyMiddleware. Implementations must be safe for concurrent
+// use, e.g. a shared store (like Redis) so that retries are deduplicated across several servers.
+type IdempotencyStore interface {
+	// Reserve stores a record without a response under key, for a request identified by fingerprint, unless there is
+	// already one. It returns the existing record and false if there is, and true if the key has been reserved.
+	Reserve(ctx context.Context, key, fingerprint string, ttl time.Duration) (IdempotencyRecord, bool, error)
+	// Complete stores resp as the response for key, for ttl
+	Complete(ctx context.Context, key string, resp CachedResponse, ttl time.Duration) error
+	// Release removes the record for key, so that the request can be retried
+	Release(ctx context.Context, key string) error
+}
+
+// IdempotencyPolicy configures the deduplication of retried requests to a route (see IdempotencyMiddleware)
+type IdempotencyPolicy struct {
+	// TTL is how long responses are kept to be replayed. Idempotency is disabled if it is not set.
+	TTL time.Duration
+	// Required rejects requests without an idempotency key with a 400
+	Required bool
+}
+
+// idempotencyKey returns the key that the response to r is stored under, which is scoped to the Principal so clients
+// can't see each other's responses
+func idempotencyKey(r *http.Request, key string) string {
+	sum := sha256.Sum256([]byte(Principal(r.Context()) + "\n" + key))
+	return hex.EncodeToString(sum[:])
+}
+
+// idempotencyFingerprint returns a hash of the request r with body, which must match for a key to be reused
+func idempotencyFingerprint(r *http.Request, body []byte) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %s\n", r.Method, r.URL.RequestURI())
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// IdempotencyMiddleware returns a http.Handler middleware func that makes requests with an `Idempotency-Key` header
+// safe to retry, according to policy. It is installed automatically for Routes with an Idempotency policy. The first
+// response for a key is stored in store and replayed to retries with the `Idempotent-Replayed` header, as long as they
+// have the same method, URL and body (otherwise they get a 422). Bodies are held in memory to fingerprint the
+// requests, so the ones over 10 MiB get a 413. Retries made while the first request is still being handled get a 409.
+// Responses with a 5xx status aren't stored, so those requests can be retried, and stored responses only replay the
+// headers set by the handler, except Set-Cookie. Keys are scoped to the Principal, so authenticated requests without
+// one (see ContextWithPrincipal) aren't deduplicated. If store fails, requests are let through.
+func IdempotencyMiddleware(policy IdempotencyPolicy, store IdempotencyStore) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Safe methods are idempotent already
+			if policy.TTL <= 0 || r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions {
+				next.ServeHTTP(w, r)
+				return
+			}
+			key := r.Header.Get(IdempotencyKeyHeader)
+			if key == "" {
+				if policy.Required {
+					writeError(w, r, http.StatusBadRequest, ErrIdempotencyKeyRequired)
+					return
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+			if len(key) > maxIdempotencyKeyLength {
+				writeError(w, r, http.StatusBadRequest, ErrIdempotencyKeyInvalid)
+				return
+			}
+			// Keys are scoped to the Principal, so without one a client could replay another client's response
+			if isUnscoped(r) {
+				Logger(r.Context()).Warn("[Gopi] Authenticated request without a principal, ignoring its idempotency key")
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			// The body is read upfront to fingerprint the request, and then handed over to the handler. Since it is
+			// held in memory, even for streamed requests, its size is capped.
+			var body []byte
+			if r.Body != nil {
+				var err error
+				body, err = io.ReadAll(io.LimitReader(r.Body, maxIdempotentBodySize+1))
+				if err != nil {
+					writeError(w, r, http.StatusBadRequest, err)
+					return
+				}
+				if len(body) > maxIdempotentBodySize {
+					writeError(w, r, http.StatusRequestEntityTooLarge, ErrIdempotentBodyTooLarge)
+					return
+				}
+				r.Body.Close()
+				r.Body = io.NopCloser(bytes.NewReader(body))
+			}
+
+			ctx := r.Context()
+			key = idempotencyKey(r, key)
+			fingerprint := idempotencyFingerprint(r, body)
+
+			record, reserved, err := store.Reserve(ctx, key, fingerprint, policy.TTL)
+			if err != nil {
+				Logger(ctx).Error("[Gopi] Reserving idempotency key, letting the request through", "error", err)
+				next.ServeHTTP(w, r)
+				return
+			}
+			if !reserved {
+				switch {
+				case record.Fingerprint != fingerprint:
+					writeError(w, r, http.StatusUnprocessableEntity, ErrIdempotencyKeyReused)
+				case record.Response == nil:
+					w.Header().Set("Retry-After", "1")
+					writeError(w, r, http.StatusConflict, ErrIdempotencyInFlight)
+				default:
+					writeIdempotentResponse(w, r, *record.Response)
+				}
+				return
+			}
+
+			rec := newStoringRecorder(w, func(code int, h http.Header) (http.Header, bool) {
+				if code >= http.StatusInternalServerError {
+					return nil, false
+				}
+				// Cookies are meant for the client that got the response, and may be sessions that shouldn't live on
+				stored := h.Clone()
+				stored.Del("Set-Cookie")
+				return stored, true
+			})
+			// The key must be released if the handler panics, or it would be stuck in flight until it expires
+			completed := false
+			defer func() {
+				if completed {
+					return
+				}
+				// The request is over, so its context may be canceled
+				err := store.Release(context.WithoutCancel(ctx), key)
+				if err != nil {
+					Logger(ctx).Error("[Gopi] Releasing idempotency key", "error", err)
+				}
+			}()
+
+			next.ServeHTTP(rec, r)
+
+			resp, ok := rec.response()
+			if !ok {
+				return
+			}
+			err = store.Complete(context.WithoutCancel(ctx), key, resp, policy.TTL)
+			if err != nil {
+				Logger(ctx).Error("[Gopi] Storing idempotent response", "error", err)
+				return
+			}
+			completed = true
+		})
+	}
+}
+
+// writeIdempotentResponse replays resp, the stored response to an earlier request with the same idempotency key
+func writeIdempotentResponse(w http.ResponseWriter, r *http.Request, resp CachedResponse) {
+	h := w.Header()
+	replayHeader(h, resp.Header)
+	h.Set("Idempotent-Replayed", "true")
+	w.WriteHeader(resp.StatusCode)
+	_, err := w.Write(resp.Body)
+	if err != nil {
+		Logger(r.Context()).Error("[Gopi] Writing idempotent response", "error", err)
+	}
+}
+
+/* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+* M E M O R Y   S T O R E
+* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
+
+// MemoryIdempotencyStore is an IdempotencyStore that keeps the records in memory, for a single server
+type MemoryIdempotencyStore struct {
+	mu      sync.Mutex
+	records map[string]*memoryIdempotencyRecord
+	calls   int
+}
+
+type memoryIdempotencyRecord struct {
+	record    IdempotencyRecord
+	expiresAt time.Time
+}
+
+// NewMemoryIdempotencyStore returns an empty MemoryIdempotencyStore
+func NewMemoryIdempotencyStore() *MemoryIdempotencyStore {
+	return &MemoryIdempotencyStore{records: map[string]*memoryIdempotencyRecord{}}
+}
+
+// Reserve implements IdempotencyStore
+func (s *MemoryIdempotencyStore) Reserve(ctx context.Context, key, fingerprint string, ttl time.Duration) (IdempotencyRecord, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+
+	s.calls++
+	if s.calls%memoryIdempotencySweepInterval == 0 {
+		for k, rec := range s.records {
+			if now.After(rec.expiresAt) {
+				delete(s.records, k)
+			}
+		}
+	}
+
+	if rec, ok := s.records[key]; ok && !now.After(rec.expiresAt) {
+		return rec.record, false, nil
+	}
+	s.records[key] = &memoryIdempotencyRecord{
+		record:    IdempotencyRecord{Fingerprint: fingerprint},
+		expiresAt: now.Add(ttl),
+	}
+	return IdempotencyRecord{}, true, nil
+}
+
+// Complete implements IdempotencyStore
+func (s *MemoryIdempotencyStore) Complete(ctx context.Context, key string, resp CachedResponse, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rec, ok := s.records[key]
+	if !ok {
+		return fmt.Errorf("idempotency key has not been reserved")
+	}
+	rec.record.Response = &resp
+	rec.expiresAt = time.Now().Add(ttl)
+	return nil
+}
+
+// Release implements IdempotencyStore
+func (s *MemoryIdempotencyStore) Release(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.records, key)
+	return nil
+}
@@ -0,0 +1,242 @@
+package gopi_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/teejays/gopi"
+)
+
+func TestIdempotencyMiddleware(t *testing.T) {
+	var calls int32
+	started, release := make(chan struct{}), make(chan struct{})
+	routes := []gopi.Route{
+		{
+			Method: http.MethodPost,
+			Path:   "orders",
+			HandlerFunc: gopi.HandlerWrapper(http.MethodPost, func(ctx context.Context, req SampleReq) (SampleResp, error) {
+				n := atomic.AddInt32(&calls, 1)
+				if req.Ping == "slow" {
+					close(started)
+					<-release
+				}
+				if req.RequestErrorWithMsg != "" {
+					return SampleResp{}, fmt.Errorf("%s", req.RequestErrorWithMsg)
+				}
+				return SampleResp{Pong: fmt.Sprintf("%s %d", req.Ping, n)}, nil
+			}),
+			Authenticate: true,
+			Idempotency:  gopi.IdempotencyPolicy{TTL: time.Hour},
+		},
+		{
+			Method:       http.MethodPost,
+			Path:         "required",
+			HandlerFunc:  gopi.HandlerWrapper(http.MethodPost, SampleEndpoint),
+			Authenticate: true,
+			Idempotency:  gopi.IdempotencyPolicy{TTL: time.Hour, Required: true},
+		},
+		{
+			Method: http.MethodPost,
+			Path:   "sessions",
+			HandlerFunc: func(w http.ResponseWriter, r *http.Request) {
+				n := atomic.AddInt32(&calls, 1)
+				http.SetCookie(w, &http.Cookie{Name: "session", Value: fmt.Sprint(n)})
+				fmt.Fprintf(w, "session %d", n)
+			},
+			Authenticate: true,
+			Idempotency:  gopi.IdempotencyPolicy{TTL: time.Hour},
+		},
+	}
+	auth := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := gopi.ContextWithPrincipal(r.Context(), r.Header.Get("Authorization"))
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+	// The outer middlewares set headers that belong to each request
+	var requests atomic.Int32
+	requestID := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set(gopi.RequestIDHeader, fmt.Sprint(requests.Add(1)))
+			next.ServeHTTP(w, r)
+		})
+	}
+	h, err := gopi.GetHandler(context.TODO(), routes, gopi.MiddlewareFuncs{PreMiddlewares: []mux.MiddlewareFunc{requestID}, AuthMiddleware: auth})
+	assert.NoError(t, err)
+
+	post := func(path, key, principal, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/api/v0/"+path, strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set("Authorization", principal)
+		if key != "" {
+			r.Header.Set(gopi.IdempotencyKeyHeader, key)
+		}
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	t.Run("Replay", func(t *testing.T) {
+		w := post("orders", "key-1", "alice", `{"ping":"buy"}`)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Empty(t, w.Header().Get("Idempotent-Replayed"))
+		first := w.Body.String()
+		assert.Contains(t, first, `"buy 1"`)
+
+		w = post("orders", "key-1", "alice", `{"ping":"buy"}`)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "true", w.Header().Get("Idempotent-Replayed"))
+		assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+		assert.Equal(t, first, w.Body.String())
+		assert.Equal(t, fmt.Sprint(requests.Load()), w.Header().Get(gopi.RequestIDHeader))
+		assert.EqualValues(t, 1, atomic.LoadInt32(&calls))
+
+		// Keys are scoped to the principal
+		w = post("orders", "key-1", "bob", `{"ping":"buy"}`)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), `"buy 2"`)
+
+		// Requests without a key aren't deduplicated
+		post("orders", "", "alice", `{"ping":"buy"}`)
+		post("orders", "", "alice", `{"ping":"buy"}`)
+		assert.EqualValues(t, 4, atomic.LoadInt32(&calls))
+	})
+
+	t.Run("Key reused for another request", func(t *testing.T) {
+		w := post("orders", "key-2", "alice", `{"ping":"one"}`)
+		assert.Equal(t, http.StatusOK, w.Code)
+		w = post("orders", "key-2", "alice", `{"ping":"two"}`)
+		assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+		assert.JSONEq(t, `{"status_code":422,"data":null,"error":"`+gopi.ErrIdempotencyKeyReused.Error()+`"}`, w.Body.String())
+	})
+
+	t.Run("Body too large", func(t *testing.T) {
+		before := atomic.LoadInt32(&calls)
+		w := post("orders", "key-large", "alice", `{"ping":"`+strings.Repeat("a", 10<<20)+`"}`)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+		assert.Contains(t, w.Body.String(), gopi.ErrIdempotentBodyTooLarge.Error())
+		assert.Equal(t, before, atomic.LoadInt32(&calls))
+	})
+
+	t.Run("In flight", func(t *testing.T) {
+		done := make(chan *httptest.ResponseRecorder)
+		go func() {
+			done <- post("orders", "key-3", "alice", `{"ping":"slow"}`)
+		}()
+		<-started
+		w := post("orders", "key-3", "alice", `{"ping":"slow"}`)
+		assert.Equal(t, http.StatusConflict, w.Code)
+		assert.Equal(t, "1", w.Header().Get("Retry-After"))
+		assert.JSONEq(t, `{"status_code":409,"data":null,"error":"`+gopi.ErrIdempotencyInFlight.Error()+`"}`, w.Body.String())
+		close(release)
+		w = <-done
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, w.Body.String(), post("orders", "key-3", "alice", `{"ping":"slow"}`).Body.String())
+	})
+
+	t.Run("Server errors are not stored", func(t *testing.T) {
+		before := atomic.LoadInt32(&calls)
+		w := post("orders", "key-4", "alice", `{"ping":"fail","requestErrorWithMsg":"oops"}`)
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+		w = post("orders", "key-4", "alice", `{"ping":"fail","requestErrorWithMsg":"oops"}`)
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+		assert.Empty(t, w.Header().Get("Idempotent-Replayed"))
+		assert.EqualValues(t, before+2, atomic.LoadInt32(&calls))
+	})
+
+	t.Run("Cookies are not replayed", func(t *testing.T) {
+		w := post("sessions", "key-6", "alice", "")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.NotEmpty(t, w.Header().Get("Set-Cookie"))
+		first := w.Body.String()
+
+		w = post("sessions", "key-6", "alice", "")
+		assert.Equal(t, "true", w.Header().Get("Idempotent-Replayed"))
+		assert.Equal(t, first, w.Body.String())
+		assert.Empty(t, w.Header().Get("Set-Cookie"))
+	})
+
+	t.Run("Authenticated Without Principal", func(t *testing.T) {
+		// The AuthMiddleware checks the token, but doesn't set a Principal, so the keys can't be scoped to the clients
+		checkOnly := func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("Authorization") == "" {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				next.ServeHTTP(w, r)
+			})
+		}
+		h, err := gopi.GetHandler(context.TODO(), routes, gopi.MiddlewareFuncs{AuthMiddleware: checkOnly})
+		if !assert.NoError(t, err) {
+			return
+		}
+		before := atomic.LoadInt32(&calls)
+		for _, token := range []string{"alice", "bob"} {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/api/v0/orders", strings.NewReader(`{"ping":"buy"}`))
+			r.Header.Set("Content-Type", "application/json")
+			r.Header.Set("Authorization", token)
+			r.Header.Set(gopi.IdempotencyKeyHeader, "key-7")
+			h.ServeHTTP(w, r)
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Empty(t, w.Header().Get("Idempotent-Replayed"))
+		}
+		assert.EqualValues(t, before+2, atomic.LoadInt32(&calls))
+	})
+
+	t.Run("Required", func(t *testing.T) {
+		w := post("required", "", "alice", `{"ping":"hello"}`)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.JSONEq(t, `{"status_code":400,"data":null,"error":"`+gopi.ErrIdempotencyKeyRequired.Error()+`"}`, w.Body.String())
+
+		w = post("required", strings.Repeat("k", 256), "alice", `{"ping":"hello"}`)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+
+		w = post("required", "key-5", "alice", `{"ping":"hello"}`)
+		assert.Equal(t, http.StatusOK, w.Code)
+	})
+}
+
+func TestMemoryIdempotencyStore(t *testing.T) {
+	ctx := context.Background()
+	s := gopi.NewMemoryIdempotencyStore()
+
+	_, reserved, err := s.Reserve(ctx, "key", "fingerprint", time.Hour)
+	assert.NoError(t, err)
+	assert.True(t, reserved)
+
+	rec, reserved, err := s.Reserve(ctx, "key", "fingerprint", time.Hour)
+	assert.NoError(t, err)
+	assert.False(t, reserved)
+	assert.Equal(t, "fingerprint", rec.Fingerprint)
+	assert.Nil(t, rec.Response)
+
+	assert.NoError(t, s.Complete(ctx, "key", gopi.CachedResponse{StatusCode: http.StatusCreated}, time.Hour))
+	rec, _, _ = s.Reserve(ctx, "key", "fingerprint", time.Hour)
+	if assert.NotNil(t, rec.Response) {
+		assert.Equal(t, http.StatusCreated, rec.Response.StatusCode)
+	}
+
+	assert.NoError(t, s.Release(ctx, "key"))
+	_, reserved, _ = s.Reserve(ctx, "key", "other", time.Hour)
+	assert.True(t, reserved)
+
+	// Expired keys can be reused
+	_, reserved, _ = s.Reserve(ctx, "short", "fingerprint", time.Nanosecond)
+	assert.True(t, reserved)
+	time.Sleep(time.Millisecond)
+	_, reserved, _ = s.Reserve(ctx, "short", "fingerprint", time.Hour)
+	assert.True(t, reserved)
+
+	assert.Error(t, s.Complete(ctx, "missing", gopi.CachedResponse{}, time.Hour))
+}
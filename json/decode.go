@@ -0,0 +1,826 @@
+package json
+
+import (
+	"encoding"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// decodeState holds the input and settings while unmarshaling a value. The input has already been checked to be valid
+// JSON, so the decoder doesn't need to deal with syntax errors.
+type decodeState struct {
+	data   []byte
+	off    int
+	kt     *keyTransform
+	strict bool
+
+	// errorContext is the struct and field currently being decoded, to add to UnmarshalTypeErrors
+	errorContext struct {
+		Struct     reflect.Type
+		FieldStack []string
+	}
+	savedError error
+}
+
+var textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+
+// unmarshal decodes data into the value pointed to by v
+func unmarshal(data []byte, v interface{}, kt *keyTransform, strict bool) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return &json.InvalidUnmarshalError{Type: reflect.TypeOf(v)}
+	}
+	if !json.Valid(data) {
+		// Let encoding/json describe what is wrong with the input
+		var discard interface{}
+		return json.Unmarshal(data, &discard)
+	}
+
+	d := decodeState{data: data, kt: kt, strict: strict}
+	d.skipWhitespace()
+	err := d.value(rv)
+	if err != nil {
+		return d.addErrorContext(err)
+	}
+	return d.savedError
+}
+
+// saveError saves the first err it is called with, for reporting at the end of the unmarshal
+func (d *decodeState) saveError(err error) {
+	if d.savedError == nil {
+		d.savedError = d.addErrorContext(err)
+	}
+}
+
+// addErrorContext returns a new error enhanced with information from d.errorContext
+func (d *decodeState) addErrorContext(err error) error {
+	if d.errorContext.Struct != nil || len(d.errorContext.FieldStack) > 0 {
+		switch err := err.(type) {
+		case *json.UnmarshalTypeError:
+			err.Struct = d.errorContext.Struct.Name()
+			err.Field = strings.Join(d.errorContext.FieldStack, ".")
+		}
+	}
+	return err
+}
+
+func (d *decodeState) skipWhitespace() {
+	for d.off < len(d.data) {
+		switch d.data[d.off] {
+		case ' ', '\t', '\r', '\n':
+			d.off++
+		default:
+			return
+		}
+	}
+}
+
+// skipValue skips over the value at the current offset and returns it
+func (d *decodeState) skipValue() []byte {
+	start := d.off
+	depth := 0
+	for d.off < len(d.data) {
+		switch c := d.data[d.off]; c {
+		case '"':
+			d.skipString()
+			if depth == 0 {
+				return d.data[start:d.off]
+			}
+			continue
+		case '{', '[':
+			depth++
+		case '}', ']':
+			if depth == 0 {
+				// The end of the enclosing object or array
+				return d.data[start:d.off]
+			}
+			depth--
+			if depth == 0 {
+				d.off++
+				return d.data[start:d.off]
+			}
+		case ' ', '\t', '\r', '\n', ',', ':':
+			if depth == 0 {
+				return d.data[start:d.off]
+			}
+		}
+		d.off++
+	}
+	return d.data[start:d.off]
+}
+
+// skipString skips over the string starting at the current offset
+func (d *decodeState) skipString() {
+	d.off++ // opening quote
+	for d.off < len(d.data) {
+		switch d.data[d.off] {
+		case '\\':
+			d.off += 2
+			continue
+		case '"':
+			d.off++
+			return
+		}
+		d.off++
+	}
+}
+
+// value decodes the value at the current offset into v. If v is invalid, the value is skipped.
+func (d *decodeState) value(v reflect.Value) error {
+	if !v.IsValid() {
+		d.skipValue()
+		return nil
+	}
+	switch d.data[d.off] {
+	case '{':
+		return d.object(v)
+	case '[':
+		return d.array(v)
+	default:
+		return d.literalStore(d.skipValue(), v, false)
+	}
+}
+
+// indirect walks down v allocating pointers as needed, until it gets to a non-pointer. If it encounters an Unmarshaler
+// or TextUnmarshaler along the way, it stops and returns that. If decodingNull is true, indirect stops at the first
+// settable pointer so it can be set to nil.
+func indirect(v reflect.Value, decodingNull bool) (json.Unmarshaler, encoding.TextUnmarshaler, reflect.Value) {
+	v0 := v
+	haveAddr := false
+
+	// If v is a named type and is addressable, start with its address, so that if the type has pointer methods, we
+	// find them
+	if v.Kind() != reflect.Ptr && v.Type().Name() != "" && v.CanAddr() {
+		haveAddr = true
+		v = v.Addr()
+	}
+	for {
+		// Load value from interface, but only if the result will be usefully addressable
+		if v.Kind() == reflect.Interface && !v.IsNil() {
+			e := v.Elem()
+			if e.Kind() == reflect.Ptr && !e.IsNil() && (!decodingNull || e.Elem().Kind() == reflect.Ptr) {
+				haveAddr = false
+				v = e
+				continue
+			}
+		}
+
+		if v.Kind() != reflect.Ptr {
+			break
+		}
+
+		if decodingNull && v.CanSet() {
+			break
+		}
+
+		// Prevent infinite loop if v is an interface pointing to its own address
+		if v.Elem().Kind() == reflect.Interface && v.Elem().Elem() == v {
+			v = v.Elem()
+			break
+		}
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		if v.Type().NumMethod() > 0 && v.CanInterface() {
+			if u, ok := v.Interface().(json.Unmarshaler); ok {
+				return u, nil, reflect.Value{}
+			}
+			if !decodingNull {
+				if u, ok := v.Interface().(encoding.TextUnmarshaler); ok {
+					return nil, u, reflect.Value{}
+				}
+			}
+		}
+
+		if haveAddr {
+			v = v0 // restore original value after round-trip Value.Addr().Elem()
+			haveAddr = false
+		} else {
+			v = v.Elem()
+		}
+	}
+	return nil, nil, v
+}
+
+// callUnmarshaler passes the value at the current offset to u. Its keys are transformed first, since u will match them
+// to the Go names itself.
+func (d *decodeState) callUnmarshaler(u json.Unmarshaler) error {
+	item := d.skipValue()
+	if d.kt.unmarshal != nil && (item[0] == '{' || item[0] == '[') {
+		item = replaceKeys(item, d.kt.unmarshalKey)
+	}
+	return u.UnmarshalJSON(item)
+}
+
+// object decodes the object at the current offset into v
+func (d *decodeState) object(v reflect.Value) error {
+	u, ut, pv := indirect(v, false)
+	if u != nil {
+		return d.callUnmarshaler(u)
+	}
+	if ut != nil {
+		d.saveError(&json.UnmarshalTypeError{Value: "object", Type: v.Type(), Offset: int64(d.off)})
+		d.skipValue()
+		return nil
+	}
+	v = pv
+	t := v.Type()
+
+	// Decoding into nil interface? Switch to non-reflect code.
+	if v.Kind() == reflect.Interface && v.NumMethod() == 0 {
+		oi, err := d.objectInterface()
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(oi))
+		return nil
+	}
+
+	var fields *structFields
+
+	// Check type of target: a struct, or a map with string, integer or TextUnmarshaler keys
+	switch v.Kind() {
+	case reflect.Map:
+		switch t.Key().Kind() {
+		case reflect.String,
+			reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		default:
+			if !reflect.PointerTo(t.Key()).Implements(textUnmarshalerType) {
+				d.saveError(&json.UnmarshalTypeError{Value: "object", Type: t, Offset: int64(d.off)})
+				d.skipValue()
+				return nil
+			}
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(t))
+		}
+	case reflect.Struct:
+		fields = cachedStructFields(t, d.kt)
+	default:
+		d.saveError(&json.UnmarshalTypeError{Value: "object", Type: t, Offset: int64(d.off)})
+		d.skipValue()
+		return nil
+	}
+
+	var mapElem reflect.Value
+	var seen map[string]struct{}
+	origErrorContext := d.errorContext
+
+	d.off++ // opening brace
+	d.skipWhitespace()
+	if d.data[d.off] == '}' {
+		d.off++
+		return nil
+	}
+	for {
+		// Read the key
+		start := d.off
+		key, err := d.literalString(d.skipValue())
+		if err != nil {
+			return err
+		}
+		d.skipWhitespace()
+		d.off++ // colon
+		d.skipWhitespace()
+
+		if v.Kind() == reflect.Map {
+			// Decode into a fresh element, since map elements aren't addressable
+			elemType := t.Elem()
+			if !mapElem.IsValid() {
+				mapElem = reflect.New(elemType).Elem()
+			} else {
+				mapElem.SetZero()
+			}
+			err := d.value(mapElem)
+			if err != nil {
+				return err
+			}
+
+			err = d.checkDuplicate(&seen, key, d.kt.unmarshalKey(key))
+			if err != nil {
+				return err
+			}
+			key = d.kt.unmarshalKey(key)
+			kt := t.Key()
+			var kv reflect.Value
+			if reflect.PointerTo(kt).Implements(textUnmarshalerType) {
+				kv = reflect.New(kt)
+				err := d.literalStore(appendString(nil, key, false), kv, true)
+				if err != nil {
+					return err
+				}
+				kv = kv.Elem()
+			} else {
+				switch kt.Kind() {
+				case reflect.String:
+					kv = reflect.New(kt).Elem()
+					kv.SetString(key)
+				case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+					n, err := strconv.ParseInt(key, 10, 64)
+					kv = reflect.New(kt).Elem()
+					if err != nil || kv.OverflowInt(n) {
+						d.saveError(&json.UnmarshalTypeError{Value: "number " + key, Type: kt, Offset: int64(start + 1)})
+						kv = reflect.Value{}
+						break
+					}
+					kv.SetInt(n)
+				case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+					n, err := strconv.ParseUint(key, 10, 64)
+					kv = reflect.New(kt).Elem()
+					if err != nil || kv.OverflowUint(n) {
+						d.saveError(&json.UnmarshalTypeError{Value: "number " + key, Type: kt, Offset: int64(start + 1)})
+						kv = reflect.Value{}
+						break
+					}
+					kv.SetUint(n)
+				}
+			}
+			if kv.IsValid() {
+				v.SetMapIndex(kv, mapElem)
+			}
+		} else {
+			// Figure out the field corresponding to the key
+			var subv reflect.Value
+			var quoted bool
+			f := fields.lookup(key, d.kt)
+			decoded := key
+			if f != nil {
+				decoded = f.key
+			}
+			err := d.checkDuplicate(&seen, key, decoded)
+			if err != nil {
+				return err
+			}
+			if f != nil {
+				subv = v
+				quoted = f.quoted
+				for _, i := range f.index {
+					if subv.Kind() == reflect.Ptr {
+						if subv.IsNil() {
+							// If a struct embeds a pointer to an unexported type, it is not possible to set a newly
+							// allocated value since the field is unexported
+							if !subv.CanSet() {
+								d.saveError(fmt.Errorf("json: cannot set embedded pointer to unexported struct: %v", subv.Type().Elem()))
+								subv = reflect.Value{}
+								quoted = false
+								break
+							}
+							subv.Set(reflect.New(subv.Type().Elem()))
+						}
+						subv = subv.Elem()
+					}
+					subv = subv.Field(i)
+				}
+				d.errorContext.FieldStack = append(d.errorContext.FieldStack, f.name)
+				d.errorContext.Struct = t
+			} else if d.strict {
+				d.saveError(fmt.Errorf("json: unknown field %q", key))
+			}
+
+			if quoted {
+				err = d.quotedValue(subv)
+			} else {
+				err = d.value(subv)
+			}
+			if err != nil {
+				return err
+			}
+			// Reset errorContext to its original state. Keep the same underlying array for FieldStack, to reuse its
+			// memory and keep it from growing.
+			d.errorContext.FieldStack = d.errorContext.FieldStack[:len(origErrorContext.FieldStack)]
+			d.errorContext.Struct = origErrorContext.Struct
+		}
+
+		d.skipWhitespace()
+		c := d.data[d.off]
+		d.off++
+		if c == '}' {
+			return nil
+		}
+		d.skipWhitespace()
+	}
+}
+
+// quotedValue decodes the value at the current offset, which should be a JSON string holding a literal, into v. It is
+// used for fields with the `string` tag option.
+func (d *decodeState) quotedValue(v reflect.Value) error {
+	item := d.skipValue()
+	switch item[0] {
+	case 'n':
+		return d.literalStore(item, v, false)
+	case '"':
+		s, err := d.literalString(item)
+		if err != nil {
+			return err
+		}
+		return d.literalStore([]byte(s), v, true)
+	default:
+		d.saveError(fmt.Errorf("json: invalid use of ,string struct tag, trying to unmarshal unquoted value into %v", v.Type()))
+		return nil
+	}
+}
+
+// array decodes the array at the current offset into v
+func (d *decodeState) array(v reflect.Value) error {
+	u, ut, pv := indirect(v, false)
+	if u != nil {
+		return d.callUnmarshaler(u)
+	}
+	if ut != nil {
+		d.saveError(&json.UnmarshalTypeError{Value: "array", Type: v.Type(), Offset: int64(d.off)})
+		d.skipValue()
+		return nil
+	}
+	v = pv
+
+	// Check type of target
+	switch v.Kind() {
+	case reflect.Interface:
+		if v.NumMethod() == 0 {
+			// Decoding into nil interface? Switch to non-reflect code.
+			ai, err := d.arrayInterface()
+			if err != nil {
+				return err
+			}
+			v.Set(reflect.ValueOf(ai))
+			return nil
+		}
+		// Otherwise it's invalid
+		fallthrough
+	default:
+		d.saveError(&json.UnmarshalTypeError{Value: "array", Type: v.Type(), Offset: int64(d.off)})
+		d.skipValue()
+		return nil
+	case reflect.Array, reflect.Slice:
+	}
+
+	d.off++ // opening bracket
+	d.skipWhitespace()
+	i := 0
+	if d.data[d.off] == ']' {
+		d.off++
+	} else {
+		for {
+			// Expand slice length, growing the slice if necessary
+			if v.Kind() == reflect.Slice {
+				if i >= v.Cap() {
+					v.Grow(1)
+				}
+				if i >= v.Len() {
+					v.SetLen(i + 1)
+				}
+			}
+
+			var err error
+			if i < v.Len() {
+				// Decode into element
+				err = d.value(v.Index(i))
+			} else {
+				// Ran out of fixed array: skip
+				err = d.value(reflect.Value{})
+			}
+			if err != nil {
+				return err
+			}
+			i++
+
+			d.skipWhitespace()
+			c := d.data[d.off]
+			d.off++
+			if c == ']' {
+				break
+			}
+			d.skipWhitespace()
+		}
+	}
+
+	if i < v.Len() {
+		if v.Kind() == reflect.Array {
+			for ; i < v.Len(); i++ {
+				v.Index(i).SetZero() // zero remainder of array
+			}
+		} else {
+			v.SetLen(i) // truncate the slice
+		}
+	}
+	if i == 0 && v.Kind() == reflect.Slice {
+		v.Set(reflect.MakeSlice(v.Type(), 0, 0))
+	}
+	return nil
+}
+
+// literalStore decodes the literal item into v. fromQuoted indicates whether item came from a string with the `string`
+// tag option.
+func (d *decodeState) literalStore(item []byte, v reflect.Value, fromQuoted bool) error {
+	if len(item) == 0 {
+		// Empty string given
+		d.saveError(fmt.Errorf("json: invalid use of ,string struct tag, trying to unmarshal %q into %v", item, v.Type()))
+		return nil
+	}
+	isNull := item[0] == 'n' // null
+	u, ut, pv := indirect(v, isNull)
+	if u != nil {
+		return u.UnmarshalJSON(item)
+	}
+	if ut != nil {
+		if item[0] != '"' {
+			if fromQuoted {
+				d.saveError(fmt.Errorf("json: invalid use of ,string struct tag, trying to unmarshal %q into %v", item, v.Type()))
+				return nil
+			}
+			val := "number"
+			switch item[0] {
+			case 'n':
+				val = "null"
+			case 't', 'f':
+				val = "bool"
+			}
+			d.saveError(&json.UnmarshalTypeError{Value: val, Type: v.Type(), Offset: int64(d.off)})
+			return nil
+		}
+		s, err := d.literalString(item)
+		if err != nil {
+			if fromQuoted {
+				return fmt.Errorf("json: invalid use of ,string struct tag, trying to unmarshal %q into %v", item, v.Type())
+			}
+			return err
+		}
+		return ut.UnmarshalText([]byte(s))
+	}
+
+	v = pv
+
+	switch c := item[0]; c {
+	case 'n': // null
+		// The main parser checks that only true and false can reach here, but if this was a quoted string input, it
+		// could be anything
+		if fromQuoted && string(item) != "null" {
+			d.saveError(fmt.Errorf("json: invalid use of ,string struct tag, trying to unmarshal %q into %v", item, v.Type()))
+			break
+		}
+		switch v.Kind() {
+		case reflect.Interface, reflect.Ptr, reflect.Map, reflect.Slice:
+			v.SetZero()
+			// otherwise, ignore null for primitives/string
+		}
+	case 't', 'f': // true, false
+		value := item[0] == 't'
+		if fromQuoted && string(item) != "true" && string(item) != "false" {
+			d.saveError(fmt.Errorf("json: invalid use of ,string struct tag, trying to unmarshal %q into %v", item, v.Type()))
+			break
+		}
+		switch v.Kind() {
+		default:
+			if fromQuoted {
+				d.saveError(fmt.Errorf("json: invalid use of ,string struct tag, trying to unmarshal %q into %v", item, v.Type()))
+			} else {
+				d.saveError(&json.UnmarshalTypeError{Value: "bool", Type: v.Type(), Offset: int64(d.off)})
+			}
+		case reflect.Bool:
+			v.SetBool(value)
+		case reflect.Interface:
+			if v.NumMethod() == 0 {
+				v.Set(reflect.ValueOf(value))
+			} else {
+				d.saveError(&json.UnmarshalTypeError{Value: "bool", Type: v.Type(), Offset: int64(d.off)})
+			}
+		}
+
+	case '"': // string
+		s, err := d.literalString(item)
+		if err != nil {
+			if fromQuoted {
+				return fmt.Errorf("json: invalid use of ,string struct tag, trying to unmarshal %q into %v", item, v.Type())
+			}
+			return err
+		}
+		switch v.Kind() {
+		default:
+			d.saveError(&json.UnmarshalTypeError{Value: "string", Type: v.Type(), Offset: int64(d.off)})
+		case reflect.Slice:
+			if v.Type().Elem().Kind() != reflect.Uint8 {
+				d.saveError(&json.UnmarshalTypeError{Value: "string", Type: v.Type(), Offset: int64(d.off)})
+				break
+			}
+			b, err := base64.StdEncoding.DecodeString(s)
+			if err != nil {
+				d.saveError(err)
+				break
+			}
+			v.SetBytes(b)
+		case reflect.String:
+			if v.Type() == numberType && !isValidNumber(s) {
+				return fmt.Errorf("json: invalid number literal, trying to unmarshal %q into Number", item)
+			}
+			v.SetString(s)
+		case reflect.Interface:
+			if v.NumMethod() == 0 {
+				v.Set(reflect.ValueOf(s))
+			} else {
+				d.saveError(&json.UnmarshalTypeError{Value: "string", Type: v.Type(), Offset: int64(d.off)})
+			}
+		}
+
+	default: // number
+		if c != '-' && (c < '0' || c > '9') {
+			return fmt.Errorf("json: invalid use of ,string struct tag, trying to unmarshal %q into %v", item, v.Type())
+		}
+		s := string(item)
+		if fromQuoted && !isValidNumber(s) {
+			return fmt.Errorf("json: invalid use of ,string struct tag, trying to unmarshal %q into %v", item, v.Type())
+		}
+		switch v.Kind() {
+		default:
+			if v.Kind() == reflect.String && v.Type() == numberType {
+				// s must be a valid number, because it's already been tokenized
+				v.SetString(s)
+				break
+			}
+			if fromQuoted {
+				return fmt.Errorf("json: invalid use of ,string struct tag, trying to unmarshal %q into %v", item, v.Type())
+			}
+			d.saveError(&json.UnmarshalTypeError{Value: "number", Type: v.Type(), Offset: int64(d.off)})
+		case reflect.Interface:
+			n, err := strconv.ParseFloat(s, 64)
+			if err != nil {
+				d.saveError(&json.UnmarshalTypeError{Value: "number " + s, Type: reflect.TypeOf(0.0), Offset: int64(d.off)})
+				break
+			}
+			if v.NumMethod() != 0 {
+				d.saveError(&json.UnmarshalTypeError{Value: "number", Type: v.Type(), Offset: int64(d.off)})
+				break
+			}
+			v.Set(reflect.ValueOf(n))
+
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			n, err := strconv.ParseInt(s, 10, 64)
+			if err != nil || v.OverflowInt(n) {
+				d.saveError(&json.UnmarshalTypeError{Value: "number " + s, Type: v.Type(), Offset: int64(d.off)})
+				break
+			}
+			v.SetInt(n)
+
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			n, err := strconv.ParseUint(s, 10, 64)
+			if err != nil || v.OverflowUint(n) {
+				d.saveError(&json.UnmarshalTypeError{Value: "number " + s, Type: v.Type(), Offset: int64(d.off)})
+				break
+			}
+			v.SetUint(n)
+
+		case reflect.Float32, reflect.Float64:
+			n, err := strconv.ParseFloat(s, v.Type().Bits())
+			if err != nil || v.OverflowFloat(n) {
+				d.saveError(&json.UnmarshalTypeError{Value: "number " + s, Type: v.Type(), Offset: int64(d.off)})
+				break
+			}
+			v.SetFloat(n)
+		}
+	}
+	return nil
+}
+
+// literalString returns the string value of the JSON string item
+func (d *decodeState) literalString(item []byte) (string, error) {
+	if len(item) < 2 || item[0] != '"' || item[len(item)-1] != '"' {
+		return "", fmt.Errorf("json: invalid string literal %q", item)
+	}
+	s := item[1 : len(item)-1]
+	// Most strings have no escape sequences, so they can be used as they are
+	simple := utf8.Valid(s)
+	for i := 0; simple && i < len(s); i++ {
+		if s[i] == '\\' || s[i] < 0x20 {
+			simple = false
+		}
+	}
+	if simple {
+		return string(s), nil
+	}
+	var str string
+	err := json.Unmarshal(item, &str)
+	return str, err
+}
+
+// The xxxInterface routines build up a value to be stored in an empty interface. They are not strictly necessary, but
+// they avoid the weight of reflection in this common case.
+
+// valueInterface returns the value at the current offset as an interface{}
+func (d *decodeState) valueInterface() (interface{}, error) {
+	switch d.data[d.off] {
+	case '{':
+		return d.objectInterface()
+	case '[':
+		return d.arrayInterface()
+	default:
+		return d.literalInterface(d.skipValue())
+	}
+}
+
+// checkDuplicate returns an error in strict mode if an object has two keys that decode to the same one, i.e. that
+// are the same after the key transform (e.g. user_id and userId) or that set the same struct field. seen holds the
+// keys decoded so far, and key is the key as found in the data.
+func (d *decodeState) checkDuplicate(seen *map[string]struct{}, key, decoded string) error {
+	if !d.strict {
+		return nil
+	}
+	if *seen == nil {
+		*seen = map[string]struct{}{}
+	}
+	if _, ok := (*seen)[decoded]; ok {
+		return fmt.Errorf("json: duplicate key %q", key)
+	}
+	(*seen)[decoded] = struct{}{}
+	return nil
+}
+
+// objectInterface is like object but returns map[string]interface{}
+func (d *decodeState) objectInterface() (map[string]interface{}, error) {
+	m := make(map[string]interface{})
+	var seen map[string]struct{}
+
+	d.off++ // opening brace
+	d.skipWhitespace()
+	if d.data[d.off] == '}' {
+		d.off++
+		return m, nil
+	}
+	for {
+		key, err := d.literalString(d.skipValue())
+		if err != nil {
+			return nil, err
+		}
+		err = d.checkDuplicate(&seen, key, d.kt.unmarshalKey(key))
+		if err != nil {
+			return nil, err
+		}
+		d.skipWhitespace()
+		d.off++ // colon
+		d.skipWhitespace()
+
+		val, err := d.valueInterface()
+		if err != nil {
+			return nil, err
+		}
+		m[d.kt.unmarshalKey(key)] = val
+
+		d.skipWhitespace()
+		c := d.data[d.off]
+		d.off++
+		if c == '}' {
+			return m, nil
+		}
+		d.skipWhitespace()
+	}
+}
+
+// arrayInterface is like array but returns []interface{}
+func (d *decodeState) arrayInterface() ([]interface{}, error) {
+	var v = make([]interface{}, 0)
+
+	d.off++ // opening bracket
+	d.skipWhitespace()
+	if d.data[d.off] == ']' {
+		d.off++
+		return v, nil
+	}
+	for {
+		val, err := d.valueInterface()
+		if err != nil {
+			return nil, err
+		}
+		v = append(v, val)
+
+		d.skipWhitespace()
+		c := d.data[d.off]
+		d.off++
+		if c == ']' {
+			return v, nil
+		}
+		d.skipWhitespace()
+	}
+}
+
+// literalInterface is like literalStore but returns an interface{}
+func (d *decodeState) literalInterface(item []byte) (interface{}, error) {
+	switch c := item[0]; c {
+	case 'n': // null
+		return nil, nil
+	case 't', 'f': // true, false
+		return c == 't', nil
+	case '"': // string
+		return d.literalString(item)
+	default: // number
+		n, err := strconv.ParseFloat(string(item), 64)
+		if err != nil {
+			d.saveError(&json.UnmarshalTypeError{Value: "number " + string(item), Type: reflect.TypeOf(0.0), Offset: int64(d.off)})
+			return nil, nil
+		}
+		return n, nil
+	}
+}
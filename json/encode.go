@@ -0,0 +1,705 @@
+package json
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"unicode/utf8"
+)
+
+// encodeState holds the output buffer and settings while marshaling a value
+type encodeState struct {
+	buf      []byte
+	kt       *keyTransform
+	ptrLevel uint
+}
+
+var encodeStatePool sync.Pool
+
+func newEncodeState(kt *keyTransform) *encodeState {
+	if v := encodeStatePool.Get(); v != nil {
+		e := v.(*encodeState)
+		e.buf = e.buf[:0]
+		e.kt = kt
+		e.ptrLevel = 0
+		return e
+	}
+	return &encodeState{buf: make([]byte, 0, 1024), kt: kt}
+}
+
+func (e *encodeState) release() {
+	// Don't hold on to very large buffers
+	if cap(e.buf) > 1<<20 {
+		return
+	}
+	encodeStatePool.Put(e)
+}
+
+// encodeError is used to unwind the encoding with an error, which is recovered in marshal
+type encodeError struct{ error }
+
+func (e *encodeState) fail(err error) {
+	panic(encodeError{err})
+}
+
+// marshal encodes v into e.buf
+func (e *encodeState) marshal(v interface{}) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if ee, ok := r.(encodeError); ok {
+				err = ee.error
+				return
+			}
+			panic(r)
+		}
+	}()
+	e.reflectValue(reflect.ValueOf(v), encOpts{})
+	return nil
+}
+
+func (e *encodeState) reflectValue(v reflect.Value, opts encOpts) {
+	if !v.IsValid() {
+		e.buf = append(e.buf, "null"...)
+		return
+	}
+	typeEncoder(v.Type(), e.kt)(e, v, opts)
+}
+
+type encOpts struct {
+	// quoted causes primitive fields to be encoded inside JSON strings
+	quoted bool
+}
+
+type encoderFunc func(e *encodeState, v reflect.Value, opts encOpts)
+
+type encoderKey struct {
+	t  reflect.Type
+	kt *keyTransform
+}
+
+var encoderCache sync.Map // map[encoderKey]encoderFunc
+
+// typeEncoder returns the cached encoderFunc for the type t and key transform kt
+func typeEncoder(t reflect.Type, kt *keyTransform) encoderFunc {
+	key := encoderKey{t, kt}
+	if fi, ok := encoderCache.Load(key); ok {
+		return fi.(encoderFunc)
+	}
+
+	// To deal with recursive types, populate the cache with an indirect func before we build it. This type waits on
+	// the real func (f) to be ready and then calls it. This indirect func is only used for recursive types.
+	var (
+		wg sync.WaitGroup
+		f  encoderFunc
+	)
+	wg.Add(1)
+	fi, loaded := encoderCache.LoadOrStore(key, encoderFunc(func(e *encodeState, v reflect.Value, opts encOpts) {
+		wg.Wait()
+		f(e, v, opts)
+	}))
+	if loaded {
+		return fi.(encoderFunc)
+	}
+
+	// Compute the real encoder and replace the indirect func with it
+	f = newTypeEncoder(t, kt, true)
+	wg.Done()
+	encoderCache.Store(key, f)
+	return f
+}
+
+var (
+	marshalerType     = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	numberType        = reflect.TypeOf(json.Number(""))
+)
+
+// newTypeEncoder constructs an encoderFunc for a type. The returned encoder only checks CanAddr when allowAddr is true.
+func newTypeEncoder(t reflect.Type, kt *keyTransform, allowAddr bool) encoderFunc {
+	// If we have a non-pointer value whose type implements Marshaler with a value receiver, then we're better off
+	// taking the address of the value - otherwise we end up with an allocation as we cast the value to an interface.
+	if t.Kind() != reflect.Ptr && allowAddr && reflect.PointerTo(t).Implements(marshalerType) {
+		return newCondAddrEncoder(addrMarshalerEncoder, newTypeEncoder(t, kt, false))
+	}
+	if t.Implements(marshalerType) {
+		return marshalerEncoder
+	}
+	if t.Kind() != reflect.Ptr && allowAddr && reflect.PointerTo(t).Implements(textMarshalerType) {
+		return newCondAddrEncoder(addrTextMarshalerEncoder, newTypeEncoder(t, kt, false))
+	}
+	if t.Implements(textMarshalerType) {
+		return textMarshalerEncoder
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return boolEncoder
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return intEncoder
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return uintEncoder
+	case reflect.Float32:
+		return float32Encoder
+	case reflect.Float64:
+		return float64Encoder
+	case reflect.String:
+		return stringEncoder
+	case reflect.Interface:
+		return interfaceEncoder
+	case reflect.Struct:
+		return newStructEncoder(t, kt)
+	case reflect.Map:
+		return newMapEncoder(t, kt)
+	case reflect.Slice:
+		return newSliceEncoder(t, kt)
+	case reflect.Array:
+		return newArrayEncoder(t, kt)
+	case reflect.Ptr:
+		return newPtrEncoder(t, kt)
+	default:
+		return unsupportedTypeEncoder
+	}
+}
+
+func unsupportedTypeEncoder(e *encodeState, v reflect.Value, _ encOpts) {
+	e.fail(&json.UnsupportedTypeError{Type: v.Type()})
+}
+
+func marshalerEncoder(e *encodeState, v reflect.Value, opts encOpts) {
+	if v.Kind() == reflect.Ptr && v.IsNil() {
+		e.buf = append(e.buf, "null"...)
+		return
+	}
+	m, ok := v.Interface().(json.Marshaler)
+	if !ok {
+		e.buf = append(e.buf, "null"...)
+		return
+	}
+	e.appendMarshalerOutput(v.Type(), m)
+}
+
+func addrMarshalerEncoder(e *encodeState, v reflect.Value, _ encOpts) {
+	va := v.Addr()
+	if va.IsNil() {
+		e.buf = append(e.buf, "null"...)
+		return
+	}
+	e.appendMarshalerOutput(v.Type(), va.Interface().(json.Marshaler))
+}
+
+// appendMarshalerOutput calls m.MarshalJSON and appends its (compacted) output. Since we don't know the keys of the
+// output in advance, the key transform is applied to it after the fact.
+func (e *encodeState) appendMarshalerOutput(t reflect.Type, m json.Marshaler) {
+	b, err := m.MarshalJSON()
+	if err != nil {
+		e.fail(&json.MarshalerError{Type: t, Err: err})
+	}
+	var compacted bytes.Buffer
+	err = json.Compact(&compacted, b)
+	if err != nil {
+		e.fail(&json.MarshalerError{Type: t, Err: err})
+	}
+	b = compacted.Bytes()
+	if e.kt.marshal != nil && bytes.IndexByte(b, '{') >= 0 {
+		b = replaceKeys(b, e.kt.marshalKey)
+	}
+	var escaped bytes.Buffer
+	json.HTMLEscape(&escaped, b)
+	e.buf = append(e.buf, escaped.Bytes()...)
+}
+
+func textMarshalerEncoder(e *encodeState, v reflect.Value, _ encOpts) {
+	if v.Kind() == reflect.Ptr && v.IsNil() {
+		e.buf = append(e.buf, "null"...)
+		return
+	}
+	m, ok := v.Interface().(encoding.TextMarshaler)
+	if !ok {
+		e.buf = append(e.buf, "null"...)
+		return
+	}
+	b, err := m.MarshalText()
+	if err != nil {
+		e.fail(&json.MarshalerError{Type: v.Type(), Err: err})
+	}
+	e.buf = appendString(e.buf, string(b), true)
+}
+
+func addrTextMarshalerEncoder(e *encodeState, v reflect.Value, _ encOpts) {
+	va := v.Addr()
+	if va.IsNil() {
+		e.buf = append(e.buf, "null"...)
+		return
+	}
+	m := va.Interface().(encoding.TextMarshaler)
+	b, err := m.MarshalText()
+	if err != nil {
+		e.fail(&json.MarshalerError{Type: v.Type(), Err: err})
+	}
+	e.buf = appendString(e.buf, string(b), true)
+}
+
+func boolEncoder(e *encodeState, v reflect.Value, opts encOpts) {
+	if opts.quoted {
+		e.buf = append(e.buf, '"')
+	}
+	e.buf = strconv.AppendBool(e.buf, v.Bool())
+	if opts.quoted {
+		e.buf = append(e.buf, '"')
+	}
+}
+
+func intEncoder(e *encodeState, v reflect.Value, opts encOpts) {
+	if opts.quoted {
+		e.buf = append(e.buf, '"')
+	}
+	e.buf = strconv.AppendInt(e.buf, v.Int(), 10)
+	if opts.quoted {
+		e.buf = append(e.buf, '"')
+	}
+}
+
+func uintEncoder(e *encodeState, v reflect.Value, opts encOpts) {
+	if opts.quoted {
+		e.buf = append(e.buf, '"')
+	}
+	e.buf = strconv.AppendUint(e.buf, v.Uint(), 10)
+	if opts.quoted {
+		e.buf = append(e.buf, '"')
+	}
+}
+
+type floatEncoder int // number of bits
+
+var (
+	float32Encoder = (floatEncoder(32)).encode
+	float64Encoder = (floatEncoder(64)).encode
+)
+
+func (bits floatEncoder) encode(e *encodeState, v reflect.Value, opts encOpts) {
+	f := v.Float()
+	if math.IsInf(f, 0) || math.IsNaN(f) {
+		e.fail(&json.UnsupportedValueError{Value: v, Str: strconv.FormatFloat(f, 'g', -1, int(bits))})
+	}
+
+	// Convert as if by ES6 number to string conversion. This matches most other JSON generators (and encoding/json).
+	b := e.buf
+	if opts.quoted {
+		b = append(b, '"')
+	}
+	abs := math.Abs(f)
+	fmt := byte('f')
+	if abs != 0 {
+		if bits == 64 && (abs < 1e-6 || abs >= 1e21) || bits == 32 && (float32(abs) < 1e-6 || float32(abs) >= 1e21) {
+			fmt = 'e'
+		}
+	}
+	b = strconv.AppendFloat(b, f, fmt, -1, int(bits))
+	if fmt == 'e' {
+		// clean up e-09 to e-9
+		n := len(b)
+		if n >= 4 && b[n-4] == 'e' && b[n-3] == '-' && b[n-2] == '0' {
+			b[n-2] = b[n-1]
+			b = b[:n-1]
+		}
+	}
+	if opts.quoted {
+		b = append(b, '"')
+	}
+	e.buf = b
+}
+
+func stringEncoder(e *encodeState, v reflect.Value, opts encOpts) {
+	if v.Type() == numberType {
+		numStr := v.String()
+		// In Go1.5 the empty string encodes to "0", while this is not a valid number literal we keep compatibility so
+		// check validity after this
+		if numStr == "" {
+			numStr = "0"
+		}
+		if !isValidNumber(numStr) {
+			e.fail(fmt.Errorf("json: invalid number literal %q", numStr))
+		}
+		if opts.quoted {
+			e.buf = append(e.buf, '"')
+		}
+		e.buf = append(e.buf, numStr...)
+		if opts.quoted {
+			e.buf = append(e.buf, '"')
+		}
+		return
+	}
+	if opts.quoted {
+		// The value is encoded as a JSON string inside a JSON string
+		e.buf = appendString(e.buf, string(appendString(nil, v.String(), true)), true)
+		return
+	}
+	e.buf = appendString(e.buf, v.String(), true)
+}
+
+func interfaceEncoder(e *encodeState, v reflect.Value, _ encOpts) {
+	if v.IsNil() {
+		e.buf = append(e.buf, "null"...)
+		return
+	}
+	e.reflectValue(v.Elem(), encOpts{})
+}
+
+// structEncoder encodes a struct using the keys precomputed for its type
+type structEncoder struct {
+	fields   *structFields
+	encoders []encoderFunc
+}
+
+func newStructEncoder(t reflect.Type, kt *keyTransform) encoderFunc {
+	se := structEncoder{fields: cachedStructFields(t, kt)}
+	se.encoders = make([]encoderFunc, len(se.fields.list))
+	for i, f := range se.fields.list {
+		se.encoders[i] = typeEncoder(f.typ, kt)
+	}
+	return se.encode
+}
+
+func (se structEncoder) encode(e *encodeState, v reflect.Value, _ encOpts) {
+	next := byte('{')
+FieldLoop:
+	for i := range se.fields.list {
+		f := &se.fields.list[i]
+
+		// Find the nested struct field by following f.index
+		fv := v
+		for _, i := range f.index {
+			if fv.Kind() == reflect.Ptr {
+				if fv.IsNil() {
+					continue FieldLoop
+				}
+				fv = fv.Elem()
+			}
+			fv = fv.Field(i)
+		}
+
+		if f.omitEmpty && isEmptyValue(fv) {
+			continue
+		}
+		if f.omitZero && isZeroValue(fv) {
+			continue
+		}
+		e.buf = append(e.buf, next)
+		next = ','
+		e.buf = append(e.buf, f.encodedKey...)
+		se.encoders[i](e, fv, encOpts{quoted: f.quoted})
+	}
+	if next == '{' {
+		e.buf = append(e.buf, '{', '}')
+	} else {
+		e.buf = append(e.buf, '}')
+	}
+}
+
+// mapEncoder encodes a map. Its keys are only known at runtime, so they are transformed as they are encountered.
+type mapEncoder struct {
+	elemEnc encoderFunc
+}
+
+func newMapEncoder(t reflect.Type, kt *keyTransform) encoderFunc {
+	switch t.Key().Kind() {
+	case reflect.String,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+	default:
+		if !t.Key().Implements(textMarshalerType) {
+			return unsupportedTypeEncoder
+		}
+	}
+	me := mapEncoder{elemEnc: typeEncoder(t.Elem(), kt)}
+	return me.encode
+}
+
+type mapKV struct {
+	key string
+	v   reflect.Value
+}
+
+func (me mapEncoder) encode(e *encodeState, v reflect.Value, _ encOpts) {
+	if v.IsNil() {
+		e.buf = append(e.buf, "null"...)
+		return
+	}
+	e.enterPtr(v)
+	defer e.leavePtr()
+
+	// Extract and sort the keys
+	kvs := make([]mapKV, v.Len())
+	iter := v.MapRange()
+	for i := 0; iter.Next(); i++ {
+		key, err := resolveKeyName(iter.Key())
+		if err != nil {
+			e.fail(&json.MarshalerError{Type: iter.Key().Type(), Err: err})
+		}
+		kvs[i] = mapKV{key: key, v: iter.Value()}
+	}
+	sort.Slice(kvs, func(i, j int) bool {
+		return kvs[i].key < kvs[j].key
+	})
+
+	e.buf = append(e.buf, '{')
+	for i, kv := range kvs {
+		if i > 0 {
+			e.buf = append(e.buf, ',')
+		}
+		e.buf = appendString(e.buf, e.kt.marshalKey(kv.key), true)
+		e.buf = append(e.buf, ':')
+		me.elemEnc(e, kv.v, encOpts{})
+	}
+	e.buf = append(e.buf, '}')
+}
+
+func resolveKeyName(k reflect.Value) (string, error) {
+	if k.Kind() == reflect.String {
+		return k.String(), nil
+	}
+	if tm, ok := k.Interface().(encoding.TextMarshaler); ok {
+		if k.Kind() == reflect.Ptr && k.IsNil() {
+			return "", nil
+		}
+		buf, err := tm.MarshalText()
+		return string(buf), err
+	}
+	switch k.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(k.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return strconv.FormatUint(k.Uint(), 10), nil
+	}
+	return "", fmt.Errorf("unexpected map key type")
+}
+
+func newSliceEncoder(t reflect.Type, kt *keyTransform) encoderFunc {
+	// Byte slices get special treatment; arrays don't
+	if t.Elem().Kind() == reflect.Uint8 {
+		p := reflect.PointerTo(t.Elem())
+		if !p.Implements(marshalerType) && !p.Implements(textMarshalerType) {
+			return encodeByteSlice
+		}
+	}
+	enc := arrayEncoder{elemEnc: typeEncoder(t.Elem(), kt)}
+	return func(e *encodeState, v reflect.Value, opts encOpts) {
+		if v.IsNil() {
+			e.buf = append(e.buf, "null"...)
+			return
+		}
+		e.enterPtr(v)
+		defer e.leavePtr()
+		enc.encode(e, v, opts)
+	}
+}
+
+func encodeByteSlice(e *encodeState, v reflect.Value, _ encOpts) {
+	if v.IsNil() {
+		e.buf = append(e.buf, "null"...)
+		return
+	}
+	s := v.Bytes()
+	e.buf = append(e.buf, '"')
+	e.buf = base64.StdEncoding.AppendEncode(e.buf, s)
+	e.buf = append(e.buf, '"')
+}
+
+type arrayEncoder struct {
+	elemEnc encoderFunc
+}
+
+func newArrayEncoder(t reflect.Type, kt *keyTransform) encoderFunc {
+	enc := arrayEncoder{elemEnc: typeEncoder(t.Elem(), kt)}
+	return enc.encode
+}
+
+func (ae arrayEncoder) encode(e *encodeState, v reflect.Value, _ encOpts) {
+	e.buf = append(e.buf, '[')
+	n := v.Len()
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			e.buf = append(e.buf, ',')
+		}
+		ae.elemEnc(e, v.Index(i), encOpts{})
+	}
+	e.buf = append(e.buf, ']')
+}
+
+func newPtrEncoder(t reflect.Type, kt *keyTransform) encoderFunc {
+	elemEnc := typeEncoder(t.Elem(), kt)
+	return func(e *encodeState, v reflect.Value, opts encOpts) {
+		if v.IsNil() {
+			e.buf = append(e.buf, "null"...)
+			return
+		}
+		e.enterPtr(v)
+		defer e.leavePtr()
+		elemEnc(e, v.Elem(), opts)
+	}
+}
+
+// maxPtrLevel is the nesting depth of pointers, maps and slices after which we assume the value has a cycle
+const maxPtrLevel = 1000
+
+func (e *encodeState) enterPtr(v reflect.Value) {
+	e.ptrLevel++
+	if e.ptrLevel > maxPtrLevel {
+		e.fail(&json.UnsupportedValueError{Value: v, Str: fmt.Sprintf("encountered a cycle via %s", v.Type())})
+	}
+}
+
+func (e *encodeState) leavePtr() {
+	e.ptrLevel--
+}
+
+// newCondAddrEncoder returns an encoder that checks whether its value CanAddr and delegates to canAddrEnc if so, else
+// to elseEnc
+func newCondAddrEncoder(canAddrEnc, elseEnc encoderFunc) encoderFunc {
+	return func(e *encodeState, v reflect.Value, opts encOpts) {
+		if v.CanAddr() {
+			canAddrEnc(e, v, opts)
+		} else {
+			elseEnc(e, v, opts)
+		}
+	}
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64,
+		reflect.Interface, reflect.Ptr:
+		return v.IsZero()
+	}
+	return false
+}
+
+// isZeroValue reports whether v is zero for the purpose of the `omitzero` tag option, preferring an IsZero method
+func isZeroValue(v reflect.Value) bool {
+	if z, ok := v.Interface().(interface{ IsZero() bool }); ok {
+		if v.Kind() == reflect.Ptr && v.IsNil() {
+			return true
+		}
+		return z.IsZero()
+	}
+	return v.IsZero()
+}
+
+// isValidNumber reports whether s is a valid JSON number literal
+func isValidNumber(s string) bool {
+	if s == "" {
+		return false
+	}
+	// Optional -
+	if s[0] == '-' {
+		s = s[1:]
+		if s == "" {
+			return false
+		}
+	}
+	// Digits
+	switch {
+	default:
+		return false
+	case s[0] == '0':
+		s = s[1:]
+	case '1' <= s[0] && s[0] <= '9':
+		s = s[1:]
+		for len(s) > 0 && '0' <= s[0] && s[0] <= '9' {
+			s = s[1:]
+		}
+	}
+	// . followed by 1 or more digits
+	if len(s) >= 2 && s[0] == '.' && '0' <= s[1] && s[1] <= '9' {
+		s = s[2:]
+		for len(s) > 0 && '0' <= s[0] && s[0] <= '9' {
+			s = s[1:]
+		}
+	}
+	// e or E followed by an optional - or + and 1 or more digits
+	if len(s) >= 2 && (s[0] == 'e' || s[0] == 'E') {
+		s = s[1:]
+		if s[0] == '+' || s[0] == '-' {
+			s = s[1:]
+			if s == "" {
+				return false
+			}
+		}
+		for len(s) > 0 && '0' <= s[0] && s[0] <= '9' {
+			s = s[1:]
+		}
+	}
+	// Make sure we are at the end
+	return s == ""
+}
+
+const hex = "0123456789abcdef"
+
+// appendString appends s as a JSON string to dst, escaping it like encoding/json does. Invalid UTF-8 is replaced by
+// U+FFFD, and U+2028 and U+2029 are escaped so the output can be safely embedded in JavaScript.
+func appendString(dst []byte, s string, escapeHTML bool) []byte {
+	dst = append(dst, '"')
+	start := 0
+	for i := 0; i < len(s); {
+		if b := s[i]; b < utf8.RuneSelf {
+			if b >= 0x20 && b != '"' && b != '\\' && (!escapeHTML || (b != '<' && b != '>' && b != '&')) {
+				i++
+				continue
+			}
+			dst = append(dst, s[start:i]...)
+			switch b {
+			case '\\', '"':
+				dst = append(dst, '\\', b)
+			case '\b':
+				dst = append(dst, '\\', 'b')
+			case '\f':
+				dst = append(dst, '\\', 'f')
+			case '\n':
+				dst = append(dst, '\\', 'n')
+			case '\r':
+				dst = append(dst, '\\', 'r')
+			case '\t':
+				dst = append(dst, '\\', 't')
+			default:
+				// This encodes bytes < 0x20 except for \b, \f, \n, \r and \t. If escapeHTML is set, it also escapes
+				// <, >, and & because they can lead to security holes when user-controlled strings are rendered into
+				// JSON and served to some browsers.
+				dst = append(dst, '\\', 'u', '0', '0', hex[b>>4], hex[b&0xF])
+			}
+			i++
+			start = i
+			continue
+		}
+		c, size := utf8.DecodeRuneInString(s[i:])
+		if c == utf8.RuneError && size == 1 {
+			dst = append(dst, s[start:i]...)
+			dst = append(dst, `\ufffd`...)
+			i += size
+			start = i
+			continue
+		}
+		if c == '\u2028' || c == '\u2029' {
+			dst = append(dst, s[start:i]...)
+			dst = append(dst, '\\', 'u', '2', '0', '2', hex[c&0xF])
+			i += size
+			start = i
+			continue
+		}
+		i += size
+	}
+	dst = append(dst, s[start:]...)
+	dst = append(dst, '"')
+	return dst
+}
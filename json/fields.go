@@ -0,0 +1,317 @@
+package json
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// field describes a struct field that is encoded as a JSON object key
+type field struct {
+	name   string // name of the field in JSON before the key transform, from the `json` tag or the Go field name
+	tagged bool   // whether the name came from a `json` tag
+	index  []int  // index sequence for reflect.Value.FieldByIndex
+	typ    reflect.Type
+
+	omitEmpty bool
+	omitZero  bool
+	quoted    bool // `string` tag option
+}
+
+// fieldCache caches the fields of struct types, independently of the key transform
+var fieldCache sync.Map // map[reflect.Type][]field
+
+// cachedTypeFields returns the fields that are encoded for the struct type t
+func cachedTypeFields(t reflect.Type) []field {
+	if f, ok := fieldCache.Load(t); ok {
+		return f.([]field)
+	}
+	f, _ := fieldCache.LoadOrStore(t, typeFields(t))
+	return f.([]field)
+}
+
+// typeFields returns the fields that are encoded for the struct type t. It follows the same rules as encoding/json,
+// including the promotion of fields from embedded structs.
+func typeFields(t reflect.Type) []field {
+	// Anonymous fields to explore at the current level and the next
+	var current []field
+	next := []field{{typ: t}}
+
+	// Count of queued names for current level and the next
+	var count, nextCount map[reflect.Type]int
+
+	// Types already visited at an earlier level
+	visited := map[reflect.Type]bool{}
+
+	var fields []field
+
+	for len(next) > 0 {
+		current, next = next, current[:0]
+		count, nextCount = nextCount, map[reflect.Type]int{}
+
+		for _, f := range current {
+			if visited[f.typ] {
+				continue
+			}
+			visited[f.typ] = true
+
+			for i := 0; i < f.typ.NumField(); i++ {
+				sf := f.typ.Field(i)
+				if sf.Anonymous {
+					ft := sf.Type
+					if ft.Kind() == reflect.Ptr {
+						ft = ft.Elem()
+					}
+					// Embedded unexported non-struct types are ignored, but the exported fields of embedded
+					// unexported structs are promoted
+					if !sf.IsExported() && ft.Kind() != reflect.Struct {
+						continue
+					}
+				} else if !sf.IsExported() {
+					continue
+				}
+
+				tag := sf.Tag.Get("json")
+				if tag == "-" {
+					continue
+				}
+				name, opts, _ := strings.Cut(tag, ",")
+				if !isValidTag(name) {
+					name = ""
+				}
+
+				index := make([]int, len(f.index)+1)
+				copy(index, f.index)
+				index[len(f.index)] = i
+
+				ft := sf.Type
+				if ft.Name() == "" && ft.Kind() == reflect.Ptr {
+					ft = ft.Elem()
+				}
+
+				// Only strings, floats, integers, and booleans can be quoted
+				quoted := false
+				if hasTagOption(opts, "string") {
+					switch ft.Kind() {
+					case reflect.Bool,
+						reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+						reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+						reflect.Float32, reflect.Float64,
+						reflect.String:
+						quoted = true
+					}
+				}
+
+				// Record found field and index sequence
+				if name != "" || !sf.Anonymous || ft.Kind() != reflect.Struct {
+					tagged := name != ""
+					if name == "" {
+						name = sf.Name
+					}
+					fields = append(fields, field{
+						name:      name,
+						tagged:    tagged,
+						index:     index,
+						typ:       sf.Type,
+						omitEmpty: hasTagOption(opts, "omitempty"),
+						omitZero:  hasTagOption(opts, "omitzero"),
+						quoted:    quoted,
+					})
+					if count[f.typ] > 1 {
+						// If there were multiple instances, add a second, so that the annihilation code will see
+						// a duplicate. It only cares about the distinction between 1 and 2, so don't bother
+						// generating any more copies.
+						fields = append(fields, fields[len(fields)-1])
+					}
+					continue
+				}
+
+				// Record new anonymous struct to explore in next round
+				nextCount[ft]++
+				if nextCount[ft] == 1 {
+					next = append(next, field{name: ft.Name(), index: index, typ: ft})
+				}
+			}
+		}
+	}
+
+	sort.Slice(fields, func(i, j int) bool {
+		x := fields
+		// sort field by name, breaking ties with depth, then breaking ties with "name came from json tag", then
+		// breaking ties with index sequence
+		if x[i].name != x[j].name {
+			return x[i].name < x[j].name
+		}
+		if len(x[i].index) != len(x[j].index) {
+			return len(x[i].index) < len(x[j].index)
+		}
+		if x[i].tagged != x[j].tagged {
+			return x[i].tagged
+		}
+		return indexLess(x[i].index, x[j].index)
+	})
+
+	// Delete all fields that are hidden by the Go rules for embedded fields, except that fields with JSON tags are
+	// promoted. The fields are sorted in primary order of name, secondary order of field index length.
+	out := fields[:0]
+	for advance, i := 0, 0; i < len(fields); i += advance {
+		// One iteration per name. Find the sequence of fields with the name of this first field.
+		fi := fields[i]
+		for advance = 1; i+advance < len(fields); advance++ {
+			if fields[i+advance].name != fi.name {
+				break
+			}
+		}
+		if advance == 1 {
+			out = append(out, fi)
+			continue
+		}
+		// If there are multiple top-level fields with the same name (and the same tagging), none of them win
+		if len(fields[i].index) == len(fields[i+1].index) && fields[i].tagged == fields[i+1].tagged {
+			continue
+		}
+		out = append(out, fi)
+	}
+
+	fields = out
+	sort.Slice(fields, func(i, j int) bool {
+		return indexLess(fields[i].index, fields[j].index)
+	})
+
+	return fields
+}
+
+func indexLess(a, b []int) bool {
+	for k, ak := range a {
+		if k >= len(b) {
+			return false
+		}
+		if ak != b[k] {
+			return ak < b[k]
+		}
+	}
+	return len(a) < len(b)
+}
+
+func hasTagOption(opts, name string) bool {
+	for opts != "" {
+		var opt string
+		opt, opts, _ = strings.Cut(opts, ",")
+		if opt == name {
+			return true
+		}
+	}
+	return false
+}
+
+func isValidTag(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		switch {
+		case strings.ContainsRune("!#$%&()*+-./:;<=>?@[]^_{|}~ ", c):
+			// Backslash and quote chars are reserved, but otherwise any punctuation chars are allowed in a tag name
+		case !unicode.IsLetter(c) && !unicode.IsDigit(c):
+			return false
+		}
+	}
+	return true
+}
+
+/* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+* P E R   T R A N S F O R M   S T R U C T   I N F O
+* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
+
+// structFields holds the fields of a struct type with their keys for a particular key transform
+type structFields struct {
+	list []structField
+	// byKey looks up fields by their transformed key
+	byKey map[string]*structField
+	// byFoldedName looks up fields by their lower cased name, for case-insensitive matching like encoding/json
+	byFoldedName map[string]*structField
+}
+
+type structField struct {
+	field
+	key        string
+	encodedKey []byte // `"key":`, ready to be appended to the output
+}
+
+type structFieldsKey struct {
+	t  reflect.Type
+	kt *keyTransform
+}
+
+var structFieldsCache sync.Map // map[structFieldsKey]*structFields
+
+// cachedStructFields returns the fields of the struct type t with their keys transformed by kt
+func cachedStructFields(t reflect.Type, kt *keyTransform) *structFields {
+	key := structFieldsKey{t, kt}
+	if sf, ok := structFieldsCache.Load(key); ok {
+		return sf.(*structFields)
+	}
+
+	fields := cachedTypeFields(t)
+	sf := &structFields{
+		list:         make([]structField, len(fields)),
+		byKey:        make(map[string]*structField, len(fields)),
+		byFoldedName: make(map[string]*structField, len(fields)),
+	}
+	for i, f := range fields {
+		k := f.name
+		if kt.marshal != nil {
+			k = kt.marshal(k)
+		}
+		sf.list[i] = structField{
+			field:      f,
+			key:        k,
+			encodedKey: append(appendString(nil, k, true), ':'),
+		}
+	}
+	// Earlier fields win when there are clashes
+	for i := len(sf.list) - 1; i >= 0; i-- {
+		f := &sf.list[i]
+		sf.byKey[f.key] = f
+		sf.byFoldedName[strings.ToLower(f.name)] = f
+	}
+
+	actual, _ := structFieldsCache.LoadOrStore(key, sf)
+	return actual.(*structFields)
+}
+
+// lookup finds the field for a key in the JSON input: first by exact transformed key, then by matching the key (after
+// the unmarshal transform) case-insensitively to the field names
+func (sf *structFields) lookup(key string, kt *keyTransform) *structField {
+	if f, ok := sf.byKey[key]; ok {
+		return f
+	}
+	if f, ok := sf.byFoldedName[strings.ToLower(kt.unmarshalKey(key))]; ok {
+		return f
+	}
+	return nil
+}
+
+// StructField describes a field of a struct type that is encoded as a JSON object key
+type StructField struct {
+	// Key is the object key of the field, after the key transform
+	Key string
+	// Index is the index sequence of the field, for reflect.Value.FieldByIndex
+	Index []int
+	// Field is the Go struct field
+	Field reflect.StructField
+}
+
+// StructFields returns the fields of the struct type t that are encoded as JSON object keys, with the key transform of
+// opts applied. Fields promoted from embedded structs are included, like when marshaling.
+func StructFields(t reflect.Type, opts ...Option) []StructField {
+	o := newOptions(opts...)
+	fields := cachedStructFields(t, o.keyTransform.resolve())
+	out := make([]StructField, len(fields.list))
+	for i, f := range fields.list {
+		out[i] = StructField{Key: f.key, Index: f.index, Field: t.FieldByIndex(f.index)}
+	}
+	return out
+}
@@ -2,32 +2,166 @@ package json
 
 import (
 	"encoding/json"
-
-	"github.com/Rican7/conjson"
-	"github.com/Rican7/conjson/transform"
+	"io"
 )
 
+// Option configures how values are marshaled and unmarshaled
+type Option func(*options)
+
+type options struct {
+	keyTransform KeyTransform
+	strict       bool
+}
+
+func newOptions(opts ...Option) options {
+	var o options
+	for _, opt := range opts {
+		if opt != nil {
+			opt(&o)
+		}
+	}
+	return o
+}
+
+// WithKeyTransform sets the KeyTransform used to rename object keys
+func WithKeyTransform(kt KeyTransform) Option {
+	return func(o *options) {
+		o.keyTransform = kt
+	}
+}
+
+// WithStrictDecoding makes Unmarshal reject input that would otherwise be silently accepted: keys that don't match any
+// field, duplicate keys within an object (compared after the key transform, so user_id and userId are duplicates
+// when they decode to the same key) and trailing data after the JSON value. Numbers that overflow the field they are
+// decoded into are always rejected.
+func WithStrictDecoding() Option {
+	return func(o *options) {
+		o.strict = true
+	}
+}
+
 // Marshal encodes the struct into JSON
-func Marshal(v interface{}) ([]byte, error) {
+func Marshal(v interface{}, opts ...Option) ([]byte, error) {
+	o := newOptions(opts...)
 
-	marshaler := conjson.NewMarshaler(v, transform.ConventionalKeys())
-	encoded, err := json.Marshal(marshaler)
+	e := newEncodeState(o.keyTransform.resolve())
+	defer e.release()
+
+	err := e.marshal(v)
 	if err != nil {
 		return nil, err
 	}
-	return encoded, nil
+	return append([]byte(nil), e.buf...), nil
 
 }
 
 // Unmarshal deencodes JSON bytes into the provided struct
-func Unmarshal(src []byte, v interface{}) error {
+func Unmarshal(src []byte, v interface{}, opts ...Option) error {
+	o := newOptions(opts...)
+
+	return unmarshal(src, v, o.keyTransform.resolve(), o.strict)
+
+}
 
-	unmarshaler := conjson.NewUnmarshaler(v, transform.ConventionalKeys())
+// Encoder writes JSON values, with the same key transform as Marshal, to an output stream
+type Encoder struct {
+	w    io.Writer
+	opts []Option
+}
+
+// NewEncoder returns a new Encoder that writes to w
+func NewEncoder(w io.Writer, opts ...Option) *Encoder {
+	return &Encoder{w: w, opts: opts}
+}
 
-	err := json.Unmarshal(src, unmarshaler)
+// Encode writes the JSON encoding of v to the stream, followed by a newline character
+func (e *Encoder) Encode(v interface{}) error {
+	data, err := Marshal(v, e.opts...)
 	if err != nil {
 		return err
 	}
+	_, err = e.w.Write(append(data, '\n'))
+	return err
+}
+
+// Token holds a value of one of the types returned by Decoder.Token (see encoding/json.Token)
+type Token = json.Token
+
+// Delim is a JSON array or object delimiter, one of [ ] { or } (see encoding/json.Delim)
+type Delim = json.Delim
+
+// Decoder reads JSON values, with the same key transform and strictness as Unmarshal, from an input stream. Together
+// with Token and More it can be used to decode large arrays one element at a time.
+type Decoder struct {
+	dec  *json.Decoder
+	opts []Option
+}
+
+// NewDecoder returns a new Decoder that reads from r
+func NewDecoder(r io.Reader, opts ...Option) *Decoder {
+	return &Decoder{dec: json.NewDecoder(r), opts: opts}
+}
+
+// Decode reads the next JSON value from the stream and stores it in the value pointed to by v. Only the next value is
+// held in memory, so calling Decode for each element of an array avoids reading the whole array at once.
+func (d *Decoder) Decode(v interface{}) error {
+	var raw json.RawMessage
+	err := d.dec.Decode(&raw)
+	if err != nil {
+		return err
+	}
+	return Unmarshal(raw, v, d.opts...)
+}
+
+// Token returns the next JSON token in the stream (see encoding/json.Decoder.Token)
+func (d *Decoder) Token() (Token, error) {
+	return d.dec.Token()
+}
+
+// More reports whether there is another element in the current array or object being parsed
+func (d *Decoder) More() bool {
+	return d.dec.More()
+}
+
+// ArrayEncoder writes a JSON array to an output stream one element at a time, so the whole array never has to be held
+// in memory. Close must be called after the last element to terminate the array.
+type ArrayEncoder struct {
+	w     io.Writer
+	opts  []Option
+	count int
+}
+
+// NewArrayEncoder returns a new ArrayEncoder that writes to w
+func NewArrayEncoder(w io.Writer, opts ...Option) *ArrayEncoder {
+	return &ArrayEncoder{w: w, opts: opts}
+}
+
+// Encode writes the JSON encoding of v to the stream as the next element of the array
+func (a *ArrayEncoder) Encode(v interface{}) error {
+	data, err := Marshal(v, a.opts...)
+	if err != nil {
+		return err
+	}
+	sep := []byte{','}
+	if a.count == 0 {
+		sep = []byte{'['}
+	}
+	if _, err := a.w.Write(sep); err != nil {
+		return err
+	}
+	if _, err := a.w.Write(data); err != nil {
+		return err
+	}
+	a.count++
 	return nil
+}
 
+// Close terminates the array. If no elements were written, an empty array is written.
+func (a *ArrayEncoder) Close() error {
+	end := []byte{']'}
+	if a.count == 0 {
+		end = []byte("[]")
+	}
+	_, err := a.w.Write(end)
+	return err
 }
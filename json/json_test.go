@@ -0,0 +1,256 @@
+package json_test
+
+import (
+	"bytes"
+	stdjson "encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/teejays/gopi"
+	"github.com/teejays/gopi/json"
+)
+
+type sample struct {
+	StatusCode int
+	UserName   string
+}
+
+func TestMarshal_KeyTransform(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []json.Option
+		want string
+	}{
+		{
+			name: "Default",
+			want: `{"status_code":200,"user_name":"jdoe"}`,
+		},
+		{
+			name: "Snake case",
+			opts: []json.Option{json.WithKeyTransform(json.SnakeCaseKeys)},
+			want: `{"status_code":200,"user_name":"jdoe"}`,
+		},
+		{
+			name: "Camel case",
+			opts: []json.Option{json.WithKeyTransform(json.CamelCaseKeys)},
+			want: `{"statusCode":200,"userName":"jdoe"}`,
+		},
+		{
+			name: "Identity",
+			opts: []json.Option{json.WithKeyTransform(json.IdentityKeys)},
+			want: `{"StatusCode":200,"UserName":"jdoe"}`,
+		},
+		{
+			name: "Custom",
+			opts: []json.Option{json.WithKeyTransform(json.CustomKeys(strings.ToUpper, nil))},
+			want: `{"STATUSCODE":200,"USERNAME":"jdoe"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := sample{StatusCode: 200, UserName: "jdoe"}
+
+			got, err := json.Marshal(in, tt.opts...)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, string(got))
+
+			// Round trip with the same options
+			var out sample
+			err = json.Unmarshal(got, &out, tt.opts...)
+			assert.NoError(t, err)
+			assert.Equal(t, in, out)
+		})
+	}
+}
+
+/* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+* C O M P A T I B I L I T Y   W I T H   C O N J S O N
+* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
+
+type compatEmbedded struct {
+	EmbeddedID int
+}
+
+type compatItem struct {
+	compatEmbedded
+	ItemName   string
+	Price      float64
+	Tags       []string
+	Attributes map[string]interface{}
+	Raw        stdjson.RawMessage
+	Image      []byte
+	CreatedAt  time.Time
+	Parent     *compatItem `json:",omitempty"`
+	Count      int64       `json:",string"`
+	Ignored    string      `json:"-"`
+	HTML       string
+}
+
+func newCompatItem(i int) compatItem {
+	return compatItem{
+		compatEmbedded: compatEmbedded{EmbeddedID: i},
+		ItemName:       fmt.Sprintf("item <%d> & co", i),
+		Price:          float64(i) * 1.25,
+		Tags:           []string{"new", "sale"},
+		Attributes:     map[string]interface{}{"ColorName": "red", "size_code": 42.0, "Nested": map[string]interface{}{"innerKey": true}},
+		Raw:            stdjson.RawMessage(`{"RawKey":[1,2,3]}`),
+		Image:          []byte{0xde, 0xad, 0xbe, 0xef},
+		CreatedAt:      time.Date(2024, 2, 16, 21, 19, 10, 0, time.UTC),
+		Count:          int64(i) << 40,
+		Ignored:        "ignored",
+		HTML:           "<script> </script>",
+	}
+}
+
+// TestMarshal_ConjsonCompat checks the output against the one of the conjson based implementation that the package
+// used to have, with its default key transform, which is recorded in testdata/conjson
+func TestMarshal_ConjsonCompat(t *testing.T) {
+	parent := newCompatItem(0)
+	child := newCompatItem(1)
+	child.Parent = &parent
+
+	values := []struct {
+		name string
+		v    interface{}
+	}{
+		{"nil", nil},
+		{"int", 42},
+		{"string", "hello"},
+		{"empty_slice", []int{}},
+		{"string_map", map[string]int{"OneKey": 1, "two_key": 2}},
+		{"int_map", map[int]string{2: "b", 1: "a"}},
+		{"struct", child},
+		{"pointer", &child},
+		{"slice", []compatItem{parent, child}},
+		{"response", gopi.StandardResponse{StatusCode: 200, Data: child}},
+		{"error_response", gopi.StandardResponse{StatusCode: 400, Error: "Bad request"}},
+	}
+	for _, tt := range values {
+		t.Run(tt.name, func(t *testing.T) {
+			want, err := os.ReadFile(filepath.Join("testdata", "conjson", tt.name+".json"))
+			if !assert.NoError(t, err) {
+				return
+			}
+			want = bytes.TrimSuffix(want, []byte("\n"))
+			got, err := json.Marshal(tt.v)
+			assert.NoError(t, err)
+			assert.Equal(t, string(want), string(got))
+
+			// Unmarshaling the output should give back a value with the same output (although the keys of the values
+			// decoded into an interface{} are sorted)
+			if tt.v == nil {
+				return
+			}
+			out := reflect.New(reflect.TypeOf(tt.v))
+			assert.NoError(t, json.Unmarshal(want, out.Interface()))
+			again, err := json.Marshal(out.Elem().Interface())
+			assert.NoError(t, err)
+			assert.JSONEq(t, string(want), string(again))
+		})
+	}
+}
+
+func TestUnmarshal_Errors(t *testing.T) {
+	var item compatItem
+
+	// Syntax errors are reported like encoding/json does
+	err := json.Unmarshal([]byte(`{"item_name":`), &item)
+	var syntaxErr *stdjson.SyntaxError
+	assert.ErrorAs(t, err, &syntaxErr)
+
+	// Type errors name the field, and the rest of the value is still decoded
+	err = json.Unmarshal([]byte(`{"price":"free","item_name":"x"}`), &item)
+	var typeErr *stdjson.UnmarshalTypeError
+	if assert.ErrorAs(t, err, &typeErr) {
+		assert.Equal(t, "Price", typeErr.Field)
+	}
+	assert.Equal(t, "x", item.ItemName)
+
+	// Strict decoding
+	err = json.Unmarshal([]byte(`{"item_name":"x","foo":1}`), &item, json.WithStrictDecoding())
+	assert.EqualError(t, err, `json: unknown field "foo"`)
+	err = json.Unmarshal([]byte(`{"item_name":"x","item_name":"y"}`), &item, json.WithStrictDecoding())
+	assert.EqualError(t, err, `json: duplicate key "item_name"`)
+	// Keys are compared once decoded, so two spellings of the same field are duplicates too
+	err = json.Unmarshal([]byte(`{"item_name":"x","ItemName":"y"}`), &item, json.WithStrictDecoding())
+	assert.EqualError(t, err, `json: duplicate key "ItemName"`)
+	var m map[string]interface{}
+	err = json.Unmarshal([]byte(`{"user_id":1,"userId":2}`), &m, json.WithStrictDecoding())
+	assert.EqualError(t, err, `json: duplicate key "userId"`)
+}
+
+/* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+* B E N C H M A R K S
+* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
+
+type benchUser struct {
+	UserID    int
+	FirstName string
+	LastName  string
+	Email     string
+	IsActive  bool
+	Roles     []string
+	CreatedAt time.Time
+}
+
+func benchResponse(n int) gopi.StandardResponse {
+	users := make([]benchUser, n)
+	for i := range users {
+		users[i] = benchUser{
+			UserID:    i,
+			FirstName: "Jane",
+			LastName:  "Doe",
+			Email:     fmt.Sprintf("jane.doe.%d@example.com", i),
+			IsActive:  i%2 == 0,
+			Roles:     []string{"admin", "editor"},
+			CreatedAt: time.Date(2024, 2, 16, 21, 19, 10, 0, time.UTC),
+		}
+	}
+	return gopi.StandardResponse{StatusCode: 200, Data: users}
+}
+
+var benchSizes = []int{1, 100}
+
+func BenchmarkMarshal(b *testing.B) {
+	for _, n := range benchSizes {
+		resp := benchResponse(n)
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := json.Marshal(resp); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkUnmarshal(b *testing.B) {
+	type response struct {
+		StatusCode int
+		Data       []benchUser
+		Error      interface{}
+	}
+	for _, n := range benchSizes {
+		data, err := json.Marshal(benchResponse(n))
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				var resp response
+				if err := json.Unmarshal(data, &resp); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,144 @@
+package json
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"unicode"
+	"unicode/utf8"
+)
+
+// KeyTransform determines how the keys of JSON objects are renamed when marshaling and unmarshaling. The zero value
+// is the default transform (SnakeCaseKeys).
+//
+// The keys for struct fields are computed once per type and cached, so the transform costs nothing per request. Keys
+// of maps are transformed as they are encountered (with a bounded cache), since they are only known at runtime.
+type KeyTransform struct {
+	t *keyTransform
+}
+
+type keyTransform struct {
+	name string
+	// marshal renames a key when encoding. A nil func leaves keys as they are.
+	marshal func(key string) string
+	// unmarshal renames a key when decoding, before it is matched to a struct field or stored as a map key. A nil func
+	// leaves keys as they are.
+	unmarshal func(key string) string
+
+	marshalKeys   keyCache
+	unmarshalKeys keyCache
+}
+
+var (
+	// SnakeCaseKeys renames Go field names to snake_case keys (e.g. StatusCode -> status_code). This is the default.
+	SnakeCaseKeys = KeyTransform{&keyTransform{name: "snake_case", marshal: toSnakeCase, unmarshal: snakeToCamelCaseWordBarrier}}
+	// CamelCaseKeys renames Go field names to camelCase keys (e.g. StatusCode -> statusCode)
+	CamelCaseKeys = KeyTransform{&keyTransform{name: "camelCase", marshal: toCamelCase}}
+	// IdentityKeys leaves the keys as they are, i.e. the Go field names (or names from `json` tags) are used
+	IdentityKeys = KeyTransform{&keyTransform{name: "identity"}}
+)
+
+// CustomKeys returns a KeyTransform that renames keys using marshal when encoding, and unmarshal when decoding.
+// unmarshal should map the keys back to the Go field names; if it is nil, keys are matched to the fields as they are
+// (case-insensitively, like encoding/json).
+func CustomKeys(marshal, unmarshal func(key string) string) KeyTransform {
+	return KeyTransform{&keyTransform{name: "custom", marshal: marshal, unmarshal: unmarshal}}
+}
+
+// IsZero returns true if kt is the zero value, i.e. no KeyTransform has been chosen
+func (kt KeyTransform) IsZero() bool {
+	return kt.t == nil
+}
+
+// String returns the name of the KeyTransform
+func (kt KeyTransform) String() string {
+	return kt.resolve().name
+}
+
+// resolve returns the transform to use for kt, which is the default one for the zero value
+func (kt KeyTransform) resolve() *keyTransform {
+	if kt.t == nil {
+		return SnakeCaseKeys.t
+	}
+	return kt.t
+}
+
+// marshalKey returns the key to encode for key
+func (t *keyTransform) marshalKey(key string) string {
+	return t.marshalKeys.get(key, t.marshal)
+}
+
+// unmarshalKey returns the key to decode for key
+func (t *keyTransform) unmarshalKey(key string) string {
+	return t.unmarshalKeys.get(key, t.unmarshal)
+}
+
+// maxCachedKeys bounds the number of map keys cached per KeyTransform, since map keys can be arbitrary client data
+const maxCachedKeys = 4096
+
+// keyCache memoizes the results of a key transform func
+type keyCache struct {
+	m sync.Map
+	n atomic.Int64
+}
+
+func (c *keyCache) get(key string, fn func(string) string) string {
+	if fn == nil {
+		return key
+	}
+	if v, ok := c.m.Load(key); ok {
+		return v.(string)
+	}
+	res := fn(key)
+	if c.n.Load() < maxCachedKeys {
+		if _, loaded := c.m.LoadOrStore(key, res); !loaded {
+			c.n.Add(1)
+		}
+	}
+	return res
+}
+
+var (
+	keyRegex                  = regexp.MustCompile(`"((?:[^"\\]|\\.)*)"(\s*):`)
+	camelCaseWordBarrierRegex = regexp.MustCompile(`([^A-Z])([A-Z])`)
+	snakeCaseWordBarrierRegex = regexp.MustCompile(`(?:[^_])_(.)`)
+)
+
+// toSnakeCase converts a camelCase (or PascalCase) key to snake_case
+func toSnakeCase(key string) string {
+	return strings.ToLower(camelCaseWordBarrierRegex.ReplaceAllString(key, "${1}_${2}"))
+}
+
+// toCamelCase converts a snake_case, kebab-case or PascalCase key to camelCase
+func toCamelCase(key string) string {
+	key = snakeToCamelCaseWordBarrier(strings.ReplaceAll(key, "-", "_"))
+	r, size := utf8.DecodeRuneInString(key)
+	if size == 0 {
+		return key
+	}
+	return string(unicode.ToLower(r)) + key[size:]
+}
+
+// snakeToCamelCaseWordBarrier removes the underscores between words and capitalizes the words after them
+func snakeToCamelCaseWordBarrier(key string) string {
+	return snakeCaseWordBarrierRegex.ReplaceAllStringFunc(key, func(match string) string {
+		i := strings.IndexByte(match, '_')
+		return match[:i] + strings.ToUpper(match[i+1:])
+	})
+}
+
+// replaceKeys calls fn for each object key in the JSON data and replaces the key with the result. It is used for JSON
+// that we don't produce ourselves (e.g. from a json.Marshaler), where we can't know the keys in advance.
+func replaceKeys(data []byte, fn func(string) string) []byte {
+	return keyRegex.ReplaceAllFunc(data, func(match []byte) []byte {
+		sub := keyRegex.FindSubmatch(match)
+		// Leave keys with escape sequences alone, rather than risk mangling them
+		if bytes.IndexByte(sub[1], '\\') >= 0 {
+			return match
+		}
+		key := appendString(nil, fn(string(sub[1])), true)
+		return append(append(key, sub[2]...), ':')
+	})
+}
@@ -0,0 +1,167 @@
+package gopi
+
+import (
+	"bytes"
+	"context"
+	stdjson "encoding/json"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// defaultBodyLogMaxSize is the number of bytes of each body that are logged, unless configured otherwise
+const defaultBodyLogMaxSize = 4096
+
+type loggerContextKey struct{}
+
+// contextWithLogger returns a copy of ctx that carries the server's logger
+func contextWithLogger(ctx context.Context, l *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerContextKey{}, l)
+}
+
+// Logger returns the logger of the server handling the request that ctx belongs to (see WithLogger), with the ID of
+// the request and its trace, if any. Outside of a request, it returns slog.Default().
+func Logger(ctx context.Context) *slog.Logger {
+	l, ok := ctx.Value(loggerContextKey{}).(*slog.Logger)
+	if !ok {
+		l = slog.Default()
+	}
+	var attrs []interface{}
+	if id := RequestID(ctx); id != "" {
+		attrs = append(attrs, "request_id", id)
+	}
+	attrs = append(attrs, TraceLogFields(ctx)...)
+	if len(attrs) > 0 {
+		l = l.With(attrs...)
+	}
+	return l
+}
+
+// requestLogger returns the logger for r, which may be nil
+func requestLogger(r *http.Request) *slog.Logger {
+	if r == nil {
+		return slog.Default()
+	}
+	return Logger(r.Context())
+}
+
+// newLogger returns the logger for the server, which only logs at level or above if it is set
+func newLogger(l *slog.Logger, level slog.Leveler) *slog.Logger {
+	if l == nil {
+		l = slog.Default()
+	}
+	if level == nil {
+		return l
+	}
+	return slog.New(&levelHandler{Handler: l.Handler(), level: level})
+}
+
+// levelHandler is a slog.Handler that drops the records below a level, on top of the filtering of the wrapped handler
+type levelHandler struct {
+	slog.Handler
+	level slog.Leveler
+}
+
+func (h *levelHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.level.Level() && h.Handler.Enabled(ctx, level)
+}
+
+func (h *levelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &levelHandler{Handler: h.Handler.WithAttrs(attrs), level: h.level}
+}
+
+func (h *levelHandler) WithGroup(name string) slog.Handler {
+	return &levelHandler{Handler: h.Handler.WithGroup(name), level: h.level}
+}
+
+/* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+* B O D Y   L O G G I N G
+* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
+
+// BodyRedactor returns a copy of body, which has the media type contentType, without the secrets and PII that
+// shouldn't be logged
+type BodyRedactor func(contentType string, body []byte) []byte
+
+// BodyLogConfig configures the logging of request and response bodies (see WithBodyLogging)
+type BodyLogConfig struct {
+	// MaxSize is the number of bytes of each body that are logged, after redaction. Defaults to 4KB.
+	MaxSize int
+	// Redact is called with each body before it is logged. Bodies are logged as they are if it is not set.
+	Redact BodyRedactor
+}
+
+func (cfg BodyLogConfig) withDefaults() BodyLogConfig {
+	if cfg.MaxSize <= 0 {
+		cfg.MaxSize = defaultBodyLogMaxSize
+	}
+	return cfg
+}
+
+// logBody logs the body of a request or a response to r, at debug level, if body logging is enabled for its route
+func logBody(r *http.Request, msg, contentType string, body []byte) {
+	cfg := getRouteConfig(r).bodyLog
+	if cfg == nil {
+		return
+	}
+	l := requestLogger(r)
+	if !l.Enabled(context.Background(), slog.LevelDebug) {
+		return
+	}
+	if cfg.Redact != nil {
+		body = cfg.Redact(contentType, body)
+	}
+	truncated := len(body) > cfg.MaxSize
+	if truncated {
+		body = body[:cfg.MaxSize]
+	}
+	l.Debug(msg, "content_type", contentType, "body", string(body), "truncated", truncated)
+}
+
+// RedactJSONFields returns a BodyRedactor that replaces the values of the given keys of JSON bodies with [REDACTED],
+// at any depth. Keys are matched case-insensitively. Bodies that aren't JSON are replaced altogether, since they can't
+// be redacted.
+func RedactJSONFields(keys ...string) BodyRedactor {
+	redact := map[string]bool{}
+	for _, k := range keys {
+		redact[strings.ToLower(k)] = true
+	}
+	return func(contentType string, body []byte) []byte {
+		if len(bytes.TrimSpace(body)) == 0 {
+			return body
+		}
+		mediaType, _, _ := mime.ParseMediaType(contentType)
+		if mediaType != "" && mediaType != MediaTypeJSON && !strings.HasSuffix(mediaType, "+json") {
+			return []byte(redactedValue)
+		}
+		var v interface{}
+		dec := stdjson.NewDecoder(bytes.NewReader(body))
+		dec.UseNumber()
+		if err := dec.Decode(&v); err != nil {
+			return []byte(redactedValue)
+		}
+		redacted, err := stdjson.Marshal(redactJSONValue(v, redact))
+		if err != nil {
+			return []byte(redactedValue)
+		}
+		return redacted
+	}
+}
+
+func redactJSONValue(v interface{}, keys map[string]bool) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			if keys[strings.ToLower(k)] {
+				v[k] = redactedValue
+				continue
+			}
+			v[k] = redactJSONValue(child, keys)
+		}
+	case []interface{}:
+		for i, child := range v {
+			v[i] = redactJSONValue(child, keys)
+		}
+	}
+	return v
+}
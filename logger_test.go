@@ -0,0 +1,149 @@
+package gopi_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+
+	"github.com/teejays/gopi"
+)
+
+// logLines returns the records written by a slog JSON handler to out
+func logLines(t *testing.T, out *bytes.Buffer) []map[string]interface{} {
+	var lines []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var record map[string]interface{}
+		assert.NoError(t, json.Unmarshal([]byte(line), &record))
+		lines = append(lines, record)
+	}
+	return lines
+}
+
+// findLog returns the first record with the message msg
+func findLog(lines []map[string]interface{}, msg string) map[string]interface{} {
+	for _, record := range lines {
+		if record["msg"] == msg {
+			return record
+		}
+	}
+	return nil
+}
+
+func TestLogger(t *testing.T) {
+	routes := []gopi.Route{
+		{
+			Method:      http.MethodPost,
+			Path:        "ping",
+			HandlerFunc: gopi.HandlerWrapper(http.MethodPost, SampleEndpoint),
+		},
+	}
+	post := func(t *testing.T, body string, opts ...gopi.ServerOption) *httptest.ResponseRecorder {
+		h, err := gopi.GetHandler(context.TODO(), routes, gopi.MiddlewareFuncs{}, opts...)
+		assert.NoError(t, err)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/api/v0/ping", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set(gopi.RequestIDHeader, "req-1")
+		h.ServeHTTP(w, r)
+		return w
+	}
+	newLogger := func(out *bytes.Buffer) *slog.Logger {
+		return slog.New(slog.NewJSONHandler(out, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	}
+
+	t.Run("Request Fields", func(t *testing.T) {
+		var out bytes.Buffer
+		w := post(t, `{"ping":"hello","request_error_with_msg":"boom"}`,
+			gopi.WithLogger(newLogger(&out)),
+			gopi.WithAccessLog(gopi.AccessLogConfig{Output: &bytes.Buffer{}}),
+			gopi.WithTracing(gopi.TracingConfig{TracerProvider: sdktrace.NewTracerProvider()}))
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+
+		record := findLog(logLines(t, &out), "Writing error to http response")
+		if assert.NotNil(t, record) {
+			assert.Equal(t, "ERROR", record["level"])
+			assert.Equal(t, "boom", record["error"])
+			assert.Equal(t, "req-1", record["request_id"])
+			assert.Len(t, record["trace_id"], 32)
+		}
+	})
+
+	t.Run("Level", func(t *testing.T) {
+		var out bytes.Buffer
+		level := &slog.LevelVar{}
+		level.Set(slog.LevelInfo)
+		opts := []gopi.ServerOption{gopi.WithLogger(newLogger(&out)), gopi.WithLogLevel(level)}
+
+		post(t, `{"ping":"hello"}`, opts...)
+		assert.Nil(t, findLog(logLines(t, &out), "[HTTP Handler] Starting..."))
+		assert.NotNil(t, findLog(logLines(t, &out), "[Gopi] Registered Endpoint"))
+
+		// The level can be changed while the server is running
+		out.Reset()
+		level.Set(slog.LevelDebug)
+		post(t, `{"ping":"hello"}`, opts...)
+		assert.NotNil(t, findLog(logLines(t, &out), "[HTTP Handler] Starting..."))
+	})
+
+	t.Run("Bodies Not Logged By Default", func(t *testing.T) {
+		var out bytes.Buffer
+		w := post(t, `{"ping":"s3cr3t"}`, gopi.WithLogger(newLogger(&out)))
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.NotContains(t, out.String(), "s3cr3t")
+	})
+
+	t.Run("Body Logging", func(t *testing.T) {
+		var out bytes.Buffer
+		w := post(t, `{"ping":"s3cr3t"}`,
+			gopi.WithLogger(newLogger(&out)),
+			gopi.WithBodyLogging(gopi.BodyLogConfig{Redact: gopi.RedactJSONFields("ping", "pong")}))
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), "s3cr3t")
+		assert.NotContains(t, out.String(), "s3cr3t")
+
+		lines := logLines(t, &out)
+		if record := findLog(lines, "api: request body"); assert.NotNil(t, record) {
+			assert.JSONEq(t, `{"ping":"[REDACTED]"}`, record["body"].(string))
+		}
+		if record := findLog(lines, "api: writeResponse: response body"); assert.NotNil(t, record) {
+			assert.Contains(t, record["body"], `"pong":"[REDACTED]"`)
+		}
+	})
+
+	t.Run("Body Logging Truncated", func(t *testing.T) {
+		var out bytes.Buffer
+		post(t, `{"ping":"hello"}`, gopi.WithLogger(newLogger(&out)), gopi.WithBodyLogging(gopi.BodyLogConfig{MaxSize: 5}))
+		record := findLog(logLines(t, &out), "api: request body")
+		if assert.NotNil(t, record) {
+			assert.Equal(t, `{"pin`, record["body"])
+			assert.Equal(t, true, record["truncated"])
+		}
+	})
+
+	t.Run("Outside A Request", func(t *testing.T) {
+		assert.Equal(t, slog.Default(), gopi.Logger(context.Background()))
+	})
+}
+
+func TestRedactJSONFields(t *testing.T) {
+	redact := gopi.RedactJSONFields("password", "Token")
+
+	got := redact("application/json", []byte(`{"user":"alice","password":"hunter2","nested":[{"token":"abc","n":1}]}`))
+	assert.JSONEq(t, `{"user":"alice","password":"[REDACTED]","nested":[{"token":"[REDACTED]","n":1}]}`, string(got))
+
+	// Bodies that can't be parsed are redacted altogether
+	assert.Equal(t, "[REDACTED]", string(redact("application/json", []byte(`{"password":`))))
+	assert.Equal(t, "[REDACTED]", string(redact("text/plain", []byte("password=hunter2"))))
+	assert.Equal(t, "", string(redact("application/json", nil)))
+}
@@ -0,0 +1,257 @@
+package gopi
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultMetricsPath is the route that the metrics are served on, unless configured otherwise
+	defaultMetricsPath = "/metrics"
+	// defaultMetricsNamespace prefixes the metric names, unless configured otherwise
+	defaultMetricsNamespace = "gopi"
+	// metricsContentType is the media type of the Prometheus text format
+	metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+var (
+	// DefaultDurationBuckets are the upper bounds, in seconds, of the buckets of the request latency histogram
+	DefaultDurationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+	// DefaultSizeBuckets are the upper bounds, in bytes, of the buckets of the response size histogram
+	DefaultSizeBuckets = []float64{100, 1000, 10000, 100000, 1000000, 10000000}
+)
+
+// MetricsConfig configures the metrics recorded by Metrics
+type MetricsConfig struct {
+	// Path is the route that the metrics are served on by WithMetrics, outside of the /api prefix. Defaults to
+	// /metrics.
+	Path string
+	// Namespace prefixes the metric names. Defaults to "gopi".
+	Namespace string
+	// DurationBuckets are the upper bounds, in seconds, of the buckets of the request latency histogram. Defaults to
+	// DefaultDurationBuckets.
+	DurationBuckets []float64
+	// SizeBuckets are the upper bounds, in bytes, of the buckets of the response size histogram. Defaults to
+	// DefaultSizeBuckets.
+	SizeBuckets []float64
+}
+
+func (cfg MetricsConfig) withDefaults() MetricsConfig {
+	if cfg.Path == "" {
+		cfg.Path = defaultMetricsPath
+	}
+	if cfg.Namespace == "" {
+		cfg.Namespace = defaultMetricsNamespace
+	}
+	if len(cfg.DurationBuckets) == 0 {
+		cfg.DurationBuckets = DefaultDurationBuckets
+	}
+	if len(cfg.SizeBuckets) == 0 {
+		cfg.SizeBuckets = DefaultSizeBuckets
+	}
+	cfg.DurationBuckets = sortedBuckets(cfg.DurationBuckets)
+	cfg.SizeBuckets = sortedBuckets(cfg.SizeBuckets)
+	return cfg
+}
+
+// sortedBuckets returns a sorted copy of buckets
+func sortedBuckets(buckets []float64) []float64 {
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	return buckets
+}
+
+// Metrics records the number, latency and response size of the requests handled by the server, and serves them in the
+// Prometheus text format. The requests are labeled by the template of their route (e.g. `/api/v1/users/{id}`), so
+// the number of series doesn't grow with the number of paths.
+type Metrics struct {
+	cfg MetricsConfig
+
+	mu        sync.Mutex
+	requests  map[metricLabels]uint64
+	durations map[metricLabels]*histogram
+	sizes     map[metricLabels]*histogram
+	// inFlight is labeled without the status, which isn't known until the request is over
+	inFlight map[metricLabels]int64
+}
+
+// metricLabels are the labels of a series
+type metricLabels struct {
+	method string
+	route  string
+	status string
+}
+
+// histogram counts observations in buckets
+type histogram struct {
+	// counts are not cumulative, the last one being for the observations over the largest bucket
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(buckets []float64, v float64) {
+	i := sort.SearchFloat64s(buckets, v)
+	h.counts[i]++
+	h.sum += v
+	h.count++
+}
+
+// NewMetrics returns Metrics configured with cfg. It is set up automatically by WithMetrics.
+func NewMetrics(cfg MetricsConfig) *Metrics {
+	return &Metrics{
+		cfg:       cfg.withDefaults(),
+		requests:  map[metricLabels]uint64{},
+		durations: map[metricLabels]*histogram{},
+		sizes:     map[metricLabels]*histogram{},
+		inFlight:  map[metricLabels]int64{},
+	}
+}
+
+// Middleware records the metrics of the requests passed to next. It must be used on a mux router, since it labels
+// requests with the template of the route they matched.
+func (m *Metrics) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := getRouteTemplate(r)
+		if route == "" {
+			route = "unknown"
+		}
+		labels := metricLabels{method: r.Method, route: route}
+
+		m.mu.Lock()
+		m.inFlight[labels]++
+		m.mu.Unlock()
+
+		rw := newResponseRecorder(w)
+		start := time.Now()
+		// Requests that panic are still recorded, with the status written by the recovery middleware
+		defer func() {
+			elapsed := time.Since(start).Seconds()
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			m.inFlight[labels]--
+
+			labels.status = strconv.Itoa(rw.Status())
+			m.requests[labels]++
+			m.histogram(m.durations, labels, m.cfg.DurationBuckets).observe(m.cfg.DurationBuckets, elapsed)
+			m.histogram(m.sizes, labels, m.cfg.SizeBuckets).observe(m.cfg.SizeBuckets, float64(rw.bytesWritten))
+		}()
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// histogram returns the histogram for labels in hs, creating it if needed. m.mu must be held.
+func (m *Metrics) histogram(hs map[metricLabels]*histogram, labels metricLabels, buckets []float64) *histogram {
+	h, ok := hs[labels]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(buckets)+1)}
+		hs[labels] = h
+	}
+	return h
+}
+
+// ServeHTTP serves the metrics in the Prometheus text format
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", metricsContentType)
+	err := m.WritePrometheus(w)
+	if err != nil {
+		Logger(r.Context()).Error("[Gopi] Writing metrics", "error", err)
+	}
+}
+
+// WritePrometheus writes the metrics to w in the Prometheus text format
+func (m *Metrics) WritePrometheus(w io.Writer) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	ns := m.cfg.Namespace + "_"
+
+	writeMetricHeader(bw, ns+"http_requests_total", "counter", "Total number of HTTP requests handled.")
+	for _, labels := range sortedLabels(m.requests) {
+		fmt.Fprintf(bw, "%shttp_requests_total%s %d\n", ns, labels.format(""), m.requests[labels])
+	}
+
+	writeMetricHeader(bw, ns+"http_requests_in_flight", "gauge", "Number of HTTP requests being handled.")
+	for _, labels := range sortedLabels(m.inFlight) {
+		fmt.Fprintf(bw, "%shttp_requests_in_flight%s %d\n", ns, labels.format(""), m.inFlight[labels])
+	}
+
+	writeHistogram(bw, ns+"http_request_duration_seconds", "Latency of the HTTP requests, in seconds.", m.durations, m.cfg.DurationBuckets)
+	writeHistogram(bw, ns+"http_response_size_bytes", "Size of the HTTP response bodies, in bytes.", m.sizes, m.cfg.SizeBuckets)
+
+	return bw.Flush()
+}
+
+func writeMetricHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func writeHistogram(w io.Writer, name, help string, hs map[metricLabels]*histogram, buckets []float64) {
+	writeMetricHeader(w, name, "histogram", help)
+	for _, labels := range sortedLabels(hs) {
+		h := hs[labels]
+		var cumulative uint64
+		for i, upper := range buckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", name, labels.format(formatMetricValue(upper)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", name, labels.format("+Inf"), h.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", name, labels.format(""), formatMetricValue(h.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", name, labels.format(""), h.count)
+	}
+}
+
+// sortedLabels returns the labels of the series in m, sorted so the output is stable
+func sortedLabels[V any](m map[metricLabels]V) []metricLabels {
+	labels := make([]metricLabels, 0, len(m))
+	for l := range m {
+		labels = append(labels, l)
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		a, b := labels[i], labels[j]
+		if a.route != b.route {
+			return a.route < b.route
+		}
+		if a.method != b.method {
+			return a.method < b.method
+		}
+		return a.status < b.status
+	})
+	return labels
+}
+
+// format returns the labels in the Prometheus text format, with the le label of a histogram bucket if it is set
+func (l metricLabels) format(le string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, `{method="%s",route="%s"`, escapeLabelValue(l.method), escapeLabelValue(l.route))
+	if l.status != "" {
+		fmt.Fprintf(&b, `,status="%s"`, l.status)
+	}
+	if le != "" {
+		fmt.Fprintf(&b, `,le="%s"`, le)
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(v string) string {
+	return labelValueEscaper.Replace(v)
+}
+
+func formatMetricValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,78 @@
+package gopi_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/teejays/gopi"
+)
+
+func TestMetrics(t *testing.T) {
+	routes := []gopi.Route{
+		{
+			Method:      http.MethodGet,
+			Path:        "users/{id}",
+			HandlerFunc: gopi.HandlerWrapper(http.MethodGet, SampleEndpoint),
+		},
+		{
+			Method: http.MethodGet,
+			Path:   "panic",
+			HandlerFunc: func(w http.ResponseWriter, r *http.Request) {
+				panic("oops")
+			},
+		},
+	}
+	h, err := gopi.GetHandler(context.TODO(), routes, gopi.MiddlewareFuncs{},
+		gopi.WithMetrics(gopi.MetricsConfig{Path: "/internal/metrics", DurationBuckets: []float64{1, 0.5}}),
+	)
+	assert.NoError(t, err)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+	query := "?req=" + url.QueryEscape(`{"ping":"hello"}`)
+	w := get("/api/v0/users/1" + query)
+	assert.Equal(t, http.StatusOK, w.Code)
+	size := w.Body.Len()
+	assert.Equal(t, http.StatusOK, get("/api/v0/users/2"+query).Code)
+	assert.Equal(t, http.StatusInternalServerError, get("/api/v0/panic").Code)
+
+	w = get("/internal/metrics")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", w.Header().Get("Content-Type"))
+	body := w.Body.String()
+
+	// Requests are labeled by the template of their route, not their path
+	for _, line := range []string{
+		`# TYPE gopi_http_requests_total counter`,
+		`gopi_http_requests_total{method="GET",route="/api/v0/users/{id}",status="200"} 2`,
+		`gopi_http_requests_total{method="GET",route="/api/v0/panic",status="500"} 1`,
+		`# TYPE gopi_http_requests_in_flight gauge`,
+		`gopi_http_requests_in_flight{method="GET",route="/api/v0/users/{id}"} 0`,
+		`# TYPE gopi_http_request_duration_seconds histogram`,
+		`gopi_http_request_duration_seconds_bucket{method="GET",route="/api/v0/users/{id}",status="200",le="0.5"} 2`,
+		`gopi_http_request_duration_seconds_bucket{method="GET",route="/api/v0/users/{id}",status="200",le="1"} 2`,
+		`gopi_http_request_duration_seconds_bucket{method="GET",route="/api/v0/users/{id}",status="200",le="+Inf"} 2`,
+		`gopi_http_request_duration_seconds_count{method="GET",route="/api/v0/users/{id}",status="200"} 2`,
+		`# TYPE gopi_http_response_size_bytes histogram`,
+		`gopi_http_response_size_bytes_bucket{method="GET",route="/api/v0/users/{id}",status="200",le="100"} 2`,
+		`gopi_http_response_size_bytes_count{method="GET",route="/api/v0/users/{id}",status="200"} 2`,
+	} {
+		assert.Contains(t, body, line+"\n")
+	}
+	assert.NotContains(t, body, "/api/v0/users/1")
+	// The metrics endpoint doesn't record itself
+	assert.NotContains(t, body, "/internal/metrics")
+
+	// The response sizes add up to what was written
+	assert.Contains(t, body, `gopi_http_response_size_bytes_sum{method="GET",route="/api/v0/users/{id}",status="200"} `+
+		strconv.Itoa(2*size)+"\n")
+}
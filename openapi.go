@@ -0,0 +1,899 @@
+package gopi
+
+import (
+	"bytes"
+	"encoding"
+	stdjson "encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"reflect"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/teejays/gopi/json"
+	"github.com/teejays/gopi/openapi"
+)
+
+const (
+	defaultOpenAPIPath   = "/openapi.json"
+	defaultOpenAPIUIPath = "/docs"
+	// openAPISecurityScheme is the name of the security scheme of the routes with Authenticate
+	openAPISecurityScheme = "auth"
+)
+
+// OpenAPIUI is the UI that presents the OpenAPI document of the server
+type OpenAPIUI int
+
+const (
+	// OpenAPISwaggerUI presents the document with Swagger UI. This is the default.
+	OpenAPISwaggerUI OpenAPIUI = iota
+	// OpenAPIRedoc presents the document with Redoc
+	OpenAPIRedoc
+	// OpenAPINoUI only serves the document
+	OpenAPINoUI
+)
+
+// OpenAPIConfig configures the OpenAPI document of the server (see WithOpenAPI)
+type OpenAPIConfig struct {
+	// Title of the API. Defaults to API.
+	Title string
+	// Version of the API (not of OpenAPI). Defaults to 0.0.0.
+	Version     string
+	Description string
+	// Servers serving the API. The paths of the document are relative to the path of the first one, so if it is e.g.
+	// https://example.com/api, the path of a route v1/users is /v1/users.
+	Servers []openapi.Server
+	// SecurityScheme describes how the AuthMiddleware authenticates clients, e.g. {Type: "http", Scheme: "bearer"}.
+	// The routes with Authenticate require it.
+	SecurityScheme *openapi.SecurityScheme
+	// Path is where the document is served, outside of the /api prefix. Defaults to /openapi.json.
+	Path string
+	// UIPath is where the UI is served, outside of the /api prefix. Defaults to /docs.
+	UIPath string
+	// UI defaults to OpenAPISwaggerUI
+	UI OpenAPIUI
+	// UIAssets overrides where the UI is loaded from, e.g. to serve it from your own server or to check it with
+	// Subresource Integrity hashes. Defaults to a pinned version of the UI on a public CDN.
+	UIAssets *OpenAPIUIAssets
+}
+
+// OpenAPIAsset is a script or a stylesheet of the UI
+type OpenAPIAsset struct {
+	URL string
+	// Integrity is the Subresource Integrity hash of the asset (e.g. sha384-...), which browsers check it against
+	Integrity string
+}
+
+// OpenAPIUIAssets are the files that the UI is loaded from
+type OpenAPIUIAssets struct {
+	Script OpenAPIAsset
+	// Stylesheet is only used by Swagger UI
+	Stylesheet OpenAPIAsset
+}
+
+func (cfg OpenAPIConfig) withDefaults() OpenAPIConfig {
+	if cfg.Title == "" {
+		cfg.Title = "API"
+	}
+	if cfg.Version == "" {
+		cfg.Version = "0.0.0"
+	}
+	if cfg.Path == "" {
+		cfg.Path = defaultOpenAPIPath
+	}
+	if cfg.UIPath == "" {
+		cfg.UIPath = defaultOpenAPIUIPath
+	}
+	return cfg
+}
+
+// RouteDoc describes a Route in the OpenAPI document of the server. The request and response schemas of the routes
+// whose HandlerFunc comes from HandlerWrapper (or GetGenericGetHandler, GetGenericPostPutPatchHandler and
+// WebSocketWrapper) are derived from its types.
+type RouteDoc struct {
+	Summary     string
+	Description string
+	Tags        []string
+	// OperationID defaults to the method and the path of the route, e.g. postV1UsersId
+	OperationID string
+	Deprecated  bool
+	// Hidden leaves the route out of the document
+	Hidden bool
+	// Request and Response are values of the request and response types of the route, for HandlerFuncs whose types
+	// gopi can't know, e.g. when they are wrapped in another func
+	Request  interface{}
+	Response interface{}
+	// RequestExample and ResponseExample are example values of the request and of the response data
+	RequestExample  interface{}
+	ResponseExample interface{}
+}
+
+/* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+* H A N D L E R   T Y P E S
+* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
+
+// handlerKind is how a generic handler receives its request
+type handlerKind int
+
+const (
+	// handlerQuery handlers take their request as JSON in the `req` query param
+	handlerQuery handlerKind = iota + 1
+	// handlerBody handlers take their request in the body
+	handlerBody
+	// handlerWebSocket handlers exchange messages over a WebSocket
+	handlerWebSocket
+)
+
+// handlerTypes are the request and response types of a generic handler
+type handlerTypes struct {
+	kind handlerKind
+	req  reflect.Type
+	resp reflect.Type
+}
+
+// handlerDescriber is the http.ResponseWriter that getHandlerTypes passes to a generic handler, which then reports its
+// types instead of handling a request
+type handlerDescriber struct {
+	http.ResponseWriter
+	types handlerTypes
+}
+
+// describeHandler wraps the generic handler h so it can report its types, for the OpenAPI document to describe them
+func describeHandler[ReqT, RespT any](kind handlerKind, h http.HandlerFunc) http.HandlerFunc {
+	types := handlerTypes{kind: kind, req: typeOf[ReqT](), resp: typeOf[RespT]()}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if d, ok := w.(*handlerDescriber); ok {
+			d.types = types
+			return
+		}
+		h(w, r)
+	}
+}
+
+// describedHandlerName is the name of the funcs returned by describeHandler, which is the same for all its type
+// arguments. It tells them apart from other handlers, which can't be called just to get their types.
+var describedHandlerName = funcName(describeHandler[struct{}, struct{}](0, nil))
+
+func funcName(h http.HandlerFunc) string {
+	f := runtime.FuncForPC(reflect.ValueOf(h).Pointer())
+	if f == nil {
+		return ""
+	}
+	return f.Name()
+}
+
+func typeOf[T any]() reflect.Type {
+	return reflect.TypeOf((*T)(nil)).Elem()
+}
+
+// getHandlerTypes returns the types of the request and the response of route, if they are known
+func getHandlerTypes(route Route) (handlerTypes, bool) {
+	if route.Doc.Request != nil || route.Doc.Response != nil {
+		kind := handlerBody
+		if route.Method == http.MethodGet {
+			kind = handlerQuery
+		}
+		return handlerTypes{kind: kind, req: reflect.TypeOf(route.Doc.Request), resp: reflect.TypeOf(route.Doc.Response)}, true
+	}
+	if route.HandlerFunc == nil {
+		return handlerTypes{}, false
+	}
+	if funcName(route.HandlerFunc) != describedHandlerName {
+		return handlerTypes{}, false
+	}
+	d := &handlerDescriber{}
+	route.HandlerFunc(d, nil)
+	return d.types, d.types.kind != 0
+}
+
+// streamElement is implemented by the request and response streams, whose elements are described rather than the
+// stream itself
+type streamElement interface {
+	streamElementType() reflect.Type
+}
+
+var streamElementType = reflect.TypeOf((*streamElement)(nil)).Elem()
+
+// elementType returns the type of the elements of t if it is a stream
+func elementType(t reflect.Type) (reflect.Type, bool) {
+	if t == nil || !t.Implements(streamElementType) {
+		return nil, false
+	}
+	return reflect.Zero(t).Interface().(streamElement).streamElementType(), true
+}
+
+/* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+* D O C U M E N T
+* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
+
+// GenerateOpenAPI returns the OpenAPI document of the routes, as served with WithOpenAPI, according to opts (e.g. the
+// JSON key transform)
+func GenerateOpenAPI(routes []Route, opts ...ServerOption) (*openapi.Document, error) {
+	options := newServerOptions(opts...)
+	cfg := OpenAPIConfig{}.withDefaults()
+	if options.openAPI != nil {
+		cfg = *options.openAPI
+	}
+	return generateOpenAPI(routes, options, cfg)
+}
+
+func generateOpenAPI(routes []Route, options serverOptions, cfg OpenAPIConfig) (*openapi.Document, error) {
+	doc := &openapi.Document{
+		OpenAPI: openapi.Version,
+		Info:    openapi.Info{Title: cfg.Title, Version: cfg.Version, Description: cfg.Description},
+		Servers: cfg.Servers,
+		Paths:   map[string]*openapi.PathItem{},
+	}
+	// Like the paths of the documents validated with WithOpenAPIValidation, the paths are relative to the first server
+	base := specBasePath(doc)
+	g := newSchemaGenerator()
+	for _, route := range routes {
+		if route.Doc.Hidden {
+			continue
+		}
+		path, params := openAPIPath(route)
+		path, ok := relativePath(path, base)
+		if !ok {
+			return nil, fmt.Errorf("route [%s %s]: path %s is not under the path %s of the first server", route.Method, route.Path, path, base)
+		}
+		op, err := g.operation(route, options, cfg, params)
+		if err != nil {
+			return nil, fmt.Errorf("route [%s %s]: %w", route.Method, route.Path, err)
+		}
+		item, ok := doc.Paths[path]
+		if !ok {
+			item = &openapi.PathItem{}
+			doc.Paths[path] = item
+		}
+		err = item.SetOperation(route.Method, op)
+		if err != nil {
+			return nil, fmt.Errorf("route [%s %s]: %w", route.Method, route.Path, err)
+		}
+	}
+
+	for _, tag := range sortedTags(doc) {
+		doc.Tags = append(doc.Tags, openapi.Tag{Name: tag})
+	}
+	if len(g.schemas) > 0 || cfg.SecurityScheme != nil {
+		doc.Components = &openapi.Components{}
+	}
+	if len(g.schemas) > 0 {
+		doc.Components.Schemas = g.schemas
+	}
+	if cfg.SecurityScheme != nil {
+		doc.Components.SecuritySchemes = map[string]*openapi.SecurityScheme{openAPISecurityScheme: cfg.SecurityScheme}
+	}
+	return doc, nil
+}
+
+// muxVarPattern matches the variables of mux path templates, e.g. {id} or {id:[0-9]+}
+var muxVarPattern = regexp.MustCompile(`\{([^{}:]+)(?::((?:[^{}]|\{[^{}]*\})+))?\}`)
+
+// openAPIPath returns the OpenAPI path of route, without the patterns of its variables, and its path parameters
+func openAPIPath(route Route) (string, []*openapi.Parameter) {
+	var params []*openapi.Parameter
+	path := muxVarPattern.ReplaceAllStringFunc("/api"+GetRoutePattern(route), func(v string) string {
+		m := muxVarPattern.FindStringSubmatch(v)
+		schema := &openapi.Schema{Type: openapi.Types{"string"}}
+		if m[2] != "" {
+			schema.Pattern = "^" + m[2] + "$"
+		}
+		params = append(params, &openapi.Parameter{Name: m[1], In: "path", Required: true, Schema: schema})
+		return "{" + m[1] + "}"
+	})
+	return path, params
+}
+
+// relativePath returns path relative to base, if it is under it
+func relativePath(path, base string) (string, bool) {
+	if base == "" {
+		return path, true
+	}
+	if path == base {
+		return "/", true
+	}
+	if !strings.HasPrefix(path, base+"/") {
+		return path, false
+	}
+	return strings.TrimPrefix(path, base), true
+}
+
+// operationID returns the default operation ID of route, e.g. postV1UsersId
+func operationID(route Route) string {
+	var b strings.Builder
+	b.WriteString(strings.ToLower(route.Method))
+	path := muxVarPattern.ReplaceAllString(GetRoutePattern(route), "{$1}")
+	words := strings.FieldsFunc(path, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for _, w := range words {
+		b.WriteString(strings.ToUpper(w[:1]) + w[1:])
+	}
+	return b.String()
+}
+
+// operation returns the OpenAPI operation of route
+func (g *schemaGenerator) operation(route Route, options serverOptions, cfg OpenAPIConfig, params []*openapi.Parameter) (*openapi.Operation, error) {
+	kt := newRouteConfig(route, options).jsonKeyTransform
+	op := &openapi.Operation{
+		OperationID: route.Doc.OperationID,
+		Summary:     route.Doc.Summary,
+		Description: route.Doc.Description,
+		Tags:        route.Doc.Tags,
+		Deprecated:  route.Doc.Deprecated,
+		Parameters:  params,
+		Responses:   map[string]*openapi.Response{},
+	}
+	if op.OperationID == "" {
+		op.OperationID = operationID(route)
+	}
+	if route.Authenticate && cfg.SecurityScheme != nil {
+		op.Security = []map[string][]string{{openAPISecurityScheme: {}}}
+	}
+	op.Responses["default"] = &openapi.Response{
+		Description: "Error",
+		Content:     map[string]*openapi.MediaType{MediaTypeJSON: {Schema: g.envelope(&openapi.Schema{Type: openapi.Types{"null"}}, kt)}},
+	}
+
+	types, ok := getHandlerTypes(route)
+	if !ok {
+		op.Responses["200"] = &openapi.Response{Description: "OK"}
+		return op, nil
+	}
+
+	// Request
+	reqExample, err := openAPIExample(route.Doc.RequestExample, kt)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case types.req == nil && types.kind != handlerWebSocket:
+		// Hand-written handlers may only describe their response
+	case types.kind == handlerQuery:
+		schema, err := g.schema(types.req, kt)
+		if err != nil {
+			return nil, err
+		}
+		op.Parameters = append(op.Parameters, &openapi.Parameter{
+			Name:        "req",
+			In:          "query",
+			Description: "The request, as JSON",
+			Required:    true,
+			Content:     map[string]*openapi.MediaType{MediaTypeJSON: {Schema: schema, Example: reqExample}},
+		})
+	case types.kind == handlerBody:
+		body := &openapi.RequestBody{Required: true, Content: map[string]*openapi.MediaType{}}
+		if elem, ok := elementType(types.req); ok {
+			schema, err := g.schema(elem, kt)
+			if err != nil {
+				return nil, err
+			}
+			body.Content[MediaTypeJSON] = &openapi.MediaType{Schema: &openapi.Schema{Type: openapi.Types{"array"}, Items: schema}, Example: reqExample}
+		} else {
+			schema, err := g.schema(types.req, kt)
+			if err != nil {
+				return nil, err
+			}
+			body.Content[MediaTypeJSON] = &openapi.MediaType{Schema: schema, Example: reqExample}
+			if hasFormFiles(types.req) {
+				body.Content[MediaTypeMultipartForm] = &openapi.MediaType{Schema: schema}
+			}
+		}
+		op.RequestBody = body
+	case types.kind == handlerWebSocket:
+		in, err := g.schema(types.req, kt)
+		if err != nil {
+			return nil, err
+		}
+		out, err := g.schema(types.resp, kt)
+		if err != nil {
+			return nil, err
+		}
+		op.Responses["101"] = &openapi.Response{
+			Description: fmt.Sprintf("Switching Protocols: the connection is upgraded to a WebSocket, on which the client sends %s messages and receives %s messages", schemaName(in), schemaName(out)),
+		}
+		return op, nil
+	}
+
+	// Response
+	if elem, ok := eventStreamElementType(types.resp); ok {
+		schema, err := g.schema(elem, kt)
+		if err != nil {
+			return nil, err
+		}
+		op.Responses["200"] = &openapi.Response{
+			Description: "A stream of events, whose data is described by the schema",
+			Content: map[string]*openapi.MediaType{
+				MediaTypeEventStream: {Schema: schema},
+				MediaTypeNDJSON:      {Schema: schema},
+			},
+		}
+		return op, nil
+	}
+	var data *openapi.Schema
+	if elem, ok := elementType(types.resp); ok {
+		items, err := g.schema(elem, kt)
+		if err != nil {
+			return nil, err
+		}
+		data = &openapi.Schema{Type: openapi.Types{"array"}, Items: items}
+	} else {
+		data, err = g.schema(types.resp, kt)
+		if err != nil {
+			return nil, err
+		}
+	}
+	resp := &openapi.MediaType{Schema: g.envelope(data, kt)}
+	if route.Doc.ResponseExample != nil {
+		resp.Example, err = openAPIExample(StandardResponse{StatusCode: http.StatusOK, Data: route.Doc.ResponseExample}, kt)
+		if err != nil {
+			return nil, err
+		}
+	}
+	op.Responses["200"] = &openapi.Response{Description: "OK", Content: map[string]*openapi.MediaType{MediaTypeJSON: resp}}
+	return op, nil
+}
+
+// envelope returns the schema of a StandardResponse with data
+func (g *schemaGenerator) envelope(data *openapi.Schema, kt json.KeyTransform) *openapi.Schema {
+	schema := &openapi.Schema{Type: openapi.Types{"object"}, Properties: map[string]*openapi.Schema{}}
+	for _, f := range json.StructFields(reflect.TypeOf(StandardResponse{}), json.WithKeyTransform(kt)) {
+		switch f.Field.Name {
+		case "StatusCode":
+			schema.Properties[f.Key] = &openapi.Schema{Type: openapi.Types{"integer"}}
+		case "Data":
+			schema.Properties[f.Key] = data
+		case "Error":
+			schema.Properties[f.Key] = &openapi.Schema{Type: openapi.Types{"string", "null"}}
+		}
+		schema.Required = append(schema.Required, f.Key)
+	}
+	return schema
+}
+
+// openAPIExample returns v as it is encoded in JSON with kt
+func openAPIExample(v interface{}, kt json.KeyTransform) (interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(v, json.WithKeyTransform(kt))
+	if err != nil {
+		return nil, fmt.Errorf("encoding example: %w", err)
+	}
+	var example interface{}
+	err = stdjson.Unmarshal(data, &example)
+	return example, err
+}
+
+// eventStreamElementType returns the type of the data of the events of t if it is an EventStream
+func eventStreamElementType(t reflect.Type) (reflect.Type, bool) {
+	if t == nil || !t.Implements(reflect.TypeOf((*eventStreamer)(nil)).Elem()) {
+		return nil, false
+	}
+	return elementType(t)
+}
+
+// hasFormFiles returns true if the struct type t has fields for uploaded files, so its requests are multipart forms
+func hasFormFiles(t reflect.Type) bool {
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct {
+		return false
+	}
+	for _, f := range json.StructFields(t) {
+		if isFormFileType(f.Field.Type) {
+			return true
+		}
+	}
+	return false
+}
+
+/* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+* S C H E M A S
+* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
+
+var (
+	timeType          = reflect.TypeOf(time.Time{})
+	rawMessageType    = reflect.TypeOf(stdjson.RawMessage{})
+	jsonMarshalerType = reflect.TypeOf((*stdjson.Marshaler)(nil)).Elem()
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// schemaKey identifies a component schema. A type has one per key transform.
+type schemaKey struct {
+	t  reflect.Type
+	kt json.KeyTransform
+}
+
+// schemaGenerator derives JSON schemas from Go types. Named struct types become component schemas, so that they are
+// only described once (and can be recursive).
+type schemaGenerator struct {
+	schemas map[string]*openapi.Schema
+	names   map[schemaKey]string
+}
+
+func newSchemaGenerator() *schemaGenerator {
+	return &schemaGenerator{schemas: map[string]*openapi.Schema{}, names: map[schemaKey]string{}}
+}
+
+// schemaName returns the name of the component that s refers to, or its type
+func schemaName(s *openapi.Schema) string {
+	if s.Ref != "" {
+		return strings.TrimPrefix(s.Ref, "#/components/schemas/")
+	}
+	if len(s.Type) > 0 {
+		return s.Type[0]
+	}
+	return "any"
+}
+
+// schema returns the schema of the values of t, as encoded in JSON with kt
+func (g *schemaGenerator) schema(t reflect.Type, kt json.KeyTransform) (*openapi.Schema, error) {
+	if t == nil {
+		return &openapi.Schema{}, nil
+	}
+	switch {
+	case t == timeType:
+		return &openapi.Schema{Type: openapi.Types{"string"}, Format: "date-time"}, nil
+	case t == formFileType:
+		return &openapi.Schema{Type: openapi.Types{"string"}, Format: "binary"}, nil
+	case t == rawMessageType:
+		return &openapi.Schema{}, nil
+	case t.Kind() != reflect.Ptr && (t.Implements(jsonMarshalerType) || reflect.PointerTo(t).Implements(jsonMarshalerType)):
+		// Custom encodings can't be described
+		return &openapi.Schema{}, nil
+	case t.Kind() != reflect.Ptr && (t.Implements(textMarshalerType) || reflect.PointerTo(t).Implements(textMarshalerType)):
+		return &openapi.Schema{Type: openapi.Types{"string"}}, nil
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return &openapi.Schema{Type: openapi.Types{"boolean"}}, nil
+	case reflect.Int8, reflect.Int16, reflect.Int32:
+		return &openapi.Schema{Type: openapi.Types{"integer"}, Format: "int32"}, nil
+	case reflect.Int, reflect.Int64:
+		return &openapi.Schema{Type: openapi.Types{"integer"}, Format: "int64"}, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return &openapi.Schema{Type: openapi.Types{"integer"}, Minimum: openapi.Float(0)}, nil
+	case reflect.Float32:
+		return &openapi.Schema{Type: openapi.Types{"number"}, Format: "float"}, nil
+	case reflect.Float64:
+		return &openapi.Schema{Type: openapi.Types{"number"}, Format: "double"}, nil
+	case reflect.String:
+		return &openapi.Schema{Type: openapi.Types{"string"}}, nil
+	case reflect.Interface:
+		return &openapi.Schema{}, nil
+	case reflect.Ptr:
+		return g.schema(t.Elem(), kt)
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 && t.Kind() == reflect.Slice {
+			return &openapi.Schema{Type: openapi.Types{"string"}, ContentEncoding: "base64"}, nil
+		}
+		items, err := g.schema(t.Elem(), kt)
+		if err != nil {
+			return nil, err
+		}
+		schema := &openapi.Schema{Type: openapi.Types{"array"}, Items: items}
+		if t.Kind() == reflect.Array {
+			schema.MinItems, schema.MaxItems = openapi.Int(t.Len()), openapi.Int(t.Len())
+		}
+		return schema, nil
+	case reflect.Map:
+		values, err := g.schema(t.Elem(), kt)
+		if err != nil {
+			return nil, err
+		}
+		return &openapi.Schema{Type: openapi.Types{"object"}, AdditionalProperties: values}, nil
+	case reflect.Struct:
+		return g.structSchema(t, kt)
+	}
+	return nil, fmt.Errorf("type %s can't be encoded in JSON", t)
+}
+
+// structSchema returns a reference to the component schema of the struct type t, or the schema itself if t is
+// anonymous
+func (g *schemaGenerator) structSchema(t reflect.Type, kt json.KeyTransform) (*openapi.Schema, error) {
+	key := schemaKey{t: t, kt: kt}
+	if name, ok := g.names[key]; ok {
+		return &openapi.Schema{Ref: "#/components/schemas/" + name}, nil
+	}
+
+	schema := &openapi.Schema{Type: openapi.Types{"object"}, Properties: map[string]*openapi.Schema{}}
+	var name string
+	if t.Name() != "" {
+		// The component is registered before its fields are described, so they can refer to it
+		name = g.componentName(t, kt)
+		g.names[key] = name
+		g.schemas[name] = schema
+	}
+
+	for _, f := range json.StructFields(t, json.WithKeyTransform(kt)) {
+		prop, err := g.schema(f.Field.Type, kt)
+		if err != nil {
+			return nil, fmt.Errorf("field %s of %s: %w", f.Field.Name, t, err)
+		}
+		if applyValidateTag(prop, f.Field.Type, f.Field.Tag.Get("validate")) {
+			schema.Required = append(schema.Required, f.Key)
+		}
+		schema.Properties[f.Key] = prop
+	}
+
+	if name == "" {
+		return schema, nil
+	}
+	return &openapi.Schema{Ref: "#/components/schemas/" + name}, nil
+}
+
+// invalidNameChars matches the characters that can't be used in the names of components
+var invalidNameChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// componentName returns a unique name for the component schema of t
+func (g *schemaGenerator) componentName(t reflect.Type, kt json.KeyTransform) string {
+	clean := func(s string) string {
+		return strings.Trim(invalidNameChars.ReplaceAllString(s, "_"), "_")
+	}
+	pkg := t.PkgPath()
+	if i := strings.LastIndex(pkg, "/"); i >= 0 {
+		pkg = pkg[i+1:]
+	}
+	candidates := []string{
+		clean(t.Name()),
+		clean(pkg + "." + t.Name()),
+		clean(pkg + "." + t.Name() + "." + kt.String()),
+	}
+	for _, name := range candidates {
+		if _, taken := g.schemas[name]; !taken && name != "" {
+			return name
+		}
+	}
+	for i := 2; ; i++ {
+		name := candidates[len(candidates)-1] + strconv.Itoa(i)
+		if _, taken := g.schemas[name]; !taken {
+			return name
+		}
+	}
+}
+
+// Patterns of the validate tags that are described as a pattern
+var validatePatterns = map[string]string{
+	"alpha":    "^[a-zA-Z]+$",
+	"alphanum": "^[a-zA-Z0-9]+$",
+	"numeric":  "^[-+]?[0-9]+(?:\\.[0-9]+)?$",
+	"number":   "^[0-9]+$",
+}
+
+// Formats of the validate tags that are described as a format
+var validateFormats = map[string]string{
+	"email":    "email",
+	"url":      "uri",
+	"uri":      "uri",
+	"uuid":     "uuid",
+	"uuid4":    "uuid",
+	"ipv4":     "ipv4",
+	"ipv6":     "ipv6",
+	"hostname": "hostname",
+}
+
+// applyValidateTag adds the constraints of the validate tag of a field of type t to its schema, as far as JSON Schema
+// can express them. It returns true if the field is required.
+func applyValidateTag(schema *openapi.Schema, t reflect.Type, tag string) bool {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	required := false
+	rules := strings.Split(tag, ",")
+	for i, rule := range rules {
+		name, param, _ := strings.Cut(rule, "=")
+		switch {
+		case name == "dive":
+			// The rest of the rules apply to the elements
+			elem := schema.Items
+			if t.Kind() == reflect.Map {
+				elem = schema.AdditionalProperties
+			}
+			if elem != nil && (t.Kind() == reflect.Slice || t.Kind() == reflect.Array || t.Kind() == reflect.Map) {
+				applyValidateTag(elem, t.Elem(), strings.Join(rules[i+1:], ","))
+			}
+			return required
+		case strings.Contains(rule, "|"):
+			// Alternatives can't be described
+		case name == "required":
+			required = true
+		case name == "notblank":
+			required = true
+			if t.Kind() == reflect.String {
+				schema.MinLength = openapi.Int(1)
+			}
+		case name == "unique":
+			schema.UniqueItems = true
+		case name == "oneof":
+			for _, v := range strings.Fields(param) {
+				schema.Enum = append(schema.Enum, enumValue(t, v))
+			}
+		case name == "min" || name == "max" || name == "len" || name == "gt" || name == "gte" || name == "lt" || name == "lte":
+			applyValidateBound(schema, t, name, param)
+		case validatePatterns[name] != "":
+			schema.Pattern = validatePatterns[name]
+		case validateFormats[name] != "":
+			schema.Format = validateFormats[name]
+		}
+	}
+	return required
+}
+
+// applyValidateBound adds the constraint of a min, max, len, gt, gte, lt or lte rule, which bounds the length of
+// strings, arrays and objects, and the value of numbers
+func applyValidateBound(schema *openapi.Schema, t reflect.Type, rule, param string) {
+	n, err := strconv.ParseFloat(param, 64)
+	if err != nil {
+		return
+	}
+	switch t.Kind() {
+	case reflect.String, reflect.Slice, reflect.Array, reflect.Map:
+		length := int(n)
+		var min, max **int
+		switch t.Kind() {
+		case reflect.String:
+			min, max = &schema.MinLength, &schema.MaxLength
+		case reflect.Map:
+			min, max = &schema.MinProperties, &schema.MaxProperties
+		default:
+			min, max = &schema.MinItems, &schema.MaxItems
+		}
+		switch rule {
+		case "min", "gte":
+			*min = openapi.Int(length)
+		case "gt":
+			*min = openapi.Int(length + 1)
+		case "max", "lte":
+			*max = openapi.Int(length)
+		case "lt":
+			*max = openapi.Int(length - 1)
+		case "len":
+			*min, *max = openapi.Int(length), openapi.Int(length)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		switch rule {
+		case "min", "gte":
+			schema.Minimum = openapi.Float(n)
+		case "gt":
+			schema.ExclusiveMinimum = openapi.Float(n)
+		case "max", "lte":
+			schema.Maximum = openapi.Float(n)
+		case "lt":
+			schema.ExclusiveMaximum = openapi.Float(n)
+		case "len":
+			schema.Enum = []interface{}{n}
+		}
+	}
+}
+
+// enumValue returns the value v of a oneof rule as the JSON value of the type t
+func enumValue(t reflect.Type, v string) interface{} {
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		if n, err := strconv.ParseFloat(v, 64); err == nil {
+			return n
+		}
+	}
+	return v
+}
+
+/* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+* S E R V I N G
+* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
+
+// openAPIDocumentHandler serves doc as JSON
+func openAPIDocumentHandler(doc *openapi.Document) (http.Handler, error) {
+	body, err := stdjson.Marshal(doc)
+	if err != nil {
+		return nil, fmt.Errorf("encoding the OpenAPI document: %w", err)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", MediaTypeJSON)
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		if r.Method == http.MethodHead {
+			return
+		}
+		_, err := w.Write(body)
+		if err != nil {
+			Logger(r.Context()).Error("[Gopi] Writing OpenAPI document", "error", err)
+		}
+	}), nil
+}
+
+// The UIs load their assets from a CDN by default, so they don't have to be bundled with every server. The versions are
+// pinned so that a new release can't change what is served.
+var defaultOpenAPIUIAssets = map[OpenAPIUI]OpenAPIUIAssets{
+	OpenAPISwaggerUI: {
+		Script:     OpenAPIAsset{URL: "https://unpkg.com/swagger-ui-dist@5.17.14/swagger-ui-bundle.js"},
+		Stylesheet: OpenAPIAsset{URL: "https://unpkg.com/swagger-ui-dist@5.17.14/swagger-ui.css"},
+	},
+	OpenAPIRedoc: {
+		Script: OpenAPIAsset{URL: "https://cdn.redoc.ly/redoc/v2.1.5/bundles/redoc.standalone.js"},
+	},
+}
+
+var openAPIUITemplates = map[OpenAPIUI]*template.Template{
+	OpenAPISwaggerUI: template.Must(template.New("swagger").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<link rel="stylesheet" href="{{.Assets.Stylesheet.URL}}"{{with .Assets.Stylesheet.Integrity}} integrity="{{.}}" crossorigin="anonymous"{{end}}>
+</head>
+<body>
+<div id="swagger-ui"></div>
+<script src="{{.Assets.Script.URL}}"{{with .Assets.Script.Integrity}} integrity="{{.}}" crossorigin="anonymous"{{end}}></script>
+<script>window.ui = SwaggerUIBundle({url: {{.SpecURL}}, dom_id: "#swagger-ui"});</script>
+</body>
+</html>
+`)),
+	OpenAPIRedoc: template.Must(template.New("redoc").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+</head>
+<body>
+<redoc spec-url="{{.SpecURL}}"></redoc>
+<script src="{{.Assets.Script.URL}}"{{with .Assets.Script.Integrity}} integrity="{{.}}" crossorigin="anonymous"{{end}}></script>
+</body>
+</html>
+`)),
+}
+
+// openAPIUIHandler serves the UI of cfg, if any
+func openAPIUIHandler(cfg OpenAPIConfig) (http.Handler, bool) {
+	tmpl, ok := openAPIUITemplates[cfg.UI]
+	if !ok {
+		return nil, false
+	}
+	assets := defaultOpenAPIUIAssets[cfg.UI]
+	if cfg.UIAssets != nil {
+		assets = *cfg.UIAssets
+	}
+	var buf bytes.Buffer
+	err := tmpl.Execute(&buf, struct {
+		Title, SpecURL string
+		Assets         OpenAPIUIAssets
+	}{cfg.Title, cfg.Path, assets})
+	if err != nil {
+		// The templates only use strings, so this can't happen
+		panic(err)
+	}
+	page := buf.Bytes()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write(page)
+	}), true
+}
+
+// sortedTags returns the tags of the operations of doc, sorted
+func sortedTags(doc *openapi.Document) []string {
+	seen := map[string]bool{}
+	var tags []string
+	for _, item := range doc.Paths {
+		for _, op := range item.Operations() {
+			for _, tag := range op.Tags {
+				if !seen[tag] {
+					seen[tag] = true
+					tags = append(tags, tag)
+				}
+			}
+		}
+	}
+	sort.Strings(tags)
+	return tags
+}
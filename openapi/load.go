@@ -0,0 +1,70 @@
+package openapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Load parses an OpenAPI document, written in JSON or in YAML
+func Load(data []byte) (*Document, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] != '{' {
+		// YAML is loaded through JSON, so the documents are decoded the same way in both formats
+		var v interface{}
+		err := yaml.Unmarshal(data, &v)
+		if err != nil {
+			return nil, fmt.Errorf("openapi: parsing YAML: %w", err)
+		}
+		data, err = json.Marshal(stringKeys(v))
+		if err != nil {
+			return nil, fmt.Errorf("openapi: converting YAML to JSON: %w", err)
+		}
+	}
+
+	var doc Document
+	err := json.Unmarshal(data, &doc)
+	if err != nil {
+		return nil, fmt.Errorf("openapi: parsing document: %w", err)
+	}
+	if doc.OpenAPI == "" {
+		return nil, fmt.Errorf("openapi: the document has no openapi version")
+	}
+	return &doc, nil
+}
+
+// stringKeys converts the mappings of YAML values with non-string keys (e.g. response codes such as 200) to maps
+// with string keys, which can be encoded in JSON
+func stringKeys(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, x := range v {
+			m[fmt.Sprint(k)] = stringKeys(x)
+		}
+		return m
+	case map[string]interface{}:
+		for k, x := range v {
+			v[k] = stringKeys(x)
+		}
+		return v
+	case []interface{}:
+		for i, x := range v {
+			v[i] = stringKeys(x)
+		}
+		return v
+	}
+	return v
+}
+
+// LoadFile parses the OpenAPI document in the file at path, written in JSON or in YAML
+func LoadFile(path string) (*Document, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("openapi: %w", err)
+	}
+	return Load(data)
+}
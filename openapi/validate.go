@@ -0,0 +1,580 @@
+package openapi
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/mail"
+	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// maxRefDepth bounds the references (and compositions) followed without descending into the value, so that schemas
+// that refer to each other without ever reaching a value can't recurse forever
+const maxRefDepth = 64
+
+const componentSchemaPrefix = "#/components/schemas/"
+
+// ValidationError is a value that doesn't match its schema
+type ValidationError struct {
+	// In is where the value is: path, query, header or cookie for parameters, and body for bodies
+	In string `json:"in,omitempty"`
+	// Name is the name of the parameter, for parameters
+	Name string `json:"name,omitempty"`
+	// Path is the JSON pointer to the value within the parameter or the body, e.g. /users/0/email. It is empty for the
+	// whole value.
+	Path    string `json:"path,omitempty"`
+	Message string `json:"message"`
+}
+
+func (e ValidationError) Error() string {
+	var where []string
+	for _, s := range []string{e.In, e.Name, e.Path} {
+		if s != "" {
+			where = append(where, s)
+		}
+	}
+	if len(where) == 0 {
+		return e.Message
+	}
+	return strings.Join(where, " ") + ": " + e.Message
+}
+
+// ValidationErrors are all the ways in which a value doesn't match its schema
+type ValidationErrors []ValidationError
+
+func (errs ValidationErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// in sets In and Name on errs
+func (errs ValidationErrors) in(in, name string) ValidationErrors {
+	for i := range errs {
+		errs[i].In, errs[i].Name = in, name
+	}
+	return errs
+}
+
+// Validate returns the ways in which v doesn't match schema, or nil if it does. v is a value as decoded by
+// encoding/json (with or without UseNumber). References are resolved against the components of the document.
+func (d *Document) Validate(schema *Schema, v interface{}) ValidationErrors {
+	vd := validation{doc: d}
+	vd.validate(schema, v, "", 0)
+	return vd.errs
+}
+
+// ValidateJSON is Validate for an encoded JSON value
+func (d *Document) ValidateJSON(schema *Schema, data []byte) ValidationErrors {
+	v, err := decodeJSON(data)
+	if err != nil {
+		return ValidationErrors{{Message: "is not valid JSON"}}
+	}
+	return d.Validate(schema, v)
+}
+
+// ValidateParameter returns the ways in which the values of the parameter p in a request (e.g. all the values of a
+// query param) don't match its schema. Values described by a schema are converted to the type of the schema first,
+// and values described by a JSON content are decoded.
+func (d *Document) ValidateParameter(p *Parameter, values []string) ValidationErrors {
+	if len(values) == 0 {
+		if p.Required {
+			return ValidationErrors{{In: p.In, Name: p.Name, Message: "is required"}}
+		}
+		return nil
+	}
+
+	// Parameters described by a content have a single media type, whose schema applies to the decoded value
+	for mediaType, content := range p.Content {
+		if !isJSONMediaType(mediaType) || content.Schema == nil {
+			return nil
+		}
+		return d.ValidateJSON(content.Schema, []byte(values[0])).in(p.In, p.Name)
+	}
+	if p.Schema == nil {
+		return nil
+	}
+
+	schema, err := d.resolve(p.Schema)
+	if err != nil {
+		return ValidationErrors{{In: p.In, Name: p.Name, Message: err.Error()}}
+	}
+	var v interface{}
+	if schema.Type.Has("array") {
+		items, err := d.resolve(schema.Items)
+		if err != nil {
+			return ValidationErrors{{In: p.In, Name: p.Name, Message: err.Error()}}
+		}
+		var list []interface{}
+		for _, s := range values {
+			list = append(list, parseParameter(items, s))
+		}
+		v = list
+	} else {
+		v = parseParameter(schema, values[0])
+	}
+	return d.Validate(p.Schema, v).in(p.In, p.Name)
+}
+
+// parseParameter converts the parameter value s to the type of schema, if it can. Values that can't be converted are
+// left as strings, so that they fail the validation of their type.
+func parseParameter(schema *Schema, s string) interface{} {
+	if schema == nil {
+		return s
+	}
+	switch {
+	case schema.Type.Has("integer") || schema.Type.Has("number"):
+		if _, err := strconv.ParseFloat(s, 64); err == nil {
+			return json.Number(s)
+		}
+	case schema.Type.Has("boolean"):
+		if b, err := strconv.ParseBool(s); err == nil {
+			return b
+		}
+	case schema.Type.Has("null"):
+		if s == "" || s == "null" {
+			return nil
+		}
+	}
+	return s
+}
+
+// isJSONMediaType returns true if the values of mediaType are JSON, e.g. application/json or application/problem+json
+func isJSONMediaType(mediaType string) bool {
+	mediaType = strings.ToLower(strings.TrimSpace(strings.SplitN(mediaType, ";", 2)[0]))
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+func decodeJSON(data []byte) (interface{}, error) {
+	dec := json.NewDecoder(strings.NewReader(string(data)))
+	dec.UseNumber()
+	var v interface{}
+	err := dec.Decode(&v)
+	if err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, fmt.Errorf("unexpected data after the JSON value")
+	}
+	return v, nil
+}
+
+// resolve returns the schema that s refers to, if it is a reference
+func (d *Document) resolve(s *Schema) (*Schema, error) {
+	for depth := 0; s != nil && s.Ref != ""; depth++ {
+		if depth > maxRefDepth {
+			return nil, fmt.Errorf("the schema refers to itself")
+		}
+		name, ok := strings.CutPrefix(s.Ref, componentSchemaPrefix)
+		if !ok {
+			return nil, fmt.Errorf("unsupported reference %s", s.Ref)
+		}
+		var target *Schema
+		if d.Components != nil {
+			target = d.Components.Schemas[name]
+		}
+		if target == nil {
+			return nil, fmt.Errorf("unknown schema %s", name)
+		}
+		s = target
+	}
+	return s, nil
+}
+
+// validation collects the errors of validating a value
+type validation struct {
+	doc  *Document
+	errs ValidationErrors
+}
+
+func (vd *validation) fail(path, format string, args ...interface{}) {
+	vd.errs = append(vd.errs, ValidationError{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+// matches returns true if v matches schema, without recording its errors
+func (vd *validation) matches(schema *Schema, v interface{}, path string, depth int) bool {
+	sub := validation{doc: vd.doc}
+	sub.validate(schema, v, path, depth)
+	return len(sub.errs) == 0
+}
+
+// validate records the errors of v against schema. depth counts the schemas followed since the last descent into v.
+func (vd *validation) validate(schema *Schema, v interface{}, path string, depth int) {
+	if schema == nil {
+		return
+	}
+	if depth > maxRefDepth {
+		vd.fail(path, "the schema refers to itself")
+		return
+	}
+	if schema.Ref != "" {
+		target, err := vd.doc.resolve(&Schema{Ref: schema.Ref})
+		if err != nil {
+			vd.fail(path, "%s", err)
+			return
+		}
+		vd.validate(target, v, path, depth+1)
+		// In OpenAPI 3.1, the other keywords of a reference apply as well
+		rest := *schema
+		rest.Ref = ""
+		schema = &rest
+	}
+
+	// Composition
+	for _, sub := range schema.AllOf {
+		vd.validate(sub, v, path, depth+1)
+	}
+	if len(schema.AnyOf) > 0 {
+		matched := false
+		for _, sub := range schema.AnyOf {
+			if vd.matches(sub, v, path, depth+1) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			vd.fail(path, "doesn't match any of the allowed schemas")
+		}
+	}
+	if len(schema.OneOf) > 0 {
+		n := 0
+		for _, sub := range schema.OneOf {
+			if vd.matches(sub, v, path, depth+1) {
+				n++
+			}
+		}
+		if n != 1 {
+			vd.fail(path, "has to match exactly one of the allowed schemas, but matches %d", n)
+		}
+	}
+	if schema.Not != nil && vd.matches(schema.Not, v, path, depth+1) {
+		if isEmptySchema(schema.Not) {
+			vd.fail(path, "is not allowed")
+		} else {
+			vd.fail(path, "matches a schema that is not allowed")
+		}
+	}
+
+	if len(schema.Type) > 0 && !typeMatches(schema.Type, v) {
+		vd.fail(path, "has to be of type %s", strings.Join(schema.Type, " or "))
+		return
+	}
+	if len(schema.Enum) > 0 && !inEnum(schema.Enum, v) {
+		vd.fail(path, "has to be one of %s", formatEnum(schema.Enum))
+	}
+
+	switch v := v.(type) {
+	case map[string]interface{}:
+		vd.validateObject(schema, v, path, depth)
+	case []interface{}:
+		vd.validateArray(schema, v, path, depth)
+	case string:
+		vd.validateString(schema, v, path)
+	case bool, nil:
+	default:
+		if n, ok := toFloat(v); ok {
+			vd.validateNumber(schema, n, path)
+		}
+	}
+}
+
+func (vd *validation) validateObject(schema *Schema, v map[string]interface{}, path string, depth int) {
+	for _, key := range schema.Required {
+		if _, ok := v[key]; !ok {
+			vd.fail(joinPointer(path, key), "is required")
+		}
+	}
+	if schema.MinProperties != nil && len(v) < *schema.MinProperties {
+		vd.fail(path, "has to have at least %d properties", *schema.MinProperties)
+	}
+	if schema.MaxProperties != nil && len(v) > *schema.MaxProperties {
+		vd.fail(path, "has to have at most %d properties", *schema.MaxProperties)
+	}
+
+	// The keys are sorted so the errors are always in the same order
+	keys := make([]string, 0, len(v))
+	for key := range v {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if prop, ok := schema.Properties[key]; ok {
+			vd.validate(prop, v[key], joinPointer(path, key), 0)
+			continue
+		}
+		if schema.AdditionalProperties == nil {
+			continue
+		}
+		if isFalseSchema(schema.AdditionalProperties) {
+			vd.fail(joinPointer(path, key), "is not an allowed property")
+			continue
+		}
+		vd.validate(schema.AdditionalProperties, v[key], joinPointer(path, key), 0)
+	}
+}
+
+func (vd *validation) validateArray(schema *Schema, v []interface{}, path string, depth int) {
+	if schema.MinItems != nil && len(v) < *schema.MinItems {
+		vd.fail(path, "has to have at least %d items", *schema.MinItems)
+	}
+	if schema.MaxItems != nil && len(v) > *schema.MaxItems {
+		vd.fail(path, "has to have at most %d items", *schema.MaxItems)
+	}
+	if schema.UniqueItems {
+	unique:
+		for i := range v {
+			for j := 0; j < i; j++ {
+				if jsonEqual(v[i], v[j]) {
+					vd.fail(path, "has to have unique items")
+					break unique
+				}
+			}
+		}
+	}
+	if schema.Items != nil {
+		for i, item := range v {
+			vd.validate(schema.Items, item, path+"/"+strconv.Itoa(i), 0)
+		}
+	}
+}
+
+func (vd *validation) validateString(schema *Schema, v string, path string) {
+	n := utf8.RuneCountInString(v)
+	if schema.MinLength != nil && n < *schema.MinLength {
+		vd.fail(path, "has to be at least %d characters long", *schema.MinLength)
+	}
+	if schema.MaxLength != nil && n > *schema.MaxLength {
+		vd.fail(path, "has to be at most %d characters long", *schema.MaxLength)
+	}
+	if schema.Pattern != "" {
+		re, err := compilePattern(schema.Pattern)
+		if err != nil {
+			vd.fail(path, "has an invalid pattern in its schema")
+		} else if !re.MatchString(v) {
+			vd.fail(path, "has to match the pattern %s", schema.Pattern)
+		}
+	}
+	if schema.Format != "" && !formatMatches(schema.Format, v) {
+		vd.fail(path, "has to be a valid %s", schema.Format)
+	}
+	if schema.ContentEncoding == "base64" {
+		if _, err := base64.StdEncoding.DecodeString(v); err != nil {
+			vd.fail(path, "has to be base64 encoded")
+		}
+	}
+}
+
+func (vd *validation) validateNumber(schema *Schema, n float64, path string) {
+	if schema.Minimum != nil && n < *schema.Minimum {
+		vd.fail(path, "has to be at least %v", *schema.Minimum)
+	}
+	if schema.Maximum != nil && n > *schema.Maximum {
+		vd.fail(path, "has to be at most %v", *schema.Maximum)
+	}
+	if schema.ExclusiveMinimum != nil && n <= *schema.ExclusiveMinimum {
+		vd.fail(path, "has to be greater than %v", *schema.ExclusiveMinimum)
+	}
+	if schema.ExclusiveMaximum != nil && n >= *schema.ExclusiveMaximum {
+		vd.fail(path, "has to be less than %v", *schema.ExclusiveMaximum)
+	}
+	if schema.MultipleOf != nil && *schema.MultipleOf > 0 {
+		q := n / *schema.MultipleOf
+		if math.Abs(q-math.Round(q)) > 1e-9 {
+			vd.fail(path, "has to be a multiple of %v", *schema.MultipleOf)
+		}
+	}
+	switch schema.Format {
+	case "int32":
+		if n < math.MinInt32 || n > math.MaxInt32 {
+			vd.fail(path, "has to be a 32-bit integer")
+		}
+	case "int64":
+		if n < math.MinInt64 || n >= math.MaxInt64 {
+			vd.fail(path, "has to be a 64-bit integer")
+		}
+	}
+}
+
+// typeMatches returns true if v is of one of the JSON types
+func typeMatches(types Types, v interface{}) bool {
+	for _, t := range types {
+		switch t {
+		case "null":
+			if v == nil {
+				return true
+			}
+		case "boolean":
+			if _, ok := v.(bool); ok {
+				return true
+			}
+		case "object":
+			if _, ok := v.(map[string]interface{}); ok {
+				return true
+			}
+		case "array":
+			if _, ok := v.([]interface{}); ok {
+				return true
+			}
+		case "string":
+			if _, ok := v.(string); ok {
+				return true
+			}
+		case "number":
+			if _, ok := toFloat(v); ok {
+				return true
+			}
+		case "integer":
+			if isInteger(v) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// toFloat returns the number v as a float64
+func toFloat(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case json.Number:
+		n, err := v.Float64()
+		return n, err == nil
+	}
+	return 0, false
+}
+
+// isInteger returns true if v is a number without a fractional part, e.g. 1 or 1.0
+func isInteger(v interface{}) bool {
+	if n, ok := v.(json.Number); ok {
+		if _, err := n.Int64(); err == nil {
+			return true
+		}
+	}
+	f, ok := toFloat(v)
+	return ok && !math.IsInf(f, 0) && f == math.Trunc(f)
+}
+
+// normalize returns v with its numbers as float64, so that values can be compared regardless of how they were decoded
+func normalize(v interface{}) interface{} {
+	switch x := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(x))
+		for k, e := range x {
+			m[k] = normalize(e)
+		}
+		return m
+	case []interface{}:
+		list := make([]interface{}, len(x))
+		for i, e := range x {
+			list[i] = normalize(e)
+		}
+		return list
+	}
+	if f, ok := toFloat(v); ok {
+		return f
+	}
+	return v
+}
+
+func jsonEqual(a, b interface{}) bool {
+	return reflect.DeepEqual(normalize(a), normalize(b))
+}
+
+func inEnum(enum []interface{}, v interface{}) bool {
+	for _, e := range enum {
+		if jsonEqual(e, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func formatEnum(enum []interface{}) string {
+	values := make([]string, len(enum))
+	for i, e := range enum {
+		b, _ := json.Marshal(e)
+		values[i] = string(b)
+	}
+	return strings.Join(values, ", ")
+}
+
+// joinPointer appends key to the JSON pointer path
+func joinPointer(path, key string) string {
+	return path + "/" + strings.NewReplacer("~", "~0", "/", "~1").Replace(key)
+}
+
+// isEmptySchema returns true if s allows any value
+func isEmptySchema(s *Schema) bool {
+	return reflect.DeepEqual(*s, Schema{})
+}
+
+// isFalseSchema returns true if s allows no value, i.e. it is the boolean schema false
+func isFalseSchema(s *Schema) bool {
+	return s.Not != nil && isEmptySchema(s.Not) && reflect.DeepEqual(*s, Schema{Not: s.Not})
+}
+
+// patterns caches the compiled patterns of the schemas
+var patterns sync.Map
+
+func compilePattern(pattern string) (*regexp.Regexp, error) {
+	if re, ok := patterns.Load(pattern); ok {
+		return re.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	patterns.Store(pattern, re)
+	return re, nil
+}
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// formatMatches returns true if the string v has the format. Unknown formats always match, as JSON Schema requires.
+func formatMatches(format, v string) bool {
+	switch format {
+	case "date-time":
+		_, err := time.Parse(time.RFC3339, v)
+		return err == nil
+	case "date":
+		_, err := time.Parse(time.DateOnly, v)
+		return err == nil
+	case "email":
+		addr, err := mail.ParseAddress(v)
+		return err == nil && addr.Address == v
+	case "uuid":
+		return uuidPattern.MatchString(v)
+	case "uri":
+		u, err := url.Parse(v)
+		return err == nil && u.Scheme != ""
+	case "ipv4":
+		ip := net.ParseIP(v)
+		return ip != nil && ip.To4() != nil && !strings.Contains(v, ":")
+	case "ipv6":
+		ip := net.ParseIP(v)
+		return ip != nil && strings.Contains(v, ":")
+	case "byte":
+		_, err := base64.StdEncoding.DecodeString(v)
+		return err == nil
+	}
+	return true
+}
@@ -0,0 +1,94 @@
+package openapi_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/teejays/gopi/openapi"
+)
+
+func TestValidate(t *testing.T) {
+	doc, err := openapi.Load([]byte(`{
+		"openapi": "3.1.0",
+		"info": {"title": "Test", "version": "1"},
+		"paths": {},
+		"components": {"schemas": {
+			"Node": {
+				"type": "object",
+				"properties": {"value": {"type": "integer"}, "next": {"$ref": "#/components/schemas/Node"}},
+				"additionalProperties": false
+			}
+		}}
+	}`))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	tests := []struct {
+		name   string
+		schema string
+		value  string
+		want   []string
+	}{
+		{name: "Type", schema: `{"type": "string"}`, value: `1`, want: []string{"has to be of type string"}},
+		{name: "Nullable", schema: `{"type": ["string", "null"]}`, value: `null`},
+		{name: "Integer", schema: `{"type": "integer"}`, value: `1.5`, want: []string{"has to be of type integer"}},
+		{name: "Integral Number", schema: `{"type": "integer"}`, value: `2.0`},
+		{name: "Enum", schema: `{"enum": ["a", 1]}`, value: `1.0`},
+		{name: "Exclusive Bounds", schema: `{"exclusiveMinimum": 0, "exclusiveMaximum": 10}`, value: `10`, want: []string{"has to be less than 10"}},
+		{name: "Pattern", schema: `{"pattern": "^[a-z]+$"}`, value: `"abc1"`, want: []string{"has to match the pattern ^[a-z]+$"}},
+		{name: "Unique Items", schema: `{"uniqueItems": true}`, value: `[1, 2, 1.0]`, want: []string{"has to have unique items"}},
+		{name: "Items", schema: `{"items": {"format": "uuid"}}`, value: `["nope"]`, want: []string{"/0: has to be a valid uuid"}},
+		{name: "One Of", schema: `{"oneOf": [{"type": "integer"}, {"type": "number"}]}`, value: `1`, want: []string{"has to match exactly one of the allowed schemas, but matches 2"}},
+		{name: "Any Of", schema: `{"anyOf": [{"type": "integer"}, {"type": "boolean"}]}`, value: `"x"`, want: []string{"doesn't match any of the allowed schemas"}},
+		{name: "False Schema", schema: `false`, value: `1`, want: []string{"is not allowed"}},
+		{name: "Recursive Reference", schema: `{"$ref": "#/components/schemas/Node"}`, value: `{"value": 1, "next": {"value": "2", "extra": true}}`, want: []string{
+			"/next/extra: is not an allowed property",
+			"/next/value: has to be of type integer",
+		}},
+		{name: "Unknown Reference", schema: `{"$ref": "#/components/schemas/Missing"}`, value: `1`, want: []string{"unknown schema Missing"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var schema openapi.Schema
+			if !assert.NoError(t, schema.UnmarshalJSON([]byte(tt.schema))) {
+				return
+			}
+			var got []string
+			for _, err := range doc.ValidateJSON(&schema, []byte(tt.value)) {
+				got = append(got, err.Error())
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestValidateParameter(t *testing.T) {
+	doc := &openapi.Document{}
+	ids := &openapi.Parameter{Name: "id", In: "query", Required: true, Schema: &openapi.Schema{
+		Type:  openapi.Types{"array"},
+		Items: &openapi.Schema{Type: openapi.Types{"integer"}, Minimum: openapi.Float(1)},
+	}}
+	assert.Empty(t, doc.ValidateParameter(ids, []string{"1", "2"}))
+	assert.Equal(t, openapi.ValidationErrors{
+		{In: "query", Name: "id", Path: "/1", Message: "has to be of type integer"},
+		{In: "query", Name: "id", Path: "/2", Message: "has to be at least 1"},
+	}, doc.ValidateParameter(ids, []string{"1", "x", "0"}))
+	assert.Equal(t, openapi.ValidationErrors{{In: "query", Name: "id", Message: "is required"}}, doc.ValidateParameter(ids, nil))
+
+	flag := &openapi.Parameter{Name: "X-Flag", In: "header", Schema: &openapi.Schema{Type: openapi.Types{"boolean"}}}
+	assert.Empty(t, doc.ValidateParameter(flag, []string{"true"}))
+	assert.Empty(t, doc.ValidateParameter(flag, nil))
+	assert.Len(t, doc.ValidateParameter(flag, []string{"maybe"}), 1)
+}
+
+func TestLoad(t *testing.T) {
+	_, err := openapi.Load([]byte(`{"info": {"title": "Test"}}`))
+	assert.Error(t, err)
+
+	doc, err := openapi.Load([]byte("openapi: 3.1.0\ninfo: {title: Test, version: '1'}\npaths:\n  /ping:\n    get:\n      responses:\n        200: {description: OK}\n"))
+	if assert.NoError(t, err) {
+		assert.NotNil(t, doc.Paths["/ping"].Get.Responses["200"])
+	}
+}
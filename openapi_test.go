@@ -0,0 +1,235 @@
+package gopi_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/teejays/gopi"
+	gopijson "github.com/teejays/gopi/json"
+	"github.com/teejays/gopi/openapi"
+)
+
+type openAPIUser struct {
+	ID        int64    `validate:"gte=1"`
+	FullName  string   `validate:"required,min=2,max=64"`
+	Email     string   `validate:"omitempty,email"`
+	Role      string   `validate:"oneof=admin member"`
+	Tags      []string `validate:"max=5,dive,notblank"`
+	CreatedAt time.Time
+	Manager   *openAPIUser
+}
+
+type openAPIUpload struct {
+	Title string `validate:"required"`
+	File  gopi.FormFile
+}
+
+func openAPIGetUser(ctx context.Context, req struct{ ID int64 }) (openAPIUser, error) {
+	return openAPIUser{ID: req.ID}, nil
+}
+
+func openAPICreateUser(ctx context.Context, req openAPIUser) (openAPIUser, error) {
+	return req, nil
+}
+
+func openAPIUploadFile(ctx context.Context, req openAPIUpload) (string, error) {
+	return req.Title, nil
+}
+
+func openAPIListUsers(ctx context.Context, req struct{}) (gopi.ResponseStream[openAPIUser], error) {
+	return gopi.StreamSeq[openAPIUser](func(yield func(openAPIUser) bool) {}), nil
+}
+
+func TestOpenAPI(t *testing.T) {
+	routes := []gopi.Route{
+		{
+			Method:      http.MethodGet,
+			Path:        "users/{id:[0-9]+}",
+			Version:     1,
+			HandlerFunc: gopi.HandlerWrapper(http.MethodGet, openAPIGetUser),
+			Doc: gopi.RouteDoc{
+				Summary:         "Get a user",
+				Tags:            []string{"users"},
+				ResponseExample: openAPIUser{ID: 1, FullName: "Ada Lovelace"},
+			},
+		},
+		{
+			Method:       http.MethodPost,
+			Path:         "users",
+			Version:      1,
+			HandlerFunc:  gopi.HandlerWrapper(http.MethodPost, openAPICreateUser),
+			Authenticate: true,
+			Doc:          gopi.RouteDoc{Tags: []string{"users"}, OperationID: "createUser"},
+		},
+		{
+			Method:      http.MethodPost,
+			Path:        "files",
+			HandlerFunc: gopi.HandlerWrapper(http.MethodPost, openAPIUploadFile),
+		},
+		{
+			Method:      http.MethodGet,
+			Path:        "users",
+			Version:     1,
+			HandlerFunc: gopi.HandlerWrapper(http.MethodGet, openAPIListUsers),
+		},
+		{
+			Method:  http.MethodDelete,
+			Path:    "users/{id}",
+			Version: 1,
+			HandlerFunc: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusNoContent)
+			},
+			Doc: gopi.RouteDoc{Response: openAPIUser{}},
+		},
+		{
+			Method:      http.MethodGet,
+			Path:        "internal",
+			HandlerFunc: gopi.HandlerWrapper(http.MethodGet, SampleEndpoint),
+			Doc:         gopi.RouteDoc{Hidden: true},
+		},
+	}
+	cfg := gopi.OpenAPIConfig{
+		Title:          "Users",
+		Version:        "1.2.3",
+		SecurityScheme: &openapi.SecurityScheme{Type: "http", Scheme: "bearer"},
+	}
+
+	doc, err := gopi.GenerateOpenAPI(routes, gopi.WithOpenAPI(cfg))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, openapi.Version, doc.OpenAPI)
+	assert.Equal(t, openapi.Info{Title: "Users", Version: "1.2.3"}, doc.Info)
+	assert.Equal(t, []openapi.Tag{{Name: "users"}}, doc.Tags)
+	assert.NotContains(t, doc.Paths, "/api/internal")
+
+	t.Run("Schemas", func(t *testing.T) {
+		user := doc.Components.Schemas["openAPIUser"]
+		if !assert.NotNil(t, user) {
+			return
+		}
+		assert.Equal(t, []string{"full_name"}, user.Required)
+		assert.Equal(t, openapi.Float(1), user.Properties["id"].Minimum)
+		assert.Equal(t, "int64", user.Properties["id"].Format)
+		assert.Equal(t, openapi.Int(2), user.Properties["full_name"].MinLength)
+		assert.Equal(t, openapi.Int(64), user.Properties["full_name"].MaxLength)
+		assert.Equal(t, "email", user.Properties["email"].Format)
+		assert.Equal(t, []interface{}{"admin", "member"}, user.Properties["role"].Enum)
+		assert.Equal(t, openapi.Int(5), user.Properties["tags"].MaxItems)
+		assert.Equal(t, openapi.Int(1), user.Properties["tags"].Items.MinLength)
+		assert.Equal(t, "date-time", user.Properties["created_at"].Format)
+		// Recursive types refer to their component
+		assert.Equal(t, "#/components/schemas/openAPIUser", user.Properties["manager"].Ref)
+	})
+
+	t.Run("Query Request", func(t *testing.T) {
+		op := doc.Paths["/api/v1/users/{id}"].Get
+		if !assert.NotNil(t, op) {
+			return
+		}
+		assert.Equal(t, "Get a user", op.Summary)
+		assert.Equal(t, "getV1UsersId", op.OperationID)
+		if assert.Len(t, op.Parameters, 2) {
+			assert.Equal(t, "id", op.Parameters[0].Name)
+			assert.Equal(t, "path", op.Parameters[0].In)
+			assert.Equal(t, "^[0-9]+$", op.Parameters[0].Schema.Pattern)
+			assert.Equal(t, "req", op.Parameters[1].Name)
+			assert.Contains(t, op.Parameters[1].Content[gopi.MediaTypeJSON].Schema.Properties, "id")
+		}
+		resp := op.Responses["200"].Content[gopi.MediaTypeJSON]
+		assert.Equal(t, "#/components/schemas/openAPIUser", resp.Schema.Properties["data"].Ref)
+		assert.Equal(t, map[string]interface{}{
+			"status_code": float64(200),
+			"data":        map[string]interface{}{"id": float64(1), "full_name": "Ada Lovelace", "email": "", "role": "", "tags": nil, "created_at": "0001-01-01T00:00:00Z", "manager": nil},
+			"error":       nil,
+		}, resp.Example)
+		assert.NotNil(t, op.Responses["default"])
+		assert.Empty(t, op.Security)
+	})
+
+	t.Run("Body Request", func(t *testing.T) {
+		op := doc.Paths["/api/v1/users"].Post
+		if !assert.NotNil(t, op) {
+			return
+		}
+		assert.Equal(t, "createUser", op.OperationID)
+		assert.Equal(t, "#/components/schemas/openAPIUser", op.RequestBody.Content[gopi.MediaTypeJSON].Schema.Ref)
+		assert.Equal(t, []map[string][]string{{"auth": {}}}, op.Security)
+		assert.Equal(t, cfg.SecurityScheme, doc.Components.SecuritySchemes["auth"])
+
+		op = doc.Paths["/api/v0/files"].Post
+		if assert.NotNil(t, op) && assert.Contains(t, op.RequestBody.Content, gopi.MediaTypeMultipartForm) {
+			upload := doc.Components.Schemas["openAPIUpload"]
+			assert.Equal(t, "binary", upload.Properties["file"].Format)
+		}
+	})
+
+	t.Run("Streams And Hand-Written Handlers", func(t *testing.T) {
+		op := doc.Paths["/api/v1/users"].Get
+		data := op.Responses["200"].Content[gopi.MediaTypeJSON].Schema.Properties["data"]
+		assert.Equal(t, openapi.Types{"array"}, data.Type)
+		assert.Equal(t, "#/components/schemas/openAPIUser", data.Items.Ref)
+
+		op = doc.Paths["/api/v1/users/{id}"].Delete
+		data = op.Responses["200"].Content[gopi.MediaTypeJSON].Schema.Properties["data"]
+		assert.Equal(t, "#/components/schemas/openAPIUser", data.Ref)
+		assert.Nil(t, op.RequestBody)
+
+		// Hand-written handlers without a Doc aren't called to get their types
+		undocumented := []gopi.Route{{
+			Method: http.MethodGet,
+			Path:   "plain",
+			HandlerFunc: func(w http.ResponseWriter, r *http.Request) {
+				t.Error("the handler was called")
+			},
+		}}
+		doc, err := gopi.GenerateOpenAPI(undocumented)
+		if assert.NoError(t, err) {
+			assert.NotNil(t, doc.Paths["/api/v0/plain"].Get)
+		}
+	})
+
+	t.Run("Key Transform", func(t *testing.T) {
+		doc, err := gopi.GenerateOpenAPI(routes, gopi.WithJSONKeyTransform(gopijson.CamelCaseKeys))
+		assert.NoError(t, err)
+		assert.Contains(t, doc.Components.Schemas["openAPIUser"].Properties, "fullName")
+	})
+
+	t.Run("Served", func(t *testing.T) {
+		h, err := gopi.GetHandler(context.TODO(), routes, gopi.MiddlewareFuncs{AuthMiddleware: func(next http.Handler) http.Handler { return next }}, gopi.WithOpenAPI(cfg))
+		if !assert.NoError(t, err) {
+			return
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/openapi.json", nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, gopi.MediaTypeJSON, w.Header().Get("Content-Type"))
+		var served openapi.Document
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &served))
+		assert.Equal(t, "Users", served.Info.Title)
+		assert.Len(t, served.Paths, len(doc.Paths))
+
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/docs", nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), "swagger-ui")
+		assert.Contains(t, w.Body.String(), "/openapi.json")
+		assert.Contains(t, w.Body.String(), "swagger-ui-dist@5.17.14/swagger-ui-bundle.js")
+
+		assets := &gopi.OpenAPIUIAssets{Script: gopi.OpenAPIAsset{URL: "/static/redoc.js", Integrity: "sha384-abc"}}
+		h, err = gopi.GetHandler(context.TODO(), routes, gopi.MiddlewareFuncs{AuthMiddleware: func(next http.Handler) http.Handler { return next }},
+			gopi.WithOpenAPI(gopi.OpenAPIConfig{UI: gopi.OpenAPIRedoc, UIPath: "/redoc", UIAssets: assets}))
+		if assert.NoError(t, err) {
+			w = httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/redoc", nil))
+			assert.Contains(t, w.Body.String(), "<redoc")
+			assert.Contains(t, w.Body.String(), `<script src="/static/redoc.js" integrity="sha384-abc" crossorigin="anonymous"></script>`)
+		}
+	})
+}
@@ -0,0 +1,301 @@
+package gopi
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/teejays/gopi/json"
+)
+
+// ServerOption configures optional behaviour of the handler built by GetHandler (and NewServer)
+type ServerOption func(*serverOptions)
+
+// serverOptions holds all the optional settings that can be provided through ServerOptions
+type serverOptions struct {
+	panicReporter    PanicReporter
+	disableRecovery  bool
+	jsonKeyTransform json.KeyTransform
+	strictJSON       bool
+	maxBodySize      int64
+	streamHeartbeat  time.Duration
+	formLimits       FormLimits
+	compression      *CompressionConfig
+	cacheStore       CacheStore
+	idempotencyStore IdempotencyStore
+	rateLimit        *RateLimit
+	limiterStore     LimiterStore
+	timeout          time.Duration
+	maxTimeout       time.Duration
+	metrics          *Metrics
+	tracing          *TracingConfig
+	accessLog        *AccessLogConfig
+	baseLogger       *slog.Logger
+	logLevel         slog.Leveler
+	bodyLog          *BodyLogConfig
+	disableHealth    bool
+	admin            *admin
+	openAPI          *OpenAPIConfig
+	spec             *specValidator
+
+	// health keeps the health checks, which can still be registered once the server is built
+	health *health
+
+	// concurrencyLimiter is shared by all the routes, so it limits the requests to the server as a whole
+	concurrencyLimiter *concurrencyLimiter
+
+	// webSockets keeps track of the WebSocket connections to the server, so they can be closed when it shuts down
+	webSockets *webSocketConns
+}
+
+// newServerOptions applies the provided ServerOptions on top of the defaults
+func newServerOptions(opts ...ServerOption) serverOptions {
+	o := serverOptions{
+		webSockets:       newWebSocketConns(),
+		health:           newHealth(HealthConfig{}),
+		cacheStore:       NewMemoryCacheStore(defaultCacheStoreSize),
+		idempotencyStore: NewMemoryIdempotencyStore(),
+		limiterStore:     NewMemoryLimiterStore(),
+	}
+	for _, opt := range opts {
+		if opt != nil {
+			opt(&o)
+		}
+	}
+	// The admin listener changes the log level at runtime, which needs a slog.LevelVar
+	if o.admin != nil {
+		o.admin.level = newAdminLevel(o.baseLogger, o.logLevel)
+		o.admin.logger = o.baseLogger
+		o.logLevel = o.admin.level
+	}
+	return o
+}
+
+// WithPanicReporter registers a hook that is called with every panic recovered by the default recovery middleware,
+// e.g. to forward it to an error tracker
+func WithPanicReporter(fn PanicReporter) ServerOption {
+	return func(o *serverOptions) {
+		o.panicReporter = fn
+	}
+}
+
+// WithoutRecovery disables the panic recovery middleware that GetHandler installs by default
+func WithoutRecovery() ServerOption {
+	return func(o *serverOptions) {
+		o.disableRecovery = true
+	}
+}
+
+// WithJSONKeyTransform sets the default key transform used for JSON requests and responses. Routes can override it
+// with their own JSONKeyTransform. The other encodings, e.g. MessagePack, keep the Go field names.
+func WithJSONKeyTransform(kt json.KeyTransform) ServerOption {
+	return func(o *serverOptions) {
+		o.jsonKeyTransform = kt
+	}
+}
+
+// WithStrictJSON enables strict decoding of JSON requests for all routes (see json.WithStrictDecoding). Routes can turn
+// it off with their StrictJSON setting.
+func WithStrictJSON() ServerOption {
+	return func(o *serverOptions) {
+		o.strictJSON = true
+	}
+}
+
+// WithMaxBodySize limits the size of request bodies, in bytes, for all routes. Requests with a larger body are
+// rejected with a 413. Routes can override it with their own MaxBodySize, or lift it with a negative one.
+func WithMaxBodySize(n int64) ServerOption {
+	return func(o *serverOptions) {
+		o.maxBodySize = n
+	}
+}
+
+// WithFormLimits sets the limits on multipart form requests for all routes. Zero fields use the defaults (see
+// FormLimits). Routes can override them with their own FormLimits.
+func WithFormLimits(l FormLimits) ServerOption {
+	return func(o *serverOptions) {
+		o.formLimits = l
+	}
+}
+
+// WithStreamHeartbeat sets the interval between heartbeats on Server-Sent Event streams for all routes (see
+// EventStream), which keep idle connections from being closed by proxies. Defaults to 15 seconds; a negative value disables heartbeats.
+// Routes can override it with their own StreamHeartbeat.
+func WithStreamHeartbeat(d time.Duration) ServerOption {
+	return func(o *serverOptions) {
+		o.streamHeartbeat = d
+	}
+}
+
+// WithCompression compresses the responses of all routes with CompressionMiddleware
+func WithCompression(cfg CompressionConfig) ServerOption {
+	return func(o *serverOptions) {
+		o.compression = &cfg
+	}
+}
+
+// WithCacheStore sets the store that the responses of Routes with a Cache policy are cached in. Defaults to an
+// in-memory store of 1000 responses.
+func WithCacheStore(store CacheStore) ServerOption {
+	return func(o *serverOptions) {
+		o.cacheStore = store
+	}
+}
+
+// WithIdempotencyStore sets the store that the responses of Routes with an Idempotency policy are kept in, to be
+// replayed to retries. Defaults to an in-memory store, which only deduplicates the requests made to this server.
+func WithIdempotencyStore(store IdempotencyStore) ServerOption {
+	return func(o *serverOptions) {
+		o.idempotencyStore = store
+	}
+}
+
+// WithRateLimit limits the requests that each client can make to the server as a whole (see RateLimitMiddleware).
+// Since it applies before the AuthMiddleware, it can't identify clients by their Principal; use the RateLimit of the
+// Routes for that.
+func WithRateLimit(limit RateLimit) ServerOption {
+	return func(o *serverOptions) {
+		o.rateLimit = &limit
+	}
+}
+
+// WithLimiterStore sets the store that keeps track of the requests of the clients for rate limiting. Defaults to an
+// in-memory store, which only limits the requests made to this server.
+func WithLimiterStore(store LimiterStore) ServerOption {
+	return func(o *serverOptions) {
+		o.limiterStore = store
+	}
+}
+
+// WithConcurrencyLimit limits the number of requests that the server handles at the same time. Once the limit is
+// reached, requests are queued by the Priority of their Route for a short while, and then rejected with a 503 and a
+// Retry-After header, so clients can back off instead of waiting on an overloaded server.
+func WithConcurrencyLimit(limit ConcurrencyLimit) ServerOption {
+	return func(o *serverOptions) {
+		if limit.MaxInFlight <= 0 {
+			o.concurrencyLimiter = nil
+			return
+		}
+		o.concurrencyLimiter = newConcurrencyLimiter(limit)
+	}
+}
+
+// WithTimeout sets the default timeout for requests. The context passed to handlers is canceled once it is over, and
+// the client gets a 504 unless the handler has already started writing its response. Routes can override it with
+// their own Timeout, and clients can ask for a shorter one with the TimeoutHeader.
+func WithTimeout(d time.Duration) ServerOption {
+	return func(o *serverOptions) {
+		o.timeout = d
+	}
+}
+
+// WithMaxTimeout sets the longest timeout that clients can ask for with the TimeoutHeader, which can then be longer
+// than the timeout of the route. By default, clients can only ask for shorter timeouts.
+func WithMaxTimeout(d time.Duration) ServerOption {
+	return func(o *serverOptions) {
+		o.maxTimeout = d
+	}
+}
+
+// WithMetrics records the number, latency and response size of the requests to the routes, and serves them in the
+// Prometheus text format on the configured Path (see Metrics)
+func WithMetrics(cfg MetricsConfig) ServerOption {
+	return func(o *serverOptions) {
+		o.metrics = NewMetrics(cfg)
+	}
+}
+
+// WithTracing starts an OpenTelemetry span for each request to the routes, continuing the trace propagated by the
+// client (see TracingMiddleware)
+func WithTracing(cfg TracingConfig) ServerOption {
+	return func(o *serverOptions) {
+		o.tracing = &cfg
+	}
+}
+
+// WithAccessLog logs each request to the routes once it has been handled, with its status, latency and size (see
+// AccessLogMiddleware)
+func WithAccessLog(cfg AccessLogConfig) ServerOption {
+	return func(o *serverOptions) {
+		o.accessLog = &cfg
+	}
+}
+
+// WithLogger sets the logger that the server logs to, which handlers can get with Logger. Defaults to slog.Default().
+func WithLogger(l *slog.Logger) ServerOption {
+	return func(o *serverOptions) {
+		o.baseLogger = l
+	}
+}
+
+// WithLogLevel only lets the server log at level or above, on top of the level of its logger. Passing a *slog.LevelVar
+// allows changing the level while the server is running.
+func WithLogLevel(level slog.Leveler) ServerOption {
+	return func(o *serverOptions) {
+		o.logLevel = level
+	}
+}
+
+// WithBodyLogging logs the bodies of the requests and responses of all routes at debug level, after passing them
+// through the Redact hook of cfg. Bodies are never logged otherwise, since they are likely to hold secrets and PII.
+func WithBodyLogging(cfg BodyLogConfig) ServerOption {
+	return func(o *serverOptions) {
+		cfg = cfg.withDefaults()
+		o.bodyLog = &cfg
+	}
+}
+
+// WithHealth configures the liveness and readiness endpoints, which are served by default at /healthz and /readyz
+func WithHealth(cfg HealthConfig) ServerOption {
+	return func(o *serverOptions) {
+		o.health.cfg = cfg.withDefaults()
+	}
+}
+
+// WithHealthChecks registers checks that the readiness endpoint runs, and the liveness endpoint too for the Liveness
+// ones. More can be registered once the server is built with Server.RegisterHealthCheck.
+func WithHealthChecks(checks ...HealthCheck) ServerOption {
+	return func(o *serverOptions) {
+		o.health.register(checks...)
+	}
+}
+
+// WithoutHealthEndpoints disables the liveness and readiness endpoints that GetHandler serves by default
+func WithoutHealthEndpoints() ServerOption {
+	return func(o *serverOptions) {
+		o.disableHealth = true
+	}
+}
+
+// WithAdmin enables the admin listener of the Server, which serves pprof, expvar, the routes and the middlewares of the
+// server, and lets operators change the log level, on its own address and behind its own AuthMiddleware. It is only
+// started by Server.StartServer, and never mounted on the handler returned by GetHandler.
+func WithAdmin(cfg AdminConfig) ServerOption {
+	return func(o *serverOptions) {
+		o.admin = newAdmin(cfg)
+	}
+}
+
+// logger returns the logger of the server, which only logs at the configured level or above
+func (o serverOptions) logger() *slog.Logger {
+	return newLogger(o.baseLogger, o.logLevel)
+}
+
+// WithOpenAPI serves the OpenAPI 3.1 document of the routes (see RouteDoc) and a UI to browse it, outside of the /api
+// prefix. The schemas of the requests and responses use the JSON key transform of each route, and the constraints of
+// their `validate` tags.
+func WithOpenAPI(cfg OpenAPIConfig) ServerOption {
+	return func(o *serverOptions) {
+		cfg = cfg.withDefaults()
+		o.openAPI = &cfg
+	}
+}
+
+// WithOpenAPIValidation validates the server against an OpenAPI document, for APIs designed spec-first. GetHandler
+// fails with a *SpecMismatchError unless every route implements an operation of the document (and every operation is
+// implemented, unless AllowExtraOperations is set). The requests that don't match their operation are rejected with a
+// 400 listing the mismatches, before they reach the handler.
+func WithOpenAPIValidation(cfg OpenAPIValidationConfig) ServerOption {
+	return func(o *serverOptions) {
+		o.spec = newSpecValidator(cfg)
+	}
+}
@@ -0,0 +1,279 @@
+package gopi
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ErrRateLimited is used when a client has made too many requests
+var ErrRateLimited = fmt.Errorf("too many requests, please try again later")
+
+// memoryLimiterSweepInterval is the number of requests after which MemoryLimiterStore evicts the clients that are no
+// longer limited
+const memoryLimiterSweepInterval = 1024
+
+// RateLimitAlgorithm is the algorithm used to enforce a RateLimit
+type RateLimitAlgorithm int
+
+const (
+	// RateLimitTokenBucket lets clients make up to Burst requests at once, then refills at Limit requests per Period
+	RateLimitTokenBucket RateLimitAlgorithm = iota
+	// RateLimitSlidingWindow lets clients make up to Limit requests in any Period (approximated by weighting the
+	// previous window)
+	RateLimitSlidingWindow
+)
+
+// RateLimitKeyFunc returns the key identifying the client that made a request, which is limited separately from the
+// others
+type RateLimitKeyFunc func(r *http.Request) string
+
+// RateLimitByIP identifies clients by their IP address. It uses the address of the connection, so if the server is
+// behind a proxy, make sure it is set from the forwarded headers (e.g. with handlers.ProxyHeaders).
+func RateLimitByIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// RateLimitByAPIKey identifies clients by the API key sent in header, and by their IP address if there is none
+func RateLimitByAPIKey(header string) RateLimitKeyFunc {
+	return func(r *http.Request) string {
+		if key := r.Header.Get(header); key != "" {
+			return "key:" + key
+		}
+		return "ip:" + RateLimitByIP(r)
+	}
+}
+
+// RateLimitByPrincipal identifies clients by their Principal, and by their IP address if they are not authenticated.
+// The Principal is only set on routes that go through the AuthMiddleware.
+func RateLimitByPrincipal(r *http.Request) string {
+	if p := Principal(r.Context()); p != "" {
+		return "principal:" + p
+	}
+	return "ip:" + RateLimitByIP(r)
+}
+
+// RateLimit limits the number of requests that each client can make
+type RateLimit struct {
+	// Limit is the number of requests allowed per Period. Rate limiting is disabled if it is not set.
+	Limit int
+	// Period is the time over which Limit applies. Defaults to a minute.
+	Period time.Duration
+	// Burst is the number of requests that can be made at once with RateLimitTokenBucket. Defaults to Limit.
+	Burst int
+	// Algorithm defaults to RateLimitTokenBucket
+	Algorithm RateLimitAlgorithm
+	// Key identifies the clients. Defaults to RateLimitByIP.
+	Key RateLimitKeyFunc
+}
+
+func (l RateLimit) withDefaults() RateLimit {
+	if l.Period <= 0 {
+		l.Period = time.Minute
+	}
+	if l.Burst <= 0 {
+		l.Burst = l.Limit
+	}
+	if l.Key == nil {
+		l.Key = RateLimitByIP
+	}
+	return l
+}
+
+// RateLimitResult is the outcome of a request against a RateLimit
+type RateLimitResult struct {
+	// Allowed is true if the request can go ahead
+	Allowed bool
+	// Remaining is the number of requests that the client can still make right now
+	Remaining int
+	// Reset is the time until the client's quota is fully restored
+	Reset time.Duration
+	// RetryAfter is the time until the client can make another request, if it isn't Allowed
+	RetryAfter time.Duration
+}
+
+// LimiterStore keeps track of the requests made by clients, to enforce RateLimits. Implementations must be safe for
+// concurrent use, e.g. a shared store (like Redis) to enforce limits across several servers.
+type LimiterStore interface {
+	// Allow records a request made by the client identified by key at now, and returns whether it is allowed by limit
+	Allow(ctx context.Context, key string, limit RateLimit, now time.Time) (RateLimitResult, error)
+}
+
+// RateLimitMiddleware returns a http.Handler middleware func that limits the requests of each client according to
+// limit, keeping track of them in store. The `RateLimit-Limit`, `RateLimit-Remaining` and `RateLimit-Reset` headers
+// tell clients about their quota, and requests over the limit get a 429 with a `Retry-After` header. If store fails,
+// requests are let through.
+func RateLimitMiddleware(limit RateLimit, store LimiterStore) mux.MiddlewareFunc {
+	limit = limit.withDefaults()
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if limit.Limit <= 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			res, err := store.Allow(r.Context(), limit.Key(r), limit, time.Now())
+			if err != nil {
+				Logger(r.Context()).Error("[Gopi] Checking rate limit, letting the request through", "error", err)
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			h := w.Header()
+			h.Set("RateLimit-Limit", strconv.Itoa(limit.Limit))
+			h.Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+			h.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(res.Reset)))
+			h.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", limit.Limit, ceilSeconds(limit.Period)))
+			if !res.Allowed {
+				h.Set("Retry-After", strconv.Itoa(max(ceilSeconds(res.RetryAfter), 1)))
+				writeError(w, r, http.StatusTooManyRequests, ErrRateLimited)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// ceilSeconds returns d in whole seconds, rounded up
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+/* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+* M E M O R Y   S T O R E
+* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
+
+// MemoryLimiterStore is a LimiterStore that keeps track of the clients in memory, for a single server
+type MemoryLimiterStore struct {
+	mu      sync.Mutex
+	clients map[string]*limiterState
+	calls   int
+}
+
+// limiterState is the state of a client for either algorithm
+type limiterState struct {
+	// Token bucket
+	tokens float64
+	last   time.Time
+
+	// Sliding window
+	windowStart time.Time
+	prevCount   int
+	count       int
+
+	// expiresAt is when the client's quota is fully restored, so its state can be forgotten
+	expiresAt time.Time
+}
+
+// NewMemoryLimiterStore returns an empty MemoryLimiterStore
+func NewMemoryLimiterStore() *MemoryLimiterStore {
+	return &MemoryLimiterStore{clients: map[string]*limiterState{}}
+}
+
+// Allow implements LimiterStore
+func (s *MemoryLimiterStore) Allow(ctx context.Context, key string, limit RateLimit, now time.Time) (RateLimitResult, error) {
+	limit = limit.withDefaults()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.calls++
+	if s.calls%memoryLimiterSweepInterval == 0 {
+		for k, st := range s.clients {
+			if now.After(st.expiresAt) {
+				delete(s.clients, k)
+			}
+		}
+	}
+
+	st, ok := s.clients[key]
+	if !ok {
+		st = &limiterState{tokens: float64(limit.Burst), last: now, windowStart: now}
+		s.clients[key] = st
+	}
+	if limit.Algorithm == RateLimitSlidingWindow {
+		return st.allowSlidingWindow(limit, now), nil
+	}
+	return st.allowTokenBucket(limit, now), nil
+}
+
+func (st *limiterState) allowTokenBucket(limit RateLimit, now time.Time) RateLimitResult {
+	// Tokens per second
+	rate := float64(limit.Limit) / limit.Period.Seconds()
+
+	if elapsed := now.Sub(st.last).Seconds(); elapsed > 0 {
+		st.tokens = math.Min(float64(limit.Burst), st.tokens+elapsed*rate)
+		st.last = now
+	}
+
+	var res RateLimitResult
+	if st.tokens >= 1 {
+		st.tokens--
+		res.Allowed = true
+	} else {
+		res.RetryAfter = secondsDuration((1 - st.tokens) / rate)
+	}
+	res.Remaining = int(st.tokens)
+	res.Reset = secondsDuration((float64(limit.Burst) - st.tokens) / rate)
+	st.expiresAt = now.Add(res.Reset)
+	return res
+}
+
+func (st *limiterState) allowSlidingWindow(limit RateLimit, now time.Time) RateLimitResult {
+	// Move the window forward to the one that now falls in
+	if elapsed := now.Sub(st.windowStart); elapsed >= limit.Period {
+		windows := int(elapsed / limit.Period)
+		if windows == 1 {
+			st.prevCount = st.count
+		} else {
+			st.prevCount = 0
+		}
+		st.count = 0
+		st.windowStart = st.windowStart.Add(time.Duration(windows) * limit.Period)
+	}
+
+	// The previous window counts in proportion to how much of it still overlaps with the last Period
+	elapsed := now.Sub(st.windowStart)
+	weight := 1 - float64(elapsed)/float64(limit.Period)
+	estimate := float64(st.prevCount)*weight + float64(st.count)
+
+	var res RateLimitResult
+	if estimate+1 <= float64(limit.Limit) {
+		st.count++
+		estimate++
+		res.Allowed = true
+	} else if st.count >= limit.Limit || st.prevCount == 0 {
+		// Only the next window will have room
+		res.RetryAfter = limit.Period - elapsed
+	} else {
+		// Wait until enough of the previous window has slid out
+		needed := 1 - float64(limit.Limit-1-st.count)/float64(st.prevCount)
+		res.RetryAfter = time.Duration(needed*float64(limit.Period)) - elapsed
+	}
+	res.Remaining = max(limit.Limit-int(math.Ceil(estimate)), 0)
+	// The requests of a window stop counting once the next one is over
+	switch {
+	case st.count > 0:
+		res.Reset = 2*limit.Period - elapsed
+	case st.prevCount > 0:
+		res.Reset = limit.Period - elapsed
+	}
+	st.expiresAt = st.windowStart.Add(2 * limit.Period)
+	return res
+}
+
+// secondsDuration converts a number of seconds to a time.Duration
+func secondsDuration(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
@@ -0,0 +1,153 @@
+package gopi_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/teejays/gopi"
+)
+
+func TestRateLimitMiddleware(t *testing.T) {
+	routes := []gopi.Route{
+		{
+			Method:      http.MethodGet,
+			Path:        "limited",
+			HandlerFunc: gopi.HandlerWrapper(http.MethodGet, SampleEndpoint),
+			RateLimit:   gopi.RateLimit{Limit: 2, Period: time.Minute},
+		},
+		{
+			Method:       http.MethodGet,
+			Path:         "limited-principal",
+			HandlerFunc:  gopi.HandlerWrapper(http.MethodGet, SampleEndpoint),
+			Authenticate: true,
+			RateLimit:    gopi.RateLimit{Limit: 1, Period: time.Minute, Key: gopi.RateLimitByPrincipal},
+		},
+		{
+			Method:      http.MethodGet,
+			Path:        "unlimited",
+			HandlerFunc: gopi.HandlerWrapper(http.MethodGet, SampleEndpoint),
+		},
+	}
+	auth := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := gopi.ContextWithPrincipal(r.Context(), r.Header.Get("Authorization"))
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+	h, err := gopi.GetHandler(context.TODO(), routes, gopi.MiddlewareFuncs{AuthMiddleware: auth})
+	assert.NoError(t, err)
+
+	get := func(path, remoteAddr, principal string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, path+"?req="+url.QueryEscape(`{"ping":"hello"}`), nil)
+		r.RemoteAddr = remoteAddr
+		r.Header.Set("Authorization", principal)
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	t.Run("By IP", func(t *testing.T) {
+		w := get("/api/v0/limited", "10.0.0.1:1234", "")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "2", w.Header().Get("RateLimit-Limit"))
+		assert.Equal(t, "1", w.Header().Get("RateLimit-Remaining"))
+		assert.Equal(t, "2;w=60", w.Header().Get("RateLimit-Policy"))
+
+		// Another port is still the same client
+		w = get("/api/v0/limited", "10.0.0.1:5678", "")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "0", w.Header().Get("RateLimit-Remaining"))
+
+		w = get("/api/v0/limited", "10.0.0.1:1234", "")
+		assert.Equal(t, http.StatusTooManyRequests, w.Code)
+		assert.Equal(t, "30", w.Header().Get("Retry-After"))
+		assert.JSONEq(t, `{"status_code":429,"data":null,"error":"`+gopi.ErrRateLimited.Error()+`"}`, w.Body.String())
+
+		w = get("/api/v0/limited", "10.0.0.2:1234", "")
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		// Routes without a limit aren't affected
+		w = get("/api/v0/unlimited", "10.0.0.1:1234", "")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Empty(t, w.Header().Get("RateLimit-Limit"))
+	})
+
+	t.Run("By principal", func(t *testing.T) {
+		w := get("/api/v0/limited-principal", "10.0.0.3:1234", "alice")
+		assert.Equal(t, http.StatusOK, w.Code)
+		w = get("/api/v0/limited-principal", "10.0.0.3:1234", "bob")
+		assert.Equal(t, http.StatusOK, w.Code)
+		w = get("/api/v0/limited-principal", "10.0.0.4:1234", "alice")
+		assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	})
+}
+
+func TestMemoryLimiterStore(t *testing.T) {
+	ctx := context.Background()
+	start := time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+
+	t.Run("Token bucket", func(t *testing.T) {
+		s := gopi.NewMemoryLimiterStore()
+		limit := gopi.RateLimit{Limit: 60, Period: time.Minute, Burst: 3}
+
+		for i := 0; i < 3; i++ {
+			res, err := s.Allow(ctx, "client", limit, start)
+			assert.NoError(t, err)
+			assert.True(t, res.Allowed)
+			assert.Equal(t, 2-i, res.Remaining)
+		}
+		res, _ := s.Allow(ctx, "client", limit, start)
+		assert.False(t, res.Allowed)
+		assert.Equal(t, time.Second, res.RetryAfter)
+		assert.Equal(t, 3*time.Second, res.Reset)
+
+		// One token is added every second
+		res, _ = s.Allow(ctx, "client", limit, start.Add(time.Second))
+		assert.True(t, res.Allowed)
+		res, _ = s.Allow(ctx, "client", limit, start.Add(time.Second))
+		assert.False(t, res.Allowed)
+
+		// The bucket doesn't fill over the burst
+		for i := 0; i < 3; i++ {
+			res, _ = s.Allow(ctx, "client", limit, start.Add(time.Hour))
+			assert.True(t, res.Allowed)
+		}
+		res, _ = s.Allow(ctx, "client", limit, start.Add(time.Hour))
+		assert.False(t, res.Allowed)
+	})
+
+	t.Run("Sliding window", func(t *testing.T) {
+		s := gopi.NewMemoryLimiterStore()
+		limit := gopi.RateLimit{Limit: 4, Period: time.Minute, Algorithm: gopi.RateLimitSlidingWindow}
+
+		for i := 0; i < 4; i++ {
+			res, _ := s.Allow(ctx, "client", limit, start.Add(time.Duration(i)*time.Second))
+			assert.True(t, res.Allowed)
+		}
+		res, _ := s.Allow(ctx, "client", limit, start.Add(30*time.Second))
+		assert.False(t, res.Allowed)
+		assert.Equal(t, 30*time.Second, res.RetryAfter)
+
+		// Halfway through the next window, half of the previous one still counts
+		res, _ = s.Allow(ctx, "client", limit, start.Add(90*time.Second))
+		assert.True(t, res.Allowed)
+		res, _ = s.Allow(ctx, "client", limit, start.Add(90*time.Second))
+		assert.True(t, res.Allowed)
+		assert.Equal(t, 0, res.Remaining)
+		res, _ = s.Allow(ctx, "client", limit, start.Add(90*time.Second))
+		assert.False(t, res.Allowed)
+		// A quarter of the previous window has to slide out for another request
+		assert.Equal(t, 15*time.Second, res.RetryAfter)
+
+		// After two windows, nothing counts anymore
+		res, _ = s.Allow(ctx, "client", limit, start.Add(3*time.Minute))
+		assert.True(t, res.Allowed)
+		assert.Equal(t, 3, res.Remaining)
+	})
+}
@@ -0,0 +1,83 @@
+package gopi
+
+import (
+	"fmt"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/gorilla/mux"
+)
+
+// PanicReporter is called with the value recovered from a panic in a handler and the stack trace at that point. It can
+// be used to report panics to an error tracker.
+type PanicReporter func(r *http.Request, recovered interface{}, stack []byte)
+
+// ErrPanic is the error that is written to the HTTP response when a handler panics
+var ErrPanic = fmt.Errorf("handler panicked while processing the request")
+
+// RecoveryMiddleware returns a http.Handler middleware func that recovers from any panic in the handlers further down
+// the chain, logs it and writes a 500 StandardResponse error. If reporter is not nil, it is called with every panic.
+func RecoveryMiddleware(reporter PanicReporter) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rw := newResponseRecorder(w)
+			defer func() {
+				rec := recover()
+				if rec == nil {
+					return
+				}
+				// http.ErrAbortHandler is used to deliberately abort a response, so let net/http handle it
+				if rec == http.ErrAbortHandler {
+					panic(rec)
+				}
+
+				stack := debug.Stack()
+				// Handlers with a timeout run in their own goroutine, which has the stack that matters
+				if p, ok := rec.(*handlerPanic); ok {
+					rec, stack = p.value, p.stack
+				}
+				logPanic(r, rec, stack, reporter)
+
+				// If the handler has already started writing the response, we can't write a clean error response.
+				// Abort the connection so the client doesn't mistake a partial response for a complete one.
+				if rw.wroteHeader {
+					panic(http.ErrAbortHandler)
+				}
+
+				writeError(rw, r, http.StatusInternalServerError, ErrPanic)
+			}()
+
+			next.ServeHTTP(rw, r)
+		})
+	}
+}
+
+// logPanic logs rec, a panic recovered from the handler of r, and reports it to reporter if it is not nil
+func logPanic(r *http.Request, rec interface{}, stack []byte, reporter PanicReporter) {
+	logFields := []interface{}{
+		"panic", fmt.Sprintf("%v", rec),
+		"http_method", r.Method,
+		"path", r.URL.Path,
+		"route", getRouteTemplate(r),
+		"stack", string(stack),
+	}
+	Logger(r.Context()).Error("[Gopi] Recovered from panic in HTTP handler", logFields...)
+
+	if reporter != nil {
+		reporter(r, rec, stack)
+	}
+}
+
+// getRouteTemplate returns the path template of the mux route that matched the request, or an empty string if there
+// is none
+func getRouteTemplate(r *http.Request) string {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return ""
+	}
+	tmpl, err := route.GetPathTemplate()
+	if err != nil {
+		return ""
+	}
+	return tmpl
+}
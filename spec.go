@@ -0,0 +1,434 @@
+package gopi
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/teejays/gopi/openapi"
+)
+
+// ErrRequestSpecMismatch is used when a request doesn't match the OpenAPI document of the server (see
+// WithOpenAPIValidation)
+var ErrRequestSpecMismatch = fmt.Errorf("the request doesn't match the API spec")
+
+// ErrResponseSpecMismatch is used when a response doesn't match the OpenAPI document of the server, if responses are
+// validated
+var ErrResponseSpecMismatch = fmt.Errorf("the response doesn't match the API spec")
+
+// maxSpecBodySize is the size, in bytes, over which the JSON bodies of requests are rejected rather than validated,
+// since they are held in memory to be validated
+const maxSpecBodySize = 10 << 20
+
+// ErrSpecBodyTooLarge is used when the JSON body of a request is too large to be validated against the API spec
+var ErrSpecBodyTooLarge = fmt.Errorf("the body of the request must be at most %d bytes to be validated against the API spec", maxSpecBodySize)
+
+// OpenAPIValidationConfig configures the validation of the routes, the requests and the responses against an OpenAPI
+// document (see WithOpenAPIValidation)
+type OpenAPIValidationConfig struct {
+	// Document is the spec, e.g. loaded with openapi.LoadFile. Its paths are relative to the path of its first server,
+	// if any (e.g. /api).
+	Document *openapi.Document
+	// AllowExtraOperations lets the document have operations that no route implements (yet). Routes without an
+	// operation are always an error.
+	AllowExtraOperations bool
+	// ValidateResponses also validates the JSON responses, which are then buffered. A response that doesn't match is
+	// replaced by a 500 error listing the mismatches, so this is meant for tests.
+	ValidateResponses bool
+}
+
+// SpecMismatchError lists the differences between the routes and the operations of an OpenAPI document
+type SpecMismatchError struct {
+	// Missing are the routes that have no operation in the document, e.g. GET /api/v1/users/{id}
+	Missing []string
+	// Extra are the operations of the document that no route implements
+	Extra []string
+}
+
+func (e *SpecMismatchError) Error() string {
+	var diffs []string
+	if len(e.Missing) > 0 {
+		diffs = append(diffs, "routes missing from the spec: "+strings.Join(e.Missing, ", "))
+	}
+	if len(e.Extra) > 0 {
+		diffs = append(diffs, "operations of the spec without a route: "+strings.Join(e.Extra, ", "))
+	}
+	return "the routes don't match the API spec: " + strings.Join(diffs, "; ")
+}
+
+// specValidator validates the routes, the requests and the responses of a server against an OpenAPI document
+type specValidator struct {
+	cfg OpenAPIValidationConfig
+	// operations are the operations of the document, by specKey
+	operations map[string]*specOperation
+}
+
+// specOperation is an operation of the document, which a route implements
+type specOperation struct {
+	doc *openapi.Document
+	op  *openapi.Operation
+	// name is the method and the path of the operation, e.g. GET /api/v1/users/{id}
+	name string
+	// params are the parameters of the path and of the operation
+	params            []*openapi.Parameter
+	validateResponses bool
+	// streamRequest is whether the route reads its request body as a RequestStream, whose elements are validated as
+	// they are decoded rather than against the schema of the body
+	streamRequest bool
+	// vars maps the path variables of the operation to the ones of the route that implements it
+	vars map[string]string
+}
+
+func newSpecValidator(cfg OpenAPIValidationConfig) *specValidator {
+	v := &specValidator{cfg: cfg, operations: map[string]*specOperation{}}
+	if cfg.Document == nil {
+		return v
+	}
+	base := specBasePath(cfg.Document)
+	for path, item := range cfg.Document.Paths {
+		for method, op := range item.Operations() {
+			v.operations[specKey(method, base+path)] = &specOperation{
+				doc:               cfg.Document,
+				op:                op,
+				name:              method + " " + base + path,
+				params:            mergeParameters(item.Parameters, op.Parameters),
+				validateResponses: cfg.ValidateResponses,
+			}
+		}
+	}
+	return v
+}
+
+// specBasePath returns the path of the first server of doc, which its paths are relative to
+func specBasePath(doc *openapi.Document) string {
+	if len(doc.Servers) == 0 {
+		return ""
+	}
+	u, err := url.Parse(doc.Servers[0].URL)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSuffix(u.Path, "/")
+}
+
+// specKey identifies an operation by its method and path template, regardless of the names and the patterns of the
+// path variables
+func specKey(method, path string) string {
+	return strings.ToUpper(method) + " " + muxVarPattern.ReplaceAllString(path, "{}")
+}
+
+// mergeParameters returns the parameters of a path and of one of its operations, which override the parameters of
+// the path with the same name and location
+func mergeParameters(pathParams, opParams []*openapi.Parameter) []*openapi.Parameter {
+	params := append([]*openapi.Parameter(nil), opParams...)
+	for _, p := range pathParams {
+		overridden := false
+		for _, o := range opParams {
+			if o.Name == p.Name && o.In == p.In {
+				overridden = true
+				break
+			}
+		}
+		if !overridden {
+			params = append(params, p)
+		}
+	}
+	return params
+}
+
+// check returns a *SpecMismatchError if routes don't implement exactly the operations of the document
+func (v *specValidator) check(routes []Route) error {
+	if v.cfg.Document == nil {
+		return fmt.Errorf("no OpenAPI document to validate against")
+	}
+	mismatch := &SpecMismatchError{}
+	implemented := map[string]bool{}
+	for _, route := range routes {
+		path, _ := openAPIPath(route)
+		key := specKey(route.Method, path)
+		if _, ok := v.operations[key]; !ok {
+			mismatch.Missing = append(mismatch.Missing, strings.ToUpper(route.Method)+" "+path)
+		}
+		implemented[key] = true
+	}
+	if !v.cfg.AllowExtraOperations {
+		for key, op := range v.operations {
+			if !implemented[key] {
+				mismatch.Extra = append(mismatch.Extra, op.name)
+			}
+		}
+	}
+	if len(mismatch.Missing) == 0 && len(mismatch.Extra) == 0 {
+		return nil
+	}
+	sort.Strings(mismatch.Missing)
+	sort.Strings(mismatch.Extra)
+	return mismatch
+}
+
+// operation returns the operation that route implements, if any
+func (v *specValidator) operation(route Route) *specOperation {
+	path, params := openAPIPath(route)
+	op, ok := v.operations[specKey(route.Method, path)]
+	if !ok {
+		return nil
+	}
+	// The variables of the route may be named differently than in the document, so they are matched by position
+	specVars := muxVarPattern.FindAllStringSubmatch(op.name, -1)
+	routeOp := *op
+	routeOp.vars = map[string]string{}
+	for i, p := range params {
+		routeOp.vars[specVars[i][1]] = p.Name
+	}
+	if types, ok := getHandlerTypes(route); ok {
+		_, routeOp.streamRequest = elementType(types.req)
+	}
+	return &routeOp
+}
+
+// middleware validates the requests (and, if enabled, the responses) of the operation
+func (s *specOperation) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		errs, err := s.validateRequest(r)
+		if err == ErrSpecBodyTooLarge {
+			writeError(w, r, http.StatusRequestEntityTooLarge, err)
+			return
+		}
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, err)
+			return
+		}
+		if len(errs) > 0 {
+			writeSpecError(w, r, http.StatusBadRequest, ErrRequestSpecMismatch, errs)
+			return
+		}
+		if !s.validateResponses {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		rec := &specRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.passthrough || !rec.wroteHeader {
+			return
+		}
+		errs = s.validateResponse(rec.status, rec.Header().Get("Content-Type"), rec.body.Bytes())
+		if len(errs) > 0 {
+			// The headers of the invalid response don't describe the error
+			for _, h := range []string{"Content-Length", "ETag", "Last-Modified"} {
+				rec.Header().Del(h)
+			}
+			writeSpecError(w, r, http.StatusInternalServerError, ErrResponseSpecMismatch, errs)
+			return
+		}
+		w.WriteHeader(rec.status)
+		_, err = w.Write(rec.body.Bytes())
+		if err != nil {
+			Logger(r.Context()).Error("[Gopi] Writing validated response", "error", err)
+		}
+	})
+}
+
+// validateRequest returns the ways in which r doesn't match the operation. Only JSON bodies are validated against
+// their schema, unless they are streamed; for other media types, only the media type is.
+func (s *specOperation) validateRequest(r *http.Request) (openapi.ValidationErrors, error) {
+	var errs openapi.ValidationErrors
+	vars := mux.Vars(r)
+	for _, p := range s.params {
+		var values []string
+		switch p.In {
+		case "path":
+			// Requests only reach the route if the path matches, so missing variables mean that the handler is called
+			// outside of the router, e.g. in tests
+			v, ok := vars[s.vars[p.Name]]
+			if !ok {
+				continue
+			}
+			values = []string{v}
+		case "query":
+			values = r.URL.Query()[p.Name]
+		case "header":
+			values = r.Header.Values(p.Name)
+		case "cookie":
+			if c, err := r.Cookie(p.Name); err == nil {
+				values = []string{c.Value}
+			}
+		}
+		errs = append(errs, s.doc.ValidateParameter(p, values)...)
+	}
+
+	body := s.op.RequestBody
+	if body == nil {
+		return errs, nil
+	}
+	mediaType := MediaTypeJSON
+	if ct := r.Header.Get("Content-Type"); ct != "" {
+		mt, _, err := mime.ParseMediaType(ct)
+		if err != nil {
+			return nil, ErrUnsupportedMediaType
+		}
+		mediaType = mt
+	}
+	content, ok := specContent(body.Content, mediaType)
+	if !ok {
+		return append(errs, openapi.ValidationError{In: "body", Message: fmt.Sprintf("can't be %s", mediaType)}), nil
+	}
+	if !isJSONMediaType(mediaType) || content.Schema == nil || s.streamRequest {
+		return errs, nil
+	}
+
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxSpecBodySize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxSpecBodySize {
+		return nil, ErrSpecBodyTooLarge
+	}
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(data))
+	if len(bytes.TrimSpace(data)) == 0 {
+		if body.Required {
+			errs = append(errs, openapi.ValidationError{In: "body", Message: "is required"})
+		}
+		return errs, nil
+	}
+	for _, e := range s.doc.ValidateJSON(content.Schema, data) {
+		e.In = "body"
+		errs = append(errs, e)
+	}
+	return errs, nil
+}
+
+// validateResponse returns the ways in which a response doesn't match the operation
+func (s *specOperation) validateResponse(code int, contentType string, body []byte) openapi.ValidationErrors {
+	resp := s.op.Responses[strconv.Itoa(code)]
+	if resp == nil {
+		resp = s.op.Responses[strconv.Itoa(code/100)+"XX"]
+	}
+	if resp == nil {
+		resp = s.op.Responses["default"]
+	}
+	if resp == nil {
+		return openapi.ValidationErrors{{Message: fmt.Sprintf("the status %d is not documented", code)}}
+	}
+	if len(resp.Content) == 0 || len(body) == 0 {
+		return nil
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	content, ok := specContent(resp.Content, mediaType)
+	if !ok {
+		return openapi.ValidationErrors{{In: "body", Message: fmt.Sprintf("can't be %s", mediaType)}}
+	}
+	if content.Schema == nil {
+		return nil
+	}
+	errs := s.doc.ValidateJSON(content.Schema, body)
+	for i := range errs {
+		errs[i].In = "body"
+	}
+	return errs
+}
+
+// specContent returns the description of the media type in content, which may be a range, e.g. image/* or */*
+func specContent(content map[string]*openapi.MediaType, mediaType string) (*openapi.MediaType, bool) {
+	if c, ok := content[mediaType]; ok {
+		return c, true
+	}
+	if main, _, ok := strings.Cut(mediaType, "/"); ok {
+		if c, ok := content[main+"/*"]; ok {
+			return c, true
+		}
+	}
+	c, ok := content["*/*"]
+	return c, ok
+}
+
+// isJSONMediaType returns true if mediaType is JSON, e.g. application/json or application/problem+json
+func isJSONMediaType(mediaType string) bool {
+	return mediaType == MediaTypeJSON || strings.HasSuffix(mediaType, "+json")
+}
+
+// writeSpecError writes err, with the details of the mismatches as its data
+func writeSpecError(w http.ResponseWriter, r *http.Request, code int, err error, errs openapi.ValidationErrors) {
+	requestLogger(r).Error("Writing error to http response", "error", err, "mismatches", errs.Error())
+
+	trace.SpanFromContext(r.Context()).RecordError(err)
+	writeResponse(w, r, code, StandardResponse{StatusCode: code, Data: errs, Error: err.Error()})
+}
+
+// specRecorder buffers a JSON response, so that it can be validated before it is written. Other responses (e.g.
+// streams) are written as they come, without being validated.
+type specRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	// passthrough is set once the response is written as it comes
+	passthrough bool
+	body        bytes.Buffer
+}
+
+func (rec *specRecorder) WriteHeader(code int) {
+	if rec.wroteHeader {
+		return
+	}
+	rec.status = code
+	rec.wroteHeader = true
+	mediaType, _, _ := mime.ParseMediaType(rec.Header().Get("Content-Type"))
+	if !isJSONMediaType(mediaType) {
+		rec.passthrough = true
+		rec.ResponseWriter.WriteHeader(code)
+	}
+}
+
+func (rec *specRecorder) Write(b []byte) (int, error) {
+	if !rec.wroteHeader {
+		rec.WriteHeader(http.StatusOK)
+	}
+	if rec.passthrough {
+		return rec.ResponseWriter.Write(b)
+	}
+	return rec.body.Write(b)
+}
+
+// Flush writes the response as it comes from now on, since the client is meant to get it before it is complete
+func (rec *specRecorder) Flush() {
+	if !rec.wroteHeader {
+		rec.WriteHeader(http.StatusOK)
+	}
+	if !rec.passthrough {
+		rec.passthrough = true
+		rec.ResponseWriter.WriteHeader(rec.status)
+		_, _ = rec.ResponseWriter.Write(rec.body.Bytes())
+		rec.body.Reset()
+	}
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker if the underlying http.ResponseWriter supports it, e.g. for WebSocket upgrades
+func (rec *specRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(rec.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	rec.passthrough = true
+	rec.wroteHeader = true
+	return conn, brw, nil
+}
+
+// Unwrap allows http.ResponseController to reach the underlying http.ResponseWriter
+func (rec *specRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
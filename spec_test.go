@@ -0,0 +1,265 @@
+package gopi_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/teejays/gopi"
+	"github.com/teejays/gopi/openapi"
+)
+
+const specYAML = `
+openapi: 3.1.0
+info:
+  title: Users
+  version: 1.0.0
+servers:
+  - url: https://example.com/api
+paths:
+  /v1/users/{userID}:
+    parameters:
+      - name: userID
+        in: path
+        required: true
+        schema:
+          type: integer
+          minimum: 1
+    get:
+      parameters:
+        - name: req
+          in: query
+          required: true
+          content:
+            application/json:
+              schema:
+                type: object
+      responses:
+        200:
+          description: OK
+          content:
+            application/json:
+              schema:
+                $ref: '#/components/schemas/UserResponse'
+  /v1/users:
+    post:
+      requestBody:
+        required: true
+        content:
+          application/json:
+            schema:
+              $ref: '#/components/schemas/User'
+      responses:
+        200:
+          description: OK
+        default:
+          description: Error
+components:
+  schemas:
+    User:
+      type: object
+      required: [full_name]
+      additionalProperties: false
+      properties:
+        id:
+          type: integer
+        full_name:
+          type: string
+          minLength: 2
+        email:
+          type: string
+          format: email
+    UserResponse:
+      type: object
+      required: [status_code, data]
+      properties:
+        status_code:
+          type: integer
+        data:
+          $ref: '#/components/schemas/User'
+`
+
+type specUser struct {
+	ID       int64
+	FullName string
+	Email    string `json:",omitempty"`
+}
+
+func TestOpenAPIValidation(t *testing.T) {
+	doc, err := openapi.Load([]byte(specYAML))
+	if !assert.NoError(t, err) {
+		return
+	}
+	getUser := func(ctx context.Context, req struct{}) (specUser, error) {
+		return specUser{ID: 1, FullName: "Ada Lovelace"}, nil
+	}
+	createUser := func(ctx context.Context, req specUser) (specUser, error) {
+		return req, nil
+	}
+	routes := []gopi.Route{
+		{
+			Method:      http.MethodGet,
+			Path:        "users/{id:[0-9]+}",
+			Version:     1,
+			HandlerFunc: gopi.HandlerWrapper(http.MethodGet, getUser),
+		},
+		{
+			Method:      http.MethodPost,
+			Path:        "users",
+			Version:     1,
+			HandlerFunc: gopi.HandlerWrapper(http.MethodPost, createUser),
+		},
+	}
+	do := func(h http.Handler, method, path, body string) (*httptest.ResponseRecorder, gopi.StandardResponse) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		if body != "" {
+			r.Header.Set("Content-Type", gopi.MediaTypeJSON)
+		}
+		h.ServeHTTP(w, r)
+		var resp gopi.StandardResponse
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp), w.Body.String())
+		return w, resp
+	}
+
+	h, err := gopi.GetHandler(context.TODO(), routes, gopi.MiddlewareFuncs{}, gopi.WithOpenAPIValidation(gopi.OpenAPIValidationConfig{Document: doc}))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	t.Run("Valid Requests", func(t *testing.T) {
+		w, _ := do(h, http.MethodGet, "/api/v1/users/1?req={}", "")
+		assert.Equal(t, http.StatusOK, w.Code)
+		w, _ = do(h, http.MethodPost, "/api/v1/users", `{"full_name": "Ada Lovelace", "email": "ada@example.com"}`)
+		assert.Equal(t, http.StatusOK, w.Code)
+	})
+
+	t.Run("Invalid Parameters", func(t *testing.T) {
+		w, resp := do(h, http.MethodGet, "/api/v1/users/0", "")
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Equal(t, gopi.ErrRequestSpecMismatch.Error(), resp.Error)
+		assert.Equal(t, []interface{}{
+			map[string]interface{}{"in": "query", "name": "req", "message": "is required"},
+			map[string]interface{}{"in": "path", "name": "userID", "message": "has to be at least 1"},
+		}, resp.Data)
+	})
+
+	t.Run("Invalid Body", func(t *testing.T) {
+		w, resp := do(h, http.MethodPost, "/api/v1/users", `{"full_name": "A", "email": "nope", "nickname": "al"}`)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Equal(t, []interface{}{
+			map[string]interface{}{"in": "body", "path": "/email", "message": "has to be a valid email"},
+			map[string]interface{}{"in": "body", "path": "/full_name", "message": "has to be at least 2 characters long"},
+			map[string]interface{}{"in": "body", "path": "/nickname", "message": "is not an allowed property"},
+		}, resp.Data)
+
+		w, resp = do(h, http.MethodPost, "/api/v1/users", "")
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Equal(t, []interface{}{map[string]interface{}{"in": "body", "message": "is required"}}, resp.Data)
+	})
+
+	t.Run("Body Too Large", func(t *testing.T) {
+		w, resp := do(h, http.MethodPost, "/api/v1/users", `{"full_name": "`+strings.Repeat("a", 10<<20)+`"}`)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+		assert.Equal(t, gopi.ErrSpecBodyTooLarge.Error(), resp.Error)
+	})
+
+	t.Run("Streamed Body", func(t *testing.T) {
+		// The body of a RequestStream isn't buffered to be validated as a whole, so the array isn't rejected for not
+		// being a User
+		routes := append([]gopi.Route(nil), routes...)
+		routes[1].HandlerFunc = gopi.HandlerWrapper(http.MethodPost, func(ctx context.Context, req gopi.RequestStream[specUser]) (int, error) {
+			n := 0
+			for range req.Chan(ctx) {
+				n++
+			}
+			return n, req.Err()
+		})
+		h, err := gopi.GetHandler(context.TODO(), routes, gopi.MiddlewareFuncs{}, gopi.WithOpenAPIValidation(gopi.OpenAPIValidationConfig{Document: doc}))
+		if !assert.NoError(t, err) {
+			return
+		}
+		w, resp := do(h, http.MethodPost, "/api/v1/users", `[{"full_name": "Ada Lovelace"}, {"full_name": "Alan Turing"}]`)
+		assert.Equal(t, http.StatusOK, w.Code, resp.Error)
+		assert.Equal(t, float64(2), resp.Data)
+	})
+
+	t.Run("Responses", func(t *testing.T) {
+		h, err := gopi.GetHandler(context.TODO(), routes, gopi.MiddlewareFuncs{},
+			gopi.WithOpenAPIValidation(gopi.OpenAPIValidationConfig{Document: doc, ValidateResponses: true}))
+		if !assert.NoError(t, err) {
+			return
+		}
+		w, resp := do(h, http.MethodGet, "/api/v1/users/1?req={}", "")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, map[string]interface{}{"id": float64(1), "full_name": "Ada Lovelace"}, resp.Data)
+
+		// The response of the handler has an ID, but no full name
+		routes := append([]gopi.Route(nil), routes...)
+		routes[0].HandlerFunc = gopi.HandlerWrapper(http.MethodGet, func(ctx context.Context, req struct{}) (map[string]int, error) {
+			return map[string]int{"id": 1}, nil
+		})
+		h, err = gopi.GetHandler(context.TODO(), routes, gopi.MiddlewareFuncs{},
+			gopi.WithOpenAPIValidation(gopi.OpenAPIValidationConfig{Document: doc, ValidateResponses: true}))
+		if !assert.NoError(t, err) {
+			return
+		}
+		w, resp = do(h, http.MethodGet, "/api/v1/users/1?req={}", "")
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+		assert.Equal(t, gopi.ErrResponseSpecMismatch.Error(), resp.Error)
+		assert.Equal(t, []interface{}{map[string]interface{}{"in": "body", "path": "/data/full_name", "message": "is required"}}, resp.Data)
+	})
+
+	t.Run("Generated Document", func(t *testing.T) {
+		// The paths of the generated documents are relative to the first server, like the ones of the validated documents
+		for server, path := range map[string]string{"": "/api/v1/users", "https://example.com": "/api/v1/users", "https://example.com/api/": "/v1/users"} {
+			var servers []openapi.Server
+			if server != "" {
+				servers = []openapi.Server{{URL: server}}
+			}
+			generated, err := gopi.GenerateOpenAPI(routes, gopi.WithOpenAPI(gopi.OpenAPIConfig{Servers: servers}))
+			if !assert.NoError(t, err, server) {
+				continue
+			}
+			assert.Contains(t, generated.Paths, path, server)
+			h, err := gopi.GetHandler(context.TODO(), routes, gopi.MiddlewareFuncs{}, gopi.WithOpenAPIValidation(gopi.OpenAPIValidationConfig{Document: generated}))
+			if !assert.NoError(t, err, server) {
+				continue
+			}
+			w, _ := do(h, http.MethodPost, "/api/v1/users", `{"full_name": "Ada Lovelace"}`)
+			assert.Equal(t, http.StatusOK, w.Code, server)
+		}
+
+		// The routes can't be served by a server with another path
+		_, err := gopi.GenerateOpenAPI(routes, gopi.WithOpenAPI(gopi.OpenAPIConfig{Servers: []openapi.Server{{URL: "https://example.com/v2"}}}))
+		assert.Error(t, err)
+	})
+
+	t.Run("Routes Mismatch", func(t *testing.T) {
+		mismatched := []gopi.Route{
+			routes[0],
+			{
+				Method:      http.MethodDelete,
+				Path:        "users/{id}",
+				Version:     1,
+				HandlerFunc: func(w http.ResponseWriter, r *http.Request) {},
+			},
+		}
+		_, err := gopi.GetHandler(context.TODO(), mismatched, gopi.MiddlewareFuncs{}, gopi.WithOpenAPIValidation(gopi.OpenAPIValidationConfig{Document: doc}))
+		var mismatch *gopi.SpecMismatchError
+		if assert.True(t, errors.As(err, &mismatch)) {
+			assert.Equal(t, []string{"DELETE /api/v1/users/{id}"}, mismatch.Missing)
+			assert.Equal(t, []string{"POST /api/v1/users"}, mismatch.Extra)
+		}
+
+		_, err = gopi.GetHandler(context.TODO(), routes[:1], gopi.MiddlewareFuncs{},
+			gopi.WithOpenAPIValidation(gopi.OpenAPIValidationConfig{Document: doc, AllowExtraOperations: true}))
+		assert.NoError(t, err)
+	})
+}
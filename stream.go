@@ -0,0 +1,316 @@
+package gopi
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+
+	"github.com/teejays/gopi/json"
+)
+
+// Seq is an iterator over values of type T. It has the same shape as iter.Seq, so it can be used with range-over-func.
+type Seq[T any] func(yield func(T) bool)
+
+// Seq2 is an iterator over pairs of values. It has the same shape as iter.Seq2, so it can be used with
+// range-over-func.
+type Seq2[K, V any] func(yield func(K, V) bool)
+
+// ErrStreamConsumed is used when a RequestStream is iterated over more than once
+var ErrStreamConsumed = fmt.Errorf("request stream has already been consumed")
+
+/* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+* R E Q U E S T   S T R E A M
+* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
+
+// requestStreamer is implemented by ReqT types that read the HTTP request body themselves, instead of having the
+// generic handlers decode it before calling the handler
+type requestStreamer interface {
+	bindRequest(r *http.Request) error
+	streamErr() error
+}
+
+// RequestStream can be used as the ReqT of the generic POST/PUT/PATCH handlers to receive a JSON array request body
+// one element at a time, instead of decoding the whole body into memory before the handler is called. Each element
+// is validated as it is decoded. A RequestStream can only be iterated over once.
+type RequestStream[T any] struct {
+	state *requestStreamState
+}
+
+type requestStreamState struct {
+	dec      *json.Decoder
+	consumed bool
+	err      error
+}
+
+func (s *RequestStream[T]) bindRequest(r *http.Request) error {
+	if ct := r.Header.Get("Content-Type"); ct != "" {
+		mediaType, _, err := mime.ParseMediaType(ct)
+		if err != nil || mediaType != MediaTypeJSON {
+			return ErrUnsupportedMediaType
+		}
+	}
+	s.state = &requestStreamState{dec: json.NewDecoder(r.Body, getRouteConfig(r).jsonOptions()...)}
+	return nil
+}
+
+func (RequestStream[T]) streamElementType() reflect.Type {
+	return typeOf[T]()
+}
+
+func (s RequestStream[T]) streamErr() error {
+	return s.Err()
+}
+
+// All returns an iterator over the elements of the request body. Iteration stops at the first error, which is yielded
+// along with the zero value of T.
+func (s RequestStream[T]) All() Seq2[T, error] {
+	return func(yield func(T, error) bool) {
+		var zero T
+		st := s.state
+		if st == nil {
+			yield(zero, ErrEmptyBody)
+			return
+		}
+		if st.consumed {
+			yield(zero, ErrStreamConsumed)
+			return
+		}
+		st.consumed = true
+
+		fail := func(err error) {
+			st.err = err
+			yield(zero, err)
+		}
+
+		tok, err := st.dec.Token()
+		if err == io.EOF {
+			fail(ErrEmptyBody)
+			return
+		}
+		if err != nil {
+			fail(streamDecodeError(err))
+			return
+		}
+		if tok != json.Delim('[') {
+			fail(fmt.Errorf("%w: request body must be a JSON array", ErrInvalidJSON))
+			return
+		}
+
+		for st.dec.More() {
+			var v T
+			err := st.dec.Decode(&v)
+			if err != nil {
+				fail(streamDecodeError(err))
+				return
+			}
+			err = validateRequest(v)
+			if err != nil {
+				fail(err)
+				return
+			}
+			if !yield(v, nil) {
+				return
+			}
+		}
+
+		// Consume the closing bracket
+		_, err = st.dec.Token()
+		if err != nil {
+			fail(streamDecodeError(err))
+			return
+		}
+	}
+}
+
+// Chan returns a channel that receives the elements of the request body. The channel is closed when the body has been
+// read, an error occurs (see Err) or ctx is done.
+func (s RequestStream[T]) Chan(ctx context.Context) <-chan T {
+	ch := make(chan T)
+	go func() {
+		defer close(ch)
+		s.All()(func(v T, err error) bool {
+			if err != nil {
+				return false
+			}
+			select {
+			case ch <- v:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		})
+	}()
+	return ch
+}
+
+// Err returns the error that stopped the iteration over the request body, if any. When using Chan, it should only be
+// called after the channel has been closed.
+func (s RequestStream[T]) Err() error {
+	if s.state == nil {
+		return nil
+	}
+	return s.state.err
+}
+
+// streamDecodeError wraps errors from decoding a request stream so they're reported like other JSON errors, except
+// for errors from reading the body (e.g. it being too large)
+func streamDecodeError(err error) error {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return err
+	}
+	return fmt.Errorf("%w: %s", ErrInvalidJSON, err)
+}
+
+/* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+* R E S P O N S E   S T R E A M
+* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
+
+// responseStreamer is implemented by RespT types whose data is written to the response one element at a time
+type responseStreamer interface {
+	streamEach(fn func(v interface{}) error) error
+}
+
+// ResponseStream can be used as the RespT of the generic handlers to write the response data as a JSON array, element
+// by element, so the whole array never has to be held in memory. Media types other than JSON can't be streamed, so
+// for those the elements are collected and encoded as a whole.
+type ResponseStream[T any] struct {
+	seq Seq2[T, error]
+}
+
+// StreamSeq returns a ResponseStream with the elements produced by seq
+func StreamSeq[T any](seq Seq[T]) ResponseStream[T] {
+	return ResponseStream[T]{seq: func(yield func(T, error) bool) {
+		seq(func(v T) bool {
+			return yield(v, nil)
+		})
+	}}
+}
+
+// StreamSeq2 returns a ResponseStream with the elements produced by seq. If seq yields an error, the stream stops: if
+// nothing has been written yet, the error is written as the response, otherwise the response is aborted.
+func StreamSeq2[T any](seq Seq2[T, error]) ResponseStream[T] {
+	return ResponseStream[T]{seq: seq}
+}
+
+// StreamChan returns a ResponseStream with the elements received from ch, until it is closed. ctx is the context of
+// the handler: once the request is over, including when the stream stops early (e.g. the client disconnected) or is
+// never written (e.g. the client doesn't accept JSON), the rest of ch is drained in the background so that its sender
+// doesn't block forever. The sender should still stop once ctx is done, rather than produce elements for nobody.
+func StreamChan[T any](ctx context.Context, ch <-chan T) ResponseStream[T] {
+	context.AfterFunc(ctx, func() {
+		for range ch {
+		}
+	})
+	return ResponseStream[T]{seq: func(yield func(T, error) bool) {
+		for v := range ch {
+			if !yield(v, nil) {
+				return
+			}
+		}
+	}}
+}
+
+func (ResponseStream[T]) streamElementType() reflect.Type {
+	return typeOf[T]()
+}
+
+func (s ResponseStream[T]) streamEach(fn func(v interface{}) error) error {
+	if s.seq == nil {
+		return nil
+	}
+	var err error
+	s.seq(func(v T, seqErr error) bool {
+		if seqErr != nil {
+			err = seqErr
+			return false
+		}
+		err = fn(v)
+		return err == nil
+	})
+	return err
+}
+
+// responseStreamPlaceholder marks where the streamed data goes when encoding the StandardResponse around it
+const responseStreamPlaceholder = "gopi:response-stream"
+
+// writeStreamResponse writes a StandardResponse whose data is the JSON array of the elements of s
+func writeStreamResponse(w http.ResponseWriter, r *http.Request, code int, s responseStreamer) {
+
+	_, enc, ok := negotiateEncoder(r, []interface{}{})
+	if !ok {
+		writeError(w, r, http.StatusNotAcceptable, ErrNotAcceptable)
+		return
+	}
+
+	// Only JSON can be streamed, so collect the elements for any other encoder
+	if _, isJSON := enc.(jsonCodec); !isJSON {
+		var items = []interface{}{}
+		err := s.streamEach(func(v interface{}) error {
+			items = append(items, v)
+			return nil
+		})
+		if err != nil {
+			writeError(w, r, 0, err)
+			return
+		}
+		writeResponse(w, r, code, StandardResponse{StatusCode: code, Data: items})
+		return
+	}
+
+	cfg := getRouteConfig(r)
+
+	// Encode the StandardResponse with a placeholder for the data, so we know what to write before and after it
+	envelope, err := json.Marshal(StandardResponse{StatusCode: code, Data: responseStreamPlaceholder}, cfg.jsonOptions()...)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	prefix, suffix, found := bytes.Cut(envelope, []byte(`"`+responseStreamPlaceholder+`"`))
+	if !found {
+		writeError(w, r, http.StatusInternalServerError, fmt.Errorf("could not find the data placeholder in the encoded response"))
+		return
+	}
+
+	// Nothing is written until the first element is ready, so an error before that can still be written cleanly
+	var arr *json.ArrayEncoder
+	start := func() error {
+		setContentType(w, r, MediaTypeJSON)
+		w.WriteHeader(code)
+		_, err := w.Write(prefix)
+		arr = json.NewArrayEncoder(w, cfg.jsonOptions()...)
+		return err
+	}
+
+	err = s.streamEach(func(v interface{}) error {
+		if arr == nil {
+			if err := start(); err != nil {
+				return err
+			}
+		}
+		return arr.Encode(v)
+	})
+	if err != nil && arr == nil {
+		writeError(w, r, 0, err)
+		return
+	}
+	if err == nil && arr == nil {
+		err = start()
+	}
+	if err == nil {
+		err = arr.Close()
+	}
+	if err == nil {
+		_, err = w.Write(suffix)
+	}
+	if err != nil {
+		// The response is already partially written. Abort it, so the client doesn't mistake it for a complete one.
+		requestLogger(r).Error("api: writeStreamResponse: streaming response", "error", err)
+		panic(http.ErrAbortHandler)
+	}
+}
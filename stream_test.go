@@ -0,0 +1,368 @@
+package gopi_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/teejays/gopi"
+)
+
+type ImportItem struct {
+	Name string `validate:"required"`
+}
+
+type ImportResp struct {
+	Count int
+}
+
+func ImportEndpoint(ctx context.Context, req gopi.RequestStream[ImportItem]) (ImportResp, error) {
+	var count int
+	req.All()(func(item ImportItem, err error) bool {
+		if err != nil {
+			return false
+		}
+		count++
+		return true
+	})
+	return ImportResp{Count: count}, nil
+}
+
+func ImportChanEndpoint(ctx context.Context, req gopi.RequestStream[ImportItem]) (ImportResp, error) {
+	var count int
+	for range req.Chan(ctx) {
+		count++
+	}
+	return ImportResp{Count: count}, req.Err()
+}
+
+func ListEndpoint(ctx context.Context, req SampleReq) (gopi.ResponseStream[SampleResp], error) {
+	if req.RequestErrorWithMsg != "" {
+		return gopi.StreamSeq2(func(yield func(SampleResp, error) bool) {
+			yield(SampleResp{}, fmt.Errorf("%s", req.RequestErrorWithMsg))
+		}), nil
+	}
+	return gopi.StreamSeq(func(yield func(SampleResp) bool) {
+		for i := 0; i < 3; i++ {
+			if !yield(SampleResp{Pong: fmt.Sprintf("%s %d", req.Ping, i)}) {
+				return
+			}
+		}
+	}), nil
+}
+
+func TestStreaming(t *testing.T) {
+	routes := []gopi.Route{
+		{
+			Method:      http.MethodPost,
+			Path:        "import",
+			HandlerFunc: gopi.HandlerWrapper(http.MethodPost, ImportEndpoint),
+		},
+		{
+			Method:      http.MethodPost,
+			Path:        "import-chan",
+			HandlerFunc: gopi.HandlerWrapper(http.MethodPost, ImportChanEndpoint),
+		},
+		{
+			Method:      http.MethodPost,
+			Path:        "list",
+			HandlerFunc: gopi.HandlerWrapper(http.MethodPost, ListEndpoint),
+		},
+	}
+	h, err := gopi.GetHandler(context.TODO(), routes, gopi.MiddlewareFuncs{})
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name           string
+		path           string
+		body           string
+		wantStatusCode int
+		wantBody       string
+	}{
+		{
+			name:           "Request stream, iterator",
+			path:           "/api/v0/import",
+			body:           `[{"name":"a"},{"name":"b"},{"name":"c"}]`,
+			wantStatusCode: http.StatusOK,
+			wantBody:       `{"status_code":200,"data":{"count":3},"error":null}`,
+		},
+		{
+			name:           "Request stream, channel",
+			path:           "/api/v0/import-chan",
+			body:           `[{"name":"a"},{"name":"b"}]`,
+			wantStatusCode: http.StatusOK,
+			wantBody:       `{"status_code":200,"data":{"count":2},"error":null}`,
+		},
+		{
+			name:           "Request stream, empty array",
+			path:           "/api/v0/import",
+			body:           `[]`,
+			wantStatusCode: http.StatusOK,
+			wantBody:       `{"status_code":200,"data":{"count":0},"error":null}`,
+		},
+		{
+			name:           "Request stream, not an array",
+			path:           "/api/v0/import",
+			body:           `{"name":"a"}`,
+			wantStatusCode: http.StatusBadRequest,
+		},
+		{
+			name:           "Request stream, invalid element",
+			path:           "/api/v0/import-chan",
+			body:           `[{"name":"a"},{"name":""}]`,
+			wantStatusCode: http.StatusBadRequest,
+		},
+		{
+			name:           "Response stream",
+			path:           "/api/v0/list",
+			body:           `{"ping":"hello"}`,
+			wantStatusCode: http.StatusOK,
+			wantBody:       `{"status_code":200,"data":[{"pong":"hello 0"},{"pong":"hello 1"},{"pong":"hello 2"}],"error":null}`,
+		},
+		{
+			name:           "Response stream, error before first element",
+			path:           "/api/v0/list",
+			body:           `{"request_error_with_msg":"no items"}`,
+			wantStatusCode: http.StatusInternalServerError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader(tt.body))
+			h.ServeHTTP(w, r)
+
+			assert.Equal(t, tt.wantStatusCode, w.Code, w.Body.String())
+			if tt.wantBody != "" {
+				assert.JSONEq(t, tt.wantBody, w.Body.String())
+			}
+		})
+	}
+}
+
+func EventsEndpoint(ctx context.Context, req SampleReq) (gopi.EventStream[SampleResp], error) {
+	// Resume after the last event the client received
+	start := 0
+	if id := gopi.LastEventID(ctx); id != "" {
+		start, _ = strconv.Atoi(id)
+	}
+	return gopi.StreamEvents(func(yield func(gopi.Event[SampleResp], error) bool) {
+		for i := start + 1; i <= 3; i++ {
+			ev := gopi.Event[SampleResp]{ID: strconv.Itoa(i), Name: "pong", Data: SampleResp{Pong: fmt.Sprintf("%s %d", req.Ping, i)}}
+			if !yield(ev, nil) {
+				return
+			}
+			if req.RequestErrorWithMsg != "" {
+				yield(gopi.Event[SampleResp]{}, fmt.Errorf("%s", req.RequestErrorWithMsg))
+				return
+			}
+		}
+	}), nil
+}
+
+func SlowEventsEndpoint(ctx context.Context, req SampleReq) (gopi.EventStream[SampleResp], error) {
+	ch := make(chan gopi.Event[SampleResp])
+	go func() {
+		defer close(ch)
+		time.Sleep(50 * time.Millisecond)
+		ch <- gopi.Event[SampleResp]{Data: SampleResp{Pong: req.Ping}}
+	}()
+	return gopi.StreamEventChan(ch), nil
+}
+
+func TestStreamChan(t *testing.T) {
+	produced := make(chan struct{})
+	routes := []gopi.Route{
+		{
+			Method: http.MethodPost,
+			Path:   "list",
+			HandlerFunc: gopi.HandlerWrapper(http.MethodPost, func(ctx context.Context, req SampleReq) (gopi.ResponseStream[SampleResp], error) {
+				ch := make(chan SampleResp)
+				go func() {
+					defer close(produced)
+					defer close(ch)
+					for i := 0; i < 3; i++ {
+						ch <- SampleResp{Pong: fmt.Sprint(i)}
+					}
+				}()
+				return gopi.StreamChan(ctx, ch), nil
+			}),
+		},
+	}
+	h, err := gopi.GetHandler(context.TODO(), routes, gopi.MiddlewareFuncs{})
+	assert.NoError(t, err)
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	// The stream is never written, since the client doesn't accept JSON
+	r, err := http.NewRequest(http.MethodPost, srv.URL+"/api/v0/list", strings.NewReader(`{}`))
+	assert.NoError(t, err)
+	r.Header.Set("Accept", gopi.MediaTypeProtobuf)
+	resp, err := http.DefaultClient.Do(r)
+	if !assert.NoError(t, err) {
+		return
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotAcceptable, resp.StatusCode)
+
+	// but the sender doesn't block
+	select {
+	case <-produced:
+	case <-time.After(time.Second):
+		t.Fatal("the sender is blocked")
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	routes := []gopi.Route{
+		{
+			Method:      http.MethodPost,
+			Path:        "events",
+			HandlerFunc: gopi.HandlerWrapper(http.MethodPost, EventsEndpoint),
+		},
+		{
+			Method:          http.MethodPost,
+			Path:            "slow-events",
+			HandlerFunc:     gopi.HandlerWrapper(http.MethodPost, SlowEventsEndpoint),
+			StreamHeartbeat: 10 * time.Millisecond,
+		},
+	}
+	h, err := gopi.GetHandler(context.TODO(), routes, gopi.MiddlewareFuncs{})
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name            string
+		path            string
+		body            string
+		accept          string
+		lastEventID     string
+		wantStatusCode  int
+		wantContentType string
+		wantBody        string
+		wantContains    string
+	}{
+		{
+			name:            "NDJSON",
+			path:            "/api/v0/events",
+			body:            `{"ping":"hello"}`,
+			wantStatusCode:  http.StatusOK,
+			wantContentType: gopi.MediaTypeNDJSON,
+			wantBody:        "{\"pong\":\"hello 1\"}\n{\"pong\":\"hello 2\"}\n{\"pong\":\"hello 3\"}\n",
+		},
+		{
+			name:            "Server-Sent Events",
+			path:            "/api/v0/events",
+			body:            `{"ping":"hello"}`,
+			accept:          gopi.MediaTypeEventStream,
+			wantStatusCode:  http.StatusOK,
+			wantContentType: gopi.MediaTypeEventStream,
+			wantBody: "id: 1\nevent: pong\ndata: {\"pong\":\"hello 1\"}\n\n" +
+				"id: 2\nevent: pong\ndata: {\"pong\":\"hello 2\"}\n\n" +
+				"id: 3\nevent: pong\ndata: {\"pong\":\"hello 3\"}\n\n",
+		},
+		{
+			name:            "Server-Sent Events, resumed",
+			path:            "/api/v0/events",
+			body:            `{"ping":"hello"}`,
+			accept:          gopi.MediaTypeEventStream,
+			lastEventID:     "2",
+			wantStatusCode:  http.StatusOK,
+			wantContentType: gopi.MediaTypeEventStream,
+			wantBody:        "id: 3\nevent: pong\ndata: {\"pong\":\"hello 3\"}\n\n",
+		},
+		{
+			name:            "Server-Sent Events, error",
+			path:            "/api/v0/events",
+			body:            `{"ping":"hello","request_error_with_msg":"boom"}`,
+			accept:          gopi.MediaTypeEventStream,
+			wantStatusCode:  http.StatusOK,
+			wantContentType: gopi.MediaTypeEventStream,
+			wantBody: "id: 1\nevent: pong\ndata: {\"pong\":\"hello 1\"}\n\n" +
+				"event: error\ndata: {\"status_code\":500,\"data\":null,\"error\":\"" + gopi.ErrMessageGeneric + "\"}\n\n",
+		},
+		{
+			name:            "Heartbeat",
+			path:            "/api/v0/slow-events",
+			body:            `{"ping":"hello"}`,
+			accept:          gopi.MediaTypeEventStream,
+			wantStatusCode:  http.StatusOK,
+			wantContentType: gopi.MediaTypeEventStream,
+			wantContains:    ": heartbeat\n\n",
+		},
+		{
+			// Empty lines aren't valid NDJSON, so there are no heartbeats
+			name:            "NDJSON, no heartbeat",
+			path:            "/api/v0/slow-events",
+			body:            `{"ping":"hello"}`,
+			wantStatusCode:  http.StatusOK,
+			wantContentType: gopi.MediaTypeNDJSON,
+			wantBody:        "{\"pong\":\"hello\"}\n",
+		},
+		{
+			name:           "Not acceptable",
+			path:           "/api/v0/events",
+			body:           `{"ping":"hello"}`,
+			accept:         gopi.MediaTypeJSON,
+			wantStatusCode: http.StatusNotAcceptable,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader(tt.body))
+			if tt.accept != "" {
+				r.Header.Set("Accept", tt.accept)
+			}
+			if tt.lastEventID != "" {
+				r.Header.Set("Last-Event-ID", tt.lastEventID)
+			}
+			h.ServeHTTP(w, r)
+
+			assert.Equal(t, tt.wantStatusCode, w.Code, w.Body.String())
+			if tt.wantContentType != "" {
+				assert.Equal(t, tt.wantContentType, w.Header().Get("Content-Type"))
+			}
+			if tt.wantBody != "" {
+				assert.Equal(t, tt.wantBody, w.Body.String())
+			}
+			if tt.wantContains != "" {
+				assert.Contains(t, w.Body.String(), tt.wantContains)
+			}
+		})
+	}
+}
+
+func TestEventStream_ClientDisconnect(t *testing.T) {
+	stopped := make(chan struct{})
+	endless := func(ctx context.Context, req SampleReq) (gopi.EventStream[SampleResp], error) {
+		return gopi.StreamEvents(func(yield func(gopi.Event[SampleResp], error) bool) {
+			defer close(stopped)
+			for yield(gopi.Event[SampleResp]{Data: SampleResp{Pong: req.Ping}}, nil) {
+			}
+		}), nil
+	}
+	h := gopi.GetRouteHandler(gopi.Route{
+		Method:      http.MethodPost,
+		Path:        "endless",
+		HandlerFunc: gopi.HandlerWrapper(http.MethodPost, endless),
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/api/v0/endless", strings.NewReader(`{"ping":"hello"}`)).WithContext(ctx)
+	h.ServeHTTP(w, r)
+
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("the event producer was not stopped after the client disconnected")
+	}
+}
@@ -0,0 +1,263 @@
+package gopi
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// TimeoutHeader is the request header in which clients can ask for a shorter timeout than the route's (or a longer
+// one, up to the server's maximum, see WithMaxTimeout). It is either a duration (e.g. "500ms") or a number of seconds.
+const TimeoutHeader = "X-Request-Timeout"
+
+// ErrRequestTimeout is used when a request takes longer than its timeout to be handled
+var ErrRequestTimeout = fmt.Errorf("the request took too long to process")
+
+// parseTimeoutHeader parses the value of the TimeoutHeader, returning false if it isn't a valid timeout
+func parseTimeoutHeader(v string) (time.Duration, bool) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0, false
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		secs, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return 0, false
+		}
+		d = secondsDuration(secs)
+	}
+	return d, d > 0
+}
+
+// requestTimeout returns the timeout for r, given the timeout of its route and the longest timeout that clients can
+// ask for (if it's not set, clients can only shorten the route's timeout). Zero means no timeout.
+func requestTimeout(r *http.Request, timeout, maxTimeout time.Duration) time.Duration {
+	requested, ok := parseTimeoutHeader(r.Header.Get(TimeoutHeader))
+	if !ok {
+		return timeout
+	}
+	if maxTimeout <= 0 {
+		maxTimeout = timeout
+	}
+	if maxTimeout > 0 && requested > maxTimeout {
+		return maxTimeout
+	}
+	return requested
+}
+
+// timeoutMiddleware returns a middleware func that cancels the context of requests that take longer than their
+// timeout, and responds with a 504 if the handler hasn't started writing its response by then, or aborts the response
+// if it has. Further writes from the handler fail with http.ErrHandlerTimeout, and its panics are logged and reported
+// to reporter.
+func timeoutMiddleware(timeout, maxTimeout time.Duration, reporter PanicReporter) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			d := requestTimeout(r, timeout, maxTimeout)
+			// WebSocket connections outlive the request, so they can't be timed out
+			if d <= 0 || websocket.IsWebSocketUpgrade(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			ctx, cancel := context.WithTimeout(r.Context(), d)
+			defer cancel()
+			r = r.WithContext(ctx)
+
+			tw := &timeoutWriter{w: w, header: http.Header{}}
+			done := make(chan struct{})
+			// finishedAt is when the handler returned, set before done is closed
+			var finishedAt time.Time
+			panicked := make(chan *handlerPanic, 1)
+			// The handler runs in its own goroutine, so we can respond once the timeout is over even if it ignores
+			// the context
+			go func() {
+				defer func() {
+					rec := recover()
+					if rec == nil {
+						return
+					}
+					p := &handlerPanic{value: rec, stack: debug.Stack()}
+					tw.mu.Lock()
+					timedOut := tw.timedOut
+					if !timedOut {
+						panicked <- p
+					}
+					tw.mu.Unlock()
+					// Nobody is waiting for the handler anymore, so the panic would go unnoticed
+					if timedOut && rec != http.ErrAbortHandler {
+						logPanic(r, rec, p.stack, reporter)
+					}
+				}()
+				next.ServeHTTP(tw, r)
+				finishedAt = time.Now()
+				close(done)
+			}()
+
+			select {
+			case p := <-panicked:
+				p.repanic()
+			case <-done:
+				return
+			case <-ctx.Done():
+			}
+
+			tw.mu.Lock()
+			tw.timedOut = true
+			wroteHeader, wroteHeaderAt := tw.wroteHeader, tw.wroteHeaderAt
+			tw.mu.Unlock()
+			select {
+			case p := <-panicked:
+				// The handler panicked before it timed out
+				p.repanic()
+			default:
+			}
+			finished := false
+			select {
+			case <-done:
+				finished = true
+			default:
+			}
+			deadline, _ := ctx.Deadline()
+			// The response is complete if the handler finished in time, or if it only responded once it timed out
+			// (e.g. with its own error)
+			complete := finished && (finishedAt.Before(deadline) || !wroteHeaderAt.Before(deadline))
+			if wroteHeader && !complete {
+				// The response has started (e.g. a stream), and has been cut off. Abort it, so the client doesn't
+				// mistake it for a complete one.
+				panic(http.ErrAbortHandler)
+			}
+			if finished {
+				return
+			}
+			if ctx.Err() == context.DeadlineExceeded {
+				writeError(w, r, http.StatusGatewayTimeout, ErrRequestTimeout)
+			}
+		})
+	}
+}
+
+// handlerPanic is a panic recovered from a handler running in another goroutine, with the stack of that goroutine
+type handlerPanic struct {
+	value interface{}
+	stack []byte
+}
+
+// repanic raises p again in the current goroutine, for the recovery middleware to handle it as if the handler ran in
+// this goroutine
+func (p *handlerPanic) repanic() {
+	// http.ErrAbortHandler has to be raised as is, for net/http to abort the response quietly
+	if p.value == http.ErrAbortHandler {
+		panic(http.ErrAbortHandler)
+	}
+	panic(p)
+}
+
+// String keeps the original stack in the panics that aren't recovered, which net/http logs
+func (p *handlerPanic) String() string {
+	return fmt.Sprintf("%v\n\n%s", p.value, p.stack)
+}
+
+// timeoutWriter is the http.ResponseWriter passed to handlers with a timeout. Once the timeout is over, their writes
+// are discarded, since the timeout response is being written in their place.
+type timeoutWriter struct {
+	w http.ResponseWriter
+	// header is separate from the header of w, so it can't be modified by the handler while the timeout response is
+	// being written
+	header http.Header
+
+	mu          sync.Mutex
+	timedOut    bool
+	wroteHeader bool
+	// wroteHeaderAt is when the response started
+	wroteHeaderAt time.Time
+}
+
+func (tw *timeoutWriter) Header() http.Header {
+	return tw.header
+}
+
+func (tw *timeoutWriter) WriteHeader(code int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	tw.writeHeaderLocked(code)
+}
+
+func (tw *timeoutWriter) writeHeaderLocked(code int) {
+	if tw.timedOut || tw.wroteHeader {
+		return
+	}
+	// Informational responses (e.g. 103 Early Hints) are followed by the actual response
+	if code < 200 && code != http.StatusSwitchingProtocols {
+		copyHeader(tw.w.Header(), tw.header)
+		tw.w.WriteHeader(code)
+		return
+	}
+	tw.wroteHeader = true
+	tw.wroteHeaderAt = time.Now()
+	copyHeader(tw.w.Header(), tw.header)
+	tw.w.WriteHeader(code)
+}
+
+func (tw *timeoutWriter) Write(b []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	if !tw.wroteHeader {
+		tw.writeHeaderLocked(http.StatusOK)
+	}
+	return tw.w.Write(b)
+}
+
+// Flush implements http.Flusher if the underlying http.ResponseWriter supports it
+func (tw *timeoutWriter) Flush() {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return
+	}
+	if !tw.wroteHeader {
+		tw.writeHeaderLocked(http.StatusOK)
+	}
+	if f, ok := tw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker if the underlying http.ResponseWriter supports it
+func (tw *timeoutWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return nil, nil, http.ErrHandlerTimeout
+	}
+	conn, brw, err := http.NewResponseController(tw.w).Hijack()
+	if err == nil {
+		tw.wroteHeader = true
+		tw.wroteHeaderAt = time.Now()
+	}
+	return conn, brw, err
+}
+
+// Unwrap allows http.ResponseController to reach the underlying http.ResponseWriter
+func (tw *timeoutWriter) Unwrap() http.ResponseWriter {
+	return tw.w
+}
+
+// copyHeader replaces the values of dst with the ones of src
+func copyHeader(dst, src http.Header) {
+	for k, v := range src {
+		dst[k] = append([]string(nil), v...)
+	}
+}
@@ -0,0 +1,206 @@
+package gopi_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/teejays/gopi"
+)
+
+// DeadlineResp reports the time that a handler had left to handle the request
+type DeadlineResp struct {
+	HasDeadline bool
+	Remaining   time.Duration
+}
+
+func DeadlineEndpoint(ctx context.Context, req SampleReq) (DeadlineResp, error) {
+	deadline, ok := ctx.Deadline()
+	return DeadlineResp{HasDeadline: ok, Remaining: time.Until(deadline)}, nil
+}
+
+func TestTimeout(t *testing.T) {
+	lateWrite := make(chan error, 1)
+	routes := []gopi.Route{
+		{
+			Method: http.MethodGet,
+			Path:   "slow",
+			HandlerFunc: gopi.HandlerWrapper(http.MethodGet, func(ctx context.Context, req SampleReq) (SampleResp, error) {
+				<-ctx.Done()
+				return SampleResp{}, ctx.Err()
+			}),
+			Timeout: 20 * time.Millisecond,
+		},
+		{
+			Method: http.MethodGet,
+			Path:   "stuck",
+			HandlerFunc: func(w http.ResponseWriter, r *http.Request) {
+				// Ignores the context, and writes after the timeout
+				time.Sleep(100 * time.Millisecond)
+				_, err := w.Write([]byte("too late"))
+				lateWrite <- err
+			},
+			Timeout: 20 * time.Millisecond,
+		},
+		{
+			Method: http.MethodGet,
+			Path:   "stream",
+			HandlerFunc: func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("first chunk\n"))
+				w.(http.Flusher).Flush()
+				<-r.Context().Done()
+			},
+			Timeout: 20 * time.Millisecond,
+		},
+		{
+			Method: http.MethodGet,
+			Path:   "panic",
+			HandlerFunc: func(w http.ResponseWriter, r *http.Request) {
+				panic("boom")
+			},
+			Timeout: 20 * time.Millisecond,
+		},
+		{
+			Method: http.MethodGet,
+			Path:   "late-panic",
+			HandlerFunc: func(w http.ResponseWriter, r *http.Request) {
+				<-r.Context().Done()
+				time.Sleep(10 * time.Millisecond)
+				panic("too late")
+			},
+			Timeout: 20 * time.Millisecond,
+		},
+		{
+			Method:      http.MethodGet,
+			Path:        "deadline",
+			HandlerFunc: gopi.HandlerWrapper(http.MethodGet, DeadlineEndpoint),
+		},
+		{
+			Method:      http.MethodGet,
+			Path:        "no-timeout",
+			HandlerFunc: gopi.HandlerWrapper(http.MethodGet, DeadlineEndpoint),
+			Timeout:     -1,
+		},
+	}
+	type report struct {
+		recovered interface{}
+		stack     string
+	}
+	reports := make(chan report, 10)
+	reporter := func(r *http.Request, recovered interface{}, stack []byte) {
+		reports <- report{recovered: recovered, stack: string(stack)}
+	}
+	h, err := gopi.GetHandler(context.TODO(), routes, gopi.MiddlewareFuncs{}, gopi.WithTimeout(time.Minute), gopi.WithPanicReporter(reporter))
+	assert.NoError(t, err)
+
+	get := func(h http.Handler, path, timeout string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/api/v0/"+path+"?req="+url.QueryEscape(`{}`), nil)
+		if timeout != "" {
+			r.Header.Set(gopi.TimeoutHeader, timeout)
+		}
+		h.ServeHTTP(w, r)
+		return w
+	}
+	remaining := func(t *testing.T, w *httptest.ResponseRecorder) (bool, time.Duration) {
+		var resp struct {
+			Data DeadlineResp
+		}
+		assert.NoError(t, gopi.UnmarshalJSONFromRequest(httptest.NewRequest(http.MethodPost, "/", w.Body), &resp))
+		return resp.Data.HasDeadline, resp.Data.Remaining
+	}
+
+	t.Run("Timed out", func(t *testing.T) {
+		w := get(h, "slow", "")
+		assert.Equal(t, http.StatusGatewayTimeout, w.Code)
+		assert.JSONEq(t, `{"status_code":504,"data":null,"error":"`+gopi.ErrRequestTimeout.Error()+`"}`, w.Body.String())
+	})
+
+	t.Run("Writes after the timeout", func(t *testing.T) {
+		start := time.Now()
+		w := get(h, "stuck", "")
+		assert.Less(t, time.Since(start), 100*time.Millisecond)
+		assert.Equal(t, http.StatusGatewayTimeout, w.Code)
+		assert.Equal(t, http.ErrHandlerTimeout, <-lateWrite)
+		assert.NotContains(t, w.Body.String(), "too late")
+	})
+
+	t.Run("Timed out in the middle of a stream", func(t *testing.T) {
+		srv := httptest.NewServer(h)
+		defer srv.Close()
+		resp, err := http.Get(srv.URL + "/api/v0/stream")
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		// The response is aborted, so the client can tell that it is incomplete
+		body, err := io.ReadAll(resp.Body)
+		assert.Equal(t, "first chunk\n", string(body))
+		assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	})
+
+	t.Run("Panics", func(t *testing.T) {
+		w := get(h, "panic", "")
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+		rep := <-reports
+		assert.Equal(t, "boom", rep.recovered)
+		// The stack is the one of the handler
+		assert.Contains(t, rep.stack, "timeout_test.go")
+
+		// Panics after the timeout are still reported
+		w = get(h, "late-panic", "")
+		assert.Equal(t, http.StatusGatewayTimeout, w.Code)
+		select {
+		case rep := <-reports:
+			assert.Equal(t, "too late", rep.recovered)
+			assert.Contains(t, rep.stack, "timeout_test.go")
+		case <-time.After(time.Second):
+			t.Fatal("the panic after the timeout wasn't reported")
+		}
+	})
+
+	t.Run("Server default", func(t *testing.T) {
+		ok, d := remaining(t, get(h, "deadline", ""))
+		assert.True(t, ok)
+		assert.InDelta(t, time.Minute, d, float64(time.Second))
+	})
+
+	t.Run("Client timeout", func(t *testing.T) {
+		ok, d := remaining(t, get(h, "deadline", "2s"))
+		assert.True(t, ok)
+		assert.InDelta(t, 2*time.Second, d, float64(time.Second))
+
+		ok, d = remaining(t, get(h, "deadline", "1.5"))
+		assert.True(t, ok)
+		assert.InDelta(t, 1500*time.Millisecond, d, float64(500*time.Millisecond))
+
+		// Clients can't extend the timeout past the server's
+		ok, d = remaining(t, get(h, "deadline", "1h"))
+		assert.True(t, ok)
+		assert.InDelta(t, time.Minute, d, float64(time.Second))
+	})
+
+	t.Run("Client timeout up to the server maximum", func(t *testing.T) {
+		h, err := gopi.GetHandler(context.TODO(), routes, gopi.MiddlewareFuncs{}, gopi.WithTimeout(time.Minute), gopi.WithMaxTimeout(time.Hour))
+		assert.NoError(t, err)
+		ok, d := remaining(t, get(h, "deadline", "10m"))
+		assert.True(t, ok)
+		assert.InDelta(t, 10*time.Minute, d, float64(time.Second))
+
+		ok, d = remaining(t, get(h, "deadline", "2h"))
+		assert.True(t, ok)
+		assert.InDelta(t, time.Hour, d, float64(time.Second))
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		ok, _ := remaining(t, get(h, "no-timeout", "1s"))
+		assert.False(t, ok)
+	})
+}
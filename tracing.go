@@ -0,0 +1,87 @@
+package gopi
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the instrumentation scope of the spans started by TracingMiddleware
+const tracerName = "github.com/teejays/gopi"
+
+// TracingConfig configures TracingMiddleware
+type TracingConfig struct {
+	// TracerProvider creates the tracer that starts the spans, and decides which ones are sampled and where they are
+	// exported. Defaults to the global TracerProvider (see otel.SetTracerProvider).
+	TracerProvider trace.TracerProvider
+	// Propagator extracts the trace propagated by the client from the request headers. Defaults to W3C Trace Context.
+	Propagator propagation.TextMapPropagator
+}
+
+func (cfg TracingConfig) withDefaults() TracingConfig {
+	if cfg.TracerProvider == nil {
+		cfg.TracerProvider = otel.GetTracerProvider()
+	}
+	if cfg.Propagator == nil {
+		cfg.Propagator = propagation.TraceContext{}
+	}
+	return cfg
+}
+
+// TracingMiddleware returns a http.Handler middleware func that starts an OpenTelemetry server span for each request,
+// named after the method and the template of its route (e.g. `GET /api/v1/users/{id}`). The span continues the trace
+// propagated by the client, and is available to handlers with trace.SpanFromContext. Server errors set the status of
+// the span, and the errors written by the handlers are recorded on it. It must be used on a mux router, like the one
+// built by GetHandler with WithTracing.
+func TracingMiddleware(cfg TracingConfig) mux.MiddlewareFunc {
+	cfg = cfg.withDefaults()
+	tracer := cfg.TracerProvider.Tracer(tracerName)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			route := getRouteTemplate(r)
+			if route == "" {
+				route = r.URL.Path
+			}
+
+			attrs := []attribute.KeyValue{
+				attribute.String("http.request.method", r.Method),
+				attribute.String("http.route", route),
+				attribute.String("url.path", r.URL.Path),
+			}
+			if ua := r.UserAgent(); ua != "" {
+				attrs = append(attrs, attribute.String("user_agent.original", ua))
+			}
+			ctx := cfg.Propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+			ctx, span := tracer.Start(ctx, r.Method+" "+route, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(attrs...))
+
+			rw := newResponseRecorder(w)
+			// The span must end even if the handler panics, with the status written by the recovery middleware
+			defer func() {
+				status := rw.Status()
+				span.SetAttributes(attribute.Int("http.response.status_code", status))
+				// Client errors aren't failures of the server
+				if status >= http.StatusInternalServerError {
+					span.SetStatus(codes.Error, http.StatusText(status))
+				}
+				span.End()
+			}()
+			next.ServeHTTP(rw, r.WithContext(ctx))
+		})
+	}
+}
+
+// TraceLogFields returns the key-value pairs that identify the span in ctx, to be added to log lines so they can be
+// correlated with the trace. It returns nothing if there is no span.
+func TraceLogFields(ctx context.Context) []interface{} {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return nil
+	}
+	return []interface{}{"trace_id", sc.TraceID().String(), "span_id", sc.SpanID().String()}
+}
@@ -0,0 +1,144 @@
+package gopi_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/teejays/gopi"
+)
+
+// spanAttributes returns the attributes of span as a map
+func spanAttributes(span tracetest.SpanStub) map[attribute.Key]attribute.Value {
+	attrs := map[attribute.Key]attribute.Value{}
+	for _, kv := range span.Attributes {
+		attrs[kv.Key] = kv.Value
+	}
+	return attrs
+}
+
+func TestTracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	var outgoing http.Header
+	var logFields []interface{}
+	routes := []gopi.Route{
+		{
+			Method: http.MethodGet,
+			Path:   "users/{id}",
+			HandlerFunc: gopi.HandlerWrapper(http.MethodGet, func(ctx context.Context, req SampleReq) (SampleResp, error) {
+				trace.SpanFromContext(ctx).SetAttributes(attribute.String("ping", req.Ping))
+				logFields = gopi.TraceLogFields(ctx)
+				// Calls to other services continue the trace
+				outgoing = http.Header{}
+				propagation.TraceContext{}.Inject(ctx, propagation.HeaderCarrier(outgoing))
+				return SampleEndpoint(ctx, req)
+			}),
+		},
+	}
+	h, err := gopi.GetHandler(context.TODO(), routes, gopi.MiddlewareFuncs{}, gopi.WithTracing(gopi.TracingConfig{TracerProvider: provider}))
+	assert.NoError(t, err)
+
+	get := func(req, traceparent string) *httptest.ResponseRecorder {
+		exporter.Reset()
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/api/v0/users/42?req="+url.QueryEscape(req), nil)
+		if traceparent != "" {
+			r.Header.Set("traceparent", traceparent)
+			r.Header.Set("tracestate", "vendor=value")
+		}
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	t.Run("Propagated", func(t *testing.T) {
+		w := get(`{"ping":"hello"}`, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		spans := exporter.GetSpans()
+		if !assert.Len(t, spans, 1) {
+			return
+		}
+		span := spans[0]
+		assert.Equal(t, "GET /api/v0/users/{id}", span.Name)
+		assert.Equal(t, trace.SpanKindServer, span.SpanKind)
+		assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", span.SpanContext.TraceID().String())
+		assert.Equal(t, "00f067aa0ba902b7", span.Parent.SpanID().String())
+		assert.True(t, span.Parent.IsRemote())
+		assert.Equal(t, "vendor=value", span.SpanContext.TraceState().String())
+
+		attrs := spanAttributes(span)
+		assert.Equal(t, "/api/v0/users/{id}", attrs["http.route"].AsString())
+		assert.Equal(t, "/api/v0/users/42", attrs["url.path"].AsString())
+		assert.Equal(t, int64(http.StatusOK), attrs["http.response.status_code"].AsInt64())
+		assert.Equal(t, "hello", attrs["ping"].AsString())
+		assert.Equal(t, codes.Unset, span.Status.Code)
+
+		assert.Equal(t, fmt.Sprintf("00-%s-%s-01", span.SpanContext.TraceID(), span.SpanContext.SpanID()), outgoing.Get("traceparent"))
+		assert.Equal(t, "vendor=value", outgoing.Get("tracestate"))
+		assert.Equal(t, []interface{}{"trace_id", span.SpanContext.TraceID().String(), "span_id", span.SpanContext.SpanID().String()}, logFields)
+	})
+
+	t.Run("New trace", func(t *testing.T) {
+		get(`{"ping":"hello"}`, "")
+		spans := exporter.GetSpans()
+		if assert.Len(t, spans, 1) {
+			assert.True(t, spans[0].SpanContext.TraceID().IsValid())
+			assert.False(t, spans[0].Parent.IsValid())
+		}
+	})
+
+	t.Run("Not sampled", func(t *testing.T) {
+		get(`{"ping":"hello"}`, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+		assert.Empty(t, exporter.GetSpans())
+		// The trace is still propagated, so the decision is the same downstream
+		assert.Equal(t, "00", outgoing.Get("traceparent")[53:])
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		w := get(`{"requestErrorWithMsg":"oops"}`, "")
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+		spans := exporter.GetSpans()
+		if assert.Len(t, spans, 1) {
+			assert.Equal(t, codes.Error, spans[0].Status.Code)
+			if assert.Len(t, spans[0].Events, 1) {
+				assert.Equal(t, "exception", spans[0].Events[0].Name)
+				assert.Contains(t, spans[0].Events[0].Attributes, attribute.String("exception.message", "oops"))
+			}
+		}
+
+		// Client errors are recorded, but the request didn't fail on our side
+		w = get(`not json`, "")
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		spans = exporter.GetSpans()
+		if assert.Len(t, spans, 1) {
+			assert.Equal(t, codes.Unset, spans[0].Status.Code)
+			assert.Len(t, spans[0].Events, 1)
+			assert.Equal(t, int64(http.StatusBadRequest), spanAttributes(spans[0])["http.response.status_code"].AsInt64())
+		}
+	})
+
+	t.Run("Sampler", func(t *testing.T) {
+		provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter), sdktrace.WithSampler(sdktrace.NeverSample()))
+		h, err := gopi.GetHandler(context.TODO(), routes, gopi.MiddlewareFuncs{}, gopi.WithTracing(gopi.TracingConfig{TracerProvider: provider}))
+		assert.NoError(t, err)
+		exporter.Reset()
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v0/users/42?req="+url.QueryEscape(`{}`), nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Empty(t, exporter.GetSpans())
+	})
+
+	assert.Empty(t, gopi.TraceLogFields(context.Background()))
+}
@@ -0,0 +1,357 @@
+package gopi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/teejays/gopi/json"
+)
+
+const (
+	// defaultWebSocketPingInterval is how often pings are sent to WebSocket clients, unless configured otherwise
+	defaultWebSocketPingInterval = 30 * time.Second
+	// webSocketWriteWait is the time allowed to write a message to a WebSocket client
+	webSocketWriteWait = 10 * time.Second
+	// webSocketCloseGracePeriod is the time allowed for a WebSocket client to acknowledge that the connection is closed
+	webSocketCloseGracePeriod = 5 * time.Second
+)
+
+// ErrWebSocketUpgradeRequired is used when a request to a WebSocket route is not a WebSocket handshake
+var ErrWebSocketUpgradeRequired = fmt.Errorf("this route only accepts WebSocket connections")
+
+// ErrServerShuttingDown is used when a request can't be served because the server is shutting down
+var ErrServerShuttingDown = fmt.Errorf("the server is shutting down")
+
+// WebSocketHandlers handle the connections to a WebSocket route (see WebSocketWrapper). Messages are JSON text
+// messages, decoded into InT and encoded from OutT with the route's JSON settings.
+type WebSocketHandlers[InT, OutT any] struct {
+	// OnConnect is called when a client has connected, before any of its messages are read. Returning an error closes
+	// the connection.
+	OnConnect func(ctx context.Context, conn *WebSocketConn[OutT]) error
+	// OnMessage is called for each message received from the client, after it has been validated. Messages from a
+	// connection are handled one at a time. Returning an error closes the connection.
+	OnMessage func(ctx context.Context, conn *WebSocketConn[OutT], msg InT) error
+	// OnClose is called once the connection has been closed, with the error that caused it to close (nil if the client
+	// or the server closed it normally)
+	OnClose func(ctx context.Context, conn *WebSocketConn[OutT], err error)
+
+	// CheckOrigin returns true if a connection from the Origin of r should be accepted. If it is nil, only connections
+	// from the same host are accepted.
+	CheckOrigin func(r *http.Request) bool
+	// PingInterval is how often pings are sent to the client to keep the connection alive. A client that doesn't
+	// answer within two intervals is disconnected. Defaults to 30 seconds.
+	PingInterval time.Duration
+}
+
+// WebSocketConn is a WebSocket connection to a client, which OutT messages can be sent on. It is safe to use from
+// multiple goroutines.
+type WebSocketConn[OutT any] struct {
+	conn *webSocketConn
+}
+
+// Send writes msg to the client as a JSON text message
+func (c *WebSocketConn[OutT]) Send(msg OutT) error {
+	return c.conn.send(msg)
+}
+
+// Close closes the connection with a close code (see RFC 6455, section 7.4) and a reason for the client
+func (c *WebSocketConn[OutT]) Close(code int, reason string) {
+	c.conn.close(code, reason)
+}
+
+// webSocketConn is a WebSocket connection with its type parameters erased, so the server can keep track of it
+type webSocketConn struct {
+	ws       *websocket.Conn
+	jsonOpts []json.Option
+	cancel   context.CancelFunc
+	logger   *slog.Logger
+
+	writeMu   sync.Mutex
+	closeOnce sync.Once
+	closing   chan struct{}
+}
+
+func newWebSocketConn(ctx context.Context, ws *websocket.Conn, cfg routeConfig, cancel context.CancelFunc) *webSocketConn {
+	return &webSocketConn{
+		ws:       ws,
+		jsonOpts: cfg.jsonOptions(),
+		cancel:   cancel,
+		logger:   Logger(ctx),
+		closing:  make(chan struct{}),
+	}
+}
+
+func (c *webSocketConn) send(v interface{}) error {
+	data, err := json.Marshal(v, c.jsonOpts...)
+	if err != nil {
+		return err
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	err = c.ws.SetWriteDeadline(time.Now().Add(webSocketWriteWait))
+	if err != nil {
+		return err
+	}
+	return c.ws.WriteMessage(websocket.TextMessage, data)
+}
+
+// close starts the closing handshake. The connection is closed once the client acknowledges it, or after a grace period.
+func (c *webSocketConn) close(code int, reason string) {
+	c.closeOnce.Do(func() {
+		close(c.closing)
+		c.cancel()
+		// The reason has to fit in a control frame
+		if len(reason) > 123 {
+			reason = reason[:123]
+		}
+		deadline := time.Now().Add(webSocketWriteWait)
+		err := c.ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), deadline)
+		if err != nil && !errors.Is(err, websocket.ErrCloseSent) {
+			c.logger.Debug("[Gopi] Writing WebSocket close message", "error", err)
+		}
+		_ = c.ws.SetReadDeadline(time.Now().Add(webSocketCloseGracePeriod))
+	})
+}
+
+func (c *webSocketConn) isClosing() bool {
+	select {
+	case <-c.closing:
+		return true
+	default:
+		return false
+	}
+}
+
+// keepAlive pings the client every interval until ctx is done
+func (c *webSocketConn) keepAlive(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := c.ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(webSocketWriteWait))
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// WebSocketWrapper returns a HandlerFunc that upgrades requests to WebSocket connections handled by h. It should be
+// used in a Route with the GET method, so it goes through the same middlewares (and authentication) as other routes.
+// The connections are closed gracefully when the Server shuts down.
+func WebSocketWrapper[InT, OutT any](h WebSocketHandlers[InT, OutT]) http.HandlerFunc {
+	pingInterval := h.PingInterval
+	if pingInterval <= 0 {
+		pingInterval = defaultWebSocketPingInterval
+	}
+
+	upgrader := websocket.Upgrader{
+		CheckOrigin: h.CheckOrigin,
+		Error: func(w http.ResponseWriter, r *http.Request, status int, reason error) {
+			writeError(w, r, status, reason)
+		},
+	}
+
+	return describeHandler[InT, OutT](handlerWebSocket, func(w http.ResponseWriter, r *http.Request) {
+		cfg := getRouteConfig(r)
+
+		if !websocket.IsWebSocketUpgrade(r) {
+			w.Header().Set("Upgrade", "websocket")
+			writeError(w, r, http.StatusUpgradeRequired, ErrWebSocketUpgradeRequired)
+			return
+		}
+		if cfg.webSockets.isShuttingDown() {
+			writeError(w, r, http.StatusServiceUnavailable, ErrServerShuttingDown)
+			return
+		}
+
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			// The upgrader has already written the error
+			return
+		}
+		defer ws.Close()
+
+		// The connection outlives the usual request lifecycle, so it gets its own context, canceled when it closes
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+		c := newWebSocketConn(ctx, ws, cfg, cancel)
+		conn := &WebSocketConn[OutT]{conn: c}
+
+		if !cfg.webSockets.add(c) {
+			c.close(websocket.CloseGoingAway, ErrServerShuttingDown.Error())
+			return
+		}
+		defer cfg.webSockets.remove(c)
+
+		closeErr := serveWebSocket(ctx, conn, h, cfg, pingInterval)
+		if h.OnClose != nil {
+			h.OnClose(ctx, conn, closeErr)
+		}
+	})
+}
+
+// serveWebSocket reads the messages from the client and passes them to h until the connection is closed. It returns
+// the error that caused the connection to close, if any.
+func serveWebSocket[InT, OutT any](ctx context.Context, conn *WebSocketConn[OutT], h WebSocketHandlers[InT, OutT], cfg routeConfig, pingInterval time.Duration) error {
+	c := conn.conn
+	ws := c.ws
+
+	// The client has to answer pings (or send something) within two intervals
+	pongWait := 2 * pingInterval
+	if cfg.maxBodySize > 0 {
+		ws.SetReadLimit(cfg.maxBodySize)
+	}
+	_ = ws.SetReadDeadline(time.Now().Add(pongWait))
+	ws.SetPongHandler(func(string) error {
+		if c.isClosing() {
+			return nil
+		}
+		return ws.SetReadDeadline(time.Now().Add(pongWait))
+	})
+	go c.keepAlive(ctx, pingInterval)
+
+	// closeErr is the first error that made us close the connection
+	var closeErr error
+	fail := func(code int, err error) {
+		if closeErr != nil {
+			return
+		}
+		closeErr = err
+		_, resp := errorResponse(0, err)
+		reason, _ := resp.Error.(string)
+		c.logger.Error("[Gopi] Closing WebSocket connection", "error", err)
+		c.close(code, reason)
+	}
+
+	if h.OnConnect != nil {
+		err := h.OnConnect(ctx, conn)
+		if err != nil {
+			fail(websocket.CloseInternalServerErr, err)
+		}
+	}
+
+	for {
+		_, data, err := ws.ReadMessage()
+		if err != nil {
+			// A normal close by either side is not an error
+			if c.isClosing() || websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseNoStatusReceived) {
+				return closeErr
+			}
+			if errors.Is(err, websocket.ErrReadLimit) {
+				fail(websocket.CloseMessageTooBig, err)
+				return closeErr
+			}
+			return err
+		}
+		// Once we've started closing the connection, keep reading only until the client acknowledges it
+		if c.isClosing() {
+			continue
+		}
+		_ = ws.SetReadDeadline(time.Now().Add(pongWait))
+		if h.OnMessage == nil {
+			continue
+		}
+
+		var msg InT
+		err = json.Unmarshal(data, &msg, cfg.jsonOptions()...)
+		if err != nil {
+			fail(websocket.CloseInvalidFramePayloadData, fmt.Errorf("%w: %s", ErrInvalidJSON, err))
+			continue
+		}
+		err = validateRequest(msg)
+		if err != nil {
+			fail(websocket.CloseInvalidFramePayloadData, err)
+			continue
+		}
+		err = h.OnMessage(ctx, conn, msg)
+		if err != nil {
+			fail(websocket.CloseInternalServerErr, err)
+			continue
+		}
+	}
+}
+
+/* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+* S H U T D O W N
+* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
+
+// webSocketConns keeps track of the open WebSocket connections of a server, so they can be closed when it shuts down.
+// Hijacked connections aren't tracked by http.Server.
+type webSocketConns struct {
+	mu           sync.Mutex
+	conns        map[*webSocketConn]struct{}
+	shuttingDown bool
+	wg           sync.WaitGroup
+}
+
+func newWebSocketConns() *webSocketConns {
+	return &webSocketConns{conns: map[*webSocketConn]struct{}{}}
+}
+
+// add starts tracking c. It returns false if the server is shutting down.
+func (s *webSocketConns) add(c *webSocketConn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.shuttingDown {
+		return false
+	}
+	s.conns[c] = struct{}{}
+	s.wg.Add(1)
+	return true
+}
+
+func (s *webSocketConns) remove(c *webSocketConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.conns[c]; ok {
+		delete(s.conns, c)
+		s.wg.Done()
+	}
+}
+
+func (s *webSocketConns) isShuttingDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.shuttingDown
+}
+
+// closeAll rejects new connections and starts closing all the open ones
+func (s *webSocketConns) closeAll() {
+	s.mu.Lock()
+	s.shuttingDown = true
+	conns := make([]*webSocketConn, 0, len(s.conns))
+	for c := range s.conns {
+		conns = append(conns, c)
+	}
+	s.mu.Unlock()
+
+	for _, c := range conns {
+		c.close(websocket.CloseGoingAway, ErrServerShuttingDown.Error())
+	}
+}
+
+// wait blocks until all the connections have been closed, or ctx is done
+func (s *webSocketConns) wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,149 @@
+package gopi_test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/teejays/gopi"
+)
+
+var pingPongHandlers = gopi.WebSocketHandlers[SampleReq, SampleResp]{
+	OnMessage: func(ctx context.Context, conn *gopi.WebSocketConn[SampleResp], msg SampleReq) error {
+		return conn.Send(SampleResp{Pong: msg.Ping})
+	},
+}
+
+func TestWebSocket(t *testing.T) {
+	routes := []gopi.Route{
+		{
+			Method:      http.MethodGet,
+			Path:        "ws",
+			HandlerFunc: gopi.WebSocketWrapper(pingPongHandlers),
+		},
+		{
+			Method:       http.MethodGet,
+			Path:         "ws-auth",
+			HandlerFunc:  gopi.WebSocketWrapper(pingPongHandlers),
+			Authenticate: true,
+		},
+	}
+	auth := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") == "" {
+				gopi.WriteError(w, http.StatusUnauthorized, http.ErrNoCookie)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+	h, err := gopi.GetHandler(context.TODO(), routes, gopi.MiddlewareFuncs{AuthMiddleware: auth})
+	assert.NoError(t, err)
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	t.Run("Messages", func(t *testing.T) {
+		ws, _, err := websocket.DefaultDialer.Dial(wsURL+"/api/v0/ws", nil)
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer ws.Close()
+
+		assert.NoError(t, ws.WriteMessage(websocket.TextMessage, []byte(`{"ping":"hello"}`)))
+		_, data, err := ws.ReadMessage()
+		assert.NoError(t, err)
+		assert.JSONEq(t, `{"pong":"hello"}`, string(data))
+	})
+
+	t.Run("Invalid message", func(t *testing.T) {
+		ws, _, err := websocket.DefaultDialer.Dial(wsURL+"/api/v0/ws", nil)
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer ws.Close()
+
+		assert.NoError(t, ws.WriteMessage(websocket.TextMessage, []byte(`not json`)))
+		_, _, err = ws.ReadMessage()
+		assert.True(t, websocket.IsCloseError(err, websocket.CloseInvalidFramePayloadData), "unexpected error: %v", err)
+	})
+
+	t.Run("Authenticated", func(t *testing.T) {
+		_, resp, err := websocket.DefaultDialer.Dial(wsURL+"/api/v0/ws-auth", nil)
+		assert.Error(t, err)
+		if assert.NotNil(t, resp) {
+			assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+		}
+
+		ws, _, err := websocket.DefaultDialer.Dial(wsURL+"/api/v0/ws-auth", http.Header{"Authorization": {"token"}})
+		if assert.NoError(t, err) {
+			ws.Close()
+		}
+	})
+
+	t.Run("Not a WebSocket handshake", func(t *testing.T) {
+		resp, err := http.Get(srv.URL + "/api/v0/ws")
+		if assert.NoError(t, err) {
+			resp.Body.Close()
+			assert.Equal(t, http.StatusUpgradeRequired, resp.StatusCode)
+		}
+	})
+}
+
+func TestWebSocket_Shutdown(t *testing.T) {
+	routes := []gopi.Route{
+		{
+			Method:      http.MethodGet,
+			Path:        "ws",
+			HandlerFunc: gopi.WebSocketWrapper(pingPongHandlers),
+		},
+	}
+	s, err := gopi.NewServer(context.TODO(), routes, gopi.MiddlewareFuncs{})
+	assert.NoError(t, err)
+
+	// Find a free port to start the server on
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	started := make(chan error, 1)
+	go func() {
+		started <- s.StartServer(context.TODO(), "127.0.0.1", port)
+	}()
+
+	var ws *websocket.Conn
+	url := "ws://" + l.Addr().String() + "/api/v0/ws"
+	assert.Eventually(t, func() bool {
+		ws, _, err = websocket.DefaultDialer.Dial(url, nil)
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+	if ws == nil {
+		return
+	}
+	defer ws.Close()
+
+	// The client should be told that the server is going away, and answer so the connection closes cleanly
+	closed := make(chan error, 1)
+	go func() {
+		_, _, err := ws.ReadMessage()
+		closed <- err
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	assert.NoError(t, s.Shutdown(ctx))
+	assert.NoError(t, <-started)
+
+	err = <-closed
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway), "unexpected error: %v", err)
+}
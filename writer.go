@@ -0,0 +1,79 @@
+package gopi
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+)
+
+// responseRecorder wraps a http.ResponseWriter and keeps track of what has been written to it
+type responseRecorder struct {
+	http.ResponseWriter
+	status       int
+	bytesWritten int64
+	wroteHeader  bool
+	flushed      bool
+}
+
+func newResponseRecorder(w http.ResponseWriter) *responseRecorder {
+	return &responseRecorder{ResponseWriter: w}
+}
+
+func (rw *responseRecorder) WriteHeader(code int) {
+	if rw.wroteHeader {
+		return
+	}
+	rw.status = code
+	rw.wroteHeader = true
+	rw.ResponseWriter.WriteHeader(code)
+}
+
+func (rw *responseRecorder) Write(b []byte) (int, error) {
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+	n, err := rw.ResponseWriter.Write(b)
+	rw.bytesWritten += int64(n)
+	return n, err
+}
+
+// Status returns the status code written to the response, defaulting to 200 if nothing was explicitly written
+func (rw *responseRecorder) Status() int {
+	if rw.status == 0 {
+		return http.StatusOK
+	}
+	return rw.status
+}
+
+// Flushed returns true if the response has been flushed, i.e. it is streamed to the client
+func (rw *responseRecorder) Flushed() bool {
+	return rw.flushed
+}
+
+// Flush implements http.Flusher if the underlying http.ResponseWriter supports it
+func (rw *responseRecorder) Flush() {
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+	rw.flushed = true
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker if the underlying http.ResponseWriter supports it, e.g. for WebSocket upgrades. A
+// hijacked response counts as written, since nothing else can be written to it.
+func (rw *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(rw.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	rw.status = http.StatusSwitchingProtocols
+	rw.wroteHeader = true
+	return conn, brw, nil
+}
+
+// Unwrap allows http.ResponseController to reach the underlying http.ResponseWriter
+func (rw *responseRecorder) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}